@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	AB_UNTOUCHED = "none"      // -ab value for a B variant left as sliced
+	AB_REPORT    = "_ab.txt"   // Suffix of the comparison report
+	AB_LABEL     = "untouched" // Name suffix of an untouched B variant
+)
+
+// abVariant is one of the two outputs of an A/B experiment
+type abVariant struct {
+	Label    string // "A" or "B"
+	Preset   string // Empty for the untouched variant
+	Path     string
+	Lines    []string
+	Plan     *Plan
+	Duration float64 // Estimated print time (s)
+	Filament float64 // mm
+}
+
+var abMode string   // -ab, preset of the B variant of each file, or AB_UNTOUCHED
+var abPreset preset // The preset of the B variant
+
+// validateABMode exits if -ab names an unknown preset or the -preset itself, or is combined with
+// options that write a single output
+func validateABMode(presetName string, overwrite bool) {
+	if abMode == "" {
+		return
+	}
+	if overwrite || planInPath != "" || interactive || analyzeOnly || uploadBackend != "" {
+		fmt.Println("Error: -ab writes two outputs per file and can't be combined with -o, -plan-in, -interactive, -analyze-only or -upload")
+		os.Exit(1)
+	}
+	if abMode == AB_UNTOUCHED {
+		return
+	}
+	if abMode == presetName {
+		fmt.Printf("Error: -ab preset '%s' is the -preset itself; name another preset or %s\n", abMode, AB_UNTOUCHED)
+		os.Exit(1)
+	}
+	p, err := getPreset(abMode)
+	if err != nil {
+		fmt.Printf("Error: -ab: %v\n", err)
+		os.Exit(1)
+	}
+	abPreset = p
+}
+
+// getABFilePath returns the path of a variant of an A/B experiment, e.g. "part_A_default.gcode"
+// or "part_B_untouched.gcode"
+func getABFilePath(filePath string, label string, presetName string) string {
+	if presetName == "" {
+		presetName = AB_LABEL
+	}
+	return getDerivedFilePath(filePath, "_"+label+"_"+presetName)
+}
+
+// processABFile writes two variants of a G-code file for comparing prints: A modified with the
+// -preset, and B untouched or modified with the -ab preset, with a report of how they differ
+func processABFile(ctx context.Context, filePath string) {
+	if is3mfFile(filePath) || isZipFile(filePath) {
+		fmt.Printf("Skipping '%s': -ab only compares plain G-code files\n", filePath)
+		return
+	}
+	fmt.Printf("Processing '%s' for an A/B comparison\n", filePath)
+	srcInfo := getSourceInfo(filePath)
+	lines, crlf, err := readLines(filePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+	hash := ""
+	if recordHistory {
+		hash = hashLines(lines)
+	}
+
+	a := abVariant{Label: "A", Preset: activePreset.Name}
+	b := abVariant{Label: "B"}
+	if abMode != AB_UNTOUCHED {
+		b.Preset = abPreset.Name
+	}
+	for _, variant := range []*abVariant{&a, &b} {
+		variant.Path = getABFilePath(filePath, variant.Label, variant.Preset)
+		if variant.Preset == "" {
+			// Marked like the modified variant so that reruns skip it as an input
+			variant.Lines = append(slices.Clone(lines), MODIFIED_MARKER)
+		} else {
+			var p *preset
+			if variant.Preset != activePreset.Name {
+				p = &abPreset
+			}
+			firstPlan := len(exportedPlans)
+			variant.Lines, err = modifyLines(ctx, filePath, slices.Clone(lines), p)
+			if err != nil {
+				fmt.Printf("Stopped processing '%s', leaving it unchanged: %v\n", filePath, err)
+				return
+			}
+			if len(exportedPlans) > firstPlan {
+				plan := exportedPlans[len(exportedPlans)-1]
+				variant.Plan = &plan
+			}
+		}
+		if lineTimes := getLineTimes(variant.Lines); len(lineTimes) > 0 {
+			variant.Duration = lineTimes[len(lineTimes)-1]
+		}
+		variant.Filament = getFilamentUsed(variant.Lines)
+	}
+
+	for _, variant := range []abVariant{a, b} {
+		if err := writeLines(variant.Path, variant.Lines, crlf); err != nil {
+			fmt.Printf("Error creating output file: %v\n", err)
+			os.Exit(1)
+		}
+		if err := preserveFileAttributes(srcInfo, variant.Path); err != nil {
+			fmt.Printf("Error preserving file times: %v\n", err)
+		}
+		fmt.Printf("Variant %s saved as %s.\n", variant.Label, variant.Path)
+		if recordHistory {
+			entry := historyEntry{File: filePath, Hash: hash, Output: variant.Path, OutputHash: hashLines(variant.Lines), Outcome: HISTORY_PROCESSED}
+			if variant.Plan != nil {
+				entry.Plans = []Plan{*variant.Plan}
+			}
+			addHistoryEntry(entry)
+		}
+	}
+
+	name, _ := splitGcodeExt(filePath)
+	reportPath := name + AB_REPORT
+	err = writeFileAtomic(reportPath, func(w io.Writer) error {
+		writeABReport(w, filePath, a, b)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error writing the comparison report: %v\n", err)
+		os.Exit(1)
+	}
+	writeABReport(os.Stdout, filePath, a, b)
+	fmt.Printf("Report saved to %s\n", reportPath)
+}
+
+// writeABReport writes how the two variants of an A/B experiment differ: their settings, estimated
+// time and filament, and the changes each makes per layer
+func writeABReport(w io.Writer, filePath string, a abVariant, b abVariant) {
+	fmt.Fprintf(w, "A/B comparison of '%s'\n", filePath)
+	changes := map[int][2][]string{}
+	for n, variant := range []abVariant{a, b} {
+		description := "untouched"
+		if variant.Plan != nil {
+			description = fmt.Sprintf("preset %s, %d detections, %d insertions", variant.Preset, len(variant.Plan.Detections), len(variant.Plan.Modifications))
+			for _, mod := range variant.Plan.Modifications {
+				layerChanges := changes[mod.Layer]
+				change := strings.TrimSuffix(mod.String(), fmt.Sprintf(" at layer %d", displayLayer(mod.Layer)))
+				layerChanges[n] = append(layerChanges[n], change)
+				changes[mod.Layer] = layerChanges
+			}
+		}
+		fmt.Fprintf(w, "  %s  %s\n", variant.Label, variant.Path)
+		fmt.Fprintf(w, "     %s; estimated %s, %.0f mm of filament\n", description, formatEstimate(variant.Duration), variant.Filament)
+	}
+	fmt.Fprintf(w, "  B - A: %+.0fs, %+.0f mm of filament\n", b.Duration-a.Duration, b.Filament-a.Filament)
+
+	layers := []int{}
+	for layer, layerChanges := range changes {
+		if !slices.Equal(layerChanges[0], layerChanges[1]) {
+			layers = append(layers, layer)
+		}
+	}
+	slices.Sort(layers)
+	if len(layers) == 0 {
+		fmt.Fprintln(w, "The variants make the same changes")
+		return
+	}
+	fmt.Fprintln(w, "Layers where the variants differ:")
+	for _, layer := range layers {
+		for n, variant := range []abVariant{a, b} {
+			described := "no change"
+			if layerChanges := changes[layer][n]; len(layerChanges) > 0 {
+				described = strings.Join(layerChanges, "; ")
+			}
+			fmt.Fprintf(w, "  layer %d %s: %s\n", displayLayer(layer), variant.Label, described)
+		}
+	}
+	fmt.Fprintln(w, "Print both and record how these layers came out with 'gcode_modifier feedback <variant> -layer <n> ok|failed' (with -history).")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	DETECTOR_ADHESION_RISK = "adhesion-risk"
+
+	// Weights of the adhesion risk score components, summing to 1
+	ADHESION_WEIGHT_FAN    = 0.3
+	ADHESION_WEIGHT_TEMP   = 0.2
+	ADHESION_WEIGHT_TIME   = 0.2
+	ADHESION_WEIGHT_CHANGE = 0.3
+
+	ADHESION_LONG_LAYER_TIME = 60.0 // Seconds; layers this long have cooled fully before the next
+	ADHESION_TEMP_RANGE      = 20.0 // Celcius below the default temperature+10 at which the temperature component peaks
+)
+
+var printAdhesionScores bool // Print the adhesion risk score of every layer
+
+// clamp01 limits a value to the range 0-1
+func clamp01(value float64) float64 {
+	return math.Max(0, math.Min(value, 1))
+}
+
+// getAdhesionScores returns a 0-100 layer adhesion risk score for each 0-based layer, combining
+// the fan speed, how far the temperature is below the default, the layer time (time the layer
+// below has to cool) and the change in extruded length from the layer below. Requires the
+// perimeter lengths from detectProblematicLayers.
+func (a *Analysis) getAdhesionScores(lines []string, defaultTemp int) []float64 {
+	flows := a.getLayerFlows(lines)
+	scores := make([]float64, len(flows))
+	for layer := range scores {
+		flow := flows[layer]
+		fanScore := float64(flow.FanSpeed) / 255
+		tempScore := clamp01(float64(defaultTemp+10-flow.HotendTemp) / ADHESION_TEMP_RANGE)
+		timeScore := clamp01(flow.LayerTime / ADHESION_LONG_LAYER_TIME)
+		changeScore := 0.0
+		if previous := a.perimeterLengths[layer-1]; layer > 0 && previous > 0 {
+			changeScore = clamp01(math.Abs(a.perimeterLengths[layer]-previous) / previous)
+		}
+		scores[layer] = 100 * (ADHESION_WEIGHT_FAN*fanScore + ADHESION_WEIGHT_TEMP*tempScore +
+			ADHESION_WEIGHT_TIME*timeScore + ADHESION_WEIGHT_CHANGE*changeScore)
+	}
+	return scores
+}
+
+// detectAdhesionRisk returns the layers from MinProbLayer up whose adhesion risk score reaches the
+// preset's AdhesionScoreThreshold
+func (a *Analysis) detectAdhesionRisk(scores []float64) []Detection {
+	detections := []Detection{}
+	for layer, score := range scores {
+		if layer >= a.preset.MinProbLayer && score >= a.preset.AdhesionScoreThreshold {
+			detections = append(detections, Detection{
+				Layer:    layer,
+				Detector: DETECTOR_ADHESION_RISK,
+				Details:  fmt.Sprintf("adhesion risk score %.0f (threshold %.0f)", score, a.preset.AdhesionScoreThreshold),
+			})
+		}
+	}
+	return detections
+}
+
+// mergeLayers returns the sorted layers of both lists without duplicates
+func mergeLayers(a []int, b []int) []int {
+	seen := make(map[int]bool)
+	merged := []int{}
+	for _, layer := range append(append([]int{}, a...), b...) {
+		if !seen[layer] {
+			seen[layer] = true
+			merged = append(merged, layer)
+		}
+	}
+	sort.Ints(merged)
+	return merged
+}
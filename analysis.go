@@ -0,0 +1,39 @@
+package main
+
+// Analysis is the state of analyzing or modifying one file (or 3MF plate): its slicer dialect,
+// the preset adjusted for it and what was measured per layer. Every file gets its own, but the
+// options still come from the command-line flags, so files processed in parallel, as by serve,
+// share the same options.
+type Analysis struct {
+	dialect           slicerDialect
+	preset            preset
+	layerLines        map[int]int                  // 1-based line of each 0-based layer's change comment
+	supportOnlyLayers map[int]bool                 // Layers printing nothing but support
+	layerZHeights     map[int]float64              // First Z height printed in each layer
+	perimeterLengths  map[int]float64              // Extruded length per 0-based layer
+	travelLengths     map[int]float64              // Non-extruding XY move length per 0-based layer
+	explanations      map[int]detectionExplanation // Why each problematic layer was flagged
+	calibratedTemps   map[int]int                  // -calibration temperature of layers to correct
+	numbers           numberFormat                 // How the file writes numbers, for inserted commands
+}
+
+// newAnalysis detects the dialect of the lines and indexes their layers; p is the preset the
+// detectors and modification rules use
+func newAnalysis(lines []string, p preset) *Analysis {
+	a := &Analysis{dialect: detectDialect(lines), preset: p, numbers: getNumberFormat(lines)}
+	a.indexLayers(lines)
+	return a
+}
+
+// detectLayerChange detects layer changes based on explicit comments like "; layer n", in the
+// format of the file's slicer dialect
+func (a *Analysis) detectLayerChange(line string) bool {
+	return a.dialect.IsLayerChange(line)
+}
+
+// indexLayers builds the per-layer maps used to locate and describe layers
+func (a *Analysis) indexLayers(lines []string) {
+	a.layerLines = a.getMapOfLayerStartLines(lines)
+	a.supportOnlyLayers = a.getMapOfSupportLayers(lines)
+	a.layerZHeights = a.getMapOfLayerZHeights(lines)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	STDIN_PATH        = "-"
+	STREAM_CHUNK_SIZE = 1 << 20
+)
+
+// Analyzer analyzes G-code as it arrives, e.g. during an upload: feed it chunks with Write, ask
+// for the results so far with Progress and get the final plan with Finish. Analyzers share no
+// state, so several may run at once.
+type Analyzer struct {
+	filePath string
+	partial  []byte    // Bytes of the line still being received
+	lines    []string  // Complete lines received so far
+	preset   *preset   // File preset, fixed once the first layer has been received
+	analysis *Analysis // Of the complete layers at the last Progress
+}
+
+// AnalyzerProgress is what an Analyzer found in the layers received so far
+type AnalyzerProgress struct {
+	Lines             int         `json:"lines"`
+	CompleteLayers    int         `json:"complete_layers"` // Layers whose end has been received
+	ProblematicLayers []int       `json:"problematic_layers"`
+	Detections        []Detection `json:"detections"`
+}
+
+// NewAnalyzer returns an Analyzer for the G-code of a file
+func NewAnalyzer(filePath string) *Analyzer {
+	return &Analyzer{filePath: filePath}
+}
+
+// Write adds a chunk of G-code; lines may be split across chunks
+func (a *Analyzer) Write(p []byte) (int, error) {
+	data := append(a.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		a.lines = append(a.lines, string(bytes.TrimSuffix(data[:i], []byte{'\r'})))
+		data = data[i+1:]
+	}
+	a.partial = append([]byte{}, data...)
+	return len(p), nil
+}
+
+// Progress runs the perimeter-change detector over the complete layers received so far. A layer
+// is complete once the next layer change has arrived, since the detector compares whole layers.
+// Each call rescans the lines received so far, so call it every few chunks rather than for each.
+// Material defaults and scaled thresholds come from the metadata seen before the first layer;
+// slicers that write their settings at the end of the file only get them applied by Finish.
+func (a *Analyzer) Progress(ctx context.Context) (AnalyzerProgress, error) {
+	progress := AnalyzerProgress{Lines: len(a.lines), ProblematicLayers: []int{}, Detections: []Detection{}}
+	if err := ctx.Err(); err != nil {
+		return progress, err
+	}
+
+	dialect := detectDialect(a.lines)
+	lastLayerStart := -1
+	for i, line := range a.lines {
+		if dialect.IsLayerChange(line) {
+			progress.CompleteLayers++
+			lastLayerStart = i
+		}
+	}
+	// The last layer started is still being received
+	progress.CompleteLayers = max(0, progress.CompleteLayers-1)
+	if progress.CompleteLayers == 0 {
+		return progress, nil
+	}
+	complete := a.lines[:lastLayerStart]
+
+	if a.preset == nil {
+		p := scaleThresholds(getFilePreset(complete), complete)
+		a.preset = &p
+	}
+
+	a.analysis = newAnalysis(complete, *a.preset)
+	if a.preset.hasDetector(DETECTOR_PERIMETER_CHANGE) {
+		progress.ProblematicLayers = a.analysis.detectProblematicLayers(complete)
+	}
+	for _, layer := range progress.ProblematicLayers {
+		progress.Detections = append(progress.Detections,
+			Detection{Layer: layer, Detector: DETECTOR_PERIMETER_CHANGE, Why: a.analysis.explanations[layer]})
+	}
+	return progress, nil
+}
+
+// Finish analyzes everything received, including a last line without a line ending, and
+// returns the plan for the whole file
+func (a *Analyzer) Finish(ctx context.Context) (Plan, error) {
+	if len(a.partial) > 0 {
+		a.lines = append(a.lines, string(bytes.TrimSuffix(a.partial, []byte{'\r'})))
+		a.partial = nil
+	}
+	return AnalyzeLines(ctx, a.filePath, a.lines)
+}
+
+// analyzeStream analyzes G-code read from r with an Analyzer, reporting problematic layers as
+// soon as they are complete, and records the final plan like analyzeFile
+func analyzeStream(ctx context.Context, r io.Reader, name string) {
+	fmt.Printf("Analyzing '%s' as it arrives\n", name)
+	analyzer := NewAnalyzer(name)
+	reported := 0
+	buf := make([]byte, STREAM_CHUNK_SIZE)
+	for {
+		n, err := r.Read(buf)
+		analyzer.Write(buf[:n])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fmt.Printf("Error reading '%s': %v\n", name, err)
+			os.Exit(1)
+		}
+
+		progress, perr := analyzer.Progress(ctx)
+		if perr != nil {
+			fmt.Printf("Stopped analyzing '%s': %v\n", name, perr)
+			return
+		}
+		for _, detection := range progress.Detections[min(reported, len(progress.Detections)):] {
+			fmt.Printf("  Problematic %s after %d lines: %s\n", analyzer.analysis.describeLayer(detection.Layer), progress.Lines, detection.Why)
+		}
+		reported = len(progress.Detections)
+	}
+
+	plan, err := analyzer.Finish(ctx)
+	if err != nil {
+		fmt.Printf("Stopped analyzing '%s': %v\n", name, err)
+		return
+	}
+	exportedPlans = append(exportedPlans, plan)
+	addBatchEntry(analyzer.lines, plan, analyzer.lines)
+	sendWebhooks(webhookEvent{Event: EVENT_ANALYZED, File: name, Plans: []Plan{plan}})
+}
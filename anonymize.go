@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const REDACTED = "redacted"
+
+var sanitizeMetadata bool // -sanitize-metadata, strip identifying metadata before sharing an output
+
+// identifyingSettingRegexp matches the keys of slicer settings that name the user's own profiles,
+// printers, hosts or machine serial numbers, or hold free text of theirs
+var identifyingSettingRegexp = regexp.MustCompile(`(?i)(settings_id|inherits|_profile$|compatible_print(er)?s$|serial|(^|_)sn$|dev(ice)?_id|machine_id|access_code|api_?key|password|print_?host|notes$|post_process|author|user)`)
+
+// userPathRegexp matches the user name in home directory paths, e.g. "/home/alice/",
+// "/Users/alice/" or "C:\Users\alice\" (also with the doubled backslashes of escaped settings)
+var userPathRegexp = regexp.MustCompile(`((?:/home|/Users|[A-Za-z]:(?:\\+|/)Users)(?:\\+|/))[^/\\\s;"',]+`)
+
+// chatWebhookRegexp matches Slack and Discord webhook URLs, whose paths are their credentials
+var chatWebhookRegexp = regexp.MustCompile(`(https?://(?:hooks\.slack\.com|(?:\w+\.)?discord(?:app)?\.com/api/webhooks)/)\S+`)
+
+// redactUserPaths returns the text with the user names in home directory paths replaced
+func redactUserPaths(text string) string {
+	return userPathRegexp.ReplaceAllString(text, "${1}"+REDACTED)
+}
+
+// sanitizeMetadataLines strips what identifies the user or their printers from the lines, for
+// sharing a file publicly: the values of settings naming profiles, hosts and serial numbers, the
+// user names in paths, Slack and Discord webhook URLs, and Cura's serialized profile (";SETTING_3" lines), which names the user's
+// profiles throughout. Settings used to print, such as temperatures and speeds, are kept.
+func sanitizeMetadataLines(lines []string) []string {
+	sanitized := make([]string, 0, len(lines))
+	redacted, removed := 0, 0
+	for _, line := range lines {
+		if strings.HasPrefix(line, ";SETTING_3 ") {
+			removed++
+			continue
+		}
+		clean := chatWebhookRegexp.ReplaceAllString(redactUserPaths(line), "${1}"+REDACTED)
+		if strings.HasPrefix(clean, ";") {
+			for _, re := range settingRegexps {
+				if m := re.FindStringSubmatchIndex(clean); m != nil {
+					if key := clean[m[2]:m[3]]; identifyingSettingRegexp.MatchString(key) && m[4] < m[5] {
+						clean = clean[:m[4]] + REDACTED
+					}
+					break
+				}
+			}
+		}
+		if clean != line {
+			redacted++
+		}
+		sanitized = append(sanitized, clean)
+	}
+	if redacted > 0 || removed > 0 {
+		fmt.Printf("Sanitized metadata: redacted %d lines, removed %d serialized profile lines\n", redacted, removed)
+	}
+	return sanitized
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes a file through a temporary file in the same directory that is renamed
+// over the target once complete, so a failure part way leaves any existing file untouched. An
+// existing target keeps its permissions.
+func writeFileAtomic(filePath string, write func(w io.Writer) error) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filePath); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath) // No-op once renamed
+
+	writer := bufio.NewWriter(tmpFile)
+	if err := write(writer); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+var preserveTimes bool // Give outputs the modification time and permissions of their source
+
+// getSourceInfo returns the source file's info for preserveFileAttributes, or nil when
+// -preserve-times is off
+func getSourceInfo(filePath string) os.FileInfo {
+	if !preserveTimes {
+		return nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// preserveFileAttributes copies the source's modification time and permissions to an output
+func preserveFileAttributes(srcInfo os.FileInfo, outputFilePath string) error {
+	if srcInfo == nil {
+		return nil
+	}
+	if err := os.Chmod(outputFilePath, srcInfo.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(outputFilePath, srcInfo.ModTime(), srcInfo.ModTime())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+)
+
+// auditEndOfFile compares the machine state at the end of the modified lines with the original:
+// heaters, fan and motors must end as they did before the transforms. Any difference is reported
+// and fixed by appending the commands that restore the original end state. A print that didn't
+// end with heaters off, fan off and motors disabled in the first place is only reported.
+func auditEndOfFile(original []string, modified []string) []string {
+	want := getEndState(original)
+	got := getEndState(modified)
+
+	if want.HotendTemp != 0 || want.BedTemp != 0 || want.FanSpeed != 0 || !want.MotorsOff {
+		fmt.Printf("Warning: the original file doesn't end with heaters off, fan off and motors disabled (%s)\n", describeEndState(want))
+	}
+
+	fixes := []string{}
+	if got.HotendTemp != want.HotendTemp {
+		fixes = append(fixes, withComment(fmt.Sprintf("M104 S%d", want.HotendTemp), msg(MSG_RESTORE_HOTEND)))
+	}
+	if got.BedTemp != want.BedTemp {
+		fixes = append(fixes, withComment(fmt.Sprintf("M140 S%d", want.BedTemp), msg(MSG_RESTORE_BED)))
+	}
+	if got.FanSpeed != want.FanSpeed {
+		fixes = append(fixes, withComment(fmt.Sprintf("M106 S%d", want.FanSpeed), msg(MSG_RESTORE_FAN)))
+	}
+	if got.speedFactor() != want.speedFactor() {
+		fixes = append(fixes, withComment(fmt.Sprintf("M220 S%d", want.speedFactor()), msg(MSG_RESTORE_SPEED)))
+	}
+	if want.MotorsOff && (!got.MotorsOff || len(fixes) > 0) {
+		fixes = append(fixes, withComment("M84", msg(MSG_RESTORE_MOTORS)))
+	}
+	if len(fixes) == 0 {
+		return modified
+	}
+
+	fmt.Printf("Warning: transforms changed the end of the print (%s, expected %s), appending:\n",
+		describeEndState(got), describeEndState(want))
+	for _, fix := range fixes {
+		fmt.Printf("  %s\n", fix)
+	}
+	return append(modified, fixes...)
+}
+
+// getEndState returns the machine state after the last line
+func getEndState(lines []string) machineState {
+	var state machineState
+	for _, line := range lines {
+		state.update(line)
+	}
+	return state
+}
+
+// describeEndState formats the audited part of an end state
+func describeEndState(state machineState) string {
+	return fmt.Sprintf("hotend %d°C, bed %d°C, fan %d, speed factor %d%%, motors off %t",
+		state.HotendTemp, state.BedTemp, state.FanSpeed, state.speedFactor(), state.MotorsOff)
+}
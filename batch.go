@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const BATCH_MAX_VALUE_LEN = 24
+
+// batchEntry is one file (or 3MF plate) of a directory run, for the comparison report
+type batchEntry struct {
+	File       string
+	ProbLayers []int             // 0-based layers flagged by any detector
+	Settings   map[string]string // Slicer settings from the metadata comments
+	Usage      *batchUsage       // What printing it takes, for the batch summary
+}
+
+var batchEntries []batchEntry
+var batchReportPath string // -report, also write the directory comparison report to this file
+
+// settingRegexps match the slicer settings in metadata comments: "; layer_height = 0.2"
+// (Bambu/Orca, PrusaSlicer) and ";Layer height: 0.2" (Cura, ideaMaker)
+var settingRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`^; ([a-z][a-z0-9_ ]*?) = (.*)$`),
+	regexp.MustCompile(`^;([A-Z][A-Za-z0-9_ ]*?): (.*)$`),
+}
+
+// getSettings returns the slicer settings recorded in the metadata comments
+func getSettings(lines []string) map[string]string {
+	settings := make(map[string]string)
+	for _, line := range lines {
+		for _, re := range settingRegexps {
+			if m := re.FindStringSubmatch(line); m != nil {
+				// Cloned, as the lines may point into a memory-mapped file
+				if _, ok := settings[m[1]]; !ok {
+					settings[strings.Clone(m[1])] = strings.Clone(strings.TrimSpace(m[2]))
+				}
+				break
+			}
+		}
+	}
+	return settings
+}
+
+// addBatchEntry records the outcome of a file's plan for the comparison report, and in a
+// directory run what printing the lines it prints takes for the batch summary
+func addBatchEntry(lines []string, plan Plan, printed []string) {
+	entry := batchEntry{File: plan.File, ProbLayers: []int{}, Settings: getSettings(lines)}
+	if batchRun {
+		entry.Usage = getBatchUsage(printed)
+	}
+	for _, detection := range plan.Detections {
+		if !slices.Contains(entry.ProbLayers, detection.Layer) {
+			entry.ProbLayers = append(entry.ProbLayers, detection.Layer)
+		}
+	}
+	slices.Sort(entry.ProbLayers)
+	batchEntries = append(batchEntries, entry)
+}
+
+// getDifferingSettings returns the settings whose values are not the same in every entry, sorted
+func getDifferingSettings(entries []batchEntry) []string {
+	keys := []string{}
+	for key, value := range entries[0].Settings {
+		for _, entry := range entries[1:] {
+			if other, ok := entry.Settings[key]; !ok || other != value {
+				keys = append(keys, key)
+				break
+			}
+		}
+	}
+	for _, entry := range entries[1:] {
+		for key := range entry.Settings {
+			if _, ok := entries[0].Settings[key]; !ok && !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// writeBatchReport compares the detections of the files of a directory run: a table of every
+// file with its problematic layers and the settings that differ between files, then the settings
+// whose values never overlap between clean and flagged files, which are the likely cause
+func writeBatchReport(w io.Writer, entries []batchEntry) {
+	fmt.Fprintf(w, "Comparison of %d files:\n", len(entries))
+	settings := getDifferingSettings(entries)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "  file\tproblematic layers")
+	for _, key := range settings {
+		fmt.Fprintf(tw, "\t%s", key)
+	}
+	fmt.Fprintln(tw)
+	clean, flagged := []batchEntry{}, []batchEntry{}
+	for _, entry := range entries {
+		layers := "none"
+		if len(entry.ProbLayers) > 0 {
+			layers = fmt.Sprint(displayLayers(entry.ProbLayers))
+			flagged = append(flagged, entry)
+		} else {
+			clean = append(clean, entry)
+		}
+		fmt.Fprintf(tw, "  %s\t%s", entry.File, layers)
+		for _, key := range settings {
+			value, ok := entry.Settings[key]
+			if !ok {
+				value = "-"
+			}
+			if len(value) > BATCH_MAX_VALUE_LEN {
+				value = value[:BATCH_MAX_VALUE_LEN-3] + "..."
+			}
+			fmt.Fprintf(tw, "\t%s", value)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+
+	if len(clean) == 0 || len(flagged) == 0 {
+		fmt.Fprintf(w, "%d of %d files have problematic layers\n", len(flagged), len(entries))
+		return
+	}
+	fmt.Fprintf(w, "Files without problematic layers: %d of %d\n", len(clean), len(entries))
+	for _, key := range settings {
+		cleanValues, flaggedValues := getSettingValues(clean, key), getSettingValues(flagged, key)
+		if !slices.ContainsFunc(cleanValues, func(v string) bool { return slices.Contains(flaggedValues, v) }) {
+			fmt.Fprintf(w, "  %s: %s avoided problematic layers, %s did not\n",
+				key, strings.Join(cleanValues, ", "), strings.Join(flaggedValues, ", "))
+		}
+	}
+}
+
+// getSettingValues returns the distinct values of a setting among the entries, "-" when missing
+func getSettingValues(entries []batchEntry, key string) []string {
+	values := []string{}
+	for _, entry := range entries {
+		value, ok := entry.Settings[key]
+		if !ok {
+			value = "-"
+		}
+		if !slices.Contains(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// printBatchReport prints the batch summary of a directory run, and with two or more files the
+// comparison report, and saves them with -report
+func printBatchReport() {
+	if len(batchEntries) == 0 {
+		return
+	}
+	write := func(w io.Writer) {
+		writeBatchSummary(w, batchEntries)
+		if len(batchEntries) >= 2 {
+			writeBatchReport(w, batchEntries)
+		}
+	}
+	write(os.Stdout)
+	if batchReportPath == "" {
+		return
+	}
+	err := writeFileAtomic(batchReportPath, func(w io.Writer) error {
+		write(w)
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error writing report: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Report saved to %s\n", batchReportPath)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// buildVolume is the range of nozzle positions a printer can reach, in mm
+type buildVolume struct {
+	MinX float64 `json:"x_min"`
+	MaxX float64 `json:"x_max"`
+	MinY float64 `json:"y_min"`
+	MaxY float64 `json:"y_max"`
+	MaxZ float64 `json:"z_max"`
+}
+
+// bounds is an XY bounding box with the highest Z reached in it
+type bounds struct {
+	MinX, MinY, MaxX, MaxY, MaxZ float64
+	set                          bool
+}
+
+// add extends the bounds to a point
+func (b *bounds) add(x float64, y float64, z float64) {
+	if !b.set {
+		*b = bounds{MinX: x, MinY: y, MaxX: x, MaxY: y, MaxZ: z, set: true}
+		return
+	}
+	b.MinX, b.MinY = math.Min(b.MinX, x), math.Min(b.MinY, y)
+	b.MaxX, b.MaxY, b.MaxZ = math.Max(b.MaxX, x), math.Max(b.MaxY, y), math.Max(b.MaxZ, z)
+}
+
+func (b bounds) String() string {
+	if !b.set {
+		return "nothing"
+	}
+	return fmt.Sprintf("X %.2f..%.2f, Y %.2f..%.2f (%.2f x %.2fmm), Z up to %.2f", b.MinX, b.MaxX, b.MinY, b.MaxY, b.MaxX-b.MinX, b.MaxY-b.MinY, b.MaxZ)
+}
+
+// sequentialObject is a run of layers printed as one object of a sequential print, before the
+// next object starts again from the bed
+type sequentialObject struct {
+	FirstLayer, LastLayer int // 0-based
+	FirstLine             int // 1-based line of the first layer change
+	Bounds                bounds
+}
+
+// printBounds is the extent of a print: what it extrudes per layer and overall, where the nozzle
+// moves, and the objects of a sequential print
+type printBounds struct {
+	Layers  []bounds // Extrusions per 0-based layer
+	Printed bounds   // All extrusions
+	Moves   bounds   // Every nozzle position from the first layer on, travel included
+	Objects []sequentialObject
+	extreme [5]int // 1-based lines reaching MinX, MaxX, MinY, MaxY and MaxZ of Moves
+}
+
+// getPrintBounds measures the bounding boxes of a print. A layer starting lower than the layer
+// before it by more than a layer height starts another object of a sequential print.
+func (a *Analysis) getPrintBounds(lines []string) printBounds {
+	pb := printBounds{Layers: make([]bounds, a.countLayers(lines))}
+	layerHeight := getLayerHeight(lines)
+	if layerHeight == 0 {
+		layerHeight = REFERENCE_LAYER_HEIGHT
+	}
+	for layer := range pb.Layers {
+		z := a.layerZHeights[layer]
+		if layer == 0 || z < a.layerZHeights[layer-1]-layerHeight-THRESHOLD_MATCH_TOLERANCE {
+			pb.Objects = append(pb.Objects, sequentialObject{FirstLayer: layer, FirstLine: a.layerLines[layer]})
+		}
+		pb.Objects[len(pb.Objects)-1].LastLayer = layer
+	}
+
+	var state machineState
+	layer := -1
+	for i, line := range lines {
+		if a.detectLayerChange(line) {
+			layer++
+			continue
+		}
+		previous := state
+		state.update(line)
+		if layer < 0 || !state.hasPosition {
+			continue
+		}
+		if state.X != previous.X || state.Y != previous.Y || state.Z != previous.Z {
+			before := pb.Moves
+			pb.Moves.add(state.X, state.Y, state.Z)
+			moved := []bool{pb.Moves.MinX < before.MinX, pb.Moves.MaxX > before.MaxX,
+				pb.Moves.MinY < before.MinY, pb.Moves.MaxY > before.MaxY, pb.Moves.MaxZ > before.MaxZ}
+			for n := range pb.extreme {
+				if moved[n] || !before.set {
+					pb.extreme[n] = i + 1
+				}
+			}
+		}
+		if state.E > previous.E && (state.X != previous.X || state.Y != previous.Y) && previous.hasPosition && layer < len(pb.Layers) {
+			for _, b := range []*bounds{&pb.Layers[layer], &pb.Printed} {
+				b.add(previous.X, previous.Y, state.Z)
+				b.add(state.X, state.Y, state.Z)
+			}
+		}
+	}
+	for n := range pb.Objects {
+		o := &pb.Objects[n]
+		for layer := o.FirstLayer; layer <= o.LastLayer; layer++ {
+			if b := pb.Layers[layer]; b.set {
+				o.Bounds.add(b.MinX, b.MinY, b.MaxZ)
+				o.Bounds.add(b.MaxX, b.MaxY, b.MaxZ)
+			}
+		}
+	}
+	return pb
+}
+
+// distance returns the distance from a segment to the XY bounding box, 0 when it crosses the box
+func (b bounds) distance(x1 float64, y1 float64, x2 float64, y2 float64) float64 {
+	// Clip the segment to the box (Liang-Barsky)
+	t0, t1 := 0.0, 1.0
+	dx, dy := x2-x1, y2-y1
+	inside := true
+	for _, edge := range [][2]float64{{-dx, x1 - b.MinX}, {dx, b.MaxX - x1}, {-dy, y1 - b.MinY}, {dy, b.MaxY - y1}} {
+		p, q := edge[0], edge[1]
+		if p == 0 {
+			if q < 0 {
+				inside = false
+			}
+			continue
+		}
+		if t := q / p; p < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+	}
+	if inside && t0 <= t1 {
+		return 0
+	}
+
+	pointDistance := func(x float64, y float64) float64 {
+		return math.Hypot(math.Max(0, math.Max(b.MinX-x, x-b.MaxX)), math.Max(0, math.Max(b.MinY-y, y-b.MaxY)))
+	}
+	cornerDistance := func(x float64, y float64) float64 {
+		length := dx*dx + dy*dy
+		if length == 0 {
+			return calculateDistance(x, y, x1, y1)
+		}
+		t := math.Max(0, math.Min(1, ((x-x1)*dx+(y-y1)*dy)/length))
+		return calculateDistance(x, y, x1+t*dx, y1+t*dy)
+	}
+	return min(pointDistance(x1, y1), pointDistance(x2, y2), cornerDistance(b.MinX, b.MinY),
+		cornerDistance(b.MinX, b.MaxY), cornerDistance(b.MaxX, b.MinY), cornerDistance(b.MaxX, b.MaxY))
+}
+
+// findCollisions returns the moves of a sequential print that would hit an object printed before:
+// the print head, within the profile's extruder_clearance_radius of the nozzle, passing an object
+// taller than the nozzle height, or the gantry, gantry_height above the nozzle, crossing the Y
+// range of an object taller than that. The first collision of each object with each earlier one
+// is reported, with its line and layer.
+func (a *Analysis) findCollisions(lines []string, pb printBounds, profile *printerProfile) []string {
+	collisions := []string{}
+	if len(pb.Objects) < 2 || (profile.ExtruderClearanceRadius == 0 && profile.GantryHeight == 0) {
+		return collisions
+	}
+	reported := make(map[[2]int]bool) // Object and earlier object
+	var state machineState
+	layer, object := -1, 0
+	for i, line := range lines {
+		if a.detectLayerChange(line) {
+			layer++
+			for object+1 < len(pb.Objects) && layer >= pb.Objects[object+1].FirstLayer {
+				object++
+			}
+			continue
+		}
+		previous := state
+		state.update(line)
+		if layer < 0 || object == 0 || !previous.hasPosition ||
+			(state.X == previous.X && state.Y == previous.Y && state.Z == previous.Z) {
+			continue
+		}
+		// The lower end of the move
+		z := math.Min(previous.Z, state.Z)
+		for n, earlier := range pb.Objects[:object] {
+			b := earlier.Bounds
+			if reported[[2]int{object, n}] || !b.set {
+				continue
+			}
+			collision := ""
+			if profile.ExtruderClearanceRadius > 0 && z < b.MaxZ {
+				if d := b.distance(previous.X, previous.Y, state.X, state.Y); d < profile.ExtruderClearanceRadius {
+					collision = fmt.Sprintf("the print head passes %.2fmm from object %d (%.2fmm tall) at Z=%.2f, inside the %.2fmm extruder clearance radius",
+						d, n+1, b.MaxZ, z, profile.ExtruderClearanceRadius)
+				}
+			}
+			if collision == "" && profile.GantryHeight > 0 && z+profile.GantryHeight < b.MaxZ &&
+				math.Max(previous.Y, state.Y) >= b.MinY-profile.ExtruderClearanceRadius && math.Min(previous.Y, state.Y) <= b.MaxY+profile.ExtruderClearanceRadius {
+				collision = fmt.Sprintf("the gantry, %.2fmm above the nozzle at Z=%.2f, crosses object %d (%.2fmm tall)", profile.GantryHeight, z, n+1, b.MaxZ)
+			}
+			if collision != "" {
+				reported[[2]int{object, n}] = true
+				collisions = append(collisions, fmt.Sprintf("line %d (layer %d, object %d): %s", i+1, displayLayer(layer), object+1, collision))
+			}
+		}
+	}
+	return collisions
+}
+
+// getMachineProblems returns where a print exceeds the -printer profile's build volume and, for a
+// sequential print, where an object is taller than the gantry clears while later objects print
+func (pb printBounds) getMachineProblems(profile *printerProfile) []string {
+	problems := []string{}
+	if v := profile.BuildVolume; v != nil && pb.Moves.set {
+		limits := []struct {
+			axis     string
+			value    float64
+			limit    float64
+			exceeded bool
+		}{
+			{"X", pb.Moves.MinX, v.MinX, pb.Moves.MinX < v.MinX},
+			{"X", pb.Moves.MaxX, v.MaxX, pb.Moves.MaxX > v.MaxX},
+			{"Y", pb.Moves.MinY, v.MinY, pb.Moves.MinY < v.MinY},
+			{"Y", pb.Moves.MaxY, v.MaxY, pb.Moves.MaxY > v.MaxY},
+			{"Z", pb.Moves.MaxZ, v.MaxZ, v.MaxZ > 0 && pb.Moves.MaxZ > v.MaxZ},
+		}
+		for n, l := range limits {
+			if l.exceeded {
+				problems = append(problems, fmt.Sprintf("the nozzle reaches %s=%.2f, beyond the build volume's %.2f (line %d)", l.axis, l.value, l.limit, pb.extreme[n]))
+			}
+		}
+	}
+	if profile.GantryHeight > 0 && len(pb.Objects) > 1 {
+		// The last object has nothing left to print after it
+		for n, o := range pb.Objects[:len(pb.Objects)-1] {
+			if o.Bounds.MaxZ > profile.GantryHeight {
+				problems = append(problems, fmt.Sprintf("object %d (layers %d-%d, from line %d) is %.2fmm tall, above the %.2fmm gantry clearance: the gantry hits it while later objects print",
+					n+1, displayLayer(o.FirstLayer), displayLayer(o.LastLayer), o.FirstLine, o.Bounds.MaxZ, profile.GantryHeight))
+			}
+		}
+	}
+	return problems
+}
+
+// hasMachineLimits reports whether the profile sets limits that files are checked against
+func (p *printerProfile) hasMachineLimits() bool {
+	return p.BuildVolume != nil || p.GantryHeight > 0 || p.ExtruderClearanceRadius > 0
+}
+
+// checkMachineLimits warns, or with -strict-printer exits, when a file doesn't fit the -printer
+// profile's build volume or clearances, or a sequential print's head or gantry would hit an object
+func checkMachineLimits(filePath string, lines []string) {
+	if activePrinter == nil || !activePrinter.hasMachineLimits() {
+		return
+	}
+	a := newAnalysis(lines, activePreset)
+	pb := a.getPrintBounds(lines)
+	problems := append(pb.getMachineProblems(activePrinter), a.findCollisions(lines, pb, activePrinter)...)
+	for _, problem := range problems {
+		if strictPrinter {
+			fmt.Printf("Error: '%s' doesn't fit printer '%s': %s\n", filePath, activePrinter.Name, problem)
+			os.Exit(1)
+		}
+		fmt.Printf("Warning: '%s' doesn't fit printer '%s': %s\n", filePath, activePrinter.Name, problem)
+	}
+}
+
+// boundsFlags are the flags of the bounds command
+type boundsFlags struct {
+	inputFilePath *string
+	printerName   *string
+	perLayer      *bool
+}
+
+// defineBoundsFlags defines the flags of the bounds command on a flag set
+func defineBoundsFlags(fs *flag.FlagSet) boundsFlags {
+	var flags boundsFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	flags.printerName = fs.String("printer", "", "Printer profile whose build volume and gantry clearance the file is checked against")
+	flags.perLayer = fs.Bool("layers", false, "Print the bounding box of every layer (Default=false)")
+	addLayerBaseFlag(fs)
+	addMacrosFlag(fs)
+	return flags
+}
+
+// runBoundsCommand implements "bounds": it prints the bounding box of a file's extrusions and
+// nozzle moves, the objects of a sequential print, and checks them against a printer profile
+func runBoundsCommand(args []string) {
+	fs := flag.NewFlagSet("bounds", flag.ExitOnError)
+	flags := defineBoundsFlags(fs)
+	setCommandUsage(fs, "bounds")
+	fs.Parse(args)
+	if *flags.inputFilePath == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	validateLayerBase()
+	loadMacrosFlag()
+	lines, _, err := readLines(*flags.inputFilePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+
+	a := newAnalysis(lines, activePreset)
+	pb := a.getPrintBounds(lines)
+	fmt.Printf("Bounds of '%s' (%d layers):\n", *flags.inputFilePath, len(pb.Layers))
+	fmt.Printf("  Printed: %s\n", pb.Printed)
+	fmt.Printf("  Moves:   %s\n", pb.Moves)
+	if len(pb.Objects) > 1 {
+		fmt.Printf("Objects printed in sequence: %d\n", len(pb.Objects))
+		for n, o := range pb.Objects {
+			fmt.Printf("  %d: layers %d-%d (from line %d), %s\n", n+1, displayLayer(o.FirstLayer), displayLayer(o.LastLayer), o.FirstLine, o.Bounds)
+		}
+	}
+	if *flags.perLayer {
+		for layer, b := range pb.Layers {
+			fmt.Printf("  %s: %s\n", a.describeLayer(layer), b)
+		}
+	}
+
+	if *flags.printerName == "" {
+		return
+	}
+	profile, err := loadPrinterProfile(*flags.printerName)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if !profile.hasMachineLimits() {
+		fmt.Printf("Printer profile '%s' has no build_volume, gantry_height or extruder_clearance_radius to check against\n", profile.Name)
+		return
+	}
+	problems := append(pb.getMachineProblems(profile), a.findCollisions(lines, pb, profile)...)
+	for _, problem := range problems {
+		fmt.Printf("Problem: %s\n", problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("Doesn't fit printer '%s': %d problems\n", profile.Name, len(problems))
+		os.Exit(1)
+	}
+	fmt.Printf("Fits printer '%s'\n", profile.Name)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const CALIBRATION_DEFAULT = "default" // Calibration entry for layers without a calibrated feature
+
+// calibrationResults is a -calibration file: the hotend temperatures a calibration print, such as
+// a temperature tower, showed to work best for each feature class, e.g.
+// {"material": "PETG", "temps": {"overhang_wall": 245, "bridge": 240, "default": 240}}
+type calibrationResults struct {
+	Material string         `json:"material,omitempty"` // Filament type the results apply to
+	Source   string         `json:"source,omitempty"`   // What they were measured with, e.g. "temp tower, 2026-09-14"
+	Temps    map[string]int `json:"temps"`              // °C by feature type (see FEATURE_*) or CALIBRATION_DEFAULT
+}
+
+var calibrationPath string // -calibration, temperatures used instead of the preset's temperature increase
+var activeCalibration *calibrationResults
+
+// loadCalibration reads a calibration results file, with its feature classes given as any of the
+// slicers' labels
+func loadCalibration(filePath string) (*calibrationResults, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var results calibrationResults
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	if len(results.Temps) == 0 {
+		return nil, fmt.Errorf("%s: no temps", filePath)
+	}
+	temps := make(map[string]int)
+	for name, temp := range results.Temps {
+		feature := CALIBRATION_DEFAULT
+		if !strings.EqualFold(name, CALIBRATION_DEFAULT) {
+			feature = canonicalFeature(name)
+		}
+		if temp <= 0 {
+			return nil, fmt.Errorf("%s: temperature of '%s' must be above 0°C", filePath, name)
+		}
+		if _, ok := temps[feature]; ok {
+			return nil, fmt.Errorf("%s: feature '%s' (%s) is calibrated twice", filePath, name, feature)
+		}
+		temps[feature] = temp
+	}
+	results.Temps = temps
+	results.Material = normalizeMaterial(results.Material)
+	return &results, nil
+}
+
+// getLayerFeatureLengths returns the length extruded per feature type in each 0-based layer
+func (a *Analysis) getLayerFeatureLengths(lines []string) map[int]map[string]float64 {
+	lengths := make(map[int]map[string]float64)
+	var state machineState
+	layer, feature := -1, ""
+	for _, line := range lines {
+		if a.detectLayerChange(line) {
+			layer++
+			lengths[layer] = make(map[string]float64)
+			continue
+		}
+		if name, ok := getFeatureName(line); ok {
+			feature = canonicalFeature(name)
+			continue
+		}
+		previous := state
+		state.update(line)
+		if layer >= 0 && previous.hasPosition && state.E > previous.E {
+			lengths[layer][feature] += calculateDistance(previous.X, previous.Y, state.X, state.Y)
+		}
+	}
+	return lengths
+}
+
+// getCalibratedTemps returns the -calibration temperature for each layer to correct: that of the
+// calibrated feature type the layer extrudes most of, else the default entry. Layers without
+// either keep the preset's temperature increase, as do all layers when the calibration was made
+// for another filament type than the file is printed with.
+func (a *Analysis) getCalibratedTemps(lines []string, layers []int, material string) map[int]int {
+	temps := make(map[int]int)
+	if activeCalibration == nil || len(layers) == 0 {
+		return temps
+	}
+	if activeCalibration.Material != "" && material != "" && activeCalibration.Material != normalizeMaterial(material) {
+		fmt.Printf("Warning: the calibration is for %s, but the file is printed with %s; using the preset's temperature increase\n",
+			activeCalibration.Material, material)
+		return temps
+	}
+	lengths := a.getLayerFeatureLengths(lines)
+	for _, layer := range layers {
+		// In a fixed order, so ties go the same way every run
+		features := []string{}
+		for feature := range lengths[layer] {
+			features = append(features, feature)
+		}
+		sort.Strings(features)
+		best := ""
+		for _, feature := range features {
+			if _, ok := activeCalibration.Temps[feature]; ok && (best == "" || lengths[layer][feature] > lengths[layer][best]) {
+				best = feature
+			}
+		}
+		if best == "" {
+			if _, ok := activeCalibration.Temps[CALIBRATION_DEFAULT]; !ok {
+				continue
+			}
+			best = CALIBRATION_DEFAULT
+		}
+		temps[layer] = activeCalibration.Temps[best]
+		fmt.Printf("  Calibrated %d°C (%s) for %s\n", temps[layer], best, a.describeLayer(layer))
+	}
+	return temps
+}
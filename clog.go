@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	DETECTOR_CLOG_RISK        = "clog-risk"
+	DEFAULT_FILAMENT_DIAMETER = 1.75 // mm
+	MOD_SPEED_FACTOR          = "speed"
+)
+
+// layerFlow is the extrusion measured over one layer
+type layerFlow struct {
+	Volume     float64 // Extruded filament volume (mm³)
+	Time       float64 // Time spent extruding (s)
+	HotendTemp int     // Highest hotend temperature set during the layer
+	FanSpeed   int     // Highest fan speed (0-255) set during the layer
+	LayerTime  float64 // Time spent on all moves (s)
+}
+
+// AverageFlow returns the layer's average volumetric flow in mm³/s
+func (f layerFlow) AverageFlow() float64 {
+	if f.Time == 0 {
+		return 0
+	}
+	return f.Volume / f.Time
+}
+
+// getFilamentDiameter gets the filament diameter (e.g. "; filament_diameter = 1.75")
+func getFilamentDiameter(lines []string) float64 {
+	for _, line := range lines {
+		if strings.HasPrefix(line, "; filament_diameter = ") {
+			value := strings.Split(strings.Split(line, " = ")[1], ",")[0]
+			if diameter, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && diameter > 0 {
+				return diameter
+			}
+		}
+	}
+	return DEFAULT_FILAMENT_DIAMETER
+}
+
+// getLayerFlows measures the extruded volume, extrusion time, layer time, hotend temperature and
+// fan speed of each 0-based layer
+func (a *Analysis) getLayerFlows(lines []string) map[int]layerFlow {
+	flows := make(map[int]layerFlow)
+	filamentArea := math.Pi * math.Pow(getFilamentDiameter(lines)/2, 2)
+	var state machineState
+	currentLayer := -1
+	for _, line := range lines {
+		if a.detectLayerChange(line) {
+			currentLayer++
+			flows[currentLayer] = layerFlow{HotendTemp: state.HotendTemp, FanSpeed: state.FanSpeed}
+			continue
+		}
+
+		previous := state
+		state.update(line)
+		if currentLayer < 0 {
+			continue
+		}
+		flow := flows[currentLayer]
+		flow.HotendTemp = max(flow.HotendTemp, state.HotendTemp)
+		flow.FanSpeed = max(flow.FanSpeed, state.FanSpeed)
+
+		fields := strings.Fields(stripComment(line))
+		if len(fields) > 0 && (fields[0] == "G0" || fields[0] == "G1") && state.Feedrate > 0 && previous.hasPosition {
+			distance := math.Hypot(calculateDistance(previous.X, previous.Y, state.X, state.Y), state.Z-previous.Z)
+			moveTime := distance / (state.Feedrate / 60)
+			flow.LayerTime += moveTime
+			if fields[0] == "G1" && state.E > previous.E && distance > 0 {
+				flow.Volume += (state.E - previous.E) * filamentArea
+				flow.Time += moveTime
+			}
+		}
+		flows[currentLayer] = flow
+	}
+	return flows
+}
+
+// detectClogRisk returns runs of at least ClogMinLayers consecutive layers printed with an
+// average flow below ClogMaxFlow at ClogMinTemp or hotter, where slow filament movement lets heat
+// creep up the heat break
+func (a *Analysis) detectClogRisk(lines []string) []Detection {
+	flows := a.getLayerFlows(lines)
+	detections := []Detection{}
+
+	runStart := -1
+	minFlow := math.MaxFloat64
+	endRun := func(end int) {
+		if runStart >= 0 && end-runStart+1 >= a.preset.ClogMinLayers {
+			detections = append(detections, Detection{
+				Layer:    runStart,
+				EndLayer: end,
+				Detector: DETECTOR_CLOG_RISK,
+				Details: fmt.Sprintf("%d layers with average flow below %.1fmm³/s (lowest %.2fmm³/s) at %d°C or hotter",
+					end-runStart+1, a.preset.ClogMaxFlow, minFlow, a.preset.ClogMinTemp),
+			})
+		}
+		runStart = -1
+		minFlow = math.MaxFloat64
+	}
+
+	for layer := 0; layer < len(flows); layer++ {
+		flow := flows[layer]
+		if flow.Time > 0 && flow.AverageFlow() < a.preset.ClogMaxFlow && flow.HotendTemp >= a.preset.ClogMinTemp {
+			if runStart < 0 {
+				runStart = layer
+			}
+			minFlow = min(minFlow, flow.AverageFlow())
+		} else {
+			endRun(layer - 1)
+		}
+	}
+	endRun(len(flows) - 1)
+	return detections
+}
+
+// planClogModifications lowers the temperature and speeds up printing over each clog risk run,
+// restoring both after it
+func (a *Analysis) planClogModifications(detections []Detection, defaultTemp int) []modification {
+	modifications := []modification{}
+	for _, detection := range detections {
+		reason := fmt.Sprintf("clog risk over layers %d-%d", displayLayer(detection.Layer), displayLayer(detection.EndLayer))
+		modifications = append(modifications,
+			modification{Layer: detection.Layer, Kind: MOD_TEMPERATURE, Value: defaultTemp - a.preset.ClogTempDrop, Reason: reason},
+			modification{Layer: detection.Layer, Kind: MOD_SPEED_FACTOR, Value: a.preset.ClogSpeedPct, Reason: reason})
+
+		reason = RESET_REASON_PREFIX + reason
+		modifications = append(modifications,
+			modification{Layer: detection.EndLayer + 1, Kind: MOD_TEMPERATURE, Value: defaultTemp, Reason: reason},
+			modification{Layer: detection.EndLayer + 1, Kind: MOD_SPEED_FACTOR, Value: 100, Reason: reason})
+	}
+	return modifications
+}
+
+// modifyGcodeSpeedFactor sets the feedrate percentage (M220) at a specific layer.
+func (a *Analysis) modifyGcodeSpeedFactor(lines []string, layerNumber int, speedPercent int, reason string) []string {
+	return a.insertModifications(lines, []modification{{Layer: layerNumber, Kind: MOD_SPEED_FACTOR, Value: speedPercent, Reason: reason}})
+}
+
+// getSpeedFactorLines returns the lines that set the feedrate percentage at a layer
+func (a *Analysis) getSpeedFactorLines(layerNumber int, speedPercent int, reason string) []string {
+	command := withComment(fmt.Sprintf("M220 S%d", speedPercent), msg(MSG_SET_SPEED_FACTOR, speedPercent, displayLayer(layerNumber)))
+	fmt.Println(msg(MSG_LOG_SET_SPEED, speedPercent, displayLayer(layerNumber), a.layerLines[layerNumber], a.layerZHeights[layerNumber], reason))
+	return insertedLines(command, reason)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Flags that take a file path, completed with file names
+var fileFlags = map[string]bool{"f": true, "d": true, "plan-in": true, "plan-out": true, "report": true,
+	"macros": true, "transforms": true, "plugins": true, "api-keys": true}
+
+// getCommandFlags returns the flags of a command, sorted by name
+func getCommandFlags(c command) []*flag.Flag {
+	flags := []*flag.Flag{}
+	newCommandFlagSet(c).VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+	return flags
+}
+
+// getPresetNames returns the names of the built-in and user presets, sorted
+func getPresetNames() []string {
+	names := []string{}
+	for name := range getAllPresets() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runCompletionCommand implements "completion": it prints a completion script for a shell
+func runCompletionCommand(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: gcode_modifier completion bash | zsh | fish")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "bash":
+		fmt.Print(getBashCompletion())
+	case "zsh":
+		// zsh runs the bash script through its bash completion emulation
+		fmt.Print("autoload -U +X compinit && compinit\nautoload -U +X bashcompinit && bashcompinit\n\n" + getBashCompletion())
+	case "fish":
+		fmt.Print(getFishCompletion())
+	default:
+		fmt.Printf("Error: unknown shell '%s' (use bash, zsh or fish)\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// getBashCompletion returns the bash completion script
+func getBashCompletion() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `# bash completion for %[1]s, generated by '%[1]s completion bash'
+_%[1]s() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" command="" words
+    if [[ ${COMP_CWORD} -gt 1 && "${COMP_WORDS[1]}" != -* ]]; then
+        command="${COMP_WORDS[1]}"
+    fi
+    case "$prev" in
+        -preset) COMPREPLY=($(compgen -W "%[2]s" -- "$cur")); return ;;
+`, PROGRAM_NAME, strings.Join(getPresetNames(), " "))
+	fileNames := []string{}
+	for name := range fileFlags {
+		fileNames = append(fileNames, "-"+name)
+	}
+	sort.Strings(fileNames)
+	fmt.Fprintf(&b, "        %s) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n    esac\n    case \"$command\" in\n", strings.Join(fileNames, "|"))
+
+	for _, c := range commands[1:] {
+		names := []string{}
+		for _, f := range getCommandFlags(c) {
+			names = append(names, "-"+f.Name)
+		}
+		switch c.Name {
+		case "presets":
+			fmt.Fprintf(&b, "        presets) words=\"list show %s\" ;;\n", strings.Join(getPresetNames(), " "))
+		case "completion":
+			fmt.Fprintf(&b, "        completion) words=\"bash zsh fish\" ;;\n")
+		case "help":
+			fmt.Fprintf(&b, "        help) words=%q ;;\n", strings.Join(getCommandNames(), " "))
+		default:
+			fmt.Fprintf(&b, "        %s) words=%q ;;\n", c.Name, strings.Join(names, " "))
+		}
+	}
+	// Without a command, the flags of processing files and the commands are completed
+	names := getCommandNames()
+	for _, f := range getCommandFlags(commands[0]) {
+		names = append(names, "-"+f.Name)
+	}
+	fmt.Fprintf(&b, "        *) words=%q ;;\n", strings.Join(names, " "))
+	fmt.Fprintf(&b, `    esac
+    if [[ "$cur" == -* || -z "$command" || "$command" == presets || "$command" == completion || "$command" == help ]]; then
+        COMPREPLY=($(compgen -W "$words" -- "$cur"))
+    else
+        COMPREPLY=($(compgen -f -- "$cur"))
+    fi
+}
+complete -o filenames -F _%[1]s %[1]s
+`, PROGRAM_NAME)
+	return b.String()
+}
+
+// getFishCompletion returns the fish completion script
+func getFishCompletion() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %[1]s, generated by '%[1]s completion fish'\ncomplete -c %[1]s -f\n", PROGRAM_NAME)
+	subcommands := strings.Join(getCommandNames(), " ")
+	for _, c := range commands {
+		condition := "__fish_seen_subcommand_from " + c.Name
+		if c.Name == "" {
+			condition = "not __fish_seen_subcommand_from " + subcommands
+		} else {
+			fmt.Fprintf(&b, "complete -c %s -n '__fish_use_subcommand' -a %s -d %q\n", PROGRAM_NAME, c.Name, c.Summary)
+		}
+		for _, f := range getCommandFlags(c) {
+			line := fmt.Sprintf("complete -c %s -n '%s' -o %s -d %q", PROGRAM_NAME, condition, f.Name, strings.Split(f.Usage, " (")[0])
+			switch {
+			case fileFlags[f.Name]:
+				line += " -r -F"
+			case f.Name == "preset":
+				line += fmt.Sprintf(" -x -a %q", strings.Join(getPresetNames(), " "))
+			}
+			fmt.Fprintln(&b, line)
+		}
+	}
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from presets' -a 'list show'\n", PROGRAM_NAME)
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n", PROGRAM_NAME)
+	fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from help' -a %q\n", PROGRAM_NAME, subcommands)
+	return b.String()
+}
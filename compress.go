@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	GZIP_SUFFIX = ".gz"
+	ZIP_SUFFIX  = ".zip"
+)
+
+var compressOutputs bool // -compress, gzip the outputs of uncompressed inputs
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gcodeExtensions are the extensions of G-code inputs, longest first
+var gcodeExtensions = []string{".gcode.3mf", ".gcode.gz", ".gcode.zip", ".gcode", ZIP_SUFFIX, GZIP_SUFFIX}
+
+// splitGcodeExt splits a path into its name and G-code extension, e.g. "part" and ".gcode.gz";
+// the extension is "" for other paths
+func splitGcodeExt(filePath string) (string, string) {
+	lower := strings.ToLower(filePath)
+	for _, ext := range gcodeExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return filePath[:len(filePath)-len(ext)], filePath[len(filePath)-len(ext):]
+		}
+	}
+	return filePath, ""
+}
+
+// isZipFile reports whether the path is a zip archive of G-code files (e.g. "part.gcode.zip")
+func isZipFile(filePath string) bool {
+	return strings.HasSuffix(strings.ToLower(filePath), ZIP_SUFFIX)
+}
+
+// isGzipFile reports whether the path is gzip-compressed G-code (e.g. "part.gcode.gz")
+func isGzipFile(filePath string) bool {
+	return strings.HasSuffix(strings.ToLower(filePath), GZIP_SUFFIX)
+}
+
+// getDerivedFilePath returns the path of a G-code file written from an input, with a suffix
+// added to its name: compressed like the input, or with -compress, and uncompressed otherwise
+func getDerivedFilePath(filePath string, suffix string) string {
+	name, ext := splitGcodeExt(filePath)
+	if !isGzipFile(ext) {
+		ext = ".gcode"
+		if compressOutputs {
+			ext += GZIP_SUFFIX
+		}
+	}
+	return name + suffix + ext
+}
+
+// decompress returns a reader of the G-code read from r, decompressing it when it is gzipped
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(gzipMagic))
+	if !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// isZipGcodeEntry reports whether a zip entry is a G-code file, skipping macOS metadata
+func isZipGcodeEntry(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".gcode") && !strings.HasPrefix(name, "__MACOSX/")
+}
+
+// readZipFileLines reads the G-code lines of a zip archive holding a single G-code file, and
+// reports whether it has CRLF line endings
+func readZipFileLines(filePath string) ([]string, bool, error) {
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	entries := []*zip.File{}
+	for _, f := range reader.File {
+		if isZipGcodeEntry(f.Name) {
+			entries = append(entries, f)
+		}
+	}
+	if len(entries) != 1 {
+		return nil, false, fmt.Errorf("'%s' holds %d G-code files, not one", filePath, len(entries))
+	}
+	return readZipLines(entries[0])
+}
+
+// writeGcode writes lines to w, gzipped when the output path is a .gz file
+func writeGcode(w io.Writer, filePath string, lines []string, inputCRLF bool) error {
+	if !isGzipFile(filePath) {
+		return newLineWriter(w, inputCRLF).WriteLines(lines)
+	}
+	gz := gzip.NewWriter(w)
+	if err := newLineWriter(gz, inputCRLF).WriteLines(lines); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	DETECTOR_COOLING_MODEL = "cooling-model"
+	COOLING_TAU_STILL      = 25.0 // Seconds for a thin wall to lose 63% of its excess heat without fan
+	COOLING_TAU_FAN        = 5.0  // Seconds for the same at full fan
+	DEFAULT_GLASS_TEMP     = 70.0 // Celcius, for unknown materials
+	DEFAULT_AMBIENT_TEMP   = 25.0
+)
+
+// materialThermal is what the cooling model needs to know about a filament
+type materialThermal struct {
+	GlassTemp   float64 // A layer must cool below this before the next one is laid on it
+	AmbientTemp float64 // Air temperature around the part (enclosed for ABS/ASA/PC)
+}
+
+var materialThermalByType = map[string]materialThermal{
+	"PLA":  {GlassTemp: 60, AmbientTemp: 25},
+	"PETG": {GlassTemp: 80, AmbientTemp: 25},
+	"ABS":  {GlassTemp: 105, AmbientTemp: 40},
+	"ASA":  {GlassTemp: 100, AmbientTemp: 40},
+	"PC":   {GlassTemp: 145, AmbientTemp: 40},
+	"TPU":  {GlassTemp: 60, AmbientTemp: 25},
+}
+
+// getMaterialThermal returns the thermal properties of a filament type
+func getMaterialThermal(material string) materialThermal {
+	if thermal, ok := materialThermalByType[material]; ok {
+		return thermal
+	}
+	return materialThermal{GlassTemp: DEFAULT_GLASS_TEMP, AmbientTemp: DEFAULT_AMBIENT_TEMP}
+}
+
+// estimateLayerEndTemp estimates the temperature of a layer when the next one starts, with
+// Newton cooling from the hotend temperature over the layer time. The fan shortens the time
+// constant linearly from COOLING_TAU_STILL to COOLING_TAU_FAN.
+func estimateLayerEndTemp(flow layerFlow, thermal materialThermal) float64 {
+	tau := COOLING_TAU_STILL - (COOLING_TAU_STILL-COOLING_TAU_FAN)*float64(flow.FanSpeed)/255
+	excess := float64(flow.HotendTemp) - thermal.AmbientTemp
+	return thermal.AmbientTemp + excess*math.Exp(-flow.LayerTime/tau)
+}
+
+// filterByCoolingModel keeps the problematic layers that don't cool below the material's glass
+// transition temperature before the next layer starts; a small layer printed slowly enough cools
+// down on its own and needs no correction
+func (a *Analysis) filterByCoolingModel(lines []string, probLayers []int, material string) []int {
+	thermal := getMaterialThermal(material)
+	flows := a.getLayerFlows(lines)
+	kept := []int{}
+	for _, layer := range probLayers {
+		flow := flows[layer]
+		endTemp := estimateLayerEndTemp(flow, thermal)
+		if flow.HotendTemp > 0 && endTemp < thermal.GlassTemp {
+			fmt.Printf("  %s cools to %.0f°C within its %.1fs layer time, below %.0f°C: no correction needed\n",
+				a.describeLayer(layer), endTemp, flow.LayerTime, thermal.GlassTemp)
+			continue
+		}
+		fmt.Printf("  %s is still at %.0f°C after its %.1fs layer time, above %.0f°C\n",
+			a.describeLayer(layer), endTemp, flow.LayerTime, thermal.GlassTemp)
+		kept = append(kept, layer)
+	}
+	return kept
+}
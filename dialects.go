@@ -0,0 +1,114 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// slicerDialect describes how a slicer marks layer changes
+type slicerDialect struct {
+	Name          string
+	Marker        func(line string) bool // Identifies files written by the slicer
+	IsLayerChange func(line string) bool
+}
+
+var simplify3dLayerRegexp = regexp.MustCompile(`^; layer -?\d+, Z = `)
+var kiriMotoLayerRegexp = regexp.MustCompile(`^;+ *--- layer \d+`)
+
+// isBambuLayerChange matches "; layer num/total_layer_count: 1/60"
+func isBambuLayerChange(line string) bool {
+	return strings.HasPrefix(line, "; layer num/total_layer_count: ")
+}
+
+// isCuraLayerChange matches ";LAYER:0", also used by ideaMaker
+func isCuraLayerChange(line string) bool {
+	return strings.HasPrefix(line, ";LAYER:")
+}
+
+// isSimplify3dLayerChange matches "; layer 1, Z = 0.200"
+func isSimplify3dLayerChange(line string) bool {
+	return simplify3dLayerRegexp.MatchString(line)
+}
+
+// isPrusaLayerChange matches ";LAYER_CHANGE", written by PrusaSlicer and SuperSlicer
+func isPrusaLayerChange(line string) bool {
+	return strings.HasPrefix(line, ";LAYER_CHANGE")
+}
+
+// isSlic3rLayerChange matches the verbose G-code comment on legacy Slic3r's layer moves,
+// e.g. "G1 Z0.500 F7800.000 ; move to next layer (1)"
+func isSlic3rLayerChange(line string) bool {
+	return strings.HasPrefix(line, "G1 Z") && strings.Contains(line, "; move to next layer")
+}
+
+// isKiriMotoLayerChange matches Kiri:Moto's layer banners, e.g. ";; --- layer 3 (0.2 @ 0.8) ---"
+func isKiriMotoLayerChange(line string) bool {
+	return kiriMotoLayerRegexp.MatchString(line)
+}
+
+// Known dialects, in the order their markers are checked
+var slicerDialects = []slicerDialect{
+	{
+		Name:          "Bambu Studio/OrcaSlicer",
+		Marker:        isBambuLayerChange,
+		IsLayerChange: isBambuLayerChange,
+	},
+	{
+		Name:          "Simplify3D",
+		Marker:        func(line string) bool { return strings.HasPrefix(line, "; G-Code generated by Simplify3D") },
+		IsLayerChange: isSimplify3dLayerChange,
+	},
+	{
+		Name:          "ideaMaker",
+		Marker:        func(line string) bool { return strings.HasPrefix(line, ";Sliced by ideaMaker") },
+		IsLayerChange: isCuraLayerChange,
+	},
+	{
+		Name:          "Cura",
+		Marker:        func(line string) bool { return strings.HasPrefix(line, ";Generated with Cura") },
+		IsLayerChange: isCuraLayerChange,
+	},
+	{
+		Name: "PrusaSlicer",
+		Marker: func(line string) bool {
+			return strings.HasPrefix(line, "; generated by PrusaSlicer") || strings.HasPrefix(line, "; generated by SuperSlicer")
+		},
+		IsLayerChange: isPrusaLayerChange,
+	},
+	{
+		Name:          "Slic3r (legacy)",
+		Marker:        func(line string) bool { return strings.HasPrefix(line, "; generated by Slic3r") },
+		IsLayerChange: isSlic3rLayerChange,
+	},
+	{
+		Name:          "Kiri:Moto",
+		Marker:        func(line string) bool { return strings.Contains(line, "Kiri:Moto") && strings.HasPrefix(line, ";") },
+		IsLayerChange: isKiriMotoLayerChange,
+	},
+}
+
+// detectDialect returns the dialect whose marker appears first in the file, falling back to the
+// dialect whose layer changes occur most often
+func detectDialect(lines []string) slicerDialect {
+	for _, line := range lines {
+		for _, dialect := range slicerDialects {
+			if dialect.Marker(line) {
+				return dialect
+			}
+		}
+	}
+
+	best, bestCount := slicerDialects[0], 0
+	for _, dialect := range slicerDialects {
+		count := 0
+		for _, line := range lines {
+			if dialect.IsLayerChange(line) {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = dialect, count
+		}
+	}
+	return best
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Document is the G-code of one file split into layers once, so transforms can read and replace
+// single layers without rescanning the whole file. Layer i starts with its layer change comment;
+// the lines before the first layer change are the header.
+type Document struct {
+	dialect slicerDialect
+	header  []string
+	layers  [][]string
+}
+
+// DocumentLayer is one layer of a Document
+type DocumentLayer struct {
+	doc   *Document
+	index int
+}
+
+// Command is a parsed G-code command
+type Command struct {
+	Name    string           // e.g. "G1", "M104" or a Klipper macro
+	Params  map[byte]float64 // Numeric parameters by letter, e.g. 'X' for X12.5
+	Args    []string         // Fields after the name as written, e.g. "FAN=aux" or "S255"
+	Comment string           // Without the ';'
+	Line    string
+}
+
+// NewDocument splits lines into the layers of the file's slicer dialect
+func NewDocument(lines []string) *Document {
+	doc := &Document{dialect: detectDialect(lines)}
+	start := len(lines)
+	for i, line := range lines {
+		if doc.dialect.IsLayerChange(line) {
+			start = i
+			break
+		}
+	}
+	doc.header = lines[:start]
+	for i := start; i < len(lines); {
+		end := i + 1
+		for end < len(lines) && !doc.dialect.IsLayerChange(lines[end]) {
+			end++
+		}
+		doc.layers = append(doc.layers, lines[i:end])
+		i = end
+	}
+	return doc
+}
+
+// Header returns the lines before the first layer change
+func (d *Document) Header() []string {
+	return d.header
+}
+
+// LayerCount returns the number of layers
+func (d *Document) LayerCount() int {
+	return len(d.layers)
+}
+
+// Layer returns the 0-based layer i, which must be below LayerCount
+func (d *Document) Layer(i int) DocumentLayer {
+	return DocumentLayer{doc: d, index: i}
+}
+
+// ReplaceHeader replaces the lines before the first layer change
+func (d *Document) ReplaceHeader(lines ...string) {
+	d.header = lines
+}
+
+// ReplaceLayer replaces the lines of the 0-based layer i. The lines should start with the layer
+// change, or the layer merges into the one before it once the document is split again.
+func (d *Document) ReplaceLayer(i int, lines ...string) {
+	d.layers[i] = lines
+}
+
+// LineNumber returns the 1-based line of the layer change of the 0-based layer i in Lines()
+func (d *Document) LineNumber(i int) int {
+	line := len(d.header) + 1
+	for _, layer := range d.layers[:i] {
+		line += len(layer)
+	}
+	return line
+}
+
+// Lines returns the lines of the whole document
+func (d *Document) Lines() []string {
+	count := len(d.header)
+	for _, layer := range d.layers {
+		count += len(layer)
+	}
+	lines := make([]string, 0, count)
+	lines = append(lines, d.header...)
+	for _, layer := range d.layers {
+		lines = append(lines, layer...)
+	}
+	return lines
+}
+
+// Index returns the 0-based number of the layer
+func (l DocumentLayer) Index() int {
+	return l.index
+}
+
+// Lines returns the lines of the layer, starting with its layer change. The slice is shared with
+// the document; use ReplaceLayer to change it.
+func (l DocumentLayer) Lines() []string {
+	return l.doc.layers[l.index]
+}
+
+// Commands returns the commands of the layer, skipping comment-only and blank lines
+func (l DocumentLayer) Commands() []Command {
+	commands := []Command{}
+	for _, line := range l.Lines() {
+		if command, ok := parseCommand(line); ok {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// parseCommand parses a G-code line into a Command, false for comment-only and blank lines
+func parseCommand(line string) (Command, bool) {
+	code := stripComment(line)
+	fields := strings.Fields(code)
+	if len(fields) == 0 {
+		return Command{}, false
+	}
+	command := Command{Name: fields[0], Params: make(map[byte]float64), Args: fields[1:],
+		Comment: strings.TrimSpace(strings.TrimPrefix(line[len(code):], ";")), Line: line}
+	for _, field := range fields[1:] {
+		if len(field) < 2 {
+			continue
+		}
+		if value, err := strconv.ParseFloat(field[1:], 64); err == nil {
+			command.Params[field[0]] = value
+		}
+	}
+	return command, true
+}
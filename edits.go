@@ -0,0 +1,119 @@
+package main
+
+// splice is one insert, delete or replace operation on a layer of a Document: Removed lines
+// starting at Index are replaced by Inserted
+type splice struct {
+	Layer    int
+	Index    int
+	Removed  []string
+	Inserted []string
+}
+
+// edit is one recorded change to a document, made of splices applied in order. Mod is the
+// modification the change applies, nil for other edits such as a skipped modification.
+type edit struct {
+	Mod     *modification
+	splices []splice
+}
+
+// editBuffer records the edits made to a Document so they can be undone and redone without
+// splitting the file again
+type editBuffer struct {
+	doc    *Document
+	done   []edit
+	undone []edit
+}
+
+// newEditBuffer returns an edit buffer for a document with nothing recorded yet
+func newEditBuffer(doc *Document) *editBuffer {
+	return &editBuffer{doc: doc}
+}
+
+// Insert returns the splice inserting lines before line index of a layer
+func (b *editBuffer) Insert(layer int, index int, lines ...string) splice {
+	return splice{Layer: layer, Index: index, Inserted: lines}
+}
+
+// Delete returns the splice deleting count lines of a layer from line index on
+func (b *editBuffer) Delete(layer int, index int, count int) splice {
+	return b.Replace(layer, index, count)
+}
+
+// Replace returns the splice replacing count lines of a layer from line index on with lines
+func (b *editBuffer) Replace(layer int, index int, count int, lines ...string) splice {
+	removed := b.doc.Layer(layer).Lines()[index : index+count]
+	return splice{Layer: layer, Index: index, Removed: append([]string{}, removed...), Inserted: lines}
+}
+
+// Apply makes the splices to the document and records them as one edit, which clears the edits
+// that could be redone
+func (b *editBuffer) Apply(mod *modification, splices ...splice) {
+	for _, s := range splices {
+		b.doc.splice(s)
+	}
+	b.done = append(b.done, edit{Mod: mod, splices: splices})
+	b.undone = nil
+}
+
+// Undo reverts the last edit, false if there is none
+func (b *editBuffer) Undo() (edit, bool) {
+	if len(b.done) == 0 {
+		return edit{}, false
+	}
+	e := b.done[len(b.done)-1]
+	for i := len(e.splices) - 1; i >= 0; i-- {
+		s := e.splices[i]
+		b.doc.splice(splice{Layer: s.Layer, Index: s.Index, Removed: s.Inserted, Inserted: s.Removed})
+	}
+	b.done = b.done[:len(b.done)-1]
+	b.undone = append(b.undone, e)
+	return e, true
+}
+
+// Redo makes the last undone edit again, false if there is none
+func (b *editBuffer) Redo() (edit, bool) {
+	if len(b.undone) == 0 {
+		return edit{}, false
+	}
+	e := b.undone[len(b.undone)-1]
+	for _, s := range e.splices {
+		b.doc.splice(s)
+	}
+	b.undone = b.undone[:len(b.undone)-1]
+	b.done = append(b.done, e)
+	return e, true
+}
+
+// Modifications returns the modifications of the edits in effect, in the order they were made
+func (b *editBuffer) Modifications() []modification {
+	modifications := []modification{}
+	for _, e := range b.done {
+		if e.Mod != nil {
+			modifications = append(modifications, *e.Mod)
+		}
+	}
+	return modifications
+}
+
+// insertedAt returns the number of lines the edits in effect added to a layer
+func (b *editBuffer) insertedAt(layer int) int {
+	inserted := 0
+	for _, e := range b.done {
+		for _, s := range e.splices {
+			if s.Layer == layer {
+				inserted += len(s.Inserted) - len(s.Removed)
+			}
+		}
+	}
+	return inserted
+}
+
+// splice makes a splice to the lines of a layer
+func (d *Document) splice(s splice) {
+	lines := d.layers[s.Layer]
+	spliced := make([]string, 0, len(lines)-len(s.Removed)+len(s.Inserted))
+	spliced = append(spliced, lines[:s.Index]...)
+	spliced = append(spliced, s.Inserted...)
+	spliced = append(spliced, lines[s.Index+len(s.Removed):]...)
+	d.layers[s.Layer] = spliced
+}
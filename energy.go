@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	ENERGY_DEFAULT_BED_WATTS     = 220.0 // W of a typical 235mm heated bed
+	ENERGY_DEFAULT_HOTEND_WATTS  = 40.0
+	ENERGY_DEFAULT_BASE_WATTS    = 10.0 // Electronics, fans and held steppers
+	ENERGY_DEFAULT_MOTION_WATTS  = 25.0 // Added while the toolhead moves
+	ENERGY_DEFAULT_BED_HEAT_RATE = 0.5  // °C/s
+	ENERGY_AMBIENT_TEMP          = 25   // °C heaters start from and lose heat to
+	ENERGY_BED_MAX_RISE          = 150.0
+	ENERGY_HOTEND_MAX_RISE       = 500.0 // °C above ambient a heater would settle at on full power
+	JOULES_PER_WH                = 3600.0
+)
+
+// powerProfile is the power draw of a printer, from the "power" block of its profile
+type powerProfile struct {
+	BedWatts    float64 `json:"bed_watts,omitempty"`
+	HotendWatts float64 `json:"hotend_watts,omitempty"`
+	BaseWatts   float64 `json:"base_watts,omitempty"`    // Electronics, fans and held steppers, all print long
+	MotionWatts float64 `json:"motion_watts,omitempty"`  // Added while the toolhead moves
+	BedHeatRate float64 `json:"bed_heat_rate,omitempty"` // °C/s the bed heats at
+}
+
+var reportEnergy bool // -energy, estimate the energy each output takes to print
+
+// getPowerProfile returns the -printer profile's power draw, with defaults for what it leaves out
+func getPowerProfile() powerProfile {
+	power := powerProfile{}
+	if activePrinter != nil && activePrinter.Power != nil {
+		power = *activePrinter.Power
+	}
+	for _, field := range []struct {
+		value        *float64
+		defaultValue float64
+	}{
+		{&power.BedWatts, ENERGY_DEFAULT_BED_WATTS},
+		{&power.HotendWatts, ENERGY_DEFAULT_HOTEND_WATTS},
+		{&power.BaseWatts, ENERGY_DEFAULT_BASE_WATTS},
+		{&power.MotionWatts, ENERGY_DEFAULT_MOTION_WATTS},
+		{&power.BedHeatRate, ENERGY_DEFAULT_BED_HEAT_RATE},
+	} {
+		if *field.value <= 0 {
+			*field.value = field.defaultValue
+		}
+	}
+	return power
+}
+
+// energyEstimate is the estimated energy a print takes, in Wh
+type energyEstimate struct {
+	Duration float64 // s, heating waits included
+	Bed      float64
+	Hotend   float64
+	Motion   float64
+	Base     float64
+}
+
+// Total returns the energy of the whole print in Wh
+func (e energyEstimate) Total() float64 {
+	return e.Bed + e.Hotend + e.Motion + e.Base
+}
+
+func (e energyEstimate) String() string {
+	return fmt.Sprintf("%.3fkWh over %s (bed %.3f, hotend %.3f, motion %.3f, electronics %.3f kWh)", e.Total()/1000,
+		formatEstimate(e.Duration), e.Bed/1000, e.Hotend/1000, e.Motion/1000, e.Base/1000)
+}
+
+// estimateEnergy estimates the energy a print takes from the -printer profile's power draw and
+// the estimated time of each line. Heaters draw full power while heating up, at the profile's
+// heat_rate and bed_heat_rate, then hold their temperature at a duty that grows with how far it
+// is above ambient. Heating waits last until the heater is up to temperature, which time
+// estimates otherwise leave out.
+func estimateEnergy(lines []string) energyEstimate {
+	power := getPowerProfile()
+	lineTimes := getLineTimes(lines)
+	// heater is the state of the bed or the hotend
+	type heater struct {
+		watts, rate, maxRise float64
+		target, reached      int
+		readyAt              float64 // When it is up to its target
+		energy               *float64
+	}
+	var estimate energyEstimate
+	bed := heater{watts: power.BedWatts, rate: power.BedHeatRate, maxRise: ENERGY_BED_MAX_RISE, reached: ENERGY_AMBIENT_TEMP, energy: &estimate.Bed}
+	hotend := heater{watts: power.HotendWatts, rate: getHeatRate(), maxRise: ENERGY_HOTEND_MAX_RISE, reached: ENERGY_AMBIENT_TEMP, energy: &estimate.Hotend}
+
+	now := 0.0 // Print time, heating waits included
+	// hold adds the energy of the heaters holding their temperatures, once they are up to them,
+	// and the base draw over a time
+	hold := func(seconds float64) {
+		for _, h := range []*heater{&bed, &hotend} {
+			held := now + seconds - math.Max(now, h.readyAt)
+			if h.target > ENERGY_AMBIENT_TEMP && held > 0 {
+				duty := math.Min(1, float64(h.target-ENERGY_AMBIENT_TEMP)/h.maxRise)
+				*h.energy += h.watts * duty * held / JOULES_PER_WH
+			}
+		}
+		estimate.Base += power.BaseWatts * seconds / JOULES_PER_WH
+		now += seconds
+	}
+	var state machineState
+	for i, line := range lines {
+		elapsed := lineTimes[i]
+		if i > 0 {
+			elapsed -= lineTimes[i-1]
+		}
+		previous := state
+		state.update(line)
+		for _, h := range []struct {
+			heater       *heater
+			target, from int
+		}{{&bed, state.BedTemp, previous.BedTemp}, {&hotend, state.HotendTemp, previous.HotendTemp}} {
+			if h.target == h.from {
+				continue
+			}
+			heater := h.heater
+			heater.target = h.target
+			if h.target > heater.reached {
+				// Full power until it is up to temperature
+				heating := float64(h.target-heater.reached) / heater.rate
+				*heater.energy += heater.watts * heating / JOULES_PER_WH
+				heater.readyAt = now + heating
+			}
+			heater.reached = max(h.target, ENERGY_AMBIENT_TEMP)
+		}
+
+		command, ok := parseCommand(line)
+		if !ok {
+			continue
+		}
+		switch strings.ToUpper(command.Name) {
+		case "M190":
+			hold(math.Max(0, bed.readyAt-now))
+		case "M109":
+			hold(math.Max(0, hotend.readyAt-now))
+		case "G0", "G1", "G2", "G3":
+			estimate.Motion += power.MotionWatts * elapsed / JOULES_PER_WH
+		}
+		hold(elapsed)
+	}
+	estimate.Duration = now
+	return estimate
+}
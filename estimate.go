@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	ESTIMATE_DEFAULT_ACCEL = 1500.0 // mm/s², when neither the file nor the -printer profile sets it
+	ESTIMATE_DEFAULT_SCV   = 5.0    // mm/s, Klipper's default square_corner_velocity
+)
+
+var refreshEstimates bool // Rewrite the time estimates embedded in outputs for their new timing
+
+var (
+	estimateCommentRegexp = regexp.MustCompile(`^(;\s*estimated printing time[^=]*=\s*)(.*)$`)
+	totalTimeRegexp       = regexp.MustCompile(`(total estimated time:\s*)([0-9dhms ]+[0-9dhms])`)
+)
+
+// estimatorMove is a move queued for the lookahead of the time estimate
+type estimatorMove struct {
+	Line      int        // Index of the line of the move
+	Distance  float64    // mm in XYZ, along the arc for G2/G3
+	Direction [3]float64 // Unit vector from the start to the end of the move
+	CruiseV2  float64    // Square of the requested speed
+	Accel     float64
+	StartV2   float64 // Highest square speed at the start, from the junction with the previous move
+	Stop      bool    // The toolhead stops before this move (first move, after a dwell or wait)
+}
+
+// getJunctionV2 returns the highest square speed through the corner between two moves, as
+// Klipper derives it from the square corner velocity
+func getJunctionV2(previous, current estimatorMove, scv float64) float64 {
+	cosTheta := 0.0
+	for axis := range 3 {
+		cosTheta -= previous.Direction[axis] * current.Direction[axis]
+	}
+	if cosTheta > 0.999999 {
+		return 0
+	}
+	cosTheta = math.Max(cosTheta, -0.999999)
+	sinThetaD2 := math.Sqrt(0.5 * (1 - cosTheta))
+	deviation := scv * scv * (math.Sqrt2 - 1) / current.Accel
+	return math.Min(sinThetaD2/(1-sinThetaD2)*deviation*current.Accel, math.Min(previous.CruiseV2, current.CruiseV2))
+}
+
+// getTrapezoidTime returns the time of a move that accelerates from the start speed toward its
+// cruise speed and decelerates to the end speed (squares of speeds)
+func getTrapezoidTime(move estimatorMove, startV2, endV2 float64) float64 {
+	peakV2 := math.Min(move.CruiseV2, (startV2+endV2)/2+move.Accel*move.Distance)
+	peak := math.Sqrt(peakV2)
+	if peak == 0 {
+		return 0
+	}
+	accelDistance := (peakV2 - startV2) / (2 * move.Accel)
+	decelDistance := (peakV2 - endV2) / (2 * move.Accel)
+	cruiseDistance := math.Max(0, move.Distance-accelDistance-decelDistance)
+	return (peak-math.Sqrt(startV2))/move.Accel + (peak-math.Sqrt(endV2))/move.Accel + cruiseDistance/peak
+}
+
+// getArcLength returns the length of a G2/G3 arc from a position, with its center at the I/J
+// offsets
+func getArcLength(fromX, fromY, toX, toY, i, j float64, clockwise bool) float64 {
+	centerX, centerY := fromX+i, fromY+j
+	start := math.Atan2(fromY-centerY, fromX-centerX)
+	end := math.Atan2(toY-centerY, toX-centerX)
+	angle := end - start
+	if clockwise {
+		angle = -angle
+	}
+	if angle <= 0 {
+		angle += 2 * math.Pi
+	}
+	return angle * math.Hypot(i, j)
+}
+
+// getLineTimes returns the estimated time (s) at which each line has been executed, with the
+// lookahead planning of Klipper's trapezoid generator: constant acceleration, cruise at the
+// requested feedrate and corners taken at the speed the square corner velocity allows. The
+// acceleration comes from M204 and SET_VELOCITY_LIMIT in the file, else the -printer profile.
+// Heating waits aren't counted, as their length can't be known.
+func getLineTimes(lines []string) []float64 {
+	accel, scv := ESTIMATE_DEFAULT_ACCEL, ESTIMATE_DEFAULT_SCV
+	if activePrinter != nil && activePrinter.Accel > 0 {
+		accel = activePrinter.Accel
+	}
+	if activePrinter != nil && activePrinter.SquareCornerVelocity > 0 {
+		scv = activePrinter.SquareCornerVelocity
+	}
+
+	lineTimes := make([]float64, len(lines)) // Time of each line itself, summed up at the end
+	moves := []estimatorMove{}
+	stop := true
+	var state machineState
+	for i, line := range lines {
+		command, ok := parseCommand(line)
+		if !ok {
+			continue
+		}
+		name := strings.ToUpper(command.Name)
+		previous := state
+		state.update(line)
+		switch name {
+		case "M204":
+			for _, param := range []byte{'S', 'P'} {
+				if value, ok := command.Params[param]; ok && value > 0 {
+					accel = value
+				}
+			}
+		case "SET_VELOCITY_LIMIT":
+			for _, field := range command.Args {
+				key, value, _ := strings.Cut(strings.ToUpper(field), "=")
+				if v, err := strconv.ParseFloat(value, 64); err == nil && v > 0 {
+					switch key {
+					case "ACCEL":
+						accel = v
+					case "SQUARE_CORNER_VELOCITY":
+						scv = v
+					}
+				}
+			}
+		case "G4":
+			lineTimes[i] = command.Params['S'] + command.Params['P']/1000
+			stop = true
+		case "M400", "M109", "M190", "M191", "G28", "G29":
+			stop = true
+		case "G0", "G1", "G2", "G3":
+			if name == "G2" || name == "G3" {
+				// The state only follows G0/G1
+				if x, ok := command.Params['X']; ok {
+					state.X = x
+				}
+				if y, ok := command.Params['Y']; ok {
+					state.Y = y
+				}
+			}
+			if state.Feedrate <= 0 {
+				continue
+			}
+			move := estimatorMove{Line: i, CruiseV2: math.Pow(state.Feedrate/60, 2), Accel: accel, Stop: stop}
+			delta := [3]float64{state.X - previous.X, state.Y - previous.Y, state.Z - previous.Z}
+			move.Distance = math.Sqrt(delta[0]*delta[0] + delta[1]*delta[1] + delta[2]*delta[2])
+			if name == "G2" || name == "G3" {
+				move.Distance = math.Hypot(getArcLength(previous.X, previous.Y, state.X, state.Y,
+					command.Params['I'], command.Params['J'], name == "G2"), delta[2])
+			}
+			if move.Distance == 0 {
+				// Extruder-only moves (retractions and primes) stop the toolhead
+				lineTimes[i] = math.Abs(state.E-previous.E) / (state.Feedrate / 60)
+				stop = true
+				continue
+			}
+			for axis := range 3 {
+				move.Direction[axis] = delta[axis] / move.Distance
+			}
+			if !stop && len(moves) > 0 {
+				move.StartV2 = getJunctionV2(moves[len(moves)-1], move, scv)
+			}
+			moves = append(moves, move)
+			stop = false
+		}
+	}
+
+	// Backward pass: each move must be able to slow down to the most the next one can start with
+	endV2 := make([]float64, len(moves))
+	for n := len(moves) - 1; n >= 0; n-- {
+		if n+1 < len(moves) && !moves[n+1].Stop {
+			endV2[n] = moves[n+1].StartV2
+		}
+		if n > 0 && !moves[n].Stop {
+			moves[n].StartV2 = math.Min(moves[n].StartV2, endV2[n]+2*moves[n].Accel*moves[n].Distance)
+		}
+	}
+	// Forward pass: each move must be able to reach the speed it hands over to the next one
+	startV2 := 0.0
+	for n, move := range moves {
+		if move.Stop {
+			startV2 = 0
+		}
+		end := math.Min(endV2[n], startV2+2*move.Accel*move.Distance)
+		lineTimes[move.Line] += getTrapezoidTime(move, startV2, end)
+		startV2 = end
+	}
+
+	for i := 1; i < len(lineTimes); i++ {
+		lineTimes[i] += lineTimes[i-1]
+	}
+	return lineTimes
+}
+
+// formatEstimate formats a duration like the slicers' estimates, e.g. "1d 2h 3m 4s" or "5m 6s"
+func formatEstimate(seconds float64) string {
+	total := int(math.Round(seconds))
+	days, hours, minutes := total/86400, total%86400/3600, total%3600/60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm %ds", days, hours, minutes, total%60)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm %ds", hours, minutes, total%60)
+	case minutes > 0:
+		return fmt.Sprintf("%dm %ds", minutes, total%60)
+	}
+	return fmt.Sprintf("%ds", total)
+}
+
+// refreshTimeEstimates rewrites the time estimates embedded in the lines for the time estimated
+// from their moves, so hosts such as Mainsail, Fluidd and OctoPrint show the right ETA: M73
+// progress (P/Q percent, R/S minutes left), the slicers' "estimated printing time" and "total
+// estimated time" comments, and Cura's ;TIME and ;TIME_ELAPSED.
+func refreshTimeEstimates(lines []string) []string {
+	lineTimes := getLineTimes(lines)
+	if len(lineTimes) == 0 {
+		return lines
+	}
+	total := lineTimes[len(lineTimes)-1]
+	refreshed := make([]string, len(lines))
+	numbers := getNumberFormat(lines)
+	previous := ""
+	updated := 0
+	for i, line := range lines {
+		elapsed := 0.0
+		if i > 0 {
+			elapsed = lineTimes[i-1]
+		}
+		refreshed[i] = line
+		trimmed := strings.TrimSpace(line)
+		if m := estimateCommentRegexp.FindStringSubmatch(trimmed); m != nil {
+			previous = m[2]
+			refreshed[i] = m[1] + formatEstimate(total)
+		} else if m := totalTimeRegexp.FindStringSubmatch(line); m != nil {
+			previous = m[2]
+			refreshed[i] = strings.Replace(line, m[0], m[1]+formatEstimate(total), 1)
+		} else if value, ok := strings.CutPrefix(trimmed, ";TIME:"); ok {
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+				previous = formatEstimate(seconds)
+			}
+			refreshed[i] = fmt.Sprintf(";TIME:%d", int(math.Round(total)))
+		} else if strings.HasPrefix(trimmed, ";TIME_ELAPSED:") {
+			refreshed[i] = fmt.Sprintf(";TIME_ELAPSED:%.6f", lineTimes[i])
+		} else if command, ok := parseCommand(line); ok && strings.ToUpper(command.Name) == "M73" {
+			percent, remaining := 0.0, 0.0
+			if total > 0 {
+				percent = math.Floor(elapsed / total * 100)
+				remaining = math.Ceil((total - elapsed) / 60)
+			}
+			actions := []transformAction{}
+			for _, param := range []byte{'P', 'Q'} {
+				if _, ok := command.Params[param]; ok {
+					actions = append(actions, transformAction{Param: param, Op: "=", Value: percent})
+				}
+			}
+			for _, param := range []byte{'R', 'S'} {
+				if _, ok := command.Params[param]; ok {
+					actions = append(actions, transformAction{Param: param, Op: "=", Value: remaining})
+				}
+			}
+			refreshed[i], _ = applyActions(line, actions, numbers)
+		} else {
+			continue
+		}
+		if refreshed[i] != line {
+			updated++
+		}
+	}
+
+	if previous != "" {
+		fmt.Printf("Refreshed time estimates: %s (was %s), %d lines updated\n", formatEstimate(total), previous, updated)
+	} else {
+		fmt.Printf("Refreshed time estimates: %s, %d lines updated\n", formatEstimate(total), updated)
+	}
+	return refreshed
+}
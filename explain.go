@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+const EXPLAIN_LINE_WIDTH = 44 // Lines are cut to this many characters before their state
+
+// explainPerimeterChange returns whether the perimeter-change detector flags a layer, with the
+// measurements and, for an unflagged layer, which thresholds it missed
+func (a *Analysis) explainPerimeterChange(layer int) (bool, []string) {
+	current := a.perimeterLengths[layer]
+	if layer < 1 {
+		return false, []string{fmt.Sprintf("perimeter %.1fmm; the first layer is never flagged", current)}
+	}
+	previous := a.perimeterLengths[layer-1]
+	change := (current - previous) / previous * 100
+	notes := []string{fmt.Sprintf("perimeter %.1fmm below -> %.1fmm (%.1f%%), travel %.1fmm", previous, current, change, a.travelLengths[layer])}
+	if _, ok := a.explanations[layer]; ok {
+		return true, notes
+	}
+	if math.IsNaN(change) || change >= a.preset.PerimPctChgUpper || change <= a.preset.PerimPctChgLower {
+		notes = append(notes, fmt.Sprintf("change is not between %.0f%% and %.0f%%", a.preset.PerimPctChgLower, a.preset.PerimPctChgUpper))
+	}
+	if current <= a.preset.MinCurrPerim {
+		notes = append(notes, fmt.Sprintf("perimeter is not above %.0fmm", a.preset.MinCurrPerim))
+	}
+	if layer < a.preset.MinProbLayer {
+		notes = append(notes, fmt.Sprintf("layer is below %d", displayLayer(a.preset.MinProbLayer)))
+	}
+	if a.supportOnlyLayers[layer] {
+		notes = append(notes, "layer prints only support")
+	}
+	return false, notes
+}
+
+// explainFlags are the flags of the explain command
+type explainFlags struct {
+	inputFilePath *string
+	userLayer     *int
+	presetName    *string
+}
+
+// defineExplainFlags defines the flags of the explain command on a flag set
+func defineExplainFlags(fs *flag.FlagSet) explainFlags {
+	var flags explainFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	flags.userLayer = fs.Int("layer", -1, "Layer to explain, numbered according to -layer-base")
+	flags.presetName = fs.String("preset", DEFAULT_PRESET, "Preset whose detection thresholds are explained")
+	addLayerBaseFlag(fs)
+	addMacrosFlag(fs)
+	return flags
+}
+
+// runExplainCommand implements "explain": it prints why the perimeter-change detector did or
+// didn't flag a layer, then every line of the layer with the machine state after it
+func runExplainCommand(args []string) {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	flags := defineExplainFlags(fs)
+	setCommandUsage(fs, "explain")
+	fs.Parse(args)
+	validateLayerBase()
+	layer := parseLayer(*flags.userLayer)
+	loadMacrosFlag()
+
+	if *flags.inputFilePath == "" || layer < 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	p, err := getPreset(*flags.presetName)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	activePreset = p
+	lines, _, err := readLines(*flags.inputFilePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+
+	a := newAnalysis(lines, scaleThresholds(getFilePreset(lines), lines))
+	a.detectProblematicLayers(lines)
+	state, start, ok := a.getStateAtLayer(lines, layer)
+	if !ok {
+		fmt.Printf("Error: layer %d not found in '%s'\n", *flags.userLayer, *flags.inputFilePath)
+		os.Exit(1)
+	}
+	layerLines := NewDocument(lines).Layer(layer).Lines()
+
+	fmt.Printf("%s, %d lines\n", a.describeLayer(layer), len(layerLines))
+	flagged, notes := a.explainPerimeterChange(layer)
+	if flagged {
+		fmt.Printf("  %s: flagged\n", DETECTOR_PERIMETER_CHANGE)
+	} else {
+		fmt.Printf("  %s: not flagged\n", DETECTOR_PERIMETER_CHANGE)
+	}
+	for _, note := range notes {
+		fmt.Printf("    %s\n", note)
+	}
+	geometry := a.getLayerGeometry(lines)
+	if current, ok := geometry[layer]; ok {
+		fmt.Printf("  Cross-section: %.1fmm² in %d outer wall loops, centroid X%.2f Y%.2f\n", current.Area, current.Loops,
+			current.Centroid.X, current.Centroid.Y)
+		if below, ok := geometry[layer-1]; ok {
+			fmt.Printf("    %.1fmm² below (%+.1f%%), centroid shifted %.2fmm\n", below.Area, (current.Area-below.Area)/below.Area*100,
+				math.Hypot(current.Centroid.X-below.Centroid.X, current.Centroid.Y-below.Centroid.Y))
+		}
+	} else {
+		fmt.Println("  Cross-section: no closed outer wall loops")
+	}
+	fmt.Printf("  State at the layer change: %s\n\n", state)
+
+	feature := ""
+	for _, line := range lines[:start] {
+		if name, ok := getFeatureName(line); ok {
+			feature = name
+		}
+	}
+	fmt.Printf("%7s  %-*s  %9s %9s %7s %9s %6s  %-16s %4s %6s\n", "line", EXPLAIN_LINE_WIDTH, "command",
+		"X", "Y", "Z", "E delta", "F", "feature", "fan", "hotend")
+	for i, line := range layerLines {
+		if name, ok := getFeatureName(line); ok {
+			feature = name
+		}
+		command, isCommand := parseCommand(line)
+		shown := strings.TrimSpace(line)
+		if len(shown) > EXPLAIN_LINE_WIDTH {
+			shown = shown[:EXPLAIN_LINE_WIDTH-3] + "..."
+		}
+		if !isCommand {
+			fmt.Printf("%7d  %s\n", start+i+1, shown)
+			continue
+		}
+
+		previousE := state.E
+		state.update(line)
+		delta := ""
+		switch strings.ToUpper(command.Name) {
+		case "G0", "G1", "G2", "G3":
+			delta = fmt.Sprintf("%+.5f", state.E-previousE)
+		}
+		fmt.Printf("%7d  %-*s  %9.3f %9.3f %7.3f %9s %6.0f  %-16s %3d%% %4d°C\n", start+i+1, EXPLAIN_LINE_WIDTH, shown,
+			state.X, state.Y, state.Z, delta, state.Feedrate, feature, state.FanSpeed*100/255, state.HotendTemp)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// Canonical feature types, which the slicer feature labels are normalized to so that detectors,
+// queries and per-feature overrides work the same on the output of any slicer
+const (
+	FEATURE_OUTER_WALL        = "outer_wall"
+	FEATURE_INNER_WALL        = "inner_wall"
+	FEATURE_OVERHANG_WALL     = "overhang_wall"
+	FEATURE_SPARSE_INFILL     = "sparse_infill"
+	FEATURE_SOLID_INFILL      = "solid_infill"
+	FEATURE_TOP_SURFACE       = "top_surface"
+	FEATURE_BOTTOM_SURFACE    = "bottom_surface"
+	FEATURE_BRIDGE            = "bridge"
+	FEATURE_GAP_FILL          = "gap_fill"
+	FEATURE_IRONING           = "ironing"
+	FEATURE_SKIRT             = "skirt"
+	FEATURE_BRIM              = "brim"
+	FEATURE_RAFT              = "raft"
+	FEATURE_SUPPORT           = "support"
+	FEATURE_SUPPORT_INTERFACE = "support_interface"
+	FEATURE_WIPE_TOWER        = "wipe_tower"
+	FEATURE_CUSTOM            = "custom"
+)
+
+// featureLabels are the normalized feature labels of Orca/Bambu, Prusa, Cura, ideaMaker and
+// Simplify3D for each canonical feature type
+var featureLabels = map[string][]string{
+	FEATURE_OUTER_WALL:        {"outer wall", "external perimeter", "wall outer", "outer perimeter"},
+	FEATURE_INNER_WALL:        {"inner wall", "perimeter", "wall inner", "inner perimeter"},
+	FEATURE_OVERHANG_WALL:     {"overhang wall", "overhang perimeter"},
+	FEATURE_SPARSE_INFILL:     {"sparse infill", "internal infill", "fill", "infill"},
+	FEATURE_SOLID_INFILL:      {"internal solid infill", "solid infill", "skin", "solid fill", "solid layer"},
+	FEATURE_TOP_SURFACE:       {"top surface", "top solid infill"},
+	FEATURE_BOTTOM_SURFACE:    {"bottom surface"},
+	FEATURE_BRIDGE:            {"bridge", "bridge infill", "internal bridge"},
+	FEATURE_GAP_FILL:          {"gap infill", "gap fill"},
+	FEATURE_IRONING:           {"ironing"},
+	FEATURE_SKIRT:             {"skirt", "skirt/brim", "draft shield"},
+	FEATURE_BRIM:              {"brim"},
+	FEATURE_RAFT:              {"raft"},
+	FEATURE_SUPPORT:           {"support", "support material", "tree support", "support transition"},
+	FEATURE_SUPPORT_INTERFACE: {"support interface", "support material interface", "dense support"},
+	FEATURE_WIPE_TOWER:        {"wipe tower", "prime tower", "prime pillar"},
+	FEATURE_CUSTOM:            {"custom"},
+}
+
+// normalizeFeature returns a feature label lowercased, with '_' and '-' read as spaces, so that
+// 'outer_wall' and ';TYPE:WALL-OUTER' compare like ';TYPE:Outer wall'
+func normalizeFeature(label string) string {
+	label = strings.NewReplacer("_", " ", "-", " ").Replace(strings.ToLower(label))
+	return strings.Join(strings.Fields(label), " ")
+}
+
+// canonicalFeature returns the canonical feature type of a slicer feature label (or of a canonical
+// name). Unknown labels mentioning support, a wipe/prime tower or a skirt are typed by that word;
+// others keep their own name, lowercased with '_' for spaces.
+func canonicalFeature(label string) string {
+	name := normalizeFeature(label)
+	for feature, labels := range featureLabels {
+		if slices.Contains(labels, name) {
+			return feature
+		}
+	}
+	switch {
+	case strings.Contains(name, "support") && strings.Contains(name, "interface"):
+		return FEATURE_SUPPORT_INTERFACE
+	case strings.Contains(name, "support"):
+		return FEATURE_SUPPORT
+	case strings.Contains(name, "wipe tower") || strings.Contains(name, "prime tower") || strings.Contains(name, "prime pillar"):
+		return FEATURE_WIPE_TOWER
+	case strings.Contains(name, "skirt") || strings.Contains(name, "draft shield"):
+		return FEATURE_SKIRT
+	}
+	return strings.ReplaceAll(name, " ", "_")
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	FEEDBACK_OK     = "ok"     // The layer printed fine
+	FEEDBACK_FAILED = "failed" // The print failed at the layer
+
+	FEEDBACK_MIN_TIGHTEN = 3 // Flagged layers that printed fine needed before suggesting to flag fewer
+)
+
+// layerFeedback is how a layer of a file in the history actually printed, with what perimeter
+// detection saw there
+type layerFeedback struct {
+	Layer      int                  `json:"layer"` // 0-based
+	Outcome    string               `json:"outcome"`
+	Time       time.Time            `json:"time"`
+	Detectors  []string             `json:"detectors,omitempty"` // Detectors that flagged the layer
+	Perimeter  detectionExplanation `json:"perimeter"`           // The layer's perimeter against the layer below
+	Thresholds thresholdOverride    `json:"thresholds"`          // Perimeter thresholds in effect for the file
+}
+
+// feedbackFlags are the flags of the feedback command
+type feedbackFlags struct {
+	userLayer *int
+}
+
+// defineFeedbackFlags defines the flags of the feedback command on a flag set
+func defineFeedbackFlags(fs *flag.FlagSet) feedbackFlags {
+	var flags feedbackFlags
+	flags.userLayer = fs.Int("layer", -1, "Layer the outcome is for, numbered according to -layer-base")
+	addLayerBaseFlag(fs)
+	return flags
+}
+
+// runFeedbackCommand implements "feedback": it records whether a layer of a file in the history
+// printed fine or failed, or reports what the recorded outcomes suggest for the thresholds
+func runFeedbackCommand(args []string) {
+	fs := flag.NewFlagSet("feedback", flag.ExitOnError)
+	flags := defineFeedbackFlags(fs)
+	setCommandUsage(fs, "feedback")
+	// Flags may come after the file, as in "feedback example.gcode -layer 57 ok"
+	positional := []string{}
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	validateLayerBase()
+
+	if len(positional) == 1 && positional[0] == "report" {
+		printFeedbackReport()
+		return
+	}
+	if len(positional) != 2 || *flags.userLayer < 0 || (positional[1] != FEEDBACK_OK && positional[1] != FEEDBACK_FAILED) {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	n, entry, err := findHistoryEntry(positional[0])
+	if err != nil {
+		fmt.Printf("Error: %v (process it with -history first)\n", err)
+		os.Exit(1)
+	}
+	feedback, err := getLayerFeedback(positional[0], entry, parseLayer(*flags.userLayer))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	feedback.Outcome = positional[1]
+
+	// Appended rather than rewriting the history, so entries added meanwhile aren't lost
+	if err := appendHistoryLine(feedbackRecord{FeedbackFor: n, Feedback: []layerFeedback{feedback}}); err != nil {
+		fmt.Printf("Error writing history: %v\n", err)
+		os.Exit(1)
+	}
+	flagged := "not flagged"
+	if len(feedback.Detectors) > 0 {
+		flagged = "flagged by " + fmt.Sprint(feedback.Detectors)
+	}
+	fmt.Printf("Recorded layer %d of history entry %d as %s (%s, %s)\n", *flags.userLayer, n, feedback.Outcome, flagged, feedback.Perimeter)
+}
+
+// getLayerFeedback measures a layer of a file for feedback on it: the detectors that flagged it
+// when processed, and its perimeter against the thresholds of the file's preset
+func getLayerFeedback(filePath string, entry historyEntry, layer int) (layerFeedback, error) {
+	feedback := layerFeedback{Layer: layer, Time: time.Now().UTC()}
+	for _, plan := range entry.Plans {
+		for _, detection := range plan.Detections {
+			if layer >= detection.Layer && layer <= max(detection.Layer, detection.EndLayer) && !slices.Contains(feedback.Detectors, detection.Detector) {
+				feedback.Detectors = append(feedback.Detectors, detection.Detector)
+			}
+		}
+	}
+
+	lines, _, err := readLines(filePath)
+	if err != nil {
+		return feedback, err
+	}
+	presetName := DEFAULT_PRESET
+	if len(entry.Plans) > 0 {
+		presetName = entry.Plans[0].Preset
+	}
+	p, err := getPreset(presetName)
+	if err != nil {
+		return feedback, err
+	}
+	if thresholdOverrides, err = loadThresholdOverrides(); err != nil {
+		return feedback, err
+	}
+	a := newAnalysis(lines, scaleThresholds(p, lines))
+	a.detectProblematicLayers(lines)
+	current, ok := a.perimeterLengths[layer]
+	if !ok || layer < 1 {
+		return feedback, fmt.Errorf("layer %d has no layer below it in '%s'", displayLayer(layer), filePath)
+	}
+	previous := a.perimeterLengths[layer-1]
+	feedback.Perimeter = detectionExplanation{PreviousPerimeter: previous, CurrentPerimeter: current}
+	if previous > 0 {
+		feedback.Perimeter.PercentChange = (current - previous) / previous * 100
+	}
+
+	feedback.Thresholds = thresholdOverride{
+		LayerHeight:      getLayerHeight(lines),
+		NozzleDiameter:   getNozzleDiameter(lines),
+		PerimPctChgUpper: &a.preset.PerimPctChgUpper,
+		PerimPctChgLower: &a.preset.PerimPctChgLower,
+		MinCurrPerim:     &a.preset.MinCurrPerim,
+		MinProbLayer:     &a.preset.MinProbLayer,
+	}
+	if feedback.Thresholds.LayerHeight == 0 {
+		feedback.Thresholds.LayerHeight = REFERENCE_LAYER_HEIGHT
+	}
+	if feedback.Thresholds.NozzleDiameter == 0 {
+		feedback.Thresholds.NozzleDiameter = REFERENCE_NOZZLE_DIAMETER
+	}
+	return feedback, nil
+}
+
+// printFeedbackReport prints how the detections compare with the recorded outcomes and, for each
+// layer height and nozzle diameter, the perimeter thresholds that would have flagged the failed
+// layers, as an entry of the threshold override table
+func printFeedbackReport() {
+	// Only the feedback of each entry is kept, merged with the records added later
+	entries := []historyEntry{}
+	err := scanHistory(func(n int, e historyEntry) {
+		if e.FeedbackFor == 0 {
+			entries = append(entries, historyEntry{Feedback: e.Feedback})
+		} else if n <= len(entries) {
+			entries[n-1].mergeFeedback(e)
+		}
+	})
+	if err != nil {
+		fmt.Printf("Error reading history: %v\n", err)
+		os.Exit(1)
+	}
+
+	groups := [][]layerFeedback{}
+	byDetector := map[string][2]int{} // Flagged layers that printed fine and that failed
+	total, files := 0, 0
+	for _, entry := range entries {
+		if len(entry.Feedback) > 0 {
+			files++
+		}
+		for _, feedback := range entry.Feedback {
+			total++
+			detectors := feedback.Detectors
+			if len(detectors) == 0 {
+				detectors = []string{"(not flagged)"}
+			}
+			for _, detector := range detectors {
+				counts := byDetector[detector]
+				if feedback.Outcome == FEEDBACK_OK {
+					counts[0]++
+				} else {
+					counts[1]++
+				}
+				byDetector[detector] = counts
+			}
+			n := slices.IndexFunc(groups, func(group []layerFeedback) bool {
+				return math.Abs(group[0].Thresholds.LayerHeight-feedback.Thresholds.LayerHeight) <= THRESHOLD_MATCH_TOLERANCE &&
+					math.Abs(group[0].Thresholds.NozzleDiameter-feedback.Thresholds.NozzleDiameter) <= THRESHOLD_MATCH_TOLERANCE
+			})
+			if n < 0 {
+				groups = append(groups, nil)
+				n = len(groups) - 1
+			}
+			groups[n] = append(groups[n], feedback)
+		}
+	}
+	if total == 0 {
+		fmt.Println("No feedback recorded yet (see 'help feedback')")
+		return
+	}
+
+	fmt.Printf("Feedback on %d layers of %d files\n", total, files)
+	detectors := []string{}
+	for detector := range byDetector {
+		detectors = append(detectors, detector)
+	}
+	slices.Sort(detectors)
+	for _, detector := range detectors {
+		counts := byDetector[detector]
+		fmt.Printf("  %-24s %3d printed fine, %3d failed\n", detector, counts[0], counts[1])
+	}
+
+	for _, group := range groups {
+		printThresholdSuggestions(group)
+	}
+}
+
+// printThresholdSuggestions prints the perimeter thresholds suggested by the feedback on layers of
+// one layer height and nozzle diameter
+func printThresholdSuggestions(group []layerFeedback) {
+	latest := group[len(group)-1].Thresholds
+	upper, lower, minCurrent := *latest.PerimPctChgUpper, *latest.PerimPctChgLower, *latest.MinCurrPerim
+	fmt.Printf("\n%.2fmm layers, %.2fmm nozzle: perim_pct_chg_upper %g, perim_pct_chg_lower %g, min_curr_perim %g\n",
+		latest.LayerHeight, latest.NozzleDiameter, upper, lower, minCurrent)
+
+	// Loosen the thresholds until every failed layer whose perimeter dropped would have been
+	// flagged; failures other detectors flagged, or without a drop, are beyond these thresholds
+	suggestedUpper, suggestedLower, suggestedMin := upper, lower, minCurrent
+	mildestFailure := math.Inf(-1)
+	noDrop := 0
+	for _, feedback := range group {
+		if feedback.Outcome != FEEDBACK_FAILED || feedback.Perimeter.PreviousPerimeter == 0 {
+			continue
+		}
+		change := feedback.Perimeter.PercentChange
+		flagged := slices.Contains(feedback.Detectors, DETECTOR_PERIMETER_CHANGE)
+		if !flagged && (len(feedback.Detectors) > 0 || change >= 0) {
+			if len(feedback.Detectors) == 0 {
+				noDrop++
+			}
+			continue
+		}
+		mildestFailure = max(mildestFailure, change)
+		if flagged {
+			continue
+		}
+		if change >= suggestedUpper {
+			suggestedUpper = math.Ceil(change) + 1
+		}
+		if change <= suggestedLower {
+			suggestedLower = math.Floor(change) - 1
+		}
+		if feedback.Perimeter.CurrentPerimeter <= suggestedMin {
+			suggestedMin = math.Max(0, math.Floor(feedback.Perimeter.CurrentPerimeter)-1)
+		}
+	}
+
+	// Without missed failures, flag fewer layers when several that printed fine dropped less
+	// than every failed one
+	if suggestedUpper == upper && !math.IsInf(mildestFailure, -1) {
+		milder := 0
+		for _, feedback := range group {
+			if feedback.Outcome == FEEDBACK_OK && slices.Contains(feedback.Detectors, DETECTOR_PERIMETER_CHANGE) &&
+				feedback.Perimeter.PercentChange > math.Ceil(mildestFailure)+1 {
+				milder++
+			}
+		}
+		if milder >= FEEDBACK_MIN_TIGHTEN {
+			suggestedUpper = math.Ceil(mildestFailure) + 1
+			fmt.Printf("  %d flagged layers that printed fine dropped less than every failed layer\n", milder)
+		}
+	}
+
+	if noDrop > 0 {
+		fmt.Printf("  %d failed layers weren't flagged and had no perimeter drop for the thresholds to catch\n", noDrop)
+	}
+	if suggestedUpper == upper && suggestedLower == lower && suggestedMin == minCurrent {
+		fmt.Println("  No threshold changes suggested")
+		return
+	}
+	// Layers that printed fine but would be flagged with the suggested thresholds
+	newlyFlagged := 0
+	for _, feedback := range group {
+		change := feedback.Perimeter.PercentChange
+		wasFlagged := slices.Contains(feedback.Detectors, DETECTOR_PERIMETER_CHANGE)
+		if feedback.Outcome == FEEDBACK_OK && !wasFlagged && feedback.Perimeter.PreviousPerimeter > 0 &&
+			change < suggestedUpper && change > suggestedLower && feedback.Perimeter.CurrentPerimeter > suggestedMin {
+			newlyFlagged++
+		}
+	}
+	if newlyFlagged > 0 {
+		fmt.Printf("  The suggestion would also flag %d layers that printed fine\n", newlyFlagged)
+	}
+	suggestion := thresholdOverride{LayerHeight: latest.LayerHeight, NozzleDiameter: latest.NozzleDiameter,
+		PerimPctChgUpper: &suggestedUpper, PerimPctChgLower: &suggestedLower, MinCurrPerim: &suggestedMin}
+	data, _ := json.Marshal(suggestion)
+	fmt.Printf("  Suggested entry for %s:\n  %s\n", getThresholdsFile(), data)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	FIRMWARE_MARLIN  = "marlin"
+	FIRMWARE_KLIPPER = "klipper"
+	FIRMWARE_REPRAP  = "reprap" // RepRapFirmware (Duet)
+
+	DEFAULT_CHAMBER_SENSOR = "temperature_sensor chamber"
+)
+
+var firmwareName string // -firmware, overrides the printer profile's firmware
+
+// getFirmware returns the firmware generated commands are written for: -firmware, else the
+// printer profile's, else Marlin
+func getFirmware() string {
+	if firmwareName != "" {
+		return firmwareName
+	}
+	if activePrinter != nil && activePrinter.Firmware != "" {
+		return activePrinter.Firmware
+	}
+	return FIRMWARE_MARLIN
+}
+
+// validateFirmware exits if -firmware or the printer profile names an unknown firmware
+func validateFirmware() {
+	switch firmware := getFirmware(); firmware {
+	case FIRMWARE_MARLIN, FIRMWARE_KLIPPER, FIRMWARE_REPRAP:
+	default:
+		fmt.Printf("Error: unknown firmware '%s' (use %s, %s or %s)\n", firmware, FIRMWARE_MARLIN, FIRMWARE_KLIPPER, FIRMWARE_REPRAP)
+		os.Exit(1)
+	}
+}
+
+// validateFirmwareArgs exits on arguments left after the flags, such as the "klipper" of
+// "-guard klipper", which -guard and -label-objects no longer take since -firmware picks the
+// commands
+func validateFirmwareArgs(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	fmt.Printf("Error: unexpected argument '%s'", args[0])
+	switch args[0] {
+	case "none", FIRMWARE_MARLIN, FIRMWARE_KLIPPER, FIRMWARE_REPRAP:
+		fmt.Print(" (-guard and -label-objects take no value; -firmware picks their commands)")
+	}
+	fmt.Println()
+	os.Exit(1)
+}
+
+// getChamberSensor returns the Klipper sensor measuring the chamber temperature
+func getChamberSensor() string {
+	if activePrinter != nil && activePrinter.ChamberSensor != "" {
+		return activePrinter.ChamberSensor
+	}
+	return DEFAULT_CHAMBER_SENSOR
+}
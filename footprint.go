@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+const (
+	DETECTOR_SMALL_FOOTPRINT = "small-footprint"
+
+	FIX_POST    = "post"    // Corrected by the modifications of the plan
+	FIX_RESLICE = "reslice" // Only a new slice with other settings can correct it
+
+	BRIM_HEIGHT_RATIO = 4.0 // Prints taller than this many times the width of a first layer island need a brim
+	RAFT_MAX_WIDTH    = 3.0 // mm, first layer islands narrower than this need a raft
+)
+
+// resliceDetectors are the detectors whose findings no modification can correct
+var resliceDetectors = []string{DETECTOR_INFILL_DENSITY, DETECTOR_SMALL_FOOTPRINT}
+
+// getDetectionFix returns whether the findings of a detector are fixable in post (FIX_POST) or
+// need the model re-sliced (FIX_RESLICE)
+func getDetectionFix(detector string) string {
+	if slices.Contains(resliceDetectors, detector) {
+		return FIX_RESLICE
+	}
+	return FIX_POST
+}
+
+// hasBrimOrRaft reports whether the first layer prints a brim or raft
+func (a *Analysis) hasBrimOrRaft(lines []string) bool {
+	for _, line := range NewDocument(lines).Layer(0).Lines() {
+		if feature, ok := getFeatureName(line); ok {
+			switch canonicalFeature(feature) {
+			case FEATURE_BRIM, FEATURE_RAFT:
+				return true
+			case FEATURE_SKIRT:
+				// Prusa labels skirt and brim alike
+				if normalizeFeature(feature) == "skirt/brim" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// detectSmallFootprint returns a recommendation to re-slice with a brim, or a raft, when the
+// print stands on a first layer island that is narrow for the height of the print and the first
+// layer has neither. Islands narrower than RAFT_MAX_WIDTH need a raft; the others need a brim
+// when the print is more than BRIM_HEIGHT_RATIO times as tall as they are wide.
+func (a *Analysis) detectSmallFootprint(lines []string) []Detection {
+	detections := []Detection{}
+	loops := a.getLayerLoops(lines)[0]
+	if len(loops) == 0 || a.hasBrimOrRaft(lines) {
+		return detections
+	}
+	height := 0.0
+	for _, z := range a.layerZHeights {
+		height = math.Max(height, z)
+	}
+
+	var smallest []point
+	smallestArea := math.Inf(1)
+	for i, loop := range loops {
+		island := true
+		for j, other := range loops {
+			if i != j && containsPoint(other, loop[0]) {
+				island = false
+			}
+		}
+		if area := polygonArea(loop); island && area < smallestArea {
+			smallest, smallestArea = loop, area
+		}
+	}
+	if smallest == nil {
+		return detections
+	}
+	width := getIslandWidth(smallestArea)
+	remedy := ""
+	switch {
+	case width < RAFT_MAX_WIDTH:
+		remedy = "raft"
+	case height/width > BRIM_HEIGHT_RATIO:
+		remedy = "brim"
+	default:
+		return detections
+	}
+
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, p := range smallest {
+		minX, minY, maxX, maxY = math.Min(minX, p.X), math.Min(minY, p.Y), math.Max(maxX, p.X), math.Max(maxY, p.Y)
+	}
+	return append(detections, Detection{Layer: 0, Detector: DETECTOR_SMALL_FOOTPRINT,
+		Details: fmt.Sprintf("first layer island of %.1fmm² (%.1fmm wide, X%.1f-%.1f Y%.1f-%.1f) under a %.1fmm tall print: re-slice with a %s",
+			smallestArea, width, minX, maxX, minY, maxY, height, remedy)})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Canonical parameter order; parameters not listed follow in alphabetical order
+const FORMAT_PARAM_ORDER = "XYZIJKRPEFST"
+
+var formatPrecisions = map[byte]int{'X': 3, 'Y': 3, 'Z': 3, 'I': 3, 'J': 3, 'K': 3, 'E': 5, 'F': 0}
+
+const FORMAT_DEFAULT_PRECISION = 4
+const NUMBER_STYLE_SAMPLE = 5000 // Moves looked at to tell how a file writes its numbers
+
+// numberStyle is how a file writes the values of a parameter
+type numberStyle struct {
+	Decimals     int
+	Pad          bool // Trailing zeros kept up to Decimals, as in "X10.000"
+	BareFraction bool // Leading zero left out, as in PrusaSlicer's "E.02542"
+}
+
+// numberFormat is the style of the numbers of each parameter letter in a file
+type numberFormat map[byte]numberStyle
+
+var xyzPrecision = -1 // -xyz-precision, decimals of inserted and changed positions; -1 follows the file
+var ePrecision = -1   // -e-precision, decimals of inserted and changed E values; -1 follows the file
+
+// getNumberFormat returns how the file's moves write their X, Y, Z, E and F values, so inserted and
+// changed commands look as if the slicer wrote them. Parameters the first moves don't use keep
+// formatPrecisions; -xyz-precision and -e-precision override the decimals.
+func getNumberFormat(lines []string) numberFormat {
+	numbers := make(numberFormat)
+	for letter, precision := range formatPrecisions {
+		numbers[letter] = numberStyle{Decimals: precision}
+	}
+	seen := make(map[byte]bool)
+	moves := 0
+	for _, line := range lines {
+		if moves >= NUMBER_STYLE_SAMPLE {
+			break
+		}
+		fields := strings.Fields(stripComment(line))
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "G0", "G1", "G2", "G3", "G92":
+		default:
+			continue
+		}
+		moves++
+		for _, field := range fields[1:] {
+			letter := strings.ToUpper(field[:1])[0]
+			if len(field) < 2 || !strings.ContainsRune("XYZEF", rune(letter)) {
+				continue
+			}
+			if _, err := strconv.ParseFloat(field[1:], 64); err != nil {
+				continue
+			}
+			style := numbers[letter]
+			if !seen[letter] {
+				style, seen[letter] = numberStyle{}, true
+			}
+			whole, fraction, _ := strings.Cut(strings.TrimPrefix(field[1:], "-"), ".")
+			style.Decimals = max(style.Decimals, len(fraction))
+			style.Pad = style.Pad || strings.HasSuffix(fraction, "0")
+			style.BareFraction = style.BareFraction || (whole == "" && fraction != "")
+			numbers[letter] = style
+		}
+	}
+	for letter, precision := range map[byte]int{'X': xyzPrecision, 'Y': xyzPrecision, 'Z': xyzPrecision, 'E': ePrecision} {
+		if precision >= 0 {
+			style := numbers[letter]
+			style.Decimals = precision
+			numbers[letter] = style
+		}
+	}
+	return numbers
+}
+
+// format returns a value of a parameter in the file's style. Numbers are always written with a
+// '.' decimal point, whatever the locale.
+func (n numberFormat) format(letter byte, value float64) string {
+	style, ok := n[letter]
+	if !ok {
+		style = numberStyle{Decimals: FORMAT_DEFAULT_PRECISION}
+	}
+	s := formatNumber(value, style.Decimals)
+	if style.Pad && s != "0" {
+		s = strconv.FormatFloat(value, 'f', style.Decimals, 64)
+	}
+	if style.BareFraction {
+		if rest, ok := strings.CutPrefix(s, "0."); ok {
+			s = "." + rest
+		} else if rest, ok := strings.CutPrefix(s, "-0."); ok {
+			s = "-." + rest
+		}
+	}
+	return s
+}
+
+// param returns a parameter with its value in the file's style, e.g. "X10.000"
+func (n numberFormat) param(letter byte, value float64) string {
+	return string(letter) + n.format(letter, value)
+}
+
+// formatNumber formats a number with at most precision decimals and no trailing zeros
+func formatNumber(value float64, precision int) string {
+	s := strconv.FormatFloat(value, 'f', precision, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
+
+// formatLine normalizes a G-code line: upper-case command and parameter letters, canonical
+// parameter order, consistent numeric precision and "cmd ; comment" spacing. Lines whose
+// parameters aren't all letter+number (M117 messages, macros) only get their spacing normalized,
+// and comment-only lines are left alone since tools parse them. Indentation is kept, as it
+// delimits RepRapFirmware conditional blocks, and meta commands and quoted strings are kept as is.
+func formatLine(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || trimmed[0] == ';' || getMetaKeyword(trimmed) != "" {
+		return strings.TrimRight(line, " \t")
+	}
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+
+	command := stripComment(trimmed)
+	comment, hasComment := strings.CutPrefix(trimmed[len(command):], ";")
+	fields := strings.Fields(command)
+	formatted := strings.Join(fields, " ")
+	if strings.Contains(command, "\"") {
+		formatted = strings.TrimSpace(command)
+	} else if isNumericCommand(fields) {
+		formatted = formatCommand(fields)
+	}
+	if hasComment {
+		comment = strings.TrimSpace(comment)
+		if comment == "" {
+			return indent + formatted
+		}
+		return indent + formatted + " ; " + comment
+	}
+	return indent + formatted
+}
+
+// isNumericCommand reports whether the fields are a G/M/T code with only letter+number parameters
+func isNumericCommand(fields []string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	code := strings.ToUpper(fields[0])
+	if len(code) < 2 || !strings.ContainsRune("GMT", rune(code[0])) {
+		return false
+	}
+	if _, err := strconv.Atoi(strings.Split(code[1:], ".")[0]); err != nil {
+		return false
+	}
+	for _, field := range fields[1:] {
+		letter := strings.ToUpper(field[:1])[0]
+		if letter < 'A' || letter > 'Z' {
+			return false
+		}
+		if len(field) > 1 {
+			if _, err := strconv.ParseFloat(field[1:], 64); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// formatCommand formats the fields of a numeric command
+func formatCommand(fields []string) string {
+	params := fields[1:]
+	sorted := make([]string, len(params))
+	copy(sorted, params)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return paramRank(sorted[i]) < paramRank(sorted[j])
+	})
+
+	parts := []string{strings.ToUpper(fields[0])}
+	for _, param := range sorted {
+		letter := strings.ToUpper(param[:1])[0]
+		if len(param) == 1 {
+			parts = append(parts, string(letter))
+			continue
+		}
+		value, _ := strconv.ParseFloat(param[1:], 64)
+		precision, ok := formatPrecisions[letter]
+		if !ok {
+			precision = FORMAT_DEFAULT_PRECISION
+		}
+		parts = append(parts, string(letter)+formatNumber(value, precision))
+	}
+	return strings.Join(parts, " ")
+}
+
+// paramRank orders parameters by FORMAT_PARAM_ORDER, then alphabetically
+func paramRank(param string) int {
+	letter := strings.ToUpper(param[:1])
+	if i := strings.Index(FORMAT_PARAM_ORDER, letter); i >= 0 {
+		return i
+	}
+	return len(FORMAT_PARAM_ORDER) + int(letter[0])
+}
+
+// formatFlags are the flags of the fmt command
+type formatFlags struct {
+	inputFilePath *string
+	overwrite     *bool
+	xyzPrecision  *int
+	ePrecision    *int
+}
+
+// defineFormatFlags defines the flags of the fmt command on a flag set
+func defineFormatFlags(fs *flag.FlagSet) formatFlags {
+	var flags formatFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	flags.overwrite = fs.Bool("o", false, "Overwrite the input file instead of writing <name>_fmt.gcode (Default=false)")
+	flags.xyzPrecision = fs.Int("xyz-precision", formatPrecisions['X'], "Decimals kept for X, Y, Z, I, J and K")
+	flags.ePrecision = fs.Int("e-precision", formatPrecisions['E'], "Decimals kept for E")
+	return flags
+}
+
+// runFormatCommand implements "fmt": it writes a normalized copy of a G-code file
+func runFormatCommand(args []string) {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	flags := defineFormatFlags(fs)
+	setCommandUsage(fs, "fmt")
+	fs.Parse(args)
+
+	if *flags.inputFilePath == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	for _, letter := range []byte("XYZIJK") {
+		formatPrecisions[letter] = *flags.xyzPrecision
+	}
+	formatPrecisions['E'] = *flags.ePrecision
+
+	lines, crlf, err := readLines(*flags.inputFilePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+	changed := 0
+	for i, line := range lines {
+		if formatted := formatLine(line); formatted != line {
+			lines[i] = formatted
+			changed++
+		}
+	}
+
+	outputFilePath := getDerivedFilePath(*flags.inputFilePath, "_fmt")
+	if *flags.overwrite && isZipFile(*flags.inputFilePath) {
+		fmt.Println("Error: -o can't overwrite a zip archive with G-code; leave it out to write <name>_fmt.gcode")
+		os.Exit(1)
+	}
+	if *flags.overwrite {
+		outputFilePath = *flags.inputFilePath
+	}
+	if err := writeLines(outputFilePath, lines, crlf); err != nil {
+		fmt.Printf("Error creating output file: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Normalized %d of %d lines. New file saved as %s.\n", changed, len(lines), outputFilePath)
+}
@@ -2,131 +2,523 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/fs"
 	"math"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
-var lastZHeight float64 = -1 // Track the last significant Z height
-var mapLayerLines map[int]int
-var mapSupportOnlyLayers map[int]bool
+var includeG0Moves bool = true // Track G0 moves for position and travel analysis
+var annotate bool              // Add explanatory comments to the output for each inserted line
 
 const (
 	MIN_PREV_PERIM            = 10.0
+	MIN_CURR_PERIM            = 80.0
 	PERIM_PCT_CHG_UPPER       = -50.0
 	PERIM_PCT_CHG_LOWER       = -95.0
 	MIN_PROB_LAYER            = 20 // Ignore "problematic" layers below this
 	FAN_SPEED_PCT_PROB_LAYERS = 1  // Percent
 	TEMP_INCREASE_PROB_LAYERS = 20 // Celcius
+	MODIFIED_MARKER           = "; gcode_modifier: processed"
 )
 
+// detectionExplanation records the metric values that caused a layer to be flagged as problematic
+type detectionExplanation struct {
+	PreviousPerimeter float64 `json:"previous_perimeter"` // Extruded length of the layer below (mm)
+	CurrentPerimeter  float64 `json:"current_perimeter"`  // Extruded length of the flagged layer (mm)
+	PercentChange     float64 `json:"percent_change"`
+}
+
+func (e detectionExplanation) String() string {
+	return fmt.Sprintf("perimeter %.1fmm -> %.1fmm (%.1f%%)", e.PreviousPerimeter, e.CurrentPerimeter, e.PercentChange)
+}
+
 func main() {
-	// Define command-line flags
-	inputFilePath := flag.String("f", "", "Path to the input G-code file")
-	dirPath := flag.String("d", "", "Path directory of G-code files")
-	overwrite := flag.Bool("o", false, "Overwrite existing G-code file (Default=false)")
+	if len(os.Args) > 1 {
+		if c, ok := findCommand(os.Args[1]); ok && c.Run != nil {
+			c.Run(os.Args[2:])
+			return
+		}
+	}
 
+	flags := defineMainFlags(flag.CommandLine)
+	setCommandUsage(flag.CommandLine, "")
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) { explicitFlags[f.Name] = true })
+	if *flags.showVersion {
+		fmt.Printf("gcode_modifier %s\n", versionString())
+		return
+	}
+	if schemaName != "" {
+		if err := printSchema(schemaName); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	p, err := getPreset(*flags.presetName)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	activePreset = p
+	validateFirmwareArgs(flag.Args())
+	validateLayerBase()
+	validateLineEnding()
+	validateReproducible()
+	validatePlanMatch()
+	validateStatusMessages()
+	validateStartHeating()
+	loadMacrosFlag()
+	if activeCatalog, err = loadCatalog(lang); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *flags.printerName != "" {
+		if activePrinter, err = loadPrinterProfile(*flags.printerName); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	validateFirmware()
+	validateWipe()
+	validateProgressMode()
+	validateUpload()
+	validateQueueOrder()
+	validateSpoolman()
+	validateABMode(*flags.presetName, *flags.overwrite)
+	queryLoadedMaterial()
+
+	if thresholdOverrides, err = loadThresholdOverrides(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if transformsPath != "" {
+		if transforms, err = loadTransforms(transformsPath); err != nil {
+			fmt.Printf("Error reading transforms: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err = loadSpeedOverrides(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err = loadFanOverrides(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if calibrationPath != "" {
+		if activeCalibration, err = loadCalibration(calibrationPath); err != nil {
+			fmt.Printf("Error reading calibration: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err = loadLayerNotifications(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err = loadSeverities(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if planInPath != "" {
+		if importedPlans, err = loadPlans(planInPath); err != nil {
+			fmt.Printf("Error reading plan file: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	if *inputFilePath == "" && *dirPath == "" {
+	if *flags.inputFilePath == "" && *flags.dirPath == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *flags.inputFilePath == STDIN_PATH && !analyzeOnly {
+		fmt.Println("Error: reading G-code from stdin (-f -) needs -analyze-only")
+		os.Exit(1)
+	}
 
-	if *dirPath != "" {
-		filepath.WalkDir(*dirPath, func(path string, d fs.DirEntry, err error) error {
+	// Ctrl-C or the -timeout stops processing between files and analysis steps, leaving the
+	// current file unwritten
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *flags.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *flags.timeout)
+		defer cancel()
+	}
+
+	if *flags.dirPath != "" {
+		// Outputs of a directory are uploaded one at a time once all are written
+		queueUploads = uploadBackend != "" && !analyzeOnly
+		batchRun = true
+		filepath.WalkDir(*flags.dirPath, func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 
-			if !d.IsDir() && strings.HasSuffix(d.Name(), ".gcode") && !strings.HasSuffix(d.Name(), "_modified.gcode") {
-				fullPath := filepath.Join(*dirPath, d.Name())
-				processFile(fullPath, *overwrite)
-				fmt.Println(fullPath)
+			if !d.IsDir() && isGcodeInput(d.Name()) {
+				if !*flags.force && !analyzeOnly {
+					if processed, reason := isAlreadyProcessed(path, *flags.overwrite); processed {
+						fmt.Printf("Skipping '%s': %s (use -force to reprocess)\n", path, reason)
+						return nil
+					}
+				}
+				processFile(ctx, path, *flags.overwrite)
+				fmt.Println(path)
 			}
 			return nil
 		})
+		printBatchReport()
+		queueUploads = false
+		runUploadQueue(ctx)
 	}
 
-	if *inputFilePath == "" {
-		processFile(*inputFilePath, *overwrite)
-		fmt.Println(*inputFilePath)
+	if *flags.inputFilePath != "" && ctx.Err() == nil {
+		processFile(ctx, *flags.inputFilePath, *flags.overwrite)
+		fmt.Println(*flags.inputFilePath)
+	}
+
+	if planOutPath != "" {
+		if err := savePlans(planOutPath, exportedPlans); err != nil {
+			fmt.Printf("Error writing plan file: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Plans saved to %s\n", planOutPath)
 	}
+	if err := ctx.Err(); err != nil {
+		fmt.Printf("Stopped: %v\n", err)
+		os.Exit(1)
+	}
+	exitOnSeverity(exportedPlans)
+}
+
+// mainFlags are the flags of processing files that main reads itself; the others set package
+// variables
+type mainFlags struct {
+	inputFilePath *string
+	dirPath       *string
+	overwrite     *bool
+	force         *bool
+	presetName    *string
+	printerName   *string
+	timeout       *time.Duration
+	showVersion   *bool
+}
+
+// defineMainFlags defines the flags of processing files on a flag set
+func defineMainFlags(fs *flag.FlagSet) mainFlags {
+	var flags mainFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	flags.dirPath = fs.String("d", "", "Path directory of G-code files")
+	flags.overwrite = fs.Bool("o", false, "Overwrite existing G-code file (Default=false)")
+	flags.force = fs.Bool("force", false, "Reprocess files that were already modified (Default=false)")
+	fs.IntVar(&plateNumber, "plate", 0, "Plate to process in a .gcode.3mf project (Default=0, all plates)")
+	fs.BoolVar(&includeG0Moves, "include-g0", true, "Track G0 moves for position and travel analysis (Default=true)")
+	fs.BoolVar(&interactive, "interactive", false, "Confirm, skip or edit each modification before writing (Default=false)")
+	flags.presetName = fs.String("preset", DEFAULT_PRESET, "Named preset of detectors and modification rules (see 'presets list')")
+	fs.IntVar(&fanSpeedOverride, "fan-speed", 0, "Fan speed percent for problematic layers (Default=from preset or material)")
+	fs.IntVar(&tempIncreaseOverride, "temp-increase", 0, "Temperature increase in °C for problematic layers (Default=from preset or material)")
+	fs.StringVar(&calibrationPath, "calibration", "", "Calibration results file of preferred temperatures per feature type, used instead of the temperature increase")
+	fs.IntVar(&maxTempOverride, "max-temp", 0, "Never emit a hotend temperature above this in °C (Default=per material)")
+	fs.BoolVar(&guardTemps, "guard", false, "Insert checks, in the -firmware's commands, that pause until temperature changes take effect (Default=false)")
+	fs.BoolVar(&labelObjectsEnabled, "label-objects", false, "Label objects found in files without labels, for cancelling, in the -firmware's commands (Default=false)")
+	fs.IntVar(&preheatChamber, "preheat-chamber", 0, "Wait for the chamber to reach this temperature in °C before the print (Default=0, no wait)")
+	fs.StringVar(&startHeating, "start-heating", START_HEATING_KEEP, "Heat the bed and hotend in the start G-code: keep, concurrent (together) or sequential (bed first)")
+	fs.IntVar(&soakMinutes, "soak-minutes", 0, "Heat soak the bed (and chamber) this many minutes before the print (Default=0)")
+	fs.StringVar(&firmwareName, "firmware", "", "Firmware of generated commands: marlin, klipper or reprap (Default=from -printer profile, else marlin)")
+	fs.IntVar(&wipeEvery, "wipe-every", 0, "Wipe the nozzle on the -printer profile's brush every this many layers (Default=0, never)")
+	fs.BoolVar(&wipeFlagged, "wipe-flagged", false, "Wipe the nozzle on the -printer profile's brush before every flagged layer (Default=false)")
+	fs.StringVar(&progressMode, "progress", "", "M73 progress commands: keep, strip or m117 (Default=from -printer profile, else keep)")
+	fs.StringVar(&pluginPaths, "plugins", "", "Executables (comma-separated) that get each layer's commands as JSON lines and return lines to insert")
+	fs.StringVar(&transformsPath, "transforms", "", "File of transform rules applied to the commands of every output, e.g. 'feature~bridge && cmd==G1: F*=0.6'")
+	fs.StringVar(&speedOverrideSpec, "speed-override", "", "Rescale the speed of extruding moves per feature type, e.g. 'outer_wall=80%,bridge=50%'")
+	fs.StringVar(&fanOverrideSpec, "fan-override", "", "Set the fan speed percent per feature type, restoring it after the feature, e.g. 'bridge=100,overhang=100'")
+	fs.BoolVar(&reportEnergy, "energy", false, "Estimate the energy each output takes to print, from the -printer profile's power draw (Default=false)")
+	fs.BoolVar(&refreshEstimates, "refresh-estimates", false, "Rewrite the time estimates and M73 progress embedded in outputs for their new timing (Default=false)")
+	fs.BoolVar(&verifyMoonraker, "verify-moonraker", false, "Leave files unchanged when the output loses metadata Moonraker extracts from the input (Default=false)")
+	fs.Float64Var(&standbyAfter, "standby-after", 0, "Drop the hotend to standby through travels and dwells without extruding for this many seconds (Default=0, never)")
+	fs.IntVar(&standbyDrop, "standby-drop", STANDBY_DEFAULT_DROP, "°C the hotend drops by in -standby-after spans (Default=30)")
+	fs.StringVar(&statusMessages, "status-messages", STATUS_NONE, "Announce where modified regions start and end: none, m117 (display), m118 (host console) or both")
+	fs.StringVar(&notifyAtLayerSpec, "notify-at-layer", "", "Beep and show a message at the start of layers, e.g. '12:Insert magnets now,40'")
+	fs.Float64Var(&pausePrime, "pause-prime", 0, "Prime this many mm of filament after inserted wipes, standby dwells and -guard waits (Default=0, no prime)")
+	fs.IntVar(&powerLossEvery, "power-loss-every", 0, "Save the print state for power-loss recovery every this many layers (Default=0, never)")
+	fs.BoolVar(&stateSnapshots, "snapshots", false, "Add a machine state snapshot comment at every layer boundary (Default=false)")
+	fs.StringVar(&planOutPath, "plan-out", "", "Save the modification plans to this JSON file")
+	fs.StringVar(&planInPath, "plan-in", "", "Apply the modification plans from this JSON file instead of analyzing")
+	fs.StringVar(&planMatch, "plan-match", PLAN_MATCH_LAYER, "How -plan-in plans are matched to layers: layer (by number) or z (by Z height, for re-sliced files)")
+	fs.BoolVar(&sanitizeOutput, "sanitize", false, "Strip byte order marks and control characters and spell non-ASCII characters in ASCII in outputs (Default=false)")
+	fs.BoolVar(&sanitizeMetadata, "sanitize-metadata", false, "Strip profile names, machine serials, hosts and user names in paths from outputs, for sharing them publicly (Default=false)")
+	fs.BoolVar(&compressOutputs, "compress", false, "Write gzipped <name>_modified.gcode.gz outputs for uncompressed inputs (Default=false)")
+	fs.BoolVar(&preserveTimes, "preserve-times", false, "Keep the source's modification time and permissions on the output (Default=false)")
+	flags.printerName = fs.String("printer", "", "Printer profile (or printer model) files must be sliced for")
+	fs.StringVar(&uploadBackend, "upload", "", "Send each output to this backend ("+strings.Join(getUploaderNames(), ", ")+"), with its settings in the -printer profile")
+	fs.StringVar(&queueOrder, "queue-order", QUEUE_ORDER_NAME, "Order in which the outputs of -d are uploaded: name, oldest or smallest")
+	fs.BoolVar(&queueWait, "queue-wait", false, "Wait for a busy printer before each upload of -d outputs, instead of leaving the rest (Default=false)")
+	fs.DurationVar(&queuePoll, "queue-poll", QUEUE_DEFAULT_POLL, "How often a busy printer is checked with -queue-wait (Default=30s)")
+	fs.StringVar(&spoolmanURL, "spoolman", "", "Spoolman server to record the filament each output uses against -spool, e.g. http://spoolman:7912")
+	fs.IntVar(&spoolID, "spool", 0, "Spoolman spool ID the filament of each output is recorded against")
+	fs.StringVar(&abMode, "ab", "", "Write each file as variant A with -preset and B untouched ("+AB_UNTOUCHED+") or with this preset, with a comparison report")
+	fs.BoolVar(&recordHistory, "history", false, "Record each processed G-code file in the local history (see 'history list') (Default=false)")
+	fs.BoolVar(&strictPrinter, "strict-printer", false, "Fail instead of warning when a file was sliced for another printer, or filament than the -upload printer has loaded (Default=false)")
+	fs.BoolVar(&printAdhesionScores, "scores", false, "Print the adhesion risk score of every layer (Default=false)")
+	fs.BoolVar(&printInfillDensities, "infill-density", false, "Print the estimated infill density of every layer with sparse infill (Default=false)")
+	addLayerBaseFlag(fs)
+	addMacrosFlag(fs)
+	addWebhookFlags(fs)
+	fs.BoolVar(&annotate, "annotate", false, "Add comments to the output explaining each inserted line (Default=false)")
+	fs.StringVar(&lang, "lang", DEFAULT_LANG, "Language of the comments on inserted commands and their console messages")
+	fs.IntVar(&xyzPrecision, "xyz-precision", -1, "Decimals of X, Y and Z in inserted and changed commands (Default=-1, as the file writes them)")
+	fs.IntVar(&ePrecision, "e-precision", -1, "Decimals of E in inserted and changed commands (Default=-1, as the file writes them)")
+	fs.StringVar(&lineEnding, "line-ending", LINE_ENDING_AUTO, "Line endings of the output: auto (as the input), lf or crlf")
+	fs.BoolVar(&logTimestamp, "timestamp", false, "Record when each output was made in its processing log (Default=false)")
+	fs.BoolVar(&reproducible, "reproducible", false, "Leave timestamps, including the tool's build date, out of outputs, so identical inputs and flags give byte-identical outputs (Default=false)")
+	fs.BoolVar(&provenanceMap, "provenance-map", false, "Write <name>_map.tsv next to each output, tracing every line to the input line it came from or the rule that inserted it (Default=false)")
+	fs.BoolVar(&noComments, "no-comments", false, "Insert bare commands, without comments, annotations or the processing log (Default=false)")
+	fs.StringVar(&batchReportPath, "report", "", "Also save the batch summary and comparison report of a -d run to this file")
+	fs.Float64Var(&filamentPrice, "filament-price", 0, "Price of filament per kg, for the cost in the batch summary of a -d run (Default=0)")
+	fs.Float64Var(&energyPrice, "energy-price", 0, "Price of electricity per kWh, for the cost in the batch summary of a -d run (Default=0)")
+	fs.Float64Var(&machineRate, "machine-rate", 0, "Cost of printer time per hour (wear, depreciation, labor), for the cost in the batch summary of a -d run (Default=0)")
+	fs.Float64Var(&co2Intensity, "co2-intensity", 0, "Grams of CO2 emitted per kWh of electricity, for the emissions in the batch summary of a -d run (Default=0, not shown)")
+	fs.StringVar(&severitySpec, "severity", "", "Severity (info, warning or critical) of a detector's findings, e.g. 'infill-density=warning,tipping-risk=info'")
+	fs.StringVar(&failOn, "fail-on", SEVERITY_NONE, "Exit with a status for the highest severity found when it is at least this: none, info, warning or critical")
+	fs.BoolVar(&analyzeOnly, "analyze-only", false, "Only report detections and plans, without writing outputs (Default=false)")
+	flags.timeout = fs.Duration("timeout", 0, "Stop processing after this long, e.g. 30s or 5m (Default=0, no limit)")
+	flags.showVersion = fs.Bool("version", false, "Print the version and build info and exit")
+	fs.StringVar(&schemaName, "schema", "", "Print the JSON Schema of an output format and exit: report or plan")
+	return flags
 }
 
-func processFile(filePath string, overwrite bool) {
+func processFile(ctx context.Context, filePath string, overwrite bool) {
+	if filePath != STDIN_PATH {
+		checkFileEncoding(filePath)
+	}
+	if abMode != "" {
+		processABFile(ctx, filePath)
+		return
+	}
+	if is3mfFile(filePath) {
+		process3mfFile(ctx, filePath, overwrite)
+		return
+	}
+	if isZipFile(filePath) {
+		processZipFile(ctx, filePath, overwrite)
+		return
+	}
+	if analyzeOnly {
+		analyzeFile(ctx, filePath)
+		return
+	}
+
 	// Read the input file
 	fmt.Printf("Processing '%s'\n", filePath)
-	inputFile, err := os.Open(filePath)
+	srcInfo := getSourceInfo(filePath)
+	lines, crlf, err := readLines(filePath)
 	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
+		fmt.Printf("Error reading file: %v\n", err)
 		os.Exit(1)
 	}
-	defer inputFile.Close()
 
-	var lines []string
-	scanner := bufio.NewScanner(inputFile)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	firstPlan := len(exportedPlans)
+	entry := historyEntry{File: filePath}
+	if recordHistory {
+		entry.Hash = hashLines(lines)
+	}
+	original := lines
+	if lines, err = modifyLines(ctx, filePath, lines, nil); errors.Is(err, errNoPlan) {
+		return
+	} else if err != nil {
+		fmt.Printf("Stopped processing '%s', leaving it unchanged: %v\n", filePath, err)
+		if recordHistory {
+			entry.Plans, entry.Outcome, entry.Error = exportedPlans[firstPlan:], HISTORY_STOPPED, err.Error()
+			addHistoryEntry(entry)
+		}
+		return
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("Error reading file: %v\n", err)
+	// Save the modified lines to a new file
+	outputFilePath := getOutputFilePath(filePath, overwrite)
+	if err := writeLines(outputFilePath, lines, crlf); err != nil {
+		fmt.Printf("Error creating output file: %v\n", err)
 		os.Exit(1)
 	}
+	if err := preserveFileAttributes(srcInfo, outputFilePath); err != nil {
+		fmt.Printf("Error preserving file times: %v\n", err)
+	}
 
-	layerCount := countLayers(lines)
-	fmt.Printf("File '%s' has %d layers\n", filePath, layerCount)
-
-	mapLayerLines = getMapOfLayerStartLines(lines)
-	// fmt.Printf("mapLayerLines: %+v\n", mapLayerLines)
+	fmt.Printf("Modification complete. New file saved as %s.\n", outputFilePath)
+	if provenanceMap {
+		saveProvenanceMap(outputFilePath, original, lines)
+	}
+	if spoolmanURL != "" {
+		recordSpoolUsage(outputFilePath, lines)
+	}
+	if recordHistory {
+		entry.Output, entry.OutputHash = outputFilePath, hashLines(lines)
+		entry.Plans, entry.Outcome = exportedPlans[firstPlan:], HISTORY_PROCESSED
+		addHistoryEntry(entry)
+	}
+	if queueUploads {
+		uploadQueue = append(uploadQueue, queuedUpload{Source: filePath, Output: outputFilePath})
+	} else if uploadBackend != "" {
+		uploadOutput(outputFilePath)
+	}
+	sendWebhooks(webhookEvent{Event: EVENT_PROCESSED, File: filePath, Output: outputFilePath, Plans: exportedPlans[firstPlan:]})
+}
 
-	mapSupportOnlyLayers = getMapOfSupportLayers(lines)
-	// fmt.Printf("mapSupportOnlyLayers: %+v\n", mapSupportOnlyLayers)
+// readLines reads a G-code file into lines, and reports whether it has CRLF line endings. The
+// file may be gzipped, or a zip archive of a single G-code file.
+func readLines(filePath string) ([]string, bool, error) {
+	if isZipFile(filePath) {
+		return readZipFileLines(filePath)
+	}
+	inputFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer inputFile.Close()
 
-	// Process the file based on the selected mode
-	probLayers := detectProblematicLayers(lines)
-	fmt.Printf("Problematic layers: %v\n", probLayers)
+	return scanLines(inputFile)
+}
 
-	defaultTemp := getDefaultTemp(lines)
-	maxFanSpeed := getMaxFanSpeed(lines)
-	for _, layer := range probLayers {
-		// Decrease the fan speed & increase the temp for the layer below
-		lines = modifyGcodeFanSpeed(lines, layer-3, FAN_SPEED_PCT_PROB_LAYERS)
-		lines = modifyGcodeTemperature(lines, layer-3, defaultTemp+TEMP_INCREASE_PROB_LAYERS)
+// writeLines atomically writes lines to a G-code file, with CRLF line endings under the auto
+// -line-ending policy when inputCRLF is set, gzipped when the path ends in .gz
+func writeLines(filePath string, lines []string, inputCRLF bool) error {
+	return writeFileAtomic(filePath, func(w io.Writer) error {
+		return writeGcode(w, filePath, lines, inputCRLF)
+	})
+}
 
-		// Reset the fan speed & temp for the layer above
-		lines = modifyGcodeFanSpeed(lines, layer+2, maxFanSpeed)
-		lines = modifyGcodeTemperature(lines, layer+2, defaultTemp)
+// modifyLines analyzes the G-code lines of one file (or 3MF plate) and returns them with the
+// corrections for problematic layers inserted. A preset given replaces the active one, without
+// material defaults, as an explicit -preset does.
+func modifyLines(ctx context.Context, filePath string, lines []string, p *preset) ([]string, error) {
+	checkPrinterModel(filePath, lines)
+	checkLoadedMaterial(filePath, lines)
+	checkMachineLimits(filePath, lines)
+
+	var plan Plan
+	if importedPlans != nil {
+		var ok bool
+		if plan, ok = findImportedPlan(filePath, lines); !ok {
+			fmt.Printf("No plan for '%s' in '%s', leaving it unchanged\n", filePath, planInPath)
+			return nil, errNoPlan
+		}
+		fmt.Printf("Applying plan for '%s' with %d modifications\n", plan.File, len(plan.Modifications))
+	} else {
+		var err error
+		if p == nil {
+			plan, err = AnalyzeLines(ctx, filePath, lines)
+		} else {
+			plan, err = analyzeLines(ctx, filePath, lines, adjustFilePreset(*p, false, lines))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if interactive {
+		plan.Modifications = newAnalysis(lines, activePreset).confirmModifications(lines, plan.Modifications)
+	}
+	exportedPlans = append(exportedPlans, plan)
+	modified, err := ApplyLines(ctx, lines, plan)
+	if err == nil {
+		addBatchEntry(lines, plan, modified)
+	}
+	if err == nil && verifyMoonraker {
+		err = verifyMoonrakerMetadata(lines, modified)
 	}
+	return modified, err
+}
 
-	// Save the modified lines to a new file
-	outputFilePath := strings.Replace(filePath, ".gcode", "_modified.gcode", 1)
+// isGcodeInput reports whether a directory entry is an unmodified G-code file (possibly gzipped
+// or zipped) or 3MF project
+func isGcodeInput(name string) bool {
+	name, ext := splitGcodeExt(name)
+	return strings.HasPrefix(ext, ".gcode") && !strings.HasSuffix(name, "_modified")
+}
+
+// getOutputFilePath returns the path the modified G-code is written to
+func getOutputFilePath(filePath string, overwrite bool) string {
 	if overwrite {
-		outputFilePath = filePath
+		return filePath
+	}
+	if is3mfFile(filePath) || isZipFile(filePath) {
+		name, ext := splitGcodeExt(filePath)
+		return name + "_modified" + ext
 	}
-	outputFile, err := os.Create(outputFilePath)
+	return getDerivedFilePath(filePath, "_modified")
+}
+
+// isAlreadyProcessed reports whether a file was already modified, either in place (it carries
+// MODIFIED_MARKER) or into a "_modified" output that is newer than the source
+func isAlreadyProcessed(filePath string, overwrite bool) (bool, string) {
+	srcInfo, err := os.Stat(filePath)
 	if err != nil {
-		fmt.Printf("Error creating output file: %v\n", err)
-		os.Exit(1)
+		return false, ""
 	}
-	defer outputFile.Close()
 
-	for _, line := range lines {
-		outputFile.WriteString(line + "\n")
+	if !overwrite {
+		outputFilePath := getOutputFilePath(filePath, overwrite)
+		if abMode != "" {
+			outputFilePath = getABFilePath(filePath, "A", activePreset.Name)
+		}
+		if outInfo, err := os.Stat(outputFilePath); err == nil && !outInfo.ModTime().Before(srcInfo.ModTime()) {
+			return true, fmt.Sprintf("'%s' is newer than the source", outputFilePath)
+		}
 	}
 
-	fmt.Printf("Modification complete. New file saved as %s.\n", outputFilePath)
+	if is3mfFile(filePath) {
+		if hasArchiveMarker(filePath, is3mfPlateEntry) {
+			return true, "a plate already contains the modification marker"
+		}
+		return false, ""
+	}
+	if isZipFile(filePath) {
+		if hasArchiveMarker(filePath, isZipGcodeEntry) {
+			return true, "a G-code file in the archive already contains the modification marker"
+		}
+		return false, ""
+	}
+
+	inputFile, err := os.Open(filePath)
+	if err != nil {
+		return false, ""
+	}
+	defer inputFile.Close()
+
+	if hasMarker(inputFile) {
+		return true, "file already contains the modification marker"
+	}
+	return false, ""
 }
 
-func detectLayerChange(line string) bool {
-	if strings.HasPrefix(line, "; layer num/total_layer_count: ") {
-		return true // Detect layer changes based on explicit comments like "; layer n"
+// hasMarker reports whether the G-code read from r, possibly gzipped, contains MODIFIED_MARKER
+func hasMarker(r io.Reader) bool {
+	r, err := decompress(r)
+	if err != nil {
+		return false
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if scanner.Text() == MODIFIED_MARKER {
+			return true
+		}
 	}
 	return false
 }
@@ -176,153 +568,319 @@ func getMaxFanSpeed(lines []string) int {
 }
 
 // countLayers uses detectLayerChange() to count the layers
-func countLayers(lines []string) int {
+func (a *Analysis) countLayers(lines []string) int {
 	var count = 0
 	for _, line := range lines {
-		if detectLayerChange(line) {
+		if a.detectLayerChange(line) {
 			count++
 		}
 	}
 	return count
 }
 
-// getMapOfSupportLayers returns a map of layer number and true/false
-func getMapOfSupportLayers(lines []string) map[int]bool {
-	mapSupportOnlyLayers = make(map[int]bool)
-	currentLayer := 0
+// getFeatureName returns the feature type of a slicer feature comment, e.g. "; FEATURE: Outer wall"
+// (Bambu/Orca), ";TYPE:External perimeter" (Prusa/Cura/ideaMaker), "; feature outer perimeter"
+// (Simplify3D) or ";; feature shells" (Kiri:Moto)
+func getFeatureName(line string) (string, bool) {
+	for _, prefix := range []string{"; FEATURE:", ";TYPE:", "; feature ", ";; feature "} {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(line[len(prefix):]), true
+		}
+	}
+	return "", false
+}
+
+// isWipeTowerFeature reports whether a feature label is a wipe/prime tower ("prime pillar" in Simplify3D)
+func isWipeTowerFeature(feature string) bool {
+	return canonicalFeature(feature) == FEATURE_WIPE_TOWER
+}
+
+// getMapOfSupportLayers returns a map of 0-based layer number and true/false
+func (a *Analysis) getMapOfSupportLayers(lines []string) map[int]bool {
+	supportOnlyLayers := make(map[int]bool)
+	currentLayer := -1
 	hasOtherFeature := false
 	for _, line := range lines {
-		if detectLayerChange(line) {
+		if a.detectLayerChange(line) {
 			if hasOtherFeature {
 				// Previous layer had a non-support feature
-				mapSupportOnlyLayers[currentLayer] = false
+				supportOnlyLayers[currentLayer] = false
 			}
 
 			currentLayer++
 			// reset var hasOtherFeature
 			hasOtherFeature = false
-			mapSupportOnlyLayers[currentLayer] = false
-		} else if strings.HasPrefix(line, "; FEATURE:") && !strings.Contains(line, "Support") {
-			hasOtherFeature = true
-		} else if line == "; FEATURE: Support" {
-			mapSupportOnlyLayers[currentLayer] = true
+			supportOnlyLayers[currentLayer] = false
+		} else if feature, ok := getFeatureName(line); ok {
+			if isSupportFeature(feature) {
+				supportOnlyLayers[currentLayer] = true
+			} else if !isWipeTowerFeature(feature) {
+				hasOtherFeature = true
+			}
 		}
 	}
-	return mapSupportOnlyLayers
+	if hasOtherFeature {
+		supportOnlyLayers[currentLayer] = false
+	}
+	return supportOnlyLayers
 }
 
-// getMapOfLayerStartLines returns a map of layer number to the line in the gcode file where that layer begins
-func getMapOfLayerStartLines(lines []string) map[int]int {
-	mapLayerLines = make(map[int]int)
-	currentLayer := 0
-	for i, line := range lines {
-		if detectLayerChange(line) {
-			currentLayer++
-			if currentLayer > 0 {
-				mapLayerLines[currentLayer] = i + 1
-			}
-		}
-	}
-	return mapLayerLines
+// isSupportFeature reports whether a feature label is support material, covering the labels used
+// for normal and tree supports by Orca/Bambu ("Support", "Support interface", "Support transition",
+// "Tree support"), Prusa ("Support material", "Support material interface") and Cura ("SUPPORT",
+// "SUPPORT-INTERFACE")
+func isSupportFeature(feature string) bool {
+	canonical := canonicalFeature(feature)
+	return canonical == FEATURE_SUPPORT || canonical == FEATURE_SUPPORT_INTERFACE
 }
 
-// modifyGcodeTemperature modifies the hotend temperature at a specific layer using improved layer detection.
-func modifyGcodeTemperature(lines []string, layerNumber int, temperature int) []string {
-	modifiedLines := []string{}
+// getMapOfLayerZHeights returns a map of 0-based layer number to the first Z height printed in that layer
+func (a *Analysis) getMapOfLayerZHeights(lines []string) map[int]float64 {
+	layerZHeights := make(map[int]float64)
+	lastZHeight := -1.0
 	currentLayer := -1
-
 	for _, line := range lines {
-		modifiedLines = append(modifiedLines, line)
-		if detectLayerChange(line) {
+		if a.detectLayerChange(line) {
 			currentLayer++
-			if currentLayer == layerNumber {
-				modifiedLines = append(modifiedLines, fmt.Sprintf("M104 S%d ; Set hotend temperature to %d°C at layer %d\n", temperature, temperature, layerNumber))
+			if lastZHeight >= 0 {
+				// Carry the height forward until the layer makes its own Z move
+				layerZHeights[currentLayer] = lastZHeight
+			}
+		} else if strings.HasPrefix(line, "G1") || strings.HasPrefix(line, "G0") {
+			if z, err := extractZValue(line); err == nil && z != lastZHeight {
+				lastZHeight = z
+				if currentLayer >= 0 {
+					layerZHeights[currentLayer] = z
+				}
 			}
 		}
 	}
-	return modifiedLines
+	return layerZHeights
 }
 
-// modifyGcodeFanSpeed modifies the fan speed at a specific layer using improved layer detection.
-func modifyGcodeFanSpeed(lines []string, layerNumber int, fanSpeedPercent int) []string {
-	fanSpeedValue := int(float64(fanSpeedPercent) / 100.0 * 255)
-	modifiedLines := []string{}
-	currentLayer := -1
+// describeLayer formats a 0-based layer index with its source line number and Z height
+func (a *Analysis) describeLayer(layer int) string {
+	lineNum, ok := a.layerLines[layer]
+	if !ok {
+		return fmt.Sprintf("layer %d (not in file)", displayLayer(layer))
+	}
+	return fmt.Sprintf("layer %d (line %d, Z=%.2f)", displayLayer(layer), lineNum, a.layerZHeights[layer])
+}
 
-	for _, line := range lines {
-		modifiedLines = append(modifiedLines, line)
-		if detectLayerChange(line) {
+// insertedLines returns the lines to insert for a command, preceded by an explanation when annotating
+func insertedLines(command string, reason string) []string {
+	if !annotate || noComments {
+		return []string{command}
+	}
+	return []string{"; " + msg(MSG_INSERTED_NEXT_LINE, reason), command}
+}
+
+// getMapOfLayerStartLines returns a map of 0-based layer number to the (1-based) line in the gcode file where that layer begins
+func (a *Analysis) getMapOfLayerStartLines(lines []string) map[int]int {
+	layerLines := make(map[int]int)
+	currentLayer := -1
+	for i, line := range lines {
+		if a.detectLayerChange(line) {
 			currentLayer++
-			if currentLayer == layerNumber {
-				modifiedLines = append(modifiedLines, fmt.Sprintf("M106 S%d ; Set fan speed to %d%% at layer %d\n", fanSpeedValue, fanSpeedPercent, layerNumber))
-			}
+			layerLines[currentLayer] = i + 1
 		}
 	}
-	return modifiedLines
+	return layerLines
+}
+
+// modifyGcodeTemperature modifies the hotend temperature at a specific layer using improved layer detection.
+func (a *Analysis) modifyGcodeTemperature(lines []string, layerNumber int, temperature int, reason string) []string {
+	return a.insertModifications(lines, []modification{{Layer: layerNumber, Kind: MOD_TEMPERATURE, Value: temperature, Reason: reason}})
+}
+
+// getTemperatureLines returns the lines that set the hotend temperature at a layer
+func (a *Analysis) getTemperatureLines(layerNumber int, temperature int, reason string) []string {
+	command := withComment(fmt.Sprintf("M104 S%d", temperature), msg(MSG_SET_TEMPERATURE, temperature, displayLayer(layerNumber)))
+	lines := insertedLines(command, reason)
+	for _, guard := range getGuardCommands(temperature) {
+		lines = append(lines, insertedLines(guard, "guard for "+reason)...)
+	}
+	fmt.Println(msg(MSG_LOG_SET_TEMPERATURE, temperature, displayLayer(layerNumber), a.layerLines[layerNumber], a.layerZHeights[layerNumber], reason))
+	return lines
+}
+
+// modifyGcodeFanSpeed modifies the fan speed at a specific layer using improved layer detection.
+func (a *Analysis) modifyGcodeFanSpeed(lines []string, layerNumber int, fanSpeedPercent int, reason string) []string {
+	return a.insertModifications(lines, []modification{{Layer: layerNumber, Kind: MOD_FAN_SPEED, Value: fanSpeedPercent, Reason: reason}})
+}
+
+// getFanSpeedLines returns the lines that set the fan speed at a layer
+func (a *Analysis) getFanSpeedLines(layerNumber int, fanSpeedPercent int, reason string) []string {
+	fanSpeedValue := int(float64(fanSpeedPercent) / 100.0 * 255)
+	command := withComment(fmt.Sprintf("M106 S%d", fanSpeedValue), msg(MSG_SET_FAN_SPEED, fanSpeedPercent, displayLayer(layerNumber)))
+	fmt.Println(msg(MSG_LOG_SET_FAN_SPEED, fanSpeedPercent, displayLayer(layerNumber), a.layerLines[layerNumber], a.layerZHeights[layerNumber], reason))
+	return insertedLines(command, reason)
 }
 
-func detectProblematicLayers(lines []string) []int {
+// detectProblematicLayers returns the layers whose extruded length dropped sharply compared to
+// the layer below. Only moves that extrude count toward a layer's length; travel moves are
+// recorded separately in a.travelLengths, including G0 moves unless includeG0Moves is off.
+// Extrusion in wipe/prime tower features is ignored.
+func (a *Analysis) detectProblematicLayers(lines []string) []int {
 	currentLayer := -1
 	previousPerimeterLength := 0.0
 	currentPerimeterLength := 0.0
+	currentTravelLength := 0.0
 	problematicLayers := []int{}
-	var lastX, lastY float64
-	extruding := false
+	a.perimeterLengths = make(map[int]float64)
+	a.travelLengths = make(map[int]float64)
+	a.explanations = make(map[int]detectionExplanation)
+	var lastX, lastY, lastE float64
+	hasPosition := false
+	var mode positioningMode
+	inWipeTower := false
+
+	// checkLayer records the lengths of a finished layer and flags it if its perimeter dropped
+	checkLayer := func(layer int) {
+		a.perimeterLengths[layer] = currentPerimeterLength
+		a.travelLengths[layer] = currentTravelLength
+		if layer < 1 {
+			return
+		}
 
-	for _, line := range lines {
-		if detectLayerChange(line) {
-			currentLayer++
-			// Analyze conditions to detect problematic layers
-			if currentLayer > 1 {
-				absolutePerimeterChange := currentPerimeterLength - previousPerimeterLength
-				perimeterPercentageChange := absolutePerimeterChange / previousPerimeterLength * 100
-
-				if perimeterPercentageChange < PERIM_PCT_CHG_UPPER && perimeterPercentageChange > PERIM_PCT_CHG_LOWER && currentPerimeterLength > 80 {
-					// Only add non-support layers and layers above MIN_PROB_LAYER
-					if currentLayer > MIN_PROB_LAYER && !mapSupportOnlyLayers[currentLayer] {
-						problematicLayers = append(problematicLayers, currentLayer)
-					}
+		// Analyze conditions to detect problematic layers
+		absolutePerimeterChange := currentPerimeterLength - previousPerimeterLength
+		perimeterPercentageChange := absolutePerimeterChange / previousPerimeterLength * 100
+
+		if perimeterPercentageChange < a.preset.PerimPctChgUpper && perimeterPercentageChange > a.preset.PerimPctChgLower && currentPerimeterLength > a.preset.MinCurrPerim {
+			// Only add non-support layers from MinProbLayer up
+			if layer >= a.preset.MinProbLayer && !a.supportOnlyLayers[layer] {
+				problematicLayers = append(problematicLayers, layer)
+				a.explanations[layer] = detectionExplanation{
+					PreviousPerimeter: previousPerimeterLength,
+					CurrentPerimeter:  currentPerimeterLength,
+					PercentChange:     perimeterPercentageChange,
 				}
-				// if mapSupportOnlyLayers[currentLayer] {
-				// 	fmt.Printf("Layer %d has length %f (chg %d%%) SUPPORT ONLY\n", currentLayer, currentPerimeterLength, int(perimeterPercentageChange))
-				// } else {
-				// 	fmt.Printf("Layer %d has length %f (chg %d%%)\n", currentLayer, currentPerimeterLength, int(perimeterPercentageChange))
-				// }
+			}
+		}
+		// if a.supportOnlyLayers[layer] {
+		// 	fmt.Printf("Layer %d has length %f (chg %d%%) SUPPORT ONLY\n", layer, currentPerimeterLength, int(perimeterPercentageChange))
+		// } else {
+		// 	fmt.Printf("Layer %d has length %f (chg %d%%)\n", layer, currentPerimeterLength, int(perimeterPercentageChange))
+		// }
+	}
 
+	for _, line := range lines {
+		if feature, ok := getFeatureName(line); ok {
+			inWipeTower = isWipeTowerFeature(feature)
+		}
+		if a.detectLayerChange(line) {
+			if currentLayer >= 0 {
+				checkLayer(currentLayer)
 			}
-			//  else if currentLayer >= 1 {
-			// 	fmt.Printf("Layer %d has length %f\n", currentLayer, currentPerimeterLength)
-			// }
+			currentLayer++
 
 			// Reset values for the new layer
 			previousPerimeterLength = currentPerimeterLength
 			currentPerimeterLength = 0.0
-		} else if strings.HasPrefix(line, "G1") {
+			currentTravelLength = 0.0
+			continue
+		}
+
+		fields := strings.Fields(stripComment(line))
+		if len(fields) == 0 {
+			continue
+		}
+		if mode.update(fields[0]) {
+			continue
+		}
+		switch fields[0] {
+		case "G92":
+			for _, field := range fields[1:] {
+				if field[0] == 'E' {
+					lastE, _ = strconv.ParseFloat(field[1:], 64)
+				}
+			}
+		case "G0", "G1":
+			if fields[0] == "G0" && !includeG0Moves {
+				continue
+			}
 			// Extract X, Y, and E values from the G-code line
-			var x, y float64
-			var hasX, hasY bool
-			fields := strings.Fields(line)
-			for _, field := range fields {
+			x, y := lastX, lastY
+			var hasXY, hasE bool
+			var e float64
+			for _, field := range fields[1:] {
 				switch field[0] {
 				case 'X':
 					x, _ = strconv.ParseFloat(field[1:], 64)
-					hasX = true
+					if mode.RelativeAxes {
+						x += lastX
+					}
+					hasXY = true
 				case 'Y':
 					y, _ = strconv.ParseFloat(field[1:], 64)
-					hasY = true
+					if mode.RelativeAxes {
+						y += lastY
+					}
+					hasXY = true
+				case 'E':
+					e, _ = strconv.ParseFloat(field[1:], 64)
+					hasE = true
 				}
 			}
 
-			// Calculate perimeter length and extrusion volume
-			if hasX && hasY {
-				if extruding {
-					currentPerimeterLength += calculateDistance(lastX, lastY, x, y)
+			// A move extrudes when it pushes filament forward; G0 is always a travel move
+			extruding := false
+			if hasE && fields[0] == "G0" {
+				if !mode.relativeE() {
+					lastE = e
+				}
+			} else if hasE {
+				if mode.relativeE() {
+					extruding = e > 0
+				} else {
+					extruding = e > lastE
+					lastE = e
 				}
-				extruding = true
+			}
+
+			// Calculate perimeter (extruded) and travel lengths
+			if hasXY {
+				if hasPosition {
+					distance := calculateDistance(lastX, lastY, x, y)
+					if extruding {
+						// The wipe tower keeps a constant perimeter that would mask model shrinkage
+						if !inWipeTower {
+							currentPerimeterLength += distance
+						}
+					} else {
+						currentTravelLength += distance
+					}
+				}
+				hasPosition = true
 				lastX, lastY = x, y
 			}
 		}
 	}
+	if currentLayer >= 0 {
+		checkLayer(currentLayer)
+	}
 
 	return problematicLayers
 }
+
+// stripComment returns the command part of a G-code line without its trailing comment
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		// RepRapFirmware string parameters may contain semicolons, e.g. M117 "a;b"
+		if strings.IndexByte(line[:i], '"') >= 0 {
+			inString := false
+			for j := 0; j < len(line); j++ {
+				switch {
+				case line[j] == '"':
+					inString = !inString
+				case line[j] == ';' && !inString:
+					return line[:j]
+				}
+			}
+			return line
+		}
+		return line[:i]
+	}
+	return line
+}
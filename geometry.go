@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// point is a position in the XY plane, in mm
+type point struct{ X, Y float64 }
+
+// cross returns the Z component of the cross product of the vectors o->a and o->b, positive when
+// a->b turns counterclockwise around o
+func cross(o, a, b point) float64 {
+	return (a.X-o.X)*(b.Y-o.Y) - (a.Y-o.Y)*(b.X-o.X)
+}
+
+// convexHull returns the convex hull of the points in counterclockwise order (Andrew's monotone
+// chain); fewer than three distinct points give a degenerate hull
+func convexHull(points []point) []point {
+	sorted := append([]point{}, points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].X < sorted[j].X || (sorted[i].X == sorted[j].X && sorted[i].Y < sorted[j].Y)
+	})
+	if len(sorted) < 3 {
+		return sorted
+	}
+	hull := make([]point, 0, 2*len(sorted))
+	for _, p := range sorted {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	for i, lower := len(sorted)-2, len(hull)+1; i >= 0; i-- {
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], sorted[i]) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, sorted[i])
+	}
+	return hull[:len(hull)-1]
+}
+
+// polygonArea returns the area enclosed by a polygon (shoelace formula), whatever its orientation
+func polygonArea(polygon []point) float64 {
+	area := 0.0
+	for i := range polygon {
+		next := polygon[(i+1)%len(polygon)]
+		area += polygon[i].X*next.Y - next.X*polygon[i].Y
+	}
+	return math.Abs(area) / 2
+}
+
+// polygonCentroid returns the centroid of the area enclosed by a polygon, or its first point when
+// the polygon encloses no area
+func polygonCentroid(polygon []point) point {
+	area, cx, cy := 0.0, 0.0, 0.0
+	for i := range polygon {
+		next := polygon[(i+1)%len(polygon)]
+		f := polygon[i].X*next.Y - next.X*polygon[i].Y
+		area += f
+		cx += (polygon[i].X + next.X) * f
+		cy += (polygon[i].Y + next.Y) * f
+	}
+	if area == 0 {
+		return polygon[0]
+	}
+	return point{cx / (3 * area), cy / (3 * area)}
+}
+
+// containsPoint reports whether a point is inside a polygon (even-odd ray casting)
+func containsPoint(polygon []point, p point) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Y > p.Y) != (b.Y > p.Y) && p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+)
+
+const GUARD_TEMP_TOLERANCE = 5 // Celcius, accepted deviation for Klipper's TEMPERATURE_WAIT
+
+var guardTemps bool // -guard, hold the print after inserted temperature changes until they take effect
+
+// getGuardCommands returns the commands that hold the print until the hotend has reached the
+// temperature just set, so a failed change pauses the print instead of printing badly. They are
+// written for the -firmware.
+func getGuardCommands(temperature int) []string {
+	if !guardTemps {
+		return nil
+	}
+	switch getFirmware() {
+	case FIRMWARE_KLIPPER:
+		return []string{fmt.Sprintf("TEMPERATURE_WAIT SENSOR=extruder MINIMUM=%d MAXIMUM=%d",
+			temperature-GUARD_TEMP_TOLERANCE, temperature+GUARD_TEMP_TOLERANCE)}
+	case FIRMWARE_REPRAP:
+		// M116 waits for the tool's heaters to reach their targets, heating or cooling
+		return []string{withComment("M116 P0", msg(MSG_WAIT_TEMPERATURE, temperature))}
+	}
+	// R waits while heating and cooling, unlike S which only waits while heating
+	return []string{withComment(fmt.Sprintf("M109 R%d", temperature), msg(MSG_WAIT_TEMPERATURE, temperature))}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	HEATMAP_SPEED = "speed" // Feedrate of extruding moves (mm/s)
+	HEATMAP_FLOW  = "flow"  // Volumetric flow of extruding moves (mm³/s)
+
+	HEATMAP_TARGET_HEIGHT = 400 // Pixels the layers are stretched to, at least one per layer
+)
+
+// heatmapSample is the metric of an extruding move along X
+type heatmapSample struct {
+	Layer  int
+	X1, X2 float64
+	Length float64 // mm, the weight of the sample
+	Value  float64
+}
+
+// getHeatmapSamples returns the speed or flow of every extruding move, by layer
+func (a *Analysis) getHeatmapSamples(lines []string, metric string) []heatmapSample {
+	samples := []heatmapSample{}
+	filamentArea := math.Pi * math.Pow(getFilamentDiameter(lines)/2, 2)
+	var state machineState
+	currentLayer := -1
+	for _, line := range lines {
+		if a.detectLayerChange(line) {
+			currentLayer++
+			continue
+		}
+		previous := state
+		state.update(line)
+		fields := strings.Fields(stripComment(line))
+		if currentLayer < 0 || len(fields) == 0 || fields[0] != "G1" || !previous.hasPosition ||
+			state.E <= previous.E || state.Feedrate <= 0 {
+			continue
+		}
+		length := calculateDistance(previous.X, previous.Y, state.X, state.Y)
+		if length == 0 {
+			continue
+		}
+		value := state.Feedrate / 60
+		if metric == HEATMAP_FLOW {
+			value = (state.E - previous.E) * filamentArea / (length / value)
+		}
+		samples = append(samples, heatmapSample{Layer: currentLayer, X1: previous.X, X2: state.X, Length: length, Value: value})
+	}
+	return samples
+}
+
+// getHeatmapGrid averages the samples, weighted by length, into a grid of layers by X columns
+// spanning the extruded X range; cells without extrusion are NaN
+func getHeatmapGrid(samples []heatmapSample, layers int, columns int) ([][]float64, float64, float64) {
+	minX, maxX := math.Inf(1), math.Inf(-1)
+	for _, sample := range samples {
+		minX = math.Min(minX, math.Min(sample.X1, sample.X2))
+		maxX = math.Max(maxX, math.Max(sample.X1, sample.X2))
+	}
+	columnWidth := math.Max(maxX-minX, 1) / float64(columns)
+
+	sums := make([][]float64, layers)
+	weights := make([][]float64, layers)
+	for layer := range sums {
+		sums[layer] = make([]float64, columns)
+		weights[layer] = make([]float64, columns)
+	}
+	for _, sample := range samples {
+		// Spread the move's length evenly over the columns it crosses
+		steps := int(math.Abs(sample.X2-sample.X1)/columnWidth) + 1
+		for step := 0; step < steps; step++ {
+			x := sample.X1 + (sample.X2-sample.X1)*(float64(step)+0.5)/float64(steps)
+			column := min(int((x-minX)/columnWidth), columns-1)
+			sums[sample.Layer][column] += sample.Value * sample.Length / float64(steps)
+			weights[sample.Layer][column] += sample.Length / float64(steps)
+		}
+	}
+	for layer := range sums {
+		for column := range sums[layer] {
+			if weights[layer][column] == 0 {
+				sums[layer][column] = math.NaN()
+			} else {
+				sums[layer][column] /= weights[layer][column]
+			}
+		}
+	}
+	return sums, minX, maxX
+}
+
+// heatmapFlags are the flags of the heatmap command
+type heatmapFlags struct {
+	inputFilePath  *string
+	outputFilePath *string
+	metric         *string
+	columns        *int
+}
+
+// defineHeatmapFlags defines the flags of the heatmap command on a flag set
+func defineHeatmapFlags(fs *flag.FlagSet) heatmapFlags {
+	var flags heatmapFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	flags.outputFilePath = fs.String("out", "", "Path of the PNG image (Default=<name>_heatmap_<metric>.png)")
+	flags.metric = fs.String("metric", HEATMAP_SPEED, "Value colored: speed (mm/s) or flow (mm³/s) of extruding moves")
+	flags.columns = fs.Int("width", 400, "Columns across the X range of the print, one pixel each")
+	return flags
+}
+
+// runHeatmapCommand implements "heatmap": it writes a PNG of layers (bottom to top) by X position,
+// colored by the speed or flow of the extrusion there, to spot anomalies across the whole print
+func runHeatmapCommand(args []string) {
+	fs := flag.NewFlagSet("heatmap", flag.ExitOnError)
+	flags := defineHeatmapFlags(fs)
+	setCommandUsage(fs, "heatmap")
+	fs.Parse(args)
+
+	if *flags.inputFilePath == "" || *flags.columns < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *flags.metric != HEATMAP_SPEED && *flags.metric != HEATMAP_FLOW {
+		fmt.Printf("Error: unknown -metric '%s' (use %s or %s)\n", *flags.metric, HEATMAP_SPEED, HEATMAP_FLOW)
+		os.Exit(1)
+	}
+	lines, _, err := readLines(*flags.inputFilePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+
+	a := newAnalysis(lines, activePreset)
+	layers := a.countLayers(lines)
+	samples := a.getHeatmapSamples(lines, *flags.metric)
+	if layers == 0 || len(samples) == 0 {
+		fmt.Printf("Error: no extrusion found in layers of '%s'\n", *flags.inputFilePath)
+		os.Exit(1)
+	}
+	grid, minX, maxX := getHeatmapGrid(samples, layers, *flags.columns)
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, sample := range samples {
+		low, high = math.Min(low, sample.Value), math.Max(high, sample.Value)
+	}
+	if high == low {
+		high = low + 1
+	}
+
+	rowHeight := max(1, HEATMAP_TARGET_HEIGHT/layers)
+	img := renderHeatmap(grid, rowHeight, low, high)
+	outputFilePath := *flags.outputFilePath
+	if outputFilePath == "" {
+		name, _ := splitGcodeExt(*flags.inputFilePath)
+		outputFilePath = fmt.Sprintf("%s_heatmap_%s.png", name, *flags.metric)
+	}
+	err = writeFileAtomic(outputFilePath, func(w io.Writer) error { return writePNG(w, img) })
+	if err != nil {
+		fmt.Printf("Error creating output file: %v\n", err)
+		os.Exit(1)
+	}
+
+	unit := "mm/s"
+	if *flags.metric == HEATMAP_FLOW {
+		unit = "mm³/s"
+	}
+	fmt.Printf("%d layers (bottom to top) by X %.1f to %.1fmm; %s from %.1f (dark blue) to %.1f %s (red)\n",
+		layers, minX, maxX, *flags.metric, low, high, unit)
+	fmt.Printf("Heatmap saved as %s.\n", outputFilePath)
+}
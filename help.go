@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const PROGRAM_NAME = "gcode_modifier"
+
+// command is a subcommand with its help; the command named "" processes files
+type command struct {
+	Name     string
+	Summary  string
+	Usage    string
+	Examples []string
+	Flags    func(fs *flag.FlagSet) // Defines the command's flags, nil for none
+	Run      func(args []string)
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{
+			Name:    "",
+			Summary: "Detect problematic layers in G-code files and insert fan, temperature and speed corrections",
+			Usage:   "-f <file.gcode> | -d <dir> [flags]",
+			Examples: []string{
+				"-f example.gcode",
+				"-d ./prints -preset aggressive -report report.txt",
+				"-f example.gcode -analyze-only -plan-out plan.json",
+			},
+			Flags: func(fs *flag.FlagSet) { defineMainFlags(fs) },
+		},
+		{
+			Name:     "presets",
+			Summary:  "List the presets or show the settings of one",
+			Usage:    "presets list | show <name>",
+			Examples: []string{"presets list", "presets show aggressive"},
+			Run:      runPresetsCommand,
+		},
+		{
+			Name:     "resume",
+			Summary:  "Write a file that continues a failed print from a layer",
+			Usage:    "resume -f <file.gcode> -layer <n>",
+			Examples: []string{"resume -f example.gcode -layer 120"},
+			Flags:    func(fs *flag.FlagSet) { defineResumeFlags(fs) },
+			Run:      runResumeCommand,
+		},
+		{
+			Name:     "fmt",
+			Summary:  "Write a normalized copy of a file, for smaller diffs",
+			Usage:    "fmt -f <file.gcode> [-o]",
+			Examples: []string{"fmt -f example.gcode -xyz-precision 3 -e-precision 5"},
+			Flags:    func(fs *flag.FlagSet) { defineFormatFlags(fs) },
+			Run:      runFormatCommand,
+		},
+		{
+			Name:    "meta",
+			Summary: "Show the header metadata of a file, or write a copy with fields such as the title set",
+			Usage:   "meta show -f <file.gcode> | meta set -f <file.gcode> [-o] [-title <title>] [-author <name>] [key=value ...]",
+			Examples: []string{
+				"meta show -f example.gcode",
+				"meta set -f example.gcode title=\"Bracket v3\" -author \"Jane Doe\"",
+			},
+			Flags: func(fs *flag.FlagSet) { defineMetaFlags(fs) },
+			Run:   runMetaCommand,
+		},
+		{
+			Name:    "query",
+			Summary: "Print the lines of a file matching a query on layers, features and parameters",
+			Usage:   "query -f <file.gcode> '<query>'",
+			Examples: []string{
+				"query -f example.gcode 'layer>50 && cmd==M106 && S<100'",
+				"query -f example.gcode -count 'feature~bridge && cmd==G1'",
+			},
+			Flags: func(fs *flag.FlagSet) { defineQueryFlags(fs) },
+			Run:   runQueryCommand,
+		},
+		{
+			Name:     "explain",
+			Summary:  "Print a layer's commands with the tracked machine state, and why detection did or didn't flag it",
+			Usage:    "explain -f <file.gcode> -layer <n>",
+			Examples: []string{"explain -f example.gcode -layer 57"},
+			Flags:    func(fs *flag.FlagSet) { defineExplainFlags(fs) },
+			Run:      runExplainCommand,
+		},
+		{
+			Name:    "heatmap",
+			Summary: "Render a PNG of speed or flow by layer and X position to spot anomalies across the print",
+			Usage:   "heatmap -f <file.gcode> [-metric speed|flow]",
+			Examples: []string{
+				"heatmap -f example.gcode -metric flow -out flow.png",
+			},
+			Flags: func(fs *flag.FlagSet) { defineHeatmapFlags(fs) },
+			Run:   runHeatmapCommand,
+		},
+		{
+			Name:    "bounds",
+			Summary: "Print the bounding box of a file's extrusions, per layer and per sequential object, and check it fits a printer",
+			Usage:   "bounds -f <file.gcode> [-printer <name>] [-layers]",
+			Examples: []string{
+				"bounds -f example.gcode -printer mk4",
+			},
+			Flags: func(fs *flag.FlagSet) { defineBoundsFlags(fs) },
+			Run:   runBoundsCommand,
+		},
+		{
+			Name:    "validate",
+			Summary: "Check a file for commands the target firmware will reject or misinterpret",
+			Usage:   "validate -f <file.gcode> [-firmware marlin|klipper|reprap|bambu]",
+			Examples: []string{
+				"validate -f example.gcode -firmware klipper -macros printer.cfg",
+			},
+			Flags: func(fs *flag.FlagSet) { defineValidateFlags(fs) },
+			Run:   runValidateCommand,
+		},
+		{
+			Name:     "serve",
+			Summary:  "Run an HTTP server that analyzes and modifies uploaded G-code",
+			Usage:    "serve [-addr :8080] [flags]",
+			Examples: []string{"serve -addr :8080 -api-keys keys.txt -max-jobs 8"},
+			Flags:    func(fs *flag.FlagSet) { defineServeFlags(fs) },
+			Run:      runServeCommand,
+		},
+		{
+			Name:    "octoprint",
+			Summary: "Modify a file for an OctoPrint preprocessor plugin and report the result as JSON",
+			Usage:   "octoprint [flags] <file.gcode>",
+			Examples: []string{
+				"octoprint -name prints/example.gcode /tmp/upload.gcode",
+				"octoprint -preset aggressive -result result.json /tmp/upload.gcode",
+			},
+			Flags: func(fs *flag.FlagSet) { defineOctoprintFlags(fs) },
+			Run:   runOctoprintCommand,
+		},
+		{
+			Name:     "history",
+			Summary:  "List the files processed with -history, or show what was done to one",
+			Usage:    "history list [-n <count>] | show <n|file>",
+			Examples: []string{"history list", "history show example_modified.gcode"},
+			Run:      runHistoryCommand,
+		},
+		{
+			Name:    "feedback",
+			Summary: "Record whether a layer of a file in the history printed fine or failed, or report what the outcomes suggest",
+			Usage:   "feedback <file.gcode> -layer <n> ok|failed | feedback report",
+			Examples: []string{
+				"feedback example_modified.gcode -layer 57 failed",
+				"feedback report",
+			},
+			Flags: func(fs *flag.FlagSet) { defineFeedbackFlags(fs) },
+			Run:   runFeedbackCommand,
+		},
+		{
+			Name:     "completion",
+			Summary:  "Print a shell completion script for bash, zsh or fish",
+			Usage:    "completion bash | zsh | fish",
+			Examples: []string{"completion bash > /etc/bash_completion.d/gcode_modifier", "completion fish > ~/.config/fish/completions/gcode_modifier.fish"},
+			Run:      runCompletionCommand,
+		},
+		{
+			Name:     "help",
+			Summary:  "Show the help of a command",
+			Usage:    "help [command]",
+			Examples: []string{"help query"},
+			Run:      runHelpCommand,
+		},
+	}
+}
+
+// findCommand returns the command with a name
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// newCommandFlagSet returns a flag set with a command's flags, whose usage prints the command's help
+func newCommandFlagSet(c command) *flag.FlagSet {
+	name := c.Name
+	if name == "" {
+		name = PROGRAM_NAME
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	if c.Flags != nil {
+		c.Flags(fs)
+	}
+	setCommandUsage(fs, c.Name)
+	return fs
+}
+
+// setCommandUsage makes a flag set print the help of the command with a name as its usage
+func setCommandUsage(fs *flag.FlagSet, name string) {
+	c, _ := findCommand(name)
+	fs.Usage = func() { printCommandHelp(c, fs) }
+}
+
+// printCommandHelp prints the usage, flags and examples of a command; the help of processing
+// files also lists the other commands
+func printCommandHelp(c command, fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "%s\n\nUsage: %s %s\n", c.Summary, PROGRAM_NAME, c.Usage)
+	if c.Name == "" {
+		fmt.Fprintln(out, "       "+PROGRAM_NAME+" <command> [flags]\n\nCommands:")
+		for _, sub := range commands[1:] {
+			fmt.Fprintf(out, "  %-12s %s\n", sub.Name, sub.Summary)
+		}
+	}
+	hasFlags := false
+	fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+	if hasFlags {
+		fmt.Fprintln(out, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	if len(c.Examples) > 0 {
+		fmt.Fprintln(out, "\nExamples:")
+		for _, example := range c.Examples {
+			fmt.Fprintf(out, "  %s %s\n", PROGRAM_NAME, example)
+		}
+	}
+	if c.Name == "" {
+		fmt.Fprintf(out, "\nRun '%s help <command>' for the flags of a command.\n", PROGRAM_NAME)
+	}
+}
+
+// runHelpCommand implements "help": it prints the help of a command, or of processing files
+func runHelpCommand(args []string) {
+	name := ""
+	if len(args) > 0 {
+		name = args[0]
+	}
+	c, ok := findCommand(name)
+	if !ok {
+		fmt.Printf("Unknown command '%s' (commands: %s)\n", name, strings.Join(getCommandNames(), ", "))
+		os.Exit(1)
+	}
+	fs := newCommandFlagSet(c)
+	fs.SetOutput(os.Stdout)
+	printCommandHelp(c, fs)
+}
+
+// getCommandNames returns the names of the subcommands
+func getCommandNames() []string {
+	names := []string{}
+	for _, c := range commands[1:] {
+		names = append(names, c.Name)
+	}
+	return names
+}
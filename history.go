@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HISTORY_FILE_NAME = "gcode_modifier/history.jsonl" // Below os.UserConfigDir()
+
+	HISTORY_PROCESSED = "processed" // The output was written
+	HISTORY_STOPPED   = "stopped"   // Processing stopped, leaving the file unchanged
+)
+
+// historyEntry records what was done to one processed file, one JSON object per line of the
+// history file. Feedback on an entry is appended as a line of its own, with FeedbackFor set to
+// the entry's number, so recording it never rewrites the file.
+type historyEntry struct {
+	Time        time.Time       `json:"time"`
+	File        string          `json:"file"`                  // Absolute path of the input
+	Hash        string          `json:"hash"`                  // SHA-256 of the input lines, as in the processing log
+	Output      string          `json:"output,omitempty"`      // Absolute path of the output
+	OutputHash  string          `json:"output_hash,omitempty"` // SHA-256 of the output lines
+	Args        []string        `json:"args"`                  // Command-line parameters
+	Tool        string          `json:"tool"`
+	Plans       []Plan          `json:"plans"` // Detections and modifications
+	Outcome     string          `json:"outcome"`
+	Error       string          `json:"error,omitempty"`        // Why processing stopped
+	Feedback    []layerFeedback `json:"feedback,omitempty"`     // How layers printed, recorded with the feedback command
+	FeedbackFor int             `json:"feedback_for,omitempty"` // Number of the entry a feedback record is for
+}
+
+// feedbackRecord is the line appended for feedback on an entry, read back as a historyEntry
+type feedbackRecord struct {
+	FeedbackFor int             `json:"feedback_for"`
+	Feedback    []layerFeedback `json:"feedback"`
+}
+
+var recordHistory bool // -history, record each processed file in the history file
+
+// getHistoryPath returns the path of the history file
+func getHistoryPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, HISTORY_FILE_NAME)
+}
+
+// appendHistoryLine appends an entry or a feedback record to the history file. The line is
+// written at once to a file opened for appending, so lines appended by processes running at the
+// same time don't interleave or overwrite each other.
+func appendHistoryLine(line any) error {
+	path := getHistoryPath()
+	if path == "" {
+		return fmt.Errorf("no user config directory for the history")
+	}
+	data, err := json.Marshal(line)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+	}
+	var file *os.File
+	if err == nil {
+		file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	}
+	if err == nil {
+		_, err = file.Write(append(data, '\n'))
+		file.Close()
+	}
+	return err
+}
+
+// addHistoryEntry appends an entry to the history file; failures are reported but don't stop
+// processing
+func addHistoryEntry(entry historyEntry) {
+	entry.Time = time.Now().UTC()
+	entry.Args = getLoggedArgs()
+	entry.Tool = versionString()
+	if absolute, err := filepath.Abs(entry.File); err == nil {
+		entry.File = absolute
+	}
+	if absolute, err := filepath.Abs(entry.Output); err == nil && entry.Output != "" {
+		entry.Output = absolute
+	}
+	if err := appendHistoryLine(entry); err != nil {
+		fmt.Printf("Warning: recording '%s' in the history: %v\n", entry.File, err)
+	}
+}
+
+// scanHistory decodes the entries of the history file one at a time, oldest first, and calls
+// visit with each and its number (from 1), so the history never has to fit in memory. Feedback
+// records are passed to visit too, with the number of the entry they are for.
+func scanHistory(visit func(n int, entry historyEntry)) error {
+	file, err := os.Open(getHistoryPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 256*1024*1024)
+	n := 0
+	for line := 1; scanner.Scan(); line++ {
+		var entry historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("history line %d: %v", line, err)
+		}
+		if entry.FeedbackFor > 0 {
+			visit(entry.FeedbackFor, entry)
+			continue
+		}
+		n++
+		visit(n, entry)
+	}
+	return scanner.Err()
+}
+
+// mergeFeedback adds the feedback of a record to an entry; feedback on a layer replaces what was
+// recorded for it before
+func (e *historyEntry) mergeFeedback(record historyEntry) {
+	for _, feedback := range record.Feedback {
+		e.Feedback = slices.DeleteFunc(e.Feedback, func(f layerFeedback) bool { return f.Layer == feedback.Layer })
+		e.Feedback = append(e.Feedback, feedback)
+	}
+}
+
+// countDetections returns the number of detections in the plans of an entry
+func (e historyEntry) countDetections() int {
+	count := 0
+	for _, plan := range e.Plans {
+		count += len(plan.Detections)
+	}
+	return count
+}
+
+// findHistoryEntry returns the latest entry matching a reference, with its number (from 1): an
+// entry number, a file whose lines are the input or output of an entry, or the path of either.
+// The history is scanned rather than loaded, keeping only the best matches so far.
+func findHistoryEntry(reference string) (int, historyEntry, error) {
+	number, err := strconv.Atoi(reference)
+	isNumber := err == nil
+	hash := ""
+	if lines, _, err := readLines(reference); err == nil {
+		hash = hashLines(lines)
+	}
+	absolute, _ := filepath.Abs(reference)
+
+	var byHash, byPath historyEntry
+	hashMatch, pathMatch := 0, 0
+	err = scanHistory(func(n int, e historyEntry) {
+		switch {
+		case e.FeedbackFor > 0:
+			if n == hashMatch {
+				byHash.mergeFeedback(e)
+			}
+			if n == pathMatch {
+				byPath.mergeFeedback(e)
+			}
+		case isNumber:
+			if n == number {
+				byHash, hashMatch = e, n
+			}
+		case hash != "" && (e.Hash == hash || e.OutputHash == hash):
+			byHash, hashMatch = e, n
+		case e.File == absolute || e.Output == absolute:
+			byPath, pathMatch = e, n
+		}
+	})
+	switch {
+	case err != nil:
+		return 0, historyEntry{}, err
+	case hashMatch > 0:
+		return hashMatch, byHash, nil
+	case pathMatch > 0:
+		return pathMatch, byPath, nil
+	case isNumber:
+		return 0, historyEntry{}, fmt.Errorf("no history entry %d", number)
+	}
+	return 0, historyEntry{}, fmt.Errorf("no history entry for '%s'", reference)
+}
+
+// runHistoryCommand implements "history": it lists the processed files recorded with -history
+// or shows what was done to one of them
+func runHistoryCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: gcode_modifier history list [-n <count>] | show <n|file>")
+		os.Exit(1)
+	}
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("history list", flag.ExitOnError)
+		count := fs.Int("n", 20, "Number of latest entries to list (Default=20, 0 for all)")
+		fs.Parse(args[1:])
+		// Only the listed lines are kept, not the entries with their plans
+		listed := []string{}
+		err := scanHistory(func(n int, e historyEntry) {
+			if e.FeedbackFor > 0 {
+				return
+			}
+			listed = append(listed, fmt.Sprintf("%4d  %s  %-9s  %3d detections  %s", n, e.Time.Local().Format("2006-01-02 15:04"), e.Outcome, e.countDetections(), e.File))
+			if *count > 0 && len(listed) > *count {
+				listed = listed[1:]
+			}
+		})
+		if err != nil {
+			fmt.Printf("Error reading history: %v\n", err)
+			os.Exit(1)
+		}
+		for _, line := range listed {
+			fmt.Println(line)
+		}
+		fmt.Printf("\nHistory is read from %s\n", getHistoryPath())
+	case "show":
+		if len(args) < 2 {
+			fmt.Println("Usage: gcode_modifier history show <n|file>")
+			os.Exit(1)
+		}
+		n, entry, err := findHistoryEntry(args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		printHistoryEntry(n, entry)
+	default:
+		fmt.Printf("Unknown history command '%s'\n", args[0])
+		os.Exit(1)
+	}
+}
+
+// printHistoryEntry prints what was done to a file
+func printHistoryEntry(n int, e historyEntry) {
+	fmt.Printf("Entry %d, %s\n", n, e.Time.Local().Format("2006-01-02 15:04:05"))
+	fmt.Printf("File:    %s\n", e.File)
+	fmt.Printf("SHA-256: %s\n", e.Hash)
+	if e.Output != "" {
+		fmt.Printf("Output:  %s\n", e.Output)
+		fmt.Printf("SHA-256: %s\n", e.OutputHash)
+	}
+	fmt.Printf("Tool:    %s\n", e.Tool)
+	fmt.Printf("Args:    %s\n", strings.Join(e.Args, " "))
+	fmt.Printf("Outcome: %s", e.Outcome)
+	if e.Error != "" {
+		fmt.Printf(" (%s)", e.Error)
+	}
+	fmt.Println()
+	for _, feedback := range e.Feedback {
+		fmt.Printf("Layer %d %s: %s\n", displayLayer(feedback.Layer), feedback.Outcome, feedback.Perimeter)
+	}
+	for _, plan := range e.Plans {
+		fmt.Printf("\n%s: preset %s, %s, %d layers\n", plan.File, plan.Preset, plan.Dialect, plan.LayerCount)
+		for _, detection := range plan.Detections {
+			fmt.Printf("  detection: %s\n", describeDetection(detection))
+		}
+		for _, mod := range plan.Modifications {
+			fmt.Printf("  insertion: %s (%s)\n", mod, mod.Reason)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+const (
+	DETECTOR_INFILL_DENSITY = "infill-density"
+
+	INFILL_MIN_AREA_PCT = 10.0 // Layers whose sparse infill region is below this % of the layer area aren't judged
+)
+
+var printInfillDensities bool // Print the estimated infill density of every layer
+
+// isModelFeature reports whether a feature label is part of the printed objects, rather than a
+// skirt, brim, raft, support or wipe tower
+func isModelFeature(feature string) bool {
+	switch canonicalFeature(feature) {
+	case FEATURE_SKIRT, FEATURE_BRIM, FEATURE_RAFT, FEATURE_SUPPORT, FEATURE_SUPPORT_INTERFACE, FEATURE_WIPE_TOWER, FEATURE_CUSTOM:
+		return false
+	}
+	return true
+}
+
+// layerInfill is the model extrusion measured over one layer
+type layerInfill struct {
+	Points       []point // Ends of the model's extrusions
+	SparseVolume float64 // Filament volume (mm³) extruded as sparse infill
+	OtherVolume  float64 // Filament volume (mm³) of the model's other features
+}
+
+// getLayerInfill measures the model extrusion of each 0-based layer
+func (a *Analysis) getLayerInfill(lines []string) map[int]*layerInfill {
+	infills := make(map[int]*layerInfill)
+	filamentArea := math.Pi * math.Pow(getFilamentDiameter(lines)/2, 2)
+	var state machineState
+	currentLayer := -1
+	model, sparse := true, false
+	for _, line := range lines {
+		if a.detectLayerChange(line) {
+			currentLayer++
+			infills[currentLayer] = &layerInfill{}
+			continue
+		}
+		if feature, ok := getFeatureName(line); ok {
+			model, sparse = isModelFeature(feature), canonicalFeature(feature) == FEATURE_SPARSE_INFILL
+		}
+		previous := state
+		state.update(line)
+		fields := strings.Fields(stripComment(line))
+		if currentLayer < 0 || !model || len(fields) == 0 || fields[0] != "G1" || !previous.hasPosition ||
+			state.E <= previous.E {
+			continue
+		}
+		infill := infills[currentLayer]
+		infill.Points = append(infill.Points, point{previous.X, previous.Y}, point{state.X, state.Y})
+		if sparse {
+			infill.SparseVolume += (state.E - previous.E) * filamentArea
+		} else {
+			infill.OtherVolume += (state.E - previous.E) * filamentArea
+		}
+	}
+	return infills
+}
+
+// getLayerHeight returns the thickness of a 0-based layer from the Z heights of the layers
+func (a *Analysis) getLayerHeight(layer int) float64 {
+	if layer == 0 {
+		return a.layerZHeights[0]
+	}
+	return a.layerZHeights[layer] - a.layerZHeights[layer-1]
+}
+
+// getInfillDensities returns the effective sparse infill density (0-100%) of each 0-based layer:
+// the sparse infill volume over the volume of the region left to it, the layer's area less the
+// area the walls, solid infill and other model features cover. The layer area is that enclosed
+// by its outer walls, or else the convex hull of the model's extrusions. Layers without sparse
+// infill, or whose region is too small to judge, are 0.
+func (a *Analysis) getInfillDensities(lines []string) []float64 {
+	infills := a.getLayerInfill(lines)
+	geometry := a.getLayerGeometry(lines)
+	densities := make([]float64, len(infills))
+	for layer := range densities {
+		infill := infills[layer]
+		height := a.getLayerHeight(layer)
+		if infill.SparseVolume == 0 || height <= 0 {
+			continue
+		}
+		area := geometry[layer].Area
+		if area == 0 {
+			area = polygonArea(convexHull(infill.Points))
+		}
+		sparseArea := area - infill.OtherVolume/height
+		if sparseArea < area*INFILL_MIN_AREA_PCT/100 {
+			continue
+		}
+		densities[layer] = math.Min(100, infill.SparseVolume/(sparseArea*height)*100)
+	}
+	return densities
+}
+
+// detectInfillDensity returns the runs of layers whose infill density deviates from the median
+// of the layers with sparse infill by more than the preset's InfillDensityTolerance percent,
+// a sign of slicer bugs or thin walls collapsing into infill
+func (a *Analysis) detectInfillDensity(densities []float64) []Detection {
+	judged := []float64{}
+	for _, density := range densities {
+		if density > 0 {
+			judged = append(judged, density)
+		}
+	}
+	detections := []Detection{}
+	if len(judged) == 0 {
+		return detections
+	}
+	slices.Sort(judged)
+	median := judged[len(judged)/2]
+
+	runStart := -1
+	extreme := 0.0
+	endRun := func(end int) {
+		if runStart >= 0 {
+			detections = append(detections, Detection{
+				Layer:    runStart,
+				EndLayer: end,
+				Detector: DETECTOR_INFILL_DENSITY,
+				Details: fmt.Sprintf("infill density %.1f%% against %.1f%% typical (tolerance %.0f%%)",
+					extreme, median, a.preset.InfillDensityTolerance),
+			})
+		}
+		runStart = -1
+	}
+	for layer, density := range densities {
+		if density > 0 && math.Abs(density-median)/median*100 > a.preset.InfillDensityTolerance {
+			if runStart < 0 || math.Abs(density-median) > math.Abs(extreme-median) {
+				extreme = density
+			}
+			if runStart < 0 {
+				runStart = layer
+			}
+		} else {
+			endRun(layer - 1)
+		}
+	}
+	endRun(len(densities) - 1)
+	return detections
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const INTERACTIVE_CONTEXT_LINES = 3 // Lines shown before and after the insertion point
+
+var interactive bool // Confirm each modification on the terminal before writing
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// confirmModifications shows each proposed modification with its reason and the surrounding
+// lines, and returns the ones the user approved (with any edited values). Each decision is an edit
+// of the file, so it can be undone to revisit the modification and redone.
+func (a *Analysis) confirmModifications(lines []string, modifications []modification) []modification {
+	buffer := newEditBuffer(NewDocument(lines))
+	accept := func(mod modification) {
+		var splices []splice
+		if mod.Layer >= 0 && mod.Layer < buffer.doc.LayerCount() {
+			index := 1 + buffer.insertedAt(mod.Layer)
+			splices = append(splices, buffer.Insert(mod.Layer, index, a.getModificationLines(mod)...))
+		}
+		buffer.Apply(&mod, splices...)
+	}
+
+	for len(buffer.done) < len(modifications) {
+		i := len(buffer.done)
+		mod := modifications[i]
+		fmt.Printf("\n[%d/%d] Proposed: %s\n", i+1, len(modifications), mod)
+		fmt.Printf("Reason: %s\n", mod.Reason)
+		printLayerContext(buffer.doc, mod.Layer)
+
+		for {
+			answer := prompt("Apply? [y]es / [n]o (skip) / [e]dit value / [u]ndo / [r]edo: ")
+			switch strings.ToLower(answer) {
+			case "", "y", "yes":
+				accept(mod)
+			case "n", "no":
+				buffer.Apply(nil)
+				fmt.Println("Skipped.")
+			case "e", "edit":
+				value, err := strconv.Atoi(prompt(fmt.Sprintf("New value (currently %d): ", mod.Value)))
+				if err != nil {
+					fmt.Printf("Invalid value: %v\n", err)
+					continue
+				}
+				mod.Value = value
+				fmt.Printf("Edited: %s\n", mod)
+				accept(mod)
+			case "u", "undo":
+				if e, ok := buffer.Undo(); !ok {
+					fmt.Println("Nothing to undo.")
+					continue
+				} else if e.Mod != nil {
+					fmt.Printf("Undone: %s\n", e.Mod)
+				} else {
+					fmt.Println("Undone: skip")
+				}
+			case "r", "redo":
+				if e, ok := buffer.Redo(); !ok {
+					fmt.Println("Nothing to redo.")
+					continue
+				} else if e.Mod != nil {
+					fmt.Printf("Redone: %s\n", e.Mod)
+				} else {
+					fmt.Println("Redone: skip")
+				}
+			default:
+				continue
+			}
+			break
+		}
+	}
+	return buffer.Modifications()
+}
+
+// printLayerContext prints the lines around the start of a 0-based layer, including the lines
+// inserted by the decisions so far
+func printLayerContext(doc *Document, layer int) {
+	if layer < 0 || layer >= doc.LayerCount() {
+		fmt.Printf("Layer %d is not in the file\n", displayLayer(layer))
+		return
+	}
+	before := doc.Header()
+	if layer > 0 {
+		before = doc.Layer(layer - 1).Lines()
+	}
+	lineNum := doc.LineNumber(layer)
+	start := max(len(before)-INTERACTIVE_CONTEXT_LINES, 0)
+	for n, line := range before[start:] {
+		fmt.Printf("   %6d: %s\n", lineNum-len(before)+start+n, line)
+	}
+	current := doc.Layer(layer).Lines()
+	for n, line := range current[:min(len(current), 1+INTERACTIVE_CONTEXT_LINES)] {
+		marker := "  "
+		if n == 0 {
+			marker = "=>"
+		}
+		fmt.Printf("%s %6d: %s\n", marker, lineNum+n, line)
+	}
+}
+
+// prompt prints a question and returns the trimmed answer read from stdin
+func prompt(question string) string {
+	fmt.Print(question)
+	answer, err := stdinReader.ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		return ""
+	}
+	return strings.TrimSpace(answer)
+}
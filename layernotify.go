@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	NOTIFY_BEEP_FREQUENCY = 880 // Hz of the M300 beep
+	NOTIFY_BEEP_DURATION  = 500 // ms
+)
+
+// layerNotification is one entry of -notify-at-layer
+type layerNotification struct {
+	Layer   int // 0-based
+	Message string
+}
+
+var notifyAtLayerSpec string // -notify-at-layer, e.g. '12:Insert magnets now,40'
+var layerNotifications []layerNotification
+
+// loadLayerNotifications parses -notify-at-layer: comma-separated 'layer[:message]' entries, with
+// layers numbered according to -layer-base
+func loadLayerNotifications() error {
+	if notifyAtLayerSpec == "" {
+		return nil
+	}
+	notifications := []layerNotification{}
+	for _, entry := range strings.Split(notifyAtLayerSpec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		number, message, _ := strings.Cut(entry, ":")
+		layer, err := strconv.Atoi(strings.TrimSpace(number))
+		if err != nil || parseLayer(layer) < 0 {
+			return fmt.Errorf("-notify-at-layer: invalid entry '%s' (use layer[:message], e.g. 12:Insert magnets now)", entry)
+		}
+		// A ';' would start a comment, and quotes end RepRapFirmware's message
+		message = strings.TrimSpace(strings.NewReplacer(";", ",", "\"", "'").Replace(message))
+		notifications = append(notifications, layerNotification{Layer: parseLayer(layer), Message: message})
+	}
+	layerNotifications = notifications
+	return nil
+}
+
+// getNotificationLines returns the firmware's commands that draw attention to the printer with a
+// message: Marlin beeps with M300 and shows it with M117, RepRapFirmware beeps and shows it in a
+// message box that doesn't wait (M291 S1), and Klipper shows it with M117 and runs the -printer
+// profile's notify_macro, such as one flashing the LEDs, since it has no built-in beeper.
+func getNotificationLines(layer int, message string) []string {
+	if message == "" {
+		message = msg(MSG_NOTIFY, displayLayer(layer))
+	}
+	beep := withComment(fmt.Sprintf("M300 S%d P%d", NOTIFY_BEEP_FREQUENCY, NOTIFY_BEEP_DURATION), msg(MSG_NOTIFY_BEEP, displayLayer(layer)))
+	switch getFirmware() {
+	case FIRMWARE_KLIPPER:
+		notification := []string{"M117 " + message}
+		if activePrinter != nil && activePrinter.NotifyMacro != "" {
+			notification = append(notification, activePrinter.NotifyMacro)
+		}
+		return notification
+	case FIRMWARE_REPRAP:
+		return []string{beep, fmt.Sprintf("M291 P\"%s\" S1", message)}
+	}
+	return []string{beep, "M117 " + message}
+}
+
+// insertLayerNotifications inserts the -notify-at-layer notifications at the start of their layers
+func (a *Analysis) insertLayerNotifications(lines []string) []string {
+	if len(layerNotifications) == 0 {
+		return lines
+	}
+	layerCount := a.countLayers(lines)
+	for _, notification := range layerNotifications {
+		if notification.Layer >= layerCount {
+			fmt.Printf("Warning: -notify-at-layer layer %d is past the last layer (%d)\n", displayLayer(notification.Layer), displayLayer(layerCount-1))
+		}
+	}
+	notified := 0
+	withNotifications := a.insertAtLayerStarts(lines, nil, func(layer int) []string {
+		inserted := []string{}
+		for _, notification := range layerNotifications {
+			if notification.Layer == layer {
+				notified++
+				inserted = append(inserted, getNotificationLines(layer, notification.Message)...)
+			}
+		}
+		return inserted
+	})
+	fmt.Printf("Inserted %d layer notifications (%s)\n", notified, getFirmware())
+	return withNotifications
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Layers are numbered from 0 internally: layer 0 is the first layer change comment in the file,
+// and plans store 0-based layers. -layer-base only changes how layer numbers are read from the
+// user and printed, so "-layer-base 1" matches the numbering shown by most slicers.
+var layerNumberBase = 0
+
+// addLayerBaseFlag registers -layer-base on a flag set
+func addLayerBaseFlag(fs *flag.FlagSet) {
+	fs.IntVar(&layerNumberBase, "layer-base", 0, "Number of the first layer in layer numbers read and printed: 0 or 1")
+}
+
+// validateLayerBase exits if -layer-base isn't 0 or 1
+func validateLayerBase() {
+	if layerNumberBase != 0 && layerNumberBase != 1 {
+		fmt.Printf("Error: -layer-base must be 0 or 1, not %d\n", layerNumberBase)
+		os.Exit(1)
+	}
+}
+
+// displayLayer converts a 0-based layer to the user's numbering
+func displayLayer(layer int) int {
+	return layer + layerNumberBase
+}
+
+// displayLayers converts 0-based layers to the user's numbering
+func displayLayers(layers []int) []int {
+	displayed := make([]int, len(layers))
+	for i, layer := range layers {
+		displayed[i] = displayLayer(layer)
+	}
+	return displayed
+}
+
+// parseLayer converts a layer number given by the user to a 0-based layer
+func parseLayer(userLayer int) int {
+	validateLayerBase()
+	return userLayer - layerNumberBase
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	LINE_ENDING_AUTO = "auto" // Keep the input's line endings
+	LINE_ENDING_LF   = "lf"
+	LINE_ENDING_CRLF = "crlf"
+)
+
+var lineEnding = LINE_ENDING_AUTO // -line-ending
+
+// lineWriter writes G-code lines, each terminated by exactly one line ending. Line endings
+// already on a line are dropped and a line holding several lines is split, so a stray newline
+// in an inserted command can't produce a blank line.
+type lineWriter struct {
+	w      io.Writer
+	ending string
+}
+
+// validateLineEnding exits if -line-ending isn't a supported value
+func validateLineEnding() {
+	switch lineEnding {
+	case LINE_ENDING_AUTO, LINE_ENDING_LF, LINE_ENDING_CRLF:
+	default:
+		fmt.Printf("Error: unknown -line-ending '%s' (use %s, %s or %s)\n", lineEnding, LINE_ENDING_AUTO, LINE_ENDING_LF, LINE_ENDING_CRLF)
+		os.Exit(1)
+	}
+}
+
+// scanLines reads G-code lines, decompressing them when gzipped, without their line endings, and
+// reports whether the first line ended with CRLF
+func scanLines(r io.Reader) ([]string, bool, error) {
+	r, err := decompress(r)
+	if err != nil {
+		return nil, false, err
+	}
+	crlf := false
+	first := true
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if first && token != nil {
+			// ScanLines drops the "\r" of a "\r\n" ending from the token
+			crlf = advance == len(token)+2
+			first = false
+		}
+		return advance, token, err
+	})
+
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, crlf, scanner.Err()
+}
+
+// newLineWriter returns a lineWriter using the -line-ending policy, where auto keeps the line
+// endings of the input, CRLF when inputCRLF is set
+func newLineWriter(w io.Writer, inputCRLF bool) *lineWriter {
+	ending := "\n"
+	if lineEnding == LINE_ENDING_CRLF || (lineEnding == LINE_ENDING_AUTO && inputCRLF) {
+		ending = "\r\n"
+	}
+	return &lineWriter{w: w, ending: ending}
+}
+
+// WriteLine writes a line followed by the line ending
+func (lw *lineWriter) WriteLine(line string) error {
+	line = strings.TrimRight(line, "\r\n")
+	for _, part := range strings.Split(line, "\n") {
+		if _, err := io.WriteString(lw.w, strings.TrimSuffix(part, "\r")+lw.ending); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteLines writes every line followed by the line ending
+func (lw *lineWriter) WriteLines(lines []string) error {
+	for _, line := range lines {
+		if err := lw.WriteLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	LINT_ERROR   = "error"   // The firmware rejects the command, or stops the print
+	LINT_WARNING = "warning" // The firmware runs the command differently than written
+
+	LINT_BAMBU = "bambu" // Bambu Lab printer firmware, only a lint target
+)
+
+// lintIssue is a command the target firmware will reject or misinterpret
+type lintIssue struct {
+	Line     int // 1-based
+	Severity string
+	Message  string
+}
+
+// lintProfile is what a firmware accepts, with the limits of a stock configuration
+type lintProfile struct {
+	Name          string
+	MaxHotendTemp float64                                            // °C
+	MaxBedTemp    float64                                            // °C
+	OverTemp      string                                             // Severity of a temperature above the limit: rejected, or clamped
+	MaxFeedrate   float64                                            // mm/min, above which moves are clamped
+	MaxFanValue   float64                                            // Full speed in M106 S
+	Commands      []string                                           // The G and M commands the firmware runs, nil for any
+	ToolChanges   bool                                               // T<n> commands are run by the firmware rather than by macros
+	Check         func(command Command, known lintKnown) []lintIssue // Firmware-specific rules, nil for none
+}
+
+// lintKnown is what the machine's configuration defines, from the -macros config files
+type lintKnown struct {
+	Macros map[string]gcodeMacro
+	Fans   map[string]bool // [fan_generic] names, nil when no config was given
+}
+
+var numberedCommandRegexp = regexp.MustCompile(`^[GMT]\d+(\.\d+)?$`)
+var fanGenericRegexp = regexp.MustCompile(`^\[fan_generic\s+([^\]]+)\]\s*$`)
+
+var lintProfiles = map[string]lintProfile{
+	// Marlin clamps targets to HEATER_0_MAXTEMP (275) and BED_MAXTEMP (150) less their overshoot
+	// margins, and ignores unknown commands after an "Unknown command" echo. Which commands
+	// exist depends on the build, so any are accepted.
+	FIRMWARE_MARLIN: {Name: FIRMWARE_MARLIN, MaxHotendTemp: 260, MaxBedTemp: 140, OverTemp: LINT_WARNING,
+		MaxFeedrate: 300 * 60, MaxFanValue: 255, Check: checkMarlinCommand},
+	// Klipper stops the print on targets above a heater's max_temp
+	FIRMWARE_KLIPPER: {Name: FIRMWARE_KLIPPER, MaxHotendTemp: 300, MaxBedTemp: 130, OverTemp: LINT_ERROR,
+		MaxFeedrate: 500 * 60, MaxFanValue: 255, Check: checkKlipperCommand, Commands: []string{
+			"G0", "G1", "G2", "G3", "G4", "G10", "G11", "G20", "G21", "G28", "G90", "G91", "G92",
+			"M17", "M18", "M73", "M82", "M83", "M84", "M104", "M105", "M106", "M107", "M109", "M110", "M112",
+			"M114", "M115", "M117", "M118", "M119", "M140", "M190", "M204", "M220", "M221", "M400"}},
+	FIRMWARE_REPRAP: {Name: FIRMWARE_REPRAP, MaxHotendTemp: 285, MaxBedTemp: 120, OverTemp: LINT_ERROR,
+		MaxFeedrate: 500 * 60, MaxFanValue: 255, Check: checkReprapCommand},
+	LINT_BAMBU: {Name: LINT_BAMBU, MaxHotendTemp: 300, MaxBedTemp: 120, OverTemp: LINT_WARNING,
+		MaxFeedrate: 1000 * 60, MaxFanValue: 255, ToolChanges: true, Commands: []string{
+			"G0", "G1", "G2", "G3", "G4", "G17", "G28", "G29", "G29.1", "G29.2", "G39", "G90", "G91", "G92",
+			"G150", "G380", "M17", "M18", "M73", "M82", "M83", "M84", "M104", "M106", "M107", "M109",
+			"M140", "M141", "M190", "M191", "M201", "M204", "M205", "M220", "M221", "M400", "M412", "M500",
+			"M620", "M621", "M622", "M623", "M624", "M625", "M630", "M900", "M960", "M970", "M971",
+			"M972", "M973", "M975", "M981", "M982", "M983", "M991", "M1002", "M1003", "M1004", "M1006", "M1007"}},
+}
+
+// getLintProfileNames returns the names of the lint profiles, sorted
+func getLintProfileNames() []string {
+	names := []string{}
+	for name := range lintProfiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// lintCommand returns the issues of one command under a profile
+func (p lintProfile) lintCommand(command Command, known lintKnown) []lintIssue {
+	issues := []lintIssue{}
+	name := strings.ToUpper(command.Name)
+	_, isMacro := known.Macros[name]
+	if p.Commands != nil && numberedCommandRegexp.MatchString(name) && !isMacro &&
+		!slices.Contains(p.Commands, name) && !(p.ToolChanges && name[0] == 'T') {
+		issues = append(issues, lintIssue{Severity: LINT_WARNING, Message: fmt.Sprintf("%s is not a %s command and is ignored", name, p.Name)})
+	}
+
+	s, hasS := command.Params['S']
+	switch name {
+	case "M104", "M109":
+		if hasS && s > p.MaxHotendTemp {
+			issues = append(issues, lintIssue{Severity: p.OverTemp,
+				Message: fmt.Sprintf("hotend %.0f°C is above the %s limit of %.0f°C", s, p.Name, p.MaxHotendTemp)})
+		}
+	case "M140", "M190":
+		if hasS && s > p.MaxBedTemp {
+			issues = append(issues, lintIssue{Severity: p.OverTemp,
+				Message: fmt.Sprintf("bed %.0f°C is above the %s limit of %.0f°C", s, p.Name, p.MaxBedTemp)})
+		}
+	case "G0", "G1", "G2", "G3":
+		if f, ok := command.Params['F']; ok && f > p.MaxFeedrate {
+			issues = append(issues, lintIssue{Severity: LINT_WARNING,
+				Message: fmt.Sprintf("feedrate F%.0f is above the %s limit of F%.0f and is clamped", f, p.Name, p.MaxFeedrate)})
+		}
+	case "M106":
+		if hasS && s > p.MaxFanValue {
+			issues = append(issues, lintIssue{Severity: LINT_WARNING,
+				Message: fmt.Sprintf("fan S%g is above full speed S%.0f and is clamped", s, p.MaxFanValue)})
+		}
+	}
+	if p.Check != nil {
+		issues = append(issues, p.Check(command, known)...)
+	}
+	return issues
+}
+
+// checkMarlinCommand flags fan speeds that Marlin truncates to whole numbers
+func checkMarlinCommand(command Command, known lintKnown) []lintIssue {
+	if s, ok := command.Params['S']; ok && strings.EqualFold(command.Name, "M106") && s != math.Trunc(s) {
+		return []lintIssue{{Severity: LINT_WARNING, Message: fmt.Sprintf("Marlin truncates fan S%g to S%.0f", s, math.Trunc(s))}}
+	}
+	return nil
+}
+
+// checkReprapCommand flags fan speeds that RepRapFirmware reads as a fraction of full speed
+func checkReprapCommand(command Command, known lintKnown) []lintIssue {
+	if s, ok := command.Params['S']; ok && strings.EqualFold(command.Name, "M106") && s > 0 && s <= 1 {
+		return []lintIssue{{Severity: LINT_WARNING,
+			Message: fmt.Sprintf("RepRapFirmware reads fan S%g as %.0f%% (S1 or less is a fraction of full speed)", s, s*100)}}
+	}
+	return nil
+}
+
+// checkKlipperCommand checks the parameters of Klipper's extended commands and the fans they name
+func checkKlipperCommand(command Command, known lintKnown) []lintIssue {
+	params := parseMacroParams(command.Args)
+	issues := []lintIssue{}
+	switch strings.ToUpper(command.Name) {
+	case "M106":
+		if _, ok := command.Params['P']; ok {
+			issues = append(issues, lintIssue{Severity: LINT_WARNING, Message: "Klipper's M106 ignores P and sets the part cooling fan; use SET_FAN_SPEED FAN=<name>"})
+		}
+	case "SET_FAN_SPEED":
+		fan, ok := params["FAN"]
+		if !ok {
+			issues = append(issues, lintIssue{Severity: LINT_ERROR, Message: "SET_FAN_SPEED needs FAN=<name>"})
+		} else if known.Fans != nil && !known.Fans[strings.ToLower(fan)] {
+			issues = append(issues, lintIssue{Severity: LINT_ERROR, Message: fmt.Sprintf("fan '%s' is not a [fan_generic] in the -macros config", fan)})
+		}
+		var speed float64
+		if _, err := fmt.Sscan(params["SPEED"], &speed); err != nil || speed < 0 || speed > 1 {
+			issues = append(issues, lintIssue{Severity: LINT_ERROR, Message: "SET_FAN_SPEED needs SPEED between 0 and 1"})
+		}
+	case "SET_HEATER_TEMPERATURE":
+		if _, ok := params["HEATER"]; !ok {
+			issues = append(issues, lintIssue{Severity: LINT_ERROR, Message: "SET_HEATER_TEMPERATURE needs HEATER=<name>"})
+		}
+	}
+	return issues
+}
+
+// loadFanNames reads the [fan_generic] names of Klipper config files, in lower case
+func loadFanNames(paths string) (map[string]bool, error) {
+	fans := make(map[string]bool)
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if m := fanGenericRegexp.FindStringSubmatch(strings.TrimSpace(scanner.Text())); m != nil {
+				fans[strings.ToLower(strings.TrimSpace(m[1]))] = true
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return fans, nil
+}
+
+// lintLines returns the issues of every command in the lines under a profile
+func lintLines(lines []string, profile lintProfile, known lintKnown) []lintIssue {
+	issues := []lintIssue{}
+	for i, line := range lines {
+		command, ok := parseCommand(line)
+		if !ok {
+			continue
+		}
+		for _, issue := range profile.lintCommand(command, known) {
+			issue.Line = i + 1
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// getLintTarget returns the lint profile name for a file: -firmware if given, else Bambu for
+// files sliced for a Bambu Lab printer, else the -printer/-firmware default
+func getLintTarget(lines []string) string {
+	if firmwareName == "" && strings.HasPrefix(getPrinterModel(lines), "Bambu Lab") {
+		return LINT_BAMBU
+	}
+	return getFirmware()
+}
+
+// validateFlags are the flags of the validate command
+type validateFlags struct {
+	inputFilePath *string
+}
+
+// defineValidateFlags defines the flags of the validate command on a flag set
+func defineValidateFlags(fs *flag.FlagSet) validateFlags {
+	var flags validateFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	fs.StringVar(&firmwareName, "firmware", "", "Firmware to check for: "+strings.Join(getLintProfileNames(), ", ")+" (Default=bambu for Bambu Lab printers, else marlin)")
+	addMacrosFlag(fs)
+	return flags
+}
+
+// runValidateCommand implements "validate": it prints the commands of a G-code file that the
+// target firmware will reject or misinterpret, and exits with status 1 when any is rejected
+func runValidateCommand(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags := defineValidateFlags(fs)
+	setCommandUsage(fs, "validate")
+	fs.Parse(args)
+
+	if *flags.inputFilePath == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	lines, _, err := readLines(*flags.inputFilePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+	target := getLintTarget(lines)
+	profile, ok := lintProfiles[target]
+	if !ok {
+		fmt.Printf("Error: unknown firmware '%s' (use %s)\n", target, strings.Join(getLintProfileNames(), ", "))
+		os.Exit(1)
+	}
+	loadMacrosFlag()
+	known := lintKnown{Macros: macros}
+	if macroPaths != "" {
+		if known.Fans, err = loadFanNames(macroPaths); err != nil {
+			fmt.Printf("Error reading fans: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	issues := lintLines(lines, profile, known)
+	errors := 0
+	for _, issue := range issues {
+		fmt.Printf("%7d  %-7s %s  (%s)\n", issue.Line, issue.Severity, issue.Message, strings.TrimSpace(lines[issue.Line-1]))
+		if issue.Severity == LINT_ERROR {
+			errors++
+		}
+	}
+	fmt.Printf("Checked for %s: %d errors, %d warnings\n", profile.Name, errors, len(issues)-errors)
+	if errors > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	LOG_BEGIN  = "; gcode_modifier log: begin"
+	LOG_END    = "; gcode_modifier log: end"
+	LOG_PREFIX = "; "
+)
+
+var logTimestamp bool // -timestamp, record when the output was made in the processing log
+var reproducible bool // -reproducible, leave out timestamps so identical inputs and flags give identical outputs
+
+// validateReproducible exits if -timestamp is asked for in a -reproducible run
+func validateReproducible() {
+	if reproducible && logTimestamp {
+		fmt.Println("Error: -timestamp can't be combined with -reproducible")
+		os.Exit(1)
+	}
+}
+
+// secretFlags are the flags whose values are credentials, redacted from logged command lines
+var secretFlags = map[string]bool{"webhook-secret": true, "slack-webhook": true, "discord-webhook": true}
+
+// getLoggedArgs returns the command-line arguments with the values of secretFlags redacted, for
+// the processing log and the history
+func getLoggedArgs() []string {
+	args := append([]string{}, os.Args[1:]...)
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !secretFlags[name] {
+			continue
+		}
+		if hasValue {
+			args[i] = args[i][:strings.Index(args[i], "=")+1] + REDACTED
+		} else if i+1 < len(args) {
+			i++
+			args[i] = REDACTED
+		}
+	}
+	return args
+}
+
+// getProcessingLog returns the comment block recording how the output was made: tool version,
+// command-line parameters, a hash of the original lines, the detections, the entries of a plan
+// re-targeted by Z height and the insertions, the time with -timestamp and any extra entries, such
+// as the -energy estimate. The end line carries a hash of the block so edits to the log can be
+// spotted.
+func getProcessingLog(original []string, plan Plan, modifications []modification, pluginInsertions []pluginInsertion, extra []string) []string {
+	entries := []string{
+		"version: " + versionString(),
+		"args: " + strings.Join(getLoggedArgs(), " "),
+		"preset: " + plan.Preset,
+		"dialect: " + plan.Dialect,
+		"source_sha256: " + hashLines(original),
+	}
+	if logTimestamp {
+		entries = append(entries, "time: "+time.Now().UTC().Format(time.RFC3339))
+	}
+	for _, detection := range plan.Detections {
+		entries = append(entries, "detection: "+describeDetection(detection))
+	}
+	for _, r := range plan.Retargets {
+		entries = append(entries, "retarget: "+r.String())
+	}
+	for _, mod := range modifications {
+		entries = append(entries, fmt.Sprintf("insertion: %s (%s)", mod, mod.Reason))
+	}
+	for _, insertion := range pluginInsertions {
+		entries = append(entries, fmt.Sprintf("plugin: %s at layer %d (%s)", insertion.Plugin, displayLayer(insertion.Layer), insertion.Reason))
+	}
+	for _, t := range transforms {
+		entries = append(entries, "transform: "+t.Rule)
+	}
+	for _, override := range speedOverrides {
+		entries = append(entries, "speed override: "+override.Spec)
+	}
+	for _, override := range fanOverrides {
+		entries = append(entries, "fan override: "+override.Spec)
+	}
+	entries = append(entries, extra...)
+
+	block := []string{LOG_BEGIN}
+	for _, entry := range entries {
+		if sanitizeOutput {
+			entry = sanitizeLine(entry)
+		}
+		if sanitizeMetadata {
+			entry = redactUserPaths(entry)
+		}
+		block = append(block, LOG_PREFIX+entry)
+	}
+	return append(block, fmt.Sprintf("%s sha256=%s", LOG_END, hashLines(block)))
+}
+
+// describeDetection formats a detection for the processing log
+func describeDetection(detection Detection) string {
+	layers := fmt.Sprintf("layer %d", displayLayer(detection.Layer))
+	if detection.EndLayer > detection.Layer {
+		layers = fmt.Sprintf("layers %d-%d", displayLayer(detection.Layer), displayLayer(detection.EndLayer))
+	}
+	details := detection.Details
+	if details == "" {
+		details = detection.Why.String()
+	}
+	return fmt.Sprintf("%s %s: %s", detection.Detector, layers, details)
+}
+
+// hashLines returns the hex SHA-256 of the lines joined with newlines
+func hashLines(lines []string) string {
+	hash := sha256.New()
+	for _, line := range lines {
+		hash.Write([]byte(line))
+		hash.Write([]byte{'\n'})
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
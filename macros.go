@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const MAX_MACRO_DEPTH = 10 // Macros calling macros deeper than this are not expanded further
+
+// gcodeMacro is a Klipper [gcode_macro] definition
+type gcodeMacro struct {
+	Name  string
+	Lines []string // Template lines of the gcode: block
+}
+
+var macroPaths string // -macros, comma-separated Klipper config files with [gcode_macro] sections
+var macros = map[string]gcodeMacro{}
+var warnedMacroLines = map[string]bool{}
+var warnedMacroMu sync.Mutex
+
+var macroSectionRegexp = regexp.MustCompile(`^\[gcode_macro\s+([^\]]+)\]\s*$`)
+var macroSetRegexp = regexp.MustCompile(`^\{%-?\s*set\s+(\w+)\s*=\s*(.+?)\s*-?%\}$`)
+var macroExprRegexp = regexp.MustCompile(`\{([^{}%]+)\}`)
+
+// loadMacros reads the [gcode_macro] sections of Klipper config files. Only the gcode: block
+// is used; other options (description, rename_existing, variables) are ignored.
+func loadMacros(paths string) (map[string]gcodeMacro, error) {
+	loaded := make(map[string]gcodeMacro)
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var current *gcodeMacro
+		inGcode := false
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, "[") {
+				if current != nil {
+					loaded[current.Name] = *current
+				}
+				current, inGcode = nil, false
+				if m := macroSectionRegexp.FindStringSubmatch(trimmed); m != nil {
+					current = &gcodeMacro{Name: strings.ToUpper(strings.TrimSpace(m[1]))}
+				}
+				continue
+			}
+			if current == nil {
+				continue
+			}
+			// The gcode: block is made of the indented lines after it
+			if inGcode && (line == "" || line[0] == ' ' || line[0] == '\t') {
+				if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+					current.Lines = append(current.Lines, trimmed)
+				}
+				continue
+			}
+			inGcode = false
+			if key, value, ok := strings.Cut(trimmed, ":"); ok && strings.TrimSpace(key) == "gcode" {
+				inGcode = true
+				if value = strings.TrimSpace(value); value != "" {
+					current.Lines = append(current.Lines, value)
+				}
+			}
+		}
+		if current != nil {
+			loaded[current.Name] = *current
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+// addMacrosFlag registers -macros on a command's flag set
+func addMacrosFlag(fs *flag.FlagSet) {
+	fs.StringVar(&macroPaths, "macros", "", "Klipper config files (comma-separated) whose [gcode_macro] definitions are expanded when simulating")
+}
+
+// loadMacrosFlag loads the macros given with -macros, exiting on errors
+func loadMacrosFlag() {
+	if macroPaths == "" {
+		return
+	}
+	var err error
+	if macros, err = loadMacros(macroPaths); err != nil {
+		fmt.Printf("Error reading macros: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Loaded %d macros\n", len(macros))
+}
+
+// parseMacroParams parses the NAME=VALUE parameters of a macro call, with upper-case names
+func parseMacroParams(fields []string) map[string]string {
+	params := make(map[string]string)
+	for _, field := range fields {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			params[strings.ToUpper(key)] = value
+		}
+	}
+	return params
+}
+
+// evalMacroExpr evaluates a template expression: a macro parameter (params.NAME), a variable set
+// earlier in the macro or a literal, followed by default(), float, int or round filters.
+// Anything else, like arithmetic, is not supported.
+func evalMacroExpr(expr string, params map[string]string, vars map[string]string) (string, bool) {
+	parts := strings.Split(expr, "|")
+	base := strings.TrimSpace(parts[0])
+	value, found := "", false
+	switch {
+	case strings.HasPrefix(base, "params."):
+		value, found = params[strings.ToUpper(strings.TrimPrefix(base, "params."))]
+	case vars[base] != "":
+		value, found = vars[base], true
+	default:
+		if _, err := strconv.ParseFloat(base, 64); err == nil {
+			value, found = base, true
+		} else if unquoted, err := strconv.Unquote(strings.ReplaceAll(base, "'", "\"")); err == nil {
+			value, found = unquoted, true
+		} else {
+			return "", false
+		}
+	}
+
+	for _, filter := range parts[1:] {
+		filter = strings.TrimSpace(filter)
+		switch {
+		case strings.HasPrefix(filter, "default(") && strings.HasSuffix(filter, ")"):
+			if !found {
+				value, found = strings.Trim(filter[len("default("):len(filter)-1], `"' `), true
+			}
+		case filter == "float" || filter == "int" || filter == "round" || strings.HasPrefix(filter, "round("):
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				number = 0
+			}
+			switch filter {
+			case "float":
+				value = strconv.FormatFloat(number, 'f', -1, 64)
+			case "int":
+				value = strconv.Itoa(int(number))
+			default:
+				value = strconv.Itoa(int(math.Round(number)))
+			}
+		default:
+			return "", false
+		}
+	}
+	return value, found
+}
+
+// warnMacroLine warns, once per line, that a macro template line is left out of expansions
+func warnMacroLine(macro gcodeMacro, template string) {
+	warnedMacroMu.Lock()
+	defer warnedMacroMu.Unlock()
+	if !warnedMacroLines[macro.Name+"\x00"+template] {
+		fmt.Printf("Warning: macro %s: skipping unsupported template line '%s'\n", macro.Name, template)
+		warnedMacroLines[macro.Name+"\x00"+template] = true
+	}
+}
+
+// expandMacro returns the commands a line runs when it calls a known macro. Template lines that
+// can't be evaluated (control flow, arithmetic) are left out with a warning.
+func expandMacro(line string) ([]string, bool) {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return nil, false
+	}
+	macro, ok := macros[strings.ToUpper(fields[0])]
+	if !ok {
+		return nil, false
+	}
+
+	params := parseMacroParams(fields[1:])
+	vars := make(map[string]string)
+	expanded := []string{}
+	for _, template := range macro.Lines {
+		if m := macroSetRegexp.FindStringSubmatch(template); m != nil {
+			if value, ok := evalMacroExpr(m[2], params, vars); ok {
+				vars[m[1]] = value
+				continue
+			}
+		}
+		if strings.Contains(template, "{%") {
+			warnMacroLine(macro, template)
+			continue
+		}
+		supported := true
+		command := macroExprRegexp.ReplaceAllStringFunc(template, func(expr string) string {
+			value, ok := evalMacroExpr(expr[1:len(expr)-1], params, vars)
+			if !ok {
+				supported = false
+			}
+			return value
+		})
+		if !supported {
+			warnMacroLine(macro, template)
+			continue
+		}
+		expanded = append(expanded, command)
+	}
+	return expanded, true
+}
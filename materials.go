@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_MAX_TEMP         = 260  // Celcius, for unknown materials
+	DEFAULT_MIN_TEMP         = 170  // Celcius, for unknown materials: firmware's usual cold extrusion limit
+	DEFAULT_FILAMENT_DENSITY = 1.24 // g/cm³, for unknown materials
+)
+
+// materialDefaults are the correction rules that suit a filament type better than the preset's
+type materialDefaults struct {
+	FanSpeedPct  int
+	TempIncrease int
+	SkipFan      bool    // Leave the fan alone (materials printed with little or no cooling)
+	MaxTemp      int     // Absolute maximum hotend temperature in °C
+	MinTemp      int     // Lowest hotend temperature in °C the material still extrudes well at
+	Density      float64 // g/cm³, for the filament weight when the file doesn't give it
+}
+
+var materialDefaultsByType = map[string]materialDefaults{
+	"PLA":  {FanSpeedPct: 50, TempIncrease: 10, MaxTemp: 240, MinTemp: 180, Density: 1.24},
+	"PETG": {FanSpeedPct: FAN_SPEED_PCT_PROB_LAYERS, TempIncrease: TEMP_INCREASE_PROB_LAYERS, MaxTemp: 270, MinTemp: 210, Density: 1.27},
+	"ABS":  {TempIncrease: 10, SkipFan: true, MaxTemp: 280, MinTemp: 220, Density: 1.04},
+	"ASA":  {TempIncrease: 10, SkipFan: true, MaxTemp: 280, MinTemp: 220, Density: 1.07},
+	"PC":   {TempIncrease: 10, SkipFan: true, MaxTemp: 310, MinTemp: 250, Density: 1.20},
+	"TPU":  {FanSpeedPct: 30, TempIncrease: 10, MaxTemp: 250, MinTemp: 200, Density: 1.21},
+}
+
+var fanSpeedOverride int     // -fan-speed, applied when set on the command line
+var tempIncreaseOverride int // -temp-increase, applied when set on the command line
+var maxTempOverride int      // -max-temp, applied when set on the command line
+var explicitFlags = map[string]bool{}
+var loadedMaterial string // Filament type loaded in the -upload printer, when it reports one
+
+// getFilamentType gets the filament type from the metadata (e.g. "; filament_type = PETG")
+func getFilamentType(lines []string) string {
+	for _, line := range lines {
+		if strings.HasPrefix(line, "; filament_type = ") {
+			// Multi-material files list one type per extruder, e.g. "PLA;PETG"
+			material := strings.Split(strings.Split(line, " = ")[1], ";")[0]
+			return strings.ToUpper(strings.TrimSpace(material))
+		}
+	}
+	return ""
+}
+
+// normalizeMaterial returns a filament name as a filament type, e.g. "PETG" for "petg-black", so
+// the names printers give loaded filaments match the types of the known materials
+func normalizeMaterial(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	material := name
+	for known := range materialDefaultsByType {
+		rest, ok := strings.CutPrefix(name, known)
+		if ok && (rest == "" || rest[0] < 'A' || rest[0] > 'Z') && (material == name || len(known) > len(material)) {
+			material = known
+		}
+	}
+	return material
+}
+
+// getPrintMaterial returns the filament type the file will be printed with: what the -upload
+// printer has loaded, else the file's filament type
+func getPrintMaterial(lines []string) string {
+	if loadedMaterial != "" {
+		return loadedMaterial
+	}
+	return getFilamentType(lines)
+}
+
+// checkLoadedMaterial warns, or with -strict-printer exits, when the file was sliced for another
+// filament type than the -upload printer has loaded
+func checkLoadedMaterial(filePath string, lines []string) {
+	material := getFilamentType(lines)
+	if loadedMaterial == "" || material == "" || normalizeMaterial(material) == loadedMaterial {
+		return
+	}
+	if strictPrinter {
+		fmt.Printf("Error: '%s' was sliced for %s, but the printer has %s loaded\n", filePath, material, loadedMaterial)
+		os.Exit(1)
+	}
+	fmt.Printf("Warning: '%s' was sliced for %s, but the printer has %s loaded; using %s corrections\n", filePath, material, loadedMaterial, loadedMaterial)
+}
+
+// getFilePreset returns the active preset adjusted for the filament type the file is printed
+// with, unless a preset was chosen explicitly, with any -fan-speed/-temp-increase overrides
+// applied last
+func getFilePreset(lines []string) preset {
+	return adjustFilePreset(activePreset, !explicitFlags["preset"], lines)
+}
+
+// adjustFilePreset returns a preset adjusted for the filament type the file is printed with when
+// useMaterial is set, with any -fan-speed/-temp-increase overrides applied last
+func adjustFilePreset(p preset, useMaterial bool, lines []string) preset {
+	if useMaterial {
+		material := getPrintMaterial(lines)
+		if defaults, ok := materialDefaultsByType[material]; ok {
+			if defaults.SkipFan {
+				fmt.Println(msg(MSG_MATERIAL_NO_FAN, material, defaults.TempIncrease))
+			} else {
+				fmt.Println(msg(MSG_MATERIAL_DEFAULTS, material, defaults.FanSpeedPct, defaults.TempIncrease))
+			}
+			p.FanSpeedPct = defaults.FanSpeedPct
+			p.TempIncrease = defaults.TempIncrease
+			p.SkipFan = defaults.SkipFan
+		}
+	}
+	if explicitFlags["fan-speed"] {
+		p.FanSpeedPct = fanSpeedOverride
+		p.SkipFan = false
+	}
+	if explicitFlags["temp-increase"] {
+		p.TempIncrease = tempIncreaseOverride
+	}
+	return p
+}
+
+// getFilamentDensity returns the density of the filament in g/cm³: the file's
+// "; filament_density" metadata, else that of its material
+func getFilamentDensity(lines []string) float64 {
+	for _, line := range lines {
+		if strings.HasPrefix(line, "; filament_density = ") {
+			value := strings.Split(strings.Split(line, " = ")[1], ",")[0]
+			if density, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && density > 0 {
+				return density
+			}
+		}
+	}
+	if defaults, ok := materialDefaultsByType[getPrintMaterial(lines)]; ok && defaults.Density > 0 {
+		return defaults.Density
+	}
+	return DEFAULT_FILAMENT_DENSITY
+}
+
+// getMaxTemp returns the highest hotend temperature that may be emitted for a material
+func getMaxTemp(material string) int {
+	if explicitFlags["max-temp"] {
+		return maxTempOverride
+	}
+	if defaults, ok := materialDefaultsByType[material]; ok {
+		return defaults.MaxTemp
+	}
+	return DEFAULT_MAX_TEMP
+}
+
+// getMinTemp returns the lowest hotend temperature that may be emitted for a material
+func getMinTemp(material string) int {
+	if defaults, ok := materialDefaultsByType[material]; ok {
+		return defaults.MinTemp
+	}
+	return DEFAULT_MIN_TEMP
+}
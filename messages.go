@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	DEFAULT_LANG      = "en"
+	LOCALES_DIR_NAME  = "gcode_modifier/locales" // Below os.UserConfigDir()
+	COMMENT_SEPARATOR = " ; "
+)
+
+// Message IDs of the localizable comments on inserted commands and the matching console output
+const (
+	MSG_SET_TEMPERATURE     = "set-temperature"
+	MSG_SET_FAN_SPEED       = "set-fan-speed"
+	MSG_SET_SPEED_FACTOR    = "set-speed-factor"
+	MSG_WAIT_TEMPERATURE    = "wait-temperature"
+	MSG_INSERTED_NEXT_LINE  = "inserted-next-line"
+	MSG_RESTORE_HOTEND      = "restore-hotend"
+	MSG_RESTORE_BED         = "restore-bed"
+	MSG_RESTORE_FAN         = "restore-fan"
+	MSG_RESTORE_SPEED       = "restore-speed"
+	MSG_RESTORE_MOTORS      = "restore-motors"
+	MSG_LOG_SET_TEMPERATURE = "log-set-temperature"
+	MSG_LOG_SET_FAN_SPEED   = "log-set-fan-speed"
+	MSG_LOG_SET_SPEED       = "log-set-speed-factor"
+	MSG_MATERIAL_DEFAULTS   = "material-defaults"
+	MSG_MATERIAL_NO_FAN     = "material-defaults-no-fan"
+	MSG_PREHEAT_BED         = "preheat-bed"
+	MSG_PREHEAT_CHAMBER     = "preheat-chamber"
+	MSG_SOAK                = "soak"
+	MSG_WIPE                = "wipe"
+	MSG_FEATURE_FAN         = "feature-fan"
+	MSG_RESTORE_FEATURE_FAN = "restore-feature-fan"
+	MSG_POWER_LOSS_ENABLE   = "power-loss-enable"
+	MSG_POWER_LOSS_SAVE     = "power-loss-save"
+	MSG_STANDBY             = "standby"
+	MSG_STANDBY_REHEAT      = "standby-reheat"
+	MSG_PAUSE_PRIME         = "pause-prime"
+	MSG_NOTIFY              = "notify"
+	MSG_NOTIFY_BEEP         = "notify-beep"
+	MSG_STATUS_ACTIVE       = "status-active"
+	MSG_STATUS_DONE         = "status-done"
+	MSG_HEAT_CONCURRENTLY   = "heat-concurrently"
+)
+
+// builtinCatalogs holds the format strings of each message per language. Comments on inserted
+// commands take the value and the layer number; console messages take the value, the layer
+// number, its line and Z height, and the reason; material defaults take the material, then the fan
+// speed unless the fan is left unchanged, and the temperature increase.
+var builtinCatalogs = map[string]map[string]string{
+	"en": {
+		MSG_SET_TEMPERATURE:     "Set hotend temperature to %d°C at layer %d",
+		MSG_SET_FAN_SPEED:       "Set fan speed to %d%% at layer %d",
+		MSG_SET_SPEED_FACTOR:    "Set speed factor to %d%% at layer %d",
+		MSG_WAIT_TEMPERATURE:    "Wait for hotend to reach %d°C",
+		MSG_INSERTED_NEXT_LINE:  "gcode_modifier: inserted next line (%s)",
+		MSG_RESTORE_HOTEND:      "Restore end-of-print hotend temperature",
+		MSG_RESTORE_BED:         "Restore end-of-print bed temperature",
+		MSG_RESTORE_FAN:         "Restore end-of-print fan speed",
+		MSG_RESTORE_SPEED:       "Restore end-of-print speed factor",
+		MSG_RESTORE_MOTORS:      "Restore end-of-print motors off",
+		MSG_LOG_SET_TEMPERATURE: "Set hotend temperature to %d°C at layer %d (line %d, Z=%.2f): %s",
+		MSG_LOG_SET_FAN_SPEED:   "Set fan speed to %d%% at layer %d (line %d, Z=%.2f): %s",
+		MSG_LOG_SET_SPEED:       "Set speed factor to %d%% at layer %d (line %d, Z=%.2f): %s",
+		MSG_MATERIAL_DEFAULTS:   "Using %s defaults: fan %d%%, temperature %+d°C",
+		MSG_MATERIAL_NO_FAN:     "Using %s defaults: fan unchanged, temperature %+d°C",
+		MSG_PREHEAT_BED:         "Preheat bed to %d°C before the print",
+		MSG_PREHEAT_CHAMBER:     "Wait for chamber to reach %d°C",
+		MSG_SOAK:                "Heat soak, %d min left",
+		MSG_WIPE:                "Wipe nozzle on the brush at layer %d",
+		MSG_FEATURE_FAN:         "Set fan speed to %d%% for %s",
+		MSG_RESTORE_FEATURE_FAN: "Restore fan speed to %d%% after %s",
+		MSG_POWER_LOSS_ENABLE:   "Enable power-loss recovery",
+		MSG_POWER_LOSS_SAVE:     "Save layer %d for power-loss recovery",
+		MSG_STANDBY:             "Standby at %d°C while idle for %s",
+		MSG_STANDBY_REHEAT:      "Reheat to %d°C before printing resumes",
+		MSG_PAUSE_PRIME:         "Prime %.2fmm of filament after the pause",
+		MSG_NOTIFY:              "Layer %d reached",
+		MSG_NOTIFY_BEEP:         "Beep at layer %d",
+		MSG_STATUS_ACTIVE:       "Fix active: %s",
+		MSG_STATUS_DONE:         "Fix done: %s",
+		MSG_HEAT_CONCURRENTLY:   "Heat while the other heater heats",
+	},
+	"de": {
+		MSG_SET_TEMPERATURE:     "Hotend-Temperatur auf %d°C ab Schicht %d",
+		MSG_SET_FAN_SPEED:       "Lüfter auf %d%% ab Schicht %d",
+		MSG_SET_SPEED_FACTOR:    "Geschwindigkeitsfaktor auf %d%% ab Schicht %d",
+		MSG_WAIT_TEMPERATURE:    "Warten bis das Hotend %d°C erreicht",
+		MSG_INSERTED_NEXT_LINE:  "gcode_modifier: nächste Zeile eingefügt (%s)",
+		MSG_RESTORE_HOTEND:      "Hotend-Temperatur am Druckende wiederherstellen",
+		MSG_RESTORE_BED:         "Betttemperatur am Druckende wiederherstellen",
+		MSG_RESTORE_FAN:         "Lüfter am Druckende wiederherstellen",
+		MSG_RESTORE_SPEED:       "Geschwindigkeitsfaktor am Druckende wiederherstellen",
+		MSG_RESTORE_MOTORS:      "Motoren am Druckende abschalten",
+		MSG_LOG_SET_TEMPERATURE: "Hotend-Temperatur auf %d°C ab Schicht %d (Zeile %d, Z=%.2f): %s",
+		MSG_LOG_SET_FAN_SPEED:   "Lüfter auf %d%% ab Schicht %d (Zeile %d, Z=%.2f): %s",
+		MSG_LOG_SET_SPEED:       "Geschwindigkeitsfaktor auf %d%% ab Schicht %d (Zeile %d, Z=%.2f): %s",
+		MSG_MATERIAL_DEFAULTS:   "Standardwerte für %s: Lüfter %d%%, Temperatur %+d°C",
+		MSG_MATERIAL_NO_FAN:     "Standardwerte für %s: Lüfter unverändert, Temperatur %+d°C",
+		MSG_PREHEAT_BED:         "Bett vor dem Druck auf %d°C vorheizen",
+		MSG_PREHEAT_CHAMBER:     "Warten bis der Bauraum %d°C erreicht",
+		MSG_SOAK:                "Durchwärmen, noch %d min",
+		MSG_WIPE:                "Düse an der Bürste abwischen ab Schicht %d",
+		MSG_FEATURE_FAN:         "Lüfter auf %d%% für %s",
+		MSG_RESTORE_FEATURE_FAN: "Lüfter wieder auf %d%% nach %s",
+		MSG_POWER_LOSS_ENABLE:   "Stromausfall-Wiederherstellung einschalten",
+		MSG_POWER_LOSS_SAVE:     "Schicht %d für die Stromausfall-Wiederherstellung speichern",
+		MSG_STANDBY:             "Standby bei %d°C während %s Leerlauf",
+		MSG_STANDBY_REHEAT:      "Vor dem Weiterdrucken auf %d°C aufheizen",
+		MSG_PAUSE_PRIME:         "Nach der Pause %.2fmm Filament vorextrudieren",
+		MSG_NOTIFY:              "Schicht %d erreicht",
+		MSG_NOTIFY_BEEP:         "Signalton bei Schicht %d",
+		MSG_STATUS_ACTIVE:       "Korrektur aktiv: %s",
+		MSG_STATUS_DONE:         "Korrektur beendet: %s",
+		MSG_HEAT_CONCURRENTLY:   "Aufheizen, während die andere Heizung heizt",
+	},
+	"fr": {
+		MSG_SET_TEMPERATURE:     "Température de la buse à %d°C à la couche %d",
+		MSG_SET_FAN_SPEED:       "Ventilateur à %d%% à la couche %d",
+		MSG_SET_SPEED_FACTOR:    "Facteur de vitesse à %d%% à la couche %d",
+		MSG_WAIT_TEMPERATURE:    "Attendre que la buse atteigne %d°C",
+		MSG_INSERTED_NEXT_LINE:  "gcode_modifier: ligne suivante insérée (%s)",
+		MSG_RESTORE_HOTEND:      "Rétablir la température de la buse en fin d'impression",
+		MSG_RESTORE_BED:         "Rétablir la température du plateau en fin d'impression",
+		MSG_RESTORE_FAN:         "Rétablir le ventilateur en fin d'impression",
+		MSG_RESTORE_SPEED:       "Rétablir le facteur de vitesse en fin d'impression",
+		MSG_RESTORE_MOTORS:      "Couper les moteurs en fin d'impression",
+		MSG_LOG_SET_TEMPERATURE: "Température de la buse à %d°C à la couche %d (ligne %d, Z=%.2f) : %s",
+		MSG_LOG_SET_FAN_SPEED:   "Ventilateur à %d%% à la couche %d (ligne %d, Z=%.2f) : %s",
+		MSG_LOG_SET_SPEED:       "Facteur de vitesse à %d%% à la couche %d (ligne %d, Z=%.2f) : %s",
+		MSG_MATERIAL_DEFAULTS:   "Valeurs par défaut pour %s : ventilateur %d%%, température %+d°C",
+		MSG_MATERIAL_NO_FAN:     "Valeurs par défaut pour %s : ventilateur inchangé, température %+d°C",
+		MSG_PREHEAT_BED:         "Préchauffer le plateau à %d°C avant l'impression",
+		MSG_PREHEAT_CHAMBER:     "Attendre que l'enceinte atteigne %d°C",
+		MSG_SOAK:                "Stabilisation thermique, encore %d min",
+		MSG_WIPE:                "Essuyer la buse sur la brosse à la couche %d",
+		MSG_FEATURE_FAN:         "Ventilateur à %d%% pour %s",
+		MSG_RESTORE_FEATURE_FAN: "Rétablir le ventilateur à %d%% après %s",
+		MSG_POWER_LOSS_ENABLE:   "Activer la reprise après coupure de courant",
+		MSG_POWER_LOSS_SAVE:     "Enregistrer la couche %d pour la reprise après coupure de courant",
+		MSG_STANDBY:             "Veille à %d°C pendant %s d'inactivité",
+		MSG_STANDBY_REHEAT:      "Réchauffer à %d°C avant la reprise de l'impression",
+		MSG_PAUSE_PRIME:         "Amorcer %.2fmm de filament après la pause",
+		MSG_NOTIFY:              "Couche %d atteinte",
+		MSG_NOTIFY_BEEP:         "Bip à la couche %d",
+		MSG_STATUS_ACTIVE:       "Correction active : %s",
+		MSG_STATUS_DONE:         "Correction terminée : %s",
+		MSG_HEAT_CONCURRENTLY:   "Chauffer pendant que l'autre élément chauffe",
+	},
+	"es": {
+		MSG_SET_TEMPERATURE:     "Temperatura del hotend a %d°C en la capa %d",
+		MSG_SET_FAN_SPEED:       "Ventilador al %d%% en la capa %d",
+		MSG_SET_SPEED_FACTOR:    "Factor de velocidad al %d%% en la capa %d",
+		MSG_WAIT_TEMPERATURE:    "Esperar a que el hotend alcance %d°C",
+		MSG_INSERTED_NEXT_LINE:  "gcode_modifier: línea siguiente insertada (%s)",
+		MSG_RESTORE_HOTEND:      "Restaurar la temperatura del hotend al final",
+		MSG_RESTORE_BED:         "Restaurar la temperatura de la cama al final",
+		MSG_RESTORE_FAN:         "Restaurar el ventilador al final",
+		MSG_RESTORE_SPEED:       "Restaurar el factor de velocidad al final",
+		MSG_RESTORE_MOTORS:      "Apagar los motores al final",
+		MSG_LOG_SET_TEMPERATURE: "Temperatura del hotend a %d°C en la capa %d (línea %d, Z=%.2f): %s",
+		MSG_LOG_SET_FAN_SPEED:   "Ventilador al %d%% en la capa %d (línea %d, Z=%.2f): %s",
+		MSG_LOG_SET_SPEED:       "Factor de velocidad al %d%% en la capa %d (línea %d, Z=%.2f): %s",
+		MSG_MATERIAL_DEFAULTS:   "Valores predeterminados para %s: ventilador %d%%, temperatura %+d°C",
+		MSG_MATERIAL_NO_FAN:     "Valores predeterminados para %s: ventilador sin cambios, temperatura %+d°C",
+		MSG_PREHEAT_BED:         "Precalentar la cama a %d°C antes de imprimir",
+		MSG_PREHEAT_CHAMBER:     "Esperar a que la cámara alcance %d°C",
+		MSG_SOAK:                "Estabilización térmica, quedan %d min",
+		MSG_WIPE:                "Limpiar la boquilla en el cepillo en la capa %d",
+		MSG_FEATURE_FAN:         "Ventilador al %d%% para %s",
+		MSG_RESTORE_FEATURE_FAN: "Restaurar el ventilador al %d%% después de %s",
+		MSG_POWER_LOSS_ENABLE:   "Activar la recuperación tras un corte de luz",
+		MSG_POWER_LOSS_SAVE:     "Guardar la capa %d para la recuperación tras un corte de luz",
+		MSG_STANDBY:             "Espera a %d°C durante %s de inactividad",
+		MSG_STANDBY_REHEAT:      "Recalentar a %d°C antes de reanudar la impresión",
+		MSG_PAUSE_PRIME:         "Purgar %.2fmm de filamento tras la pausa",
+		MSG_NOTIFY:              "Capa %d alcanzada",
+		MSG_NOTIFY_BEEP:         "Pitido en la capa %d",
+		MSG_STATUS_ACTIVE:       "Corrección activa: %s",
+		MSG_STATUS_DONE:         "Corrección terminada: %s",
+		MSG_HEAT_CONCURRENTLY:   "Calentar mientras se calienta el otro calefactor",
+	},
+}
+
+var lang = DEFAULT_LANG // -lang
+var noComments bool     // -no-comments, insert bare commands without comments, annotations or the processing log
+var activeCatalog = builtinCatalogs[DEFAULT_LANG]
+
+var formatVerbRegexp = regexp.MustCompile(`%[-+# 0]*\d*(?:\.\d+)?[a-zA-Z%]`)
+
+// getLocalesDir returns the directory holding user message catalogs (<lang>.json)
+func getLocalesDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, LOCALES_DIR_NAME)
+}
+
+// loadCatalog returns the messages for a language: a user catalog from the locales directory
+// overrides the built-in one, and messages missing from either are taken from English. A message
+// whose format verbs don't match the English one is ignored, since it would garble the output.
+func loadCatalog(name string) (map[string]string, error) {
+	catalog := make(map[string]string)
+	for id, format := range builtinCatalogs[DEFAULT_LANG] {
+		catalog[id] = format
+	}
+	builtin, found := builtinCatalogs[name]
+	for id, format := range builtin {
+		catalog[id] = format
+	}
+
+	if dir := getLocalesDir(); dir != "" {
+		data, err := os.ReadFile(filepath.Join(dir, name+".json"))
+		if err == nil {
+			user := make(map[string]string)
+			if err := json.Unmarshal(data, &user); err != nil {
+				return nil, fmt.Errorf("parsing message catalog '%s': %v", name, err)
+			}
+			for id, format := range user {
+				english, ok := builtinCatalogs[DEFAULT_LANG][id]
+				if !ok {
+					fmt.Printf("Warning: unknown message '%s' in catalog '%s'\n", id, name)
+					continue
+				}
+				if !slices.Equal(formatVerbRegexp.FindAllString(format, -1), formatVerbRegexp.FindAllString(english, -1)) {
+					fmt.Printf("Warning: message '%s' in catalog '%s' must use the verbs of \"%s\", ignoring it\n", id, name, english)
+					continue
+				}
+				catalog[id] = format
+			}
+			found = true
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("unknown language '%s' (built in: %s)", name, strings.Join(getBuiltinLangs(), ", "))
+	}
+	return catalog, nil
+}
+
+// getBuiltinLangs returns the languages with a built-in catalog, sorted
+func getBuiltinLangs() []string {
+	langs := []string{}
+	for name := range builtinCatalogs {
+		langs = append(langs, name)
+	}
+	slices.Sort(langs)
+	return langs
+}
+
+// msg formats a message in the active language
+func msg(id string, args ...any) string {
+	return fmt.Sprintf(activeCatalog[id], args...)
+}
+
+// withComment appends a comment to an inserted command, unless comments are turned off
+func withComment(command string, comment string) string {
+	if noComments {
+		return command
+	}
+	return command + COMMENT_SEPARATOR + comment
+}
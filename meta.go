@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// headerFieldRegexp matches the metadata fields of file headers, in every slicer's format:
+// "; title = Bracket" (PrusaSlicer, Bambu Studio/OrcaSlicer), ";TITLE:Bracket" (Cura, ideaMaker)
+// and ";   title,Bracket" (Simplify3D)
+var headerFieldRegexp = regexp.MustCompile(`^(;\s*)([A-Za-z][A-Za-z0-9_. ]*?)(\s*[=:,]\s*)(.*)$`)
+
+// metaKeyRegexp matches the keys of fields that meta set adds
+var metaKeyRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.]*$`)
+
+// metaFlags are the flags of the meta command
+type metaFlags struct {
+	inputFilePath *string
+	overwrite     *bool
+	title         *string
+	author        *string
+}
+
+// defineMetaFlags defines the flags of the meta command on a flag set
+func defineMetaFlags(fs *flag.FlagSet) metaFlags {
+	var flags metaFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	flags.overwrite = fs.Bool("o", false, "Overwrite the input file instead of writing <name>_meta.gcode (Default=false)")
+	flags.title = fs.String("title", "", "Title of the job, the same as title=...")
+	flags.author = fs.String("author", "", "Author of the job, the same as author=...")
+	return flags
+}
+
+// headerField is a metadata field of a file header
+type headerField struct {
+	Index int // Of the line
+	Key   string
+	Value string
+}
+
+// getHeaderEnd returns the index of the first command, before which the header's comments are
+func getHeaderEnd(lines []string) int {
+	for i, line := range lines {
+		if _, ok := parseCommand(line); ok {
+			return i
+		}
+	}
+	return len(lines)
+}
+
+// getHeaderFields returns the metadata fields of the header
+func getHeaderFields(lines []string) []headerField {
+	fields := []headerField{}
+	for i, line := range lines[:getHeaderEnd(lines)] {
+		if m := headerFieldRegexp.FindStringSubmatch(line); m != nil {
+			fields = append(fields, headerField{Index: i, Key: m[2], Value: m[4]})
+		}
+	}
+	return fields
+}
+
+// normalizeFieldKey returns a field's key as compared between formats: "Print Time",
+// "print_time" and "PRINT.TIME" are the same key
+func normalizeFieldKey(key string) string {
+	return strings.NewReplacer(" ", "_", ".", "_", "-", "_").Replace(strings.ToLower(key))
+}
+
+// formatHeaderField returns a new header line for a field in the format of the slicer that wrote
+// the file
+func formatHeaderField(dialect slicerDialect, key, value string) string {
+	switch dialect.Name {
+	case "Cura", "ideaMaker":
+		return fmt.Sprintf(";%s:%s", strings.ToUpper(key), value)
+	case "Simplify3D":
+		return fmt.Sprintf(";   %s,%s", key, value)
+	}
+	return fmt.Sprintf("; %s = %s", key, value)
+}
+
+// setHeaderFields returns the lines with the header's metadata fields set to the values. An
+// existing field keeps its line and format, with only its value replaced; fields the header
+// doesn't have are added after its first line (inside Bambu's header block), in the format of the
+// file's slicer.
+func setHeaderFields(lines []string, keys []string, values map[string]string) []string {
+	dialect := detectDialect(lines)
+	fields := getHeaderFields(lines)
+	updated := append([]string{}, lines...)
+	added := []string{}
+	for _, key := range keys {
+		found := false
+		for _, field := range fields {
+			if normalizeFieldKey(field.Key) != normalizeFieldKey(key) {
+				continue
+			}
+			m := headerFieldRegexp.FindStringSubmatch(lines[field.Index])
+			updated[field.Index] = m[1] + m[2] + m[3] + values[key]
+			fmt.Printf("Set %s: %s (was %s)\n", field.Key, values[key], field.Value)
+			found = true
+		}
+		if !found {
+			added = append(added, formatHeaderField(dialect, key, values[key]))
+			fmt.Printf("Added %s: %s\n", key, values[key])
+		}
+	}
+	if len(added) == 0 {
+		return updated
+	}
+	at := 0
+	if len(lines) > 0 && strings.HasPrefix(lines[0], ";") {
+		at = 1
+	}
+	return append(updated[:at], append(added, updated[at:]...)...)
+}
+
+// runMetaCommand implements "meta": it shows the header metadata fields of a G-code file, or
+// writes a copy with fields set
+func runMetaCommand(args []string) {
+	fs := flag.NewFlagSet("meta", flag.ExitOnError)
+	flags := defineMetaFlags(fs)
+	setCommandUsage(fs, "meta")
+	// Flags may come after the fields, as in "meta set title=Bracket -author Jane -f example.gcode"
+	positional := []string{}
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) == 0 || *flags.inputFilePath == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	lines, crlf, err := readLines(*flags.inputFilePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+	switch positional[0] {
+	case "show":
+		for _, field := range getHeaderFields(lines) {
+			fmt.Printf("%s: %s\n", field.Key, field.Value)
+		}
+		return
+	case "set":
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	keys := []string{}
+	values := make(map[string]string)
+	setField := func(key, value string) {
+		if strings.ContainsAny(value, "\r\n") {
+			fmt.Printf("Error: the value of %s can't span lines\n", key)
+			os.Exit(1)
+		}
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+	for _, assignment := range positional[1:] {
+		key, value, ok := strings.Cut(assignment, "=")
+		if !ok || !metaKeyRegexp.MatchString(key) {
+			fmt.Printf("Error: invalid field '%s' (use key=value, e.g. title=\"Bracket v3\")\n", assignment)
+			os.Exit(1)
+		}
+		setField(key, value)
+	}
+	if *flags.title != "" {
+		setField("title", *flags.title)
+	}
+	if *flags.author != "" {
+		setField("author", *flags.author)
+	}
+	if len(keys) == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	lines = setHeaderFields(lines, keys, values)
+
+	outputFilePath := getDerivedFilePath(*flags.inputFilePath, "_meta")
+	if *flags.overwrite && isZipFile(*flags.inputFilePath) {
+		fmt.Println("Error: -o can't overwrite a zip archive with G-code; leave it out to write <name>_meta.gcode")
+		os.Exit(1)
+	}
+	if *flags.overwrite {
+		outputFilePath = *flags.inputFilePath
+	}
+	if err := writeLines(outputFilePath, lines, crlf); err != nil {
+		fmt.Printf("Error creating output file: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("New file saved as %s.\n", outputFilePath)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+var analyzeOnly bool // -analyze-only, report detections without writing outputs
+
+// readLinesMapped maps a G-code file into memory and returns its lines without copying them.
+// The lines point into the mapping, so they (and any substring of them) must not be used after
+// calling the returned unmap function; use strings.Clone for anything kept longer. Compressed
+// files are read into memory instead.
+func readLinesMapped(filePath string) ([]string, func() error, error) {
+	if isZipFile(filePath) {
+		lines, _, err := readLines(filePath)
+		return lines, func() error { return nil }, err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 {
+		return nil, func() error { return nil }, nil
+	}
+	data, unmap, err := mapFile(file, int(info.Size()))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		unmap()
+		lines, _, err := readLines(filePath)
+		return lines, func() error { return nil }, err
+	}
+	return splitLines(data), unmap, nil
+}
+
+// splitLines splits data into lines without their line endings, as strings sharing data's
+// memory
+func splitLines(data []byte) []string {
+	lines := make([]string, 0, len(data)/32)
+	for start := 0; start < len(data); {
+		end := start
+		for end < len(data) && data[end] != '\n' {
+			end++
+		}
+		next := end + 1
+		if end > start && data[end-1] == '\r' {
+			end--
+		}
+		if end > start {
+			lines = append(lines, unsafe.String(&data[start], end-start))
+		} else {
+			lines = append(lines, "")
+		}
+		start = next
+	}
+	return lines
+}
+
+// clonePlan returns a copy of the plan whose strings don't share memory with the analyzed lines
+func clonePlan(plan Plan) Plan {
+	plan.File = strings.Clone(plan.File)
+	plan.Preset = strings.Clone(plan.Preset)
+	plan.Dialect = strings.Clone(plan.Dialect)
+	plan.Material = strings.Clone(plan.Material)
+	plan.Detections = append([]Detection{}, plan.Detections...)
+	for i := range plan.Detections {
+		plan.Detections[i].Detector = strings.Clone(plan.Detections[i].Detector)
+		plan.Detections[i].Details = strings.Clone(plan.Detections[i].Details)
+	}
+	plan.Modifications = append([]modification{}, plan.Modifications...)
+	for i := range plan.Modifications {
+		plan.Modifications[i].Kind = strings.Clone(plan.Modifications[i].Kind)
+		plan.Modifications[i].Reason = strings.Clone(plan.Modifications[i].Reason)
+	}
+	return plan
+}
+
+// analyzeFile analyzes a G-code file through a memory mapping, without writing an output, and
+// records its plan for -plan-out and the comparison report
+func analyzeFile(ctx context.Context, filePath string) {
+	if filePath == STDIN_PATH {
+		analyzeStream(ctx, os.Stdin, "stdin")
+		return
+	}
+	fmt.Printf("Analyzing '%s'\n", filePath)
+	lines, unmap, err := readLinesMapped(filePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+	defer unmap()
+
+	checkPrinterModel(filePath, lines)
+	checkLoadedMaterial(filePath, lines)
+	checkMachineLimits(filePath, lines)
+	plan, err := AnalyzeLines(ctx, filePath, lines)
+	if err != nil {
+		fmt.Printf("Stopped analyzing '%s': %v\n", filePath, err)
+		return
+	}
+	exportedPlans = append(exportedPlans, clonePlan(plan))
+	addBatchEntry(lines, plan, lines)
+	sendWebhooks(webhookEvent{Event: EVENT_ANALYZED, File: filePath, Plans: exportedPlans[len(exportedPlans)-1:]})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	MOD_FAN_SPEED   = "fan"
+	MOD_TEMPERATURE = "temperature"
+)
+
+// modification is a single command to insert at the start of a layer, or at the end of the print
+// when Layer is the layer count
+type modification struct {
+	Layer  int    `json:"layer"` // 0-based layer the command is inserted at, or the layer count
+	Kind   string `json:"kind"`  // MOD_FAN_SPEED, MOD_TEMPERATURE or MOD_SPEED_FACTOR
+	Value  int    `json:"value"` // Fan speed percent, temperature in °C or speed percent
+	Reason string `json:"reason"`
+}
+
+func (m modification) String() string {
+	switch m.Kind {
+	case MOD_FAN_SPEED:
+		return fmt.Sprintf("set fan speed to %d%% at layer %d", m.Value, displayLayer(m.Layer))
+	case MOD_SPEED_FACTOR:
+		return fmt.Sprintf("set speed factor to %d%% at layer %d", m.Value, displayLayer(m.Layer))
+	}
+	return fmt.Sprintf("set hotend temperature to %d°C at layer %d", m.Value, displayLayer(m.Layer))
+}
+
+// planModifications returns the active preset's fan and temperature changes for the problematic
+// layers, raising the temperature to the -calibration temperature of a layer when there is one
+func (a *Analysis) planModifications(probLayers []int, defaultTemp int, maxFanSpeed int) []modification {
+	modifications := []modification{}
+	for _, layer := range probLayers {
+		// Decrease the fan speed & increase the temp for the layer below
+		reason := fmt.Sprintf("problematic layer %d", displayLayer(layer))
+		startLayer := layer - a.preset.LayersBefore
+		if !a.preset.SkipFan {
+			modifications = append(modifications,
+				modification{Layer: startLayer, Kind: MOD_FAN_SPEED, Value: a.preset.FanSpeedPct, Reason: reason})
+		}
+		temperature := defaultTemp + a.preset.TempIncrease
+		if calibrated, ok := a.calibratedTemps[layer]; ok {
+			temperature = calibrated
+		}
+		modifications = append(modifications,
+			modification{Layer: startLayer, Kind: MOD_TEMPERATURE, Value: temperature, Reason: reason})
+
+		// Reset the fan speed & temp for the layer above
+		reason = RESET_REASON_PREFIX + fmt.Sprintf("problematic layer %d", displayLayer(layer))
+		resetLayer := layer + a.preset.LayersAfter
+		if !a.preset.SkipFan {
+			modifications = append(modifications,
+				modification{Layer: resetLayer, Kind: MOD_FAN_SPEED, Value: maxFanSpeed, Reason: reason})
+		}
+		modifications = append(modifications,
+			modification{Layer: resetLayer, Kind: MOD_TEMPERATURE, Value: defaultTemp, Reason: reason})
+	}
+	return modifications
+}
+
+// applyModification inserts the command for a modification into the lines
+func (a *Analysis) applyModification(lines []string, mod modification) []string {
+	return a.insertModifications(lines, []modification{mod})
+}
+
+// getModificationLines returns the lines inserted for a modification
+func (a *Analysis) getModificationLines(mod modification) []string {
+	switch mod.Kind {
+	case MOD_FAN_SPEED:
+		return a.getFanSpeedLines(mod.Layer, mod.Value, mod.Reason)
+	case MOD_SPEED_FACTOR:
+		return a.getSpeedFactorLines(mod.Layer, mod.Value, mod.Reason)
+	}
+	return a.getTemperatureLines(mod.Layer, mod.Value, mod.Reason)
+}
+
+// insertModifications inserts the lines for all modifications in one pass, each right after its
+// layer's change comment. Modifications at the same layer keep their order, so a reset moved onto
+// the layer of the change it undoes still follows it. With -status-messages, each layer's changes
+// are announced once per reason, and with -pause-prime, the nozzle is primed after the -guard
+// waits for a temperature change. Modifications at the layer count follow the last printing move,
+// before the end sequence.
+func (a *Analysis) insertModifications(lines []string, modifications []modification) []string {
+	byLayer := make(map[int][]modification)
+	for _, mod := range modifications {
+		byLayer[mod.Layer] = append(byLayer[mod.Layer], mod)
+	}
+
+	var state machineState
+	layerCount := 0
+	getLines := func(layer int) []string {
+		inserted := []string{}
+		announced := make(map[string]bool)
+		for _, mod := range byLayer[layer] {
+			if !announced[mod.Reason] {
+				announced[mod.Reason] = true
+				inserted = append(inserted, getStatusLines(mod.Reason)...)
+			}
+		}
+		guarded := false
+		for _, mod := range byLayer[layer] {
+			inserted = append(inserted, a.getModificationLines(mod)...)
+			guarded = guarded || (mod.Kind == MOD_TEMPERATURE && guardTemps)
+		}
+		if guarded {
+			inserted = append(inserted, a.getPrimeLines(state)...)
+		}
+		return inserted
+	}
+	modifiedLines := a.insertAtLayerStarts(lines, func(line string) { state.update(line) }, func(layer int) []string {
+		layerCount = layer + 1
+		return getLines(layer)
+	})
+	if len(byLayer[layerCount]) == 0 {
+		return modifiedLines
+	}
+	end := getPrintEnd(modifiedLines)
+	return append(append(append([]string{}, modifiedLines[:end]...), getLines(layerCount)...), modifiedLines[end:]...)
+}
+
+// getPrintEnd returns the index of the line after the last extruding move, where the end sequence
+// starts, or the number of lines when nothing extrudes
+func getPrintEnd(lines []string) int {
+	var state machineState
+	end := len(lines)
+	for i, line := range lines {
+		e := state.E
+		state.update(line)
+		if command, ok := parseCommand(line); ok && (command.Name == "G0" || command.Name == "G1") && state.E > e {
+			end = i + 1
+		}
+	}
+	return end
+}
+
+// clampModifications drops temperature changes when the file has no nozzle temperature metadata
+// (they would be relative to 0°C), keeps temperatures between minTemp (or the file's own
+// temperature, if lower) and maxTemp, keeps fan speeds in 0-100% and moves modifications
+// targeting layers before the first layer onto it and those past the end of the print to the end,
+// so a reset past the end of the print is still emitted
+func clampModifications(modifications []modification, defaultTemp int, minTemp int, maxTemp int, layerCount int) []modification {
+	clamped := []modification{}
+	warnedNoTemp := false
+	for _, mod := range modifications {
+		if layerCount == 0 {
+			fmt.Printf("Warning: no layers found, skipping %s\n", mod)
+			continue
+		}
+		if mod.Layer < 0 {
+			fmt.Printf("Warning: %s is outside the file, moving it to layer %d\n", mod, displayLayer(0))
+			mod.Layer = 0
+		} else if mod.Layer > layerCount {
+			fmt.Printf("Warning: %s is outside the file, moving it to the end of the print\n", mod)
+			mod.Layer = layerCount
+		}
+
+		switch mod.Kind {
+		case MOD_TEMPERATURE:
+			if defaultTemp <= 0 {
+				if !warnedNoTemp {
+					fmt.Println("Warning: no '; nozzle_temperature' metadata found, skipping temperature changes")
+					warnedNoTemp = true
+				}
+				continue
+			}
+			if mod.Value > maxTemp {
+				fmt.Printf("Warning: clamping %s to the %d°C maximum\n", mod, maxTemp)
+				mod.Value = maxTemp
+			}
+			// A file printed colder than the material's minimum may still go back to its own temperature
+			if floor := min(minTemp, defaultTemp); mod.Value < floor {
+				fmt.Printf("Warning: clamping %s to the %d°C minimum\n", mod, floor)
+				mod.Value = floor
+			}
+		case MOD_FAN_SPEED:
+			if mod.Value < 0 || mod.Value > 100 {
+				fmt.Printf("Warning: clamping %s to 0-100%%\n", mod)
+				mod.Value = max(0, min(mod.Value, 100))
+			}
+		}
+		clamped = append(clamped, mod)
+	}
+	return clamped
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const MOONRAKER_READ_SIZE = 512 * 1024 // Bytes of the start and of the end of a file Moonraker parses
+
+var verifyMoonraker bool // Check that outputs keep the metadata Moonraker extracts from the input
+
+// moonrakerSlicer is a slicer Moonraker's metadata extractor recognizes, with the patterns of the
+// metadata fields it reads from the files of that slicer; the first pattern that matches wins
+type moonrakerSlicer struct {
+	Name     string
+	Identity *regexp.Regexp // Matches the slicer's version in the first lines
+	Fields   map[string][]*regexp.Regexp
+}
+
+var (
+	prusaSlicerFields = map[string][]*regexp.Regexp{
+		"estimated_time":        {regexp.MustCompile(`(?m)^; estimated printing time \(normal mode\) = (.+)$`), regexp.MustCompile(`total estimated time: ([0-9dhms ]+[0-9dhms])`)},
+		"layer_height":          {regexp.MustCompile(`(?m)^; layer_height = (\d+\.?\d*)`)},
+		"first_layer_height":    {regexp.MustCompile(`(?m)^; first_layer_height = (\d+\.?\d*)`), regexp.MustCompile(`(?m)^; initial_layer_print_height = (\d+\.?\d*)`)},
+		"object_height":         {regexp.MustCompile(`(?m)^; max_layer_z = (\d+\.?\d*)`), regexp.MustCompile(`(?m)^; max_z_height: (\d+\.?\d*)`)},
+		"first_layer_extr_temp": {regexp.MustCompile(`(?m)^; first_layer_temperature = (\d+\.?\d*)`), regexp.MustCompile(`(?m)^; nozzle_temperature_initial_layer = (\d+\.?\d*)`)},
+		"first_layer_bed_temp":  {regexp.MustCompile(`(?m)^; first_layer_bed_temperature = (\d+\.?\d*)`), regexp.MustCompile(`(?m)^; hot_plate_temp_initial_layer = (\d+\.?\d*)`)},
+		"nozzle_diameter":       {regexp.MustCompile(`(?m)^; nozzle_diameter = (\d+\.?\d*)`)},
+		"filament_type":         {regexp.MustCompile(`(?m)^; filament_type = (.+)$`)},
+		"filament_total":        {regexp.MustCompile(`(?m)^; filament used \[mm\] = (\d+\.?\d*)`), regexp.MustCompile(`(?m)^; total filament length \[mm\] : (\d+\.?\d*)`)},
+		"layer_count":           {regexp.MustCompile(`(?m)^; total layers count = (\d+)`), regexp.MustCompile(`(?m)^; total layer number: (\d+)`)},
+	}
+
+	// moonrakerSlicers are tried in order; OrcaSlicer and Bambu Studio files are read like
+	// PrusaSlicer's, from which they derive
+	moonrakerSlicers = []moonrakerSlicer{
+		{Name: "PrusaSlicer", Identity: regexp.MustCompile(`(?:PrusaSlicer|SuperSlicer)\s(\S+)`), Fields: prusaSlicerFields},
+		{Name: "OrcaSlicer", Identity: regexp.MustCompile(`(?:OrcaSlicer|BambuStudio)\s(\S+)`), Fields: prusaSlicerFields},
+		{Name: "Cura", Identity: regexp.MustCompile(`Cura_SteamEngine\s(\S+)`), Fields: map[string][]*regexp.Regexp{
+			"estimated_time":        {regexp.MustCompile(`(?m)^;TIME:(\d+\.?\d*)`)},
+			"layer_height":          {regexp.MustCompile(`(?m)^;Layer height: (\d+\.?\d*)`)},
+			"object_height":         {regexp.MustCompile(`(?m)^;MAXZ:(\d+\.?\d*)`)},
+			"first_layer_extr_temp": {regexp.MustCompile(`(?m)^M109 S(\d+\.?\d*)`)},
+			"first_layer_bed_temp":  {regexp.MustCompile(`(?m)^M190 S(\d+\.?\d*)`)},
+			"filament_total":        {regexp.MustCompile(`(?m)^;Filament used: (\d+\.?\d*)m`)},
+			"layer_count":           {regexp.MustCompile(`(?m)^;LAYER_COUNT:(\d+)`)},
+		}},
+		{Name: "Simplify3D", Identity: regexp.MustCompile(`Simplify3D\(R\) Version (\S+)`), Fields: map[string][]*regexp.Regexp{
+			"estimated_time":        {regexp.MustCompile(`(?m)^;\s+Build time: (.+)$`)},
+			"layer_height":          {regexp.MustCompile(`(?m)^;\s+layerHeight,(\d+\.?\d*)`)},
+			"first_layer_extr_temp": {regexp.MustCompile(`(?m)^M109 S(\d+\.?\d*)`)},
+			"first_layer_bed_temp":  {regexp.MustCompile(`(?m)^M190 S(\d+\.?\d*)`)},
+			"filament_total":        {regexp.MustCompile(`(?m)^;\s+Filament length: (\d+\.?\d*)`)},
+		}},
+	}
+
+	thumbnailBeginRegexp = regexp.MustCompile(`^;\s*thumbnail(?:_(?:PNG|JPG|QOI))?\s+begin\s+(\d+)x(\d+)\s+(\d+)`)
+	thumbnailEndRegexp   = regexp.MustCompile(`^;\s*thumbnail(?:_(?:PNG|JPG|QOI))?\s+end`)
+)
+
+// moonrakerThumbnail is an embedded thumbnail as Moonraker extracts it
+type moonrakerThumbnail struct {
+	Width, Height int
+	Size          int  // Length of the base64 data as declared
+	Valid         bool // The data has the declared length and decodes
+}
+
+// moonrakerMetadata is the metadata Moonraker extracts from a file
+type moonrakerMetadata struct {
+	Slicer     string // "" when Moonraker wouldn't recognize the slicer
+	Version    string
+	Fields     map[string]string
+	Thumbnails []moonrakerThumbnail
+}
+
+// getMoonrakerWindows returns the start and the end of the lines that Moonraker reads, up to
+// MOONRAKER_READ_SIZE bytes each
+func getMoonrakerWindows(lines []string) (header []string, footer []string) {
+	size := 0
+	for i := 0; i < len(lines) && size < MOONRAKER_READ_SIZE; i++ {
+		header = lines[:i+1]
+		size += len(lines[i]) + 1
+	}
+	size = 0
+	for i := len(lines) - 1; i >= 0 && size < MOONRAKER_READ_SIZE; i-- {
+		footer = lines[i:]
+		size += len(lines[i]) + 1
+	}
+	return header, footer
+}
+
+// getThumbnails returns the thumbnails embedded in the lines
+func getThumbnails(lines []string) []moonrakerThumbnail {
+	thumbnails := []moonrakerThumbnail{}
+	var current *moonrakerThumbnail
+	var data strings.Builder
+	for _, line := range lines {
+		if m := thumbnailBeginRegexp.FindStringSubmatch(line); m != nil {
+			width, _ := strconv.Atoi(m[1])
+			height, _ := strconv.Atoi(m[2])
+			size, _ := strconv.Atoi(m[3])
+			current = &moonrakerThumbnail{Width: width, Height: height, Size: size}
+			data.Reset()
+			continue
+		}
+		if current == nil {
+			continue
+		}
+		if thumbnailEndRegexp.MatchString(line) {
+			_, err := base64.StdEncoding.DecodeString(data.String())
+			current.Valid = err == nil && data.Len() == current.Size
+			thumbnails = append(thumbnails, *current)
+			current = nil
+			continue
+		}
+		data.WriteString(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), ";")))
+	}
+	return thumbnails
+}
+
+// getMoonrakerMetadata extracts the metadata of the lines the way Moonraker does: the slicer from
+// the first lines, the fields from the start and the end of the file, and the thumbnails
+func getMoonrakerMetadata(lines []string) moonrakerMetadata {
+	header, footer := getMoonrakerWindows(lines)
+	metadata := moonrakerMetadata{Fields: make(map[string]string), Thumbnails: getThumbnails(header)}
+	identity := strings.Join(header[:min(len(header), 20)], "\n")
+	text := strings.Join(header, "\n") + "\n" + strings.Join(footer, "\n")
+	for _, slicer := range moonrakerSlicers {
+		m := slicer.Identity.FindStringSubmatch(identity)
+		if m == nil {
+			continue
+		}
+		metadata.Slicer, metadata.Version = slicer.Name, m[1]
+		for field, patterns := range slicer.Fields {
+			for _, pattern := range patterns {
+				if m := pattern.FindStringSubmatch(text); m != nil {
+					metadata.Fields[field] = strings.TrimSpace(m[1])
+					break
+				}
+			}
+		}
+		break
+	}
+	return metadata
+}
+
+// parseEstimateSeconds parses an estimated time such as "1d 2h 3m 4s", "1 hours 2 minutes" or a
+// number of seconds
+func parseEstimateSeconds(estimate string) (float64, bool) {
+	if seconds, err := strconv.ParseFloat(estimate, 64); err == nil {
+		return seconds, true
+	}
+	units := map[byte]float64{'d': 86400, 'h': 3600, 'm': 60, 's': 1}
+	total, found := 0.0, false
+	fields := strings.Fields(estimate)
+	for i := 0; i < len(fields); i++ {
+		number := strings.TrimRight(fields[i], "abcdefghijklmnopqrstuvwxyz")
+		unit := fields[i][len(number):]
+		if unit == "" && i+1 < len(fields) {
+			i++
+			unit = fields[i]
+		}
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil || unit == "" {
+			return 0, false
+		}
+		factor, ok := units[unit[0]]
+		if !ok {
+			return 0, false
+		}
+		total += value * factor
+		found = true
+	}
+	return total, found
+}
+
+// checkMoonrakerMetadata returns the problems Moonraker would have with the metadata of the
+// modified lines that it extracted fine from the original ones (a slicer no longer recognized,
+// fields lost or unparseable, thumbnails lost or corrupted), and the fields whose values changed
+func checkMoonrakerMetadata(original, modified moonrakerMetadata) (problems []string, changes []string) {
+	if modified.Slicer != original.Slicer {
+		problems = append(problems, fmt.Sprintf("slicer %s %s no longer recognized", original.Slicer, original.Version))
+	}
+	fields := []string{}
+	for field := range original.Fields {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	for _, field := range fields {
+		value, ok := modified.Fields[field]
+		if _, parses := parseEstimateSeconds(value); field == "estimated_time" && ok && !parses {
+			problems = append(problems, fmt.Sprintf("estimated_time '%s' can't be parsed", value))
+			continue
+		}
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s (%s) no longer found", field, original.Fields[field]))
+		case value != original.Fields[field]:
+			changes = append(changes, fmt.Sprintf("%s %s (was %s)", field, value, original.Fields[field]))
+		}
+	}
+	if len(modified.Thumbnails) < len(original.Thumbnails) {
+		problems = append(problems, fmt.Sprintf("%d of %d thumbnails no longer found", len(original.Thumbnails)-len(modified.Thumbnails), len(original.Thumbnails)))
+	}
+	for i, thumbnail := range modified.Thumbnails {
+		if !thumbnail.Valid && (i >= len(original.Thumbnails) || original.Thumbnails[i].Valid) {
+			problems = append(problems, fmt.Sprintf("thumbnail %dx%d is corrupted", thumbnail.Width, thumbnail.Height))
+		}
+	}
+	return problems, changes
+}
+
+// verifyMoonrakerMetadata checks that Moonraker still extracts from the modified lines the
+// metadata it extracts from the original ones, and returns an error listing the problems when
+// it doesn't; fields whose values the modifications changed are reported
+func verifyMoonrakerMetadata(original, modified []string) error {
+	before, after := getMoonrakerMetadata(original), getMoonrakerMetadata(modified)
+	if before.Slicer == "" {
+		fmt.Println("Moonraker metadata: slicer not recognized by Moonraker, nothing to check")
+		return nil
+	}
+	problems, changes := checkMoonrakerMetadata(before, after)
+	if len(problems) > 0 {
+		return fmt.Errorf("Moonraker metadata check failed: %s", strings.Join(problems, "; "))
+	}
+	fmt.Printf("Moonraker metadata: %s %s, %d fields and %d thumbnails intact\n", after.Slicer, after.Version, len(after.Fields), len(after.Thumbnails))
+	if len(changes) > 0 {
+		fmt.Printf("Moonraker metadata changed by the modifications: %s\n", strings.Join(changes, ", "))
+	}
+	return nil
+}
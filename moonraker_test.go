@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// getThumbnailLines returns a thumbnail block with valid base64 data, wrapped the way slicers
+// write it
+func getThumbnailLines(width, height int) []string {
+	data := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("thumbnail pixels ", 20)))
+	lines := []string{fmt.Sprintf("; thumbnail begin %dx%d %d", width, height, len(data))}
+	for len(data) > 0 {
+		n := min(len(data), 78)
+		lines = append(lines, "; "+data[:n])
+		data = data[n:]
+	}
+	return append(lines, "; thumbnail end", ";")
+}
+
+// getSquareLayers returns the moves of layers printing one square each, 100mm a side up to the
+// layer the perimeter drops at and 40mm a side from there, so perimeter-change detection flags it
+func getSquareLayers(count, dropLayer int, layerChange func(layer int, z float64) []string) []string {
+	lines := []string{}
+	for layer := 0; layer < count; layer++ {
+		z := 0.2 * float64(layer+1)
+		side := 100.0
+		if layer >= dropLayer {
+			side = 40
+		}
+		lines = append(lines, layerChange(layer, z)...)
+		lines = append(lines,
+			fmt.Sprintf("G1 Z%.1f F720", z),
+			"G1 X10 Y10 F9000",
+			fmt.Sprintf("G1 X%g Y10 E4 F1800", 10+side),
+			fmt.Sprintf("G1 X%g Y%g E4", 10+side, 10+side),
+			fmt.Sprintf("G1 X10 Y%g E4", 10+side),
+			"G1 X10 Y10 E4",
+		)
+	}
+	return lines
+}
+
+// getPrusaSlicerFixture returns a PrusaSlicer file with the metadata Moonraker reads: a thumbnail,
+// the estimated time, filament and layer count at the end, and the settings block after them
+func getPrusaSlicerFixture() []string {
+	lines := []string{"; generated by PrusaSlicer 2.7.1 on 2024-03-02 at 10:21:45 UTC", ";"}
+	lines = append(lines, getThumbnailLines(16, 16)...)
+	lines = append(lines, getThumbnailLines(220, 124)...)
+	lines = append(lines, "M83", "G90", "M190 S60", "M109 S215")
+	lines = append(lines, getSquareLayers(30, 25, func(layer int, z float64) []string {
+		return []string{";LAYER_CHANGE", fmt.Sprintf(";Z:%.1f", z), ";HEIGHT:0.2"}
+	})...)
+	return append(lines,
+		"M104 S0",
+		"; filament used [mm] = 1436.21",
+		"; estimated printing time (normal mode) = 1h 2m 3s",
+		"; total layers count = 30",
+		"; prusaslicer_config = begin",
+		"; filament_type = PLA",
+		"; first_layer_bed_temperature = 60",
+		"; first_layer_height = 0.2",
+		"; first_layer_temperature = 215",
+		"; layer_height = 0.2",
+		"; max_layer_z = 6",
+		"; nozzle_diameter = 0.4",
+		"; prusaslicer_config = end",
+	)
+}
+
+// getOrcaSlicerFixture returns an OrcaSlicer file with the metadata Moonraker reads: the estimated
+// time and layer count in the header block, a thumbnail and the first-layer temperatures in the
+// config block
+func getOrcaSlicerFixture() []string {
+	lines := []string{
+		"; HEADER_BLOCK_START",
+		"; generated by OrcaSlicer 2.1.1 on 2024-03-02 at 10:21:45",
+		"; model printing time: 58m 12s; total estimated time: 1h 4m 40s",
+		"; total layer number: 30",
+		"; max_z_height: 6.00",
+		"; HEADER_BLOCK_END",
+		"",
+		"; THUMBNAIL_BLOCK_START",
+	}
+	lines = append(lines, getThumbnailLines(300, 300)...)
+	lines = append(lines,
+		"; THUMBNAIL_BLOCK_END",
+		"",
+		"; CONFIG_BLOCK_START",
+		"; filament_type = PETG",
+		"; hot_plate_temp_initial_layer = 70",
+		"; initial_layer_print_height = 0.2",
+		"; layer_height = 0.2",
+		"; nozzle_diameter = 0.4",
+		"; nozzle_temperature_initial_layer = 235",
+		"; CONFIG_BLOCK_END",
+		"M140 S70",
+		"M104 S235",
+		"M83",
+		"G90",
+	)
+	lines = append(lines, getSquareLayers(30, 25, func(layer int, z float64) []string {
+		return []string{"; CHANGE_LAYER", fmt.Sprintf("; Z_HEIGHT: %.1f", z), "; LAYER_HEIGHT: 0.2",
+			fmt.Sprintf("; layer num/total_layer_count: %d/30", layer+1)}
+	})...)
+	return append(lines, "M104 S0", "; total filament length [mm] : 1436.21")
+}
+
+// TestMoonrakerMetadataSurvivesProcessing checks that Moonraker extracts the same thumbnails,
+// first-layer temperatures, estimated time and layer count from modified files as from the
+// originals
+func TestMoonrakerMetadataSurvivesProcessing(t *testing.T) {
+	fixtures := []struct {
+		name   string
+		lines  []string
+		slicer string
+	}{
+		{"prusaslicer.gcode", getPrusaSlicerFixture(), "PrusaSlicer"},
+		{"orcaslicer.gcode", getOrcaSlicerFixture(), "OrcaSlicer"},
+	}
+	checked := []string{"estimated_time", "first_layer_extr_temp", "first_layer_bed_temp", "layer_count"}
+
+	for _, fixture := range fixtures {
+		t.Run(fixture.slicer, func(t *testing.T) {
+			before := getMoonrakerMetadata(fixture.lines)
+			if before.Slicer != fixture.slicer {
+				t.Fatalf("fixture recognized as %q, want %q", before.Slicer, fixture.slicer)
+			}
+			for _, field := range checked {
+				if before.Fields[field] == "" {
+					t.Fatalf("fixture has no %s", field)
+				}
+			}
+
+			plan, err := AnalyzeLines(context.Background(), fixture.name, fixture.lines)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Modifications) == 0 {
+				t.Fatal("no modifications planned, so the output wouldn't differ from the input")
+			}
+			modified, err := ApplyLines(context.Background(), fixture.lines, plan)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			after := getMoonrakerMetadata(modified)
+			if problems, _ := checkMoonrakerMetadata(before, after); len(problems) > 0 {
+				t.Errorf("Moonraker metadata lost: %s", strings.Join(problems, "; "))
+			}
+			for _, field := range checked {
+				if after.Fields[field] != before.Fields[field] {
+					t.Errorf("%s is %q, was %q", field, after.Fields[field], before.Fields[field])
+				}
+			}
+			if len(after.Thumbnails) != len(before.Thumbnails) {
+				t.Fatalf("%d thumbnails, was %d", len(after.Thumbnails), len(before.Thumbnails))
+			}
+			for i, thumbnail := range after.Thumbnails {
+				if !thumbnail.Valid || thumbnail != before.Thumbnails[i] {
+					t.Errorf("thumbnail %d is %+v, was %+v", i, thumbnail, before.Thumbnails[i])
+				}
+			}
+		})
+	}
+}
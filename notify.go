@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	NOTIFY_MAX_LAYERS = 10 // Problematic layers listed in a summary before it is cut short
+
+	// The webhook URLs are bearer secrets, so they can come from the environment instead of the
+	// command line
+	SLACK_WEBHOOK_ENV   = "GCODE_MODIFIER_SLACK_WEBHOOK"
+	DISCORD_WEBHOOK_ENV = "GCODE_MODIFIER_DISCORD_WEBHOOK"
+)
+
+var slackWebhookURL string   // -slack-webhook
+var discordWebhookURL string // -discord-webhook
+
+// getChatWebhookURLs returns -slack-webhook and -discord-webhook, else the URLs in the environment
+func getChatWebhookURLs() (slack, discord string) {
+	slack, discord = slackWebhookURL, discordWebhookURL
+	if slack == "" {
+		slack = os.Getenv(SLACK_WEBHOOK_ENV)
+	}
+	if discord == "" {
+		discord = os.Getenv(DISCORD_WEBHOOK_ENV)
+	}
+	return slack, discord
+}
+
+// getEventSummary returns a one-line summary of an event for chat, e.g.
+// "bracket_v3.gcode: 4 problematic layers (29, 30, 41, 57), modified"
+func getEventSummary(event webhookEvent) string {
+	layers := []int{}
+	for _, plan := range event.Plans {
+		for _, detection := range plan.Detections {
+			if !slices.Contains(layers, detection.Layer) {
+				layers = append(layers, detection.Layer)
+			}
+		}
+	}
+	slices.Sort(layers)
+
+	var summary strings.Builder
+	summary.WriteString(filepath.Base(event.File) + ": ")
+	switch len(layers) {
+	case 0:
+		summary.WriteString("no problematic layers")
+	case 1:
+		summary.WriteString("1 problematic layer")
+	default:
+		fmt.Fprintf(&summary, "%d problematic layers", len(layers))
+	}
+	if len(layers) > 0 {
+		listed := []string{}
+		for _, layer := range displayLayers(layers[:min(len(layers), NOTIFY_MAX_LAYERS)]) {
+			listed = append(listed, fmt.Sprint(layer))
+		}
+		if len(layers) > NOTIFY_MAX_LAYERS {
+			listed = append(listed, "...")
+		}
+		fmt.Fprintf(&summary, " (%s)", strings.Join(listed, ", "))
+	}
+	if event.Event == EVENT_PROCESSED {
+		summary.WriteString(", modified")
+	} else {
+		summary.WriteString(", analyzed")
+	}
+	return summary.String()
+}
+
+// sendChatNotifications posts the summary of an event to the Slack and Discord webhooks
+func sendChatNotifications(event webhookEvent) {
+	summary := getEventSummary(event)
+	slackWebhookURL, discordWebhookURL := getChatWebhookURLs()
+	if slackWebhookURL != "" {
+		body, _ := json.Marshal(map[string]string{"text": summary})
+		if err := postWebhook(slackWebhookURL, body, false); err != nil {
+			fmt.Printf("Warning: Slack notification failed: %v\n", err)
+		}
+	}
+	if discordWebhookURL != "" {
+		body, _ := json.Marshal(map[string]string{"content": summary})
+		if err := postWebhook(discordWebhookURL, body, false); err != nil {
+			fmt.Printf("Warning: Discord notification failed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	OBJECT_CELL_SIZE  = 1.0  // mm, extrusions closer than about this belong to the same object
+	OBJECT_MIN_LENGTH = 10.0 // mm of extrusion, smaller clusters (stray blobs) are left unlabeled
+)
+
+var labelObjectsEnabled bool // -label-objects, label the objects of files without labels
+
+// printObject is a group of extrusions connected in XY, printed as one object
+type printObject struct {
+	ID                     int
+	MinX, MinY, MaxX, MaxY float64
+	Length                 float64 // Extruded XY length in mm
+}
+
+// Name returns the object's name in Klipper labels
+func (o printObject) Name() string {
+	return fmt.Sprintf("object_%d", o.ID)
+}
+
+// usesM486Labels reports whether objects are labeled with M486, which Marlin, RepRapFirmware and
+// Prusa firmware understand, rather than Klipper's EXCLUDE_OBJECT_* (which needs [exclude_object])
+func usesM486Labels() bool {
+	return getFirmware() != FIRMWARE_KLIPPER
+}
+
+// isSkirtFeature reports whether a feature type is a skirt or draft shield, which surrounds the
+// objects without belonging to any of them
+func isSkirtFeature(feature string) bool {
+	return canonicalFeature(feature) == FEATURE_SKIRT
+}
+
+// objectCell is a square of the grid extrusions are rasterized on
+type objectCell struct{ X, Y int }
+
+// getObjectCell returns the grid cell holding a point
+func getObjectCell(x, y float64) objectCell {
+	return objectCell{int(math.Floor(x / OBJECT_CELL_SIZE)), int(math.Floor(y / OBJECT_CELL_SIZE))}
+}
+
+// findExtrusions returns, for every line, the XY segment it extrudes; lines that don't extrude,
+// come before the first layer (purge lines) or print a skirt or wipe tower have ok false
+func (a *Analysis) findExtrusions(lines []string) (segments [][4]float64, ok []bool) {
+	segments = make([][4]float64, len(lines))
+	ok = make([]bool, len(lines))
+	var state machineState
+	started, excluded := false, false
+	for i, line := range lines {
+		if a.detectLayerChange(line) {
+			started = true
+		} else if feature, found := getFeatureName(line); found {
+			excluded = isSkirtFeature(feature) || isWipeTowerFeature(feature)
+		}
+		previous := state
+		state.update(line)
+		fields := strings.Fields(stripComment(line))
+		if !started || excluded || len(fields) == 0 || fields[0] != "G1" || !previous.hasPosition {
+			continue
+		}
+		if state.E > previous.E && (state.X != previous.X || state.Y != previous.Y) {
+			segments[i] = [4]float64{previous.X, previous.Y, state.X, state.Y}
+			ok[i] = true
+		}
+	}
+	return segments, ok
+}
+
+// findObjects groups the extrusions into objects: cells of a grid touched by extrusions are
+// joined with their 8 neighbours, so extrusions less than about OBJECT_CELL_SIZE apart, over all
+// layers, belong to the same object. It returns the objects, numbered in printing order, and the
+// object of every line, -1 for lines outside any object.
+func (a *Analysis) findObjects(lines []string) ([]printObject, []int) {
+	segments, extrudes := a.findExtrusions(lines)
+
+	// Union-find over the touched cells
+	parents := make(map[objectCell]objectCell)
+	var find func(c objectCell) objectCell
+	find = func(c objectCell) objectCell {
+		if parents[c] != c {
+			parents[c] = find(parents[c])
+		}
+		return parents[c]
+	}
+	touch := func(c objectCell) {
+		if _, ok := parents[c]; ok {
+			return
+		}
+		parents[c] = c
+		for dx := -1; dx <= 1; dx++ {
+			for dy := -1; dy <= 1; dy++ {
+				neighbour := objectCell{c.X + dx, c.Y + dy}
+				if _, ok := parents[neighbour]; ok {
+					parents[find(neighbour)] = find(c)
+				}
+			}
+		}
+	}
+	for i, segment := range segments {
+		if !extrudes[i] {
+			continue
+		}
+		length := calculateDistance(segment[0], segment[1], segment[2], segment[3])
+		steps := int(length/(OBJECT_CELL_SIZE/2)) + 1
+		for step := 0; step <= steps; step++ {
+			t := float64(step) / float64(steps)
+			touch(getObjectCell(segment[0]+t*(segment[2]-segment[0]), segment[1]+t*(segment[3]-segment[1])))
+		}
+	}
+
+	// Measure each cluster, then number those big enough in the order they are first printed
+	clusters := make(map[objectCell]*printObject)
+	order := []objectCell{}
+	lineClusters := make([]objectCell, len(lines))
+	for i, segment := range segments {
+		if !extrudes[i] {
+			continue
+		}
+		root := find(getObjectCell(segment[2], segment[3]))
+		lineClusters[i] = root
+		object, ok := clusters[root]
+		if !ok {
+			object = &printObject{MinX: math.Inf(1), MinY: math.Inf(1), MaxX: math.Inf(-1), MaxY: math.Inf(-1)}
+			clusters[root] = object
+			order = append(order, root)
+		}
+		object.MinX = min(object.MinX, segment[0], segment[2])
+		object.MinY = min(object.MinY, segment[1], segment[3])
+		object.MaxX = max(object.MaxX, segment[0], segment[2])
+		object.MaxY = max(object.MaxY, segment[1], segment[3])
+		object.Length += calculateDistance(segment[0], segment[1], segment[2], segment[3])
+	}
+	objects := []printObject{}
+	ids := make(map[objectCell]int)
+	for _, root := range order {
+		if clusters[root].Length < OBJECT_MIN_LENGTH {
+			continue
+		}
+		clusters[root].ID = len(objects)
+		ids[root] = len(objects)
+		objects = append(objects, *clusters[root])
+	}
+
+	lineObjects := make([]int, len(lines))
+	for i := range lines {
+		lineObjects[i] = -1
+		if id, ok := ids[lineClusters[i]]; ok && extrudes[i] {
+			lineObjects[i] = id
+		}
+	}
+	return objects, lineObjects
+}
+
+// getObjectDefineLines returns the lines declaring the objects before the first layer
+func getObjectDefineLines(objects []printObject) []string {
+	if usesM486Labels() {
+		return []string{fmt.Sprintf("M486 T%d", len(objects))}
+	}
+	defines := []string{}
+	for _, o := range objects {
+		defines = append(defines, fmt.Sprintf("EXCLUDE_OBJECT_DEFINE NAME=%s CENTER=%.3f,%.3f POLYGON=[[%.3f,%.3f],[%.3f,%.3f],[%.3f,%.3f],[%.3f,%.3f]]",
+			o.Name(), (o.MinX+o.MaxX)/2, (o.MinY+o.MaxY)/2,
+			o.MinX, o.MinY, o.MaxX, o.MinY, o.MaxX, o.MaxY, o.MinX, o.MaxY))
+	}
+	return defines
+}
+
+// getObjectStartLine returns the line starting a run of an object's extrusions
+func getObjectStartLine(o printObject) string {
+	if usesM486Labels() {
+		return fmt.Sprintf("M486 S%d", o.ID)
+	}
+	return "EXCLUDE_OBJECT_START NAME=" + o.Name()
+}
+
+// getObjectEndLine returns the line ending a run of an object's extrusions
+func getObjectEndLine(o printObject) string {
+	if usesM486Labels() {
+		return "M486 S-1"
+	}
+	return "EXCLUDE_OBJECT_END NAME=" + o.Name()
+}
+
+// labelObjects returns the lines with object labels injected for -label-objects, so single
+// objects can be cancelled on the printer: the objects are declared before the first layer and
+// every run of an object's extrusions is wrapped in start and end labels. Runs end at layer
+// changes, so inserted layer commands never belong to an object. Files that already label their
+// objects, have a single object or use RepRapFirmware blocks are left as they are.
+func (a *Analysis) labelObjects(lines []string) []string {
+	if !labelObjectsEnabled {
+		return lines
+	}
+	if countLabeledObjects(lines) > 0 {
+		fmt.Println("Objects are already labeled, not adding labels")
+		return lines
+	}
+	for _, depth := range getBlockDepths(lines) {
+		if depth > 0 {
+			fmt.Println("Warning: not labeling objects in a file with conditional blocks")
+			return lines
+		}
+	}
+	objects, lineObjects := a.findObjects(lines)
+	if len(objects) < 2 {
+		fmt.Printf("Found %d objects to cancel separately, not adding labels\n", len(objects))
+		return lines
+	}
+	fmt.Printf("Labeling %d objects for cancelling (%s):\n", len(objects), getFirmware())
+	for _, o := range objects {
+		fmt.Printf("  %s: X %.1f-%.1f, Y %.1f-%.1f\n", o.Name(), o.MinX, o.MaxX, o.MinY, o.MaxY)
+	}
+
+	before := make(map[int][]string)
+	after := make(map[int][]string)
+	current, lastExtrusion := -1, -1
+	closeObject := func() {
+		if current >= 0 {
+			after[lastExtrusion] = append(after[lastExtrusion], getObjectEndLine(objects[current]))
+			current = -1
+		}
+	}
+	defined := false
+	for i, line := range lines {
+		if a.detectLayerChange(line) {
+			closeObject()
+			if !defined {
+				before[i] = getObjectDefineLines(objects)
+				defined = true
+			}
+			continue
+		}
+		if id := lineObjects[i]; id >= 0 {
+			if id != current {
+				closeObject()
+				before[i] = append(before[i], getObjectStartLine(objects[id]))
+				current = id
+			}
+			lastExtrusion = i
+		} else if feature, ok := getFeatureName(line); ok && (isSkirtFeature(feature) || isWipeTowerFeature(feature)) {
+			closeObject()
+		}
+	}
+	closeObject()
+
+	labeled := make([]string, 0, len(lines)+len(before)+len(after))
+	for i, line := range lines {
+		labeled = append(labeled, before[i]...)
+		labeled = append(labeled, line)
+		labeled = append(labeled, after[i]...)
+	}
+	return labeled
+}
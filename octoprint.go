@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+const (
+	OCTOPRINT_ENV_FILE = "OCTOPRINT_FILE"      // Path of the file to process, when not given as an argument
+	OCTOPRINT_ENV_NAME = "OCTOPRINT_FILE_NAME" // Path of the file in OctoPrint's storage, for messages and the plan
+)
+
+// octoprintResult is the JSON the octoprint command reports to the plugin
+type octoprintResult struct {
+	File     string `json:"file"`             // Path of the file in OctoPrint's storage
+	Output   string `json:"output,omitempty"` // Where the modified G-code was written
+	Modified bool   `json:"modified"`         // False when the file was already processed or failed
+	Plan     *Plan  `json:"plan,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// octoprintFlags are the flags of the octoprint command
+type octoprintFlags struct {
+	presetName *string
+	name       *string
+	outPath    *string
+	resultPath *string
+}
+
+// defineOctoprintFlags defines the flags of the octoprint command on a flag set
+func defineOctoprintFlags(fs *flag.FlagSet) octoprintFlags {
+	var flags octoprintFlags
+	flags.presetName = fs.String("preset", DEFAULT_PRESET, "Named preset of detectors and modification rules (see 'presets list')")
+	flags.name = fs.String("name", "", "Path of the file in OctoPrint's storage (Default=$"+OCTOPRINT_ENV_NAME+", else the file's path)")
+	flags.outPath = fs.String("out", "", "Where to write the modified G-code (Default=over the file, a copy the plugin hands over)")
+	flags.resultPath = fs.String("result", "", "Where to write the JSON result (Default=stdout, with messages on stderr)")
+	addLayerBaseFlag(fs)
+	return flags
+}
+
+// runOctoprintCommand implements "octoprint": the companion of an OctoPrint preprocessor plugin.
+// The plugin saves the upload to a temporary file and runs the command on it; the command
+// modifies the file and reports a JSON result, keeping stdout free of other messages.
+func runOctoprintCommand(args []string) {
+	fs := flag.NewFlagSet("octoprint", flag.ExitOnError)
+	flags := defineOctoprintFlags(fs)
+	setCommandUsage(fs, "octoprint")
+	fs.Parse(args)
+	fs.Visit(func(f *flag.Flag) { explicitFlags[f.Name] = true })
+	validateLayerBase()
+
+	results := io.Writer(os.Stdout)
+	if *flags.resultPath == "" {
+		os.Stdout = os.Stderr
+	}
+	filePath := fs.Arg(0)
+	if filePath == "" {
+		filePath = os.Getenv(OCTOPRINT_ENV_FILE)
+	}
+	if filePath == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	result := octoprintResult{File: *flags.name}
+	if result.File == "" {
+		result.File = os.Getenv(OCTOPRINT_ENV_NAME)
+	}
+	if result.File == "" {
+		result.File = filePath
+	}
+
+	if err := processOctoprintFile(filePath, *flags.presetName, *flags.outPath, &result); err != nil {
+		result.Error = err.Error()
+	}
+	if *flags.resultPath != "" {
+		file, err := os.Create(*flags.resultPath)
+		if err != nil {
+			fmt.Printf("Error creating result file: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		results = file
+	}
+	encoder := json.NewEncoder(results)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		fmt.Printf("Error writing result: %v\n", err)
+		os.Exit(1)
+	}
+	if result.Error != "" {
+		os.Exit(1)
+	}
+}
+
+// processOctoprintFile modifies a file for the octoprint command and fills in the result; files
+// that were already processed are left as they are
+func processOctoprintFile(filePath, presetName, outPath string, result *octoprintResult) error {
+	p, err := getPreset(presetName)
+	if err != nil {
+		return err
+	}
+	activePreset = p
+	if thresholdOverrides, err = loadThresholdOverrides(); err != nil {
+		return err
+	}
+
+	lines, crlf, err := readLines(filePath)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(lines, MODIFIED_MARKER) {
+		fmt.Printf("Skipping '%s': already processed\n", result.File)
+		return nil
+	}
+	plan, modified, err := processUpload(context.Background(), result.File, lines, true)
+	if err != nil {
+		return err
+	}
+	result.Plan = &plan
+	if outPath == "" {
+		outPath = filePath
+	}
+	if err := writeLines(outPath, modified, crlf); err != nil {
+		return err
+	}
+	result.Output, result.Modified = outPath, true
+	return nil
+}
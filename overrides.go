@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// featureOverride is one 'feature=value' entry of a per-feature override flag
+type featureOverride struct {
+	Feature string // Canonical feature type
+	Value   float64
+	Spec    string // The entry as given
+}
+
+var speedOverrideSpec string // -speed-override, e.g. 'outer_wall=80%,bridge=50%'
+var speedOverrides []featureOverride
+
+// parseFeatureOverrides parses comma-separated 'feature=value' entries; a '%' after the value is
+// allowed and ignored
+func parseFeatureOverrides(spec string) ([]featureOverride, error) {
+	overrides := []featureOverride{}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		feature := canonicalFeature(name)
+		number, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+		if !ok || strings.TrimSpace(name) == "" || err != nil {
+			return nil, fmt.Errorf("invalid override '%s' (use feature=value, e.g. bridge=50%%)", entry)
+		}
+		if seen[feature] {
+			return nil, fmt.Errorf("feature '%s' (%s) is overridden twice", name, feature)
+		}
+		seen[feature] = true
+		overrides = append(overrides, featureOverride{Feature: feature, Value: number, Spec: entry})
+	}
+	return overrides, nil
+}
+
+// findFeatureOverride returns the index of the override of a feature label's type, or -1
+func findFeatureOverride(overrides []featureOverride, label string) int {
+	feature := canonicalFeature(label)
+	for n, override := range overrides {
+		if override.Feature == feature {
+			return n
+		}
+	}
+	return -1
+}
+
+// loadSpeedOverrides parses -speed-override, whose values are percentages of the sliced speed
+func loadSpeedOverrides() error {
+	if speedOverrideSpec == "" {
+		return nil
+	}
+	overrides, err := parseFeatureOverrides(speedOverrideSpec)
+	if err != nil {
+		return fmt.Errorf("-speed-override: %v", err)
+	}
+	for _, override := range overrides {
+		if override.Value <= 0 {
+			return fmt.Errorf("-speed-override: speed of '%s' must be above 0%%", override.Spec)
+		}
+	}
+	speedOverrides = overrides
+	return nil
+}
+
+// applySpeedOverrides rescales the feedrate of the extruding moves of the -speed-override
+// features. Since F is modal, moves without one get the rescaled feedrate added, and the first
+// move after the feature gets the sliced feedrate back.
+func applySpeedOverrides(lines []string) []string {
+	if len(speedOverrides) == 0 {
+		return lines
+	}
+	changed := make([]int, len(speedOverrides))
+	overridden := make([]string, len(lines))
+	numbers := getNumberFormat(lines)
+	feature := ""
+	var state machineState
+	sliced := 0.0  // Feedrate in mm/min as sliced
+	emitted := 0.0 // Feedrate in mm/min the printer has been sent
+	for i, line := range lines {
+		overridden[i] = line
+		if name, ok := getFeatureName(line); ok {
+			feature = name
+		}
+		previous := state
+		state.update(line)
+		command, ok := parseCommand(line)
+		if !ok {
+			continue
+		}
+		name := strings.ToUpper(command.Name)
+		if name != "G0" && name != "G1" && name != "G2" && name != "G3" {
+			continue
+		}
+		if f, ok := command.Params['F']; ok {
+			sliced = f
+		}
+		if sliced == 0 {
+			continue
+		}
+
+		extruding := state.E > previous.E
+		if name == "G2" || name == "G3" {
+			_, extruding = command.Params['E']
+		}
+		wanted := sliced
+		if n := findFeatureOverride(speedOverrides, feature); n >= 0 && extruding {
+			wanted = sliced * speedOverrides[n].Value / 100
+			changed[n]++
+		}
+		_, hasF := command.Params['F']
+		if (hasF && wanted != sliced) || (!hasF && wanted != emitted) {
+			overridden[i], _ = applyActions(line, []transformAction{{Param: 'F', Op: "=", Value: wanted}}, numbers)
+		}
+		emitted = wanted
+	}
+
+	for n, override := range speedOverrides {
+		fmt.Printf("Speed override '%s': %d moves changed\n", override.Spec, changed[n])
+	}
+	return overridden
+}
+
+var fanOverrideSpec string // -fan-override, e.g. 'bridge=100,overhang=100,infill=40'
+var fanOverrides []featureOverride
+
+// loadFanOverrides parses -fan-override, whose values are fan speed percentages
+func loadFanOverrides() error {
+	if fanOverrideSpec == "" {
+		return nil
+	}
+	overrides, err := parseFeatureOverrides(fanOverrideSpec)
+	if err != nil {
+		return fmt.Errorf("-fan-override: %v", err)
+	}
+	for _, override := range overrides {
+		if override.Value < 0 || override.Value > 100 {
+			return fmt.Errorf("-fan-override: fan speed of '%s' must be between 0 and 100%%", override.Spec)
+		}
+	}
+	fanOverrides = overrides
+	return nil
+}
+
+// isPartFanCommand reports whether a command sets the part cooling fan, the one M106 without P
+// (or with P0) controls
+func isPartFanCommand(command Command) bool {
+	name := strings.ToUpper(command.Name)
+	return (name == "M106" || name == "M107") && command.Params['P'] == 0
+}
+
+// applyFanOverrides sets the fan speed of the -fan-override features after their feature label,
+// and restores the sliced fan speed after the label of the next feature. Fan commands of the
+// slicer within an overridden feature are removed, but still set the speed restored after it;
+// those in time-lapse sequences and other post-processors' blocks are kept.
+func applyFanOverrides(lines []string) []string {
+	if len(fanOverrides) == 0 {
+		return lines
+	}
+	changed := make([]int, len(fanOverrides))
+	overridden := make([]string, 0, len(lines))
+	current := -1 // Override of the current feature
+	feature := ""
+	sliced := 0  // Fan speed 0-255 as sliced
+	emitted := 0 // Fan speed 0-255 the printer has been sent
+	foreign := getForeignBlocks(lines)
+	for i, line := range lines {
+		if command, ok := parseCommand(line); ok && isPartFanCommand(command) {
+			var state machineState
+			state.update(line)
+			sliced = state.FanSpeed
+			if current >= 0 && !foreign[i] {
+				continue
+			}
+			emitted = sliced
+		}
+		overridden = append(overridden, line)
+
+		name, ok := getFeatureName(line)
+		if !ok {
+			continue
+		}
+		previousFeature := feature
+		feature = name
+		current = findFeatureOverride(fanOverrides, name)
+		if current >= 0 {
+			speed := int(fanOverrides[current].Value / 100 * 255)
+			if speed != emitted {
+				overridden = append(overridden, withComment(fmt.Sprintf("M106 S%d", speed), msg(MSG_FEATURE_FAN, int(fanOverrides[current].Value), name)))
+				emitted = speed
+			}
+			changed[current]++
+		} else if emitted != sliced {
+			overridden = append(overridden, withComment(fmt.Sprintf("M106 S%d", sliced), msg(MSG_RESTORE_FEATURE_FAN, sliced*100/255, previousFeature)))
+			emitted = sliced
+		}
+	}
+
+	for n, override := range fanOverrides {
+		fmt.Printf("Fan override '%s': %d features changed\n", override.Spec, changed[n])
+	}
+	return overridden
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Plan is the result of analyzing a file: what was detected and the modifications to make.
+// Plans can be saved with -plan-out, inspected, edited or merged, and applied with -plan-in.
+type Plan struct {
+	File           string         `json:"file"`
+	Preset         string         `json:"preset"`
+	Dialect        string         `json:"dialect"`
+	Material       string         `json:"material,omitempty"`
+	LayerCount     int            `json:"layer_count"`
+	DefaultTemp    int            `json:"default_temp"`
+	MaxFanSpeed    int            `json:"max_fan_speed"`
+	MaxTemp        int            `json:"max_temp"`
+	Detections     []Detection    `json:"detections"`
+	LayerScores    []float64      `json:"layer_scores,omitempty"`   // Adhesion risk score per 0-based layer
+	InfillDensity  []float64      `json:"infill_density,omitempty"` // Infill density (%) per 0-based layer, 0 if not judged
+	Modifications  []modification `json:"modifications"`
+	PostProcessors []string       `json:"post_processors,omitempty"` // Other post-processors that processed the file
+	LayerZ         []float64      `json:"layer_z,omitempty"`         // Z height per 0-based layer, for re-targeting with -plan-match z
+	Retargets      []retarget     `json:"retargets,omitempty"`       // Entries moved or dropped when re-targeted by Z height
+}
+
+// Detection is a layer flagged by a detector and why
+type Detection struct {
+	Layer    int                  `json:"layer"`
+	EndLayer int                  `json:"end_layer,omitempty"` // Last layer of a detection spanning several layers
+	Detector string               `json:"detector"`
+	Why      detectionExplanation `json:"why"`
+	Details  string               `json:"details,omitempty"`  // Explanation from detectors other than perimeter-change
+	Fix      string               `json:"fix,omitempty"`      // FIX_POST or FIX_RESLICE
+	Severity string               `json:"severity,omitempty"` // SEVERITY_INFO, SEVERITY_WARNING or SEVERITY_CRITICAL
+}
+
+// Analyze maps a G-code file into memory and returns the plan of modifications for it
+func Analyze(ctx context.Context, filePath string) (Plan, error) {
+	lines, unmap, err := readLinesMapped(filePath)
+	if err != nil {
+		return Plan{}, err
+	}
+	defer unmap()
+	plan, err := AnalyzeLines(ctx, filePath, lines)
+	return clonePlan(plan), err
+}
+
+// AnalyzeLines runs the active preset's detectors over the G-code lines of one file (or 3MF
+// plate) and plans the corrections for what they find. It stops between detectors with the
+// context's error once the context is done.
+func AnalyzeLines(ctx context.Context, filePath string, lines []string) (Plan, error) {
+	return analyzeLines(ctx, filePath, lines, getFilePreset(lines))
+}
+
+// analyzeLines is AnalyzeLines with the preset for the file given
+func analyzeLines(ctx context.Context, filePath string, lines []string, p preset) (Plan, error) {
+	// Scaled thresholds only apply to this file
+	a := newAnalysis(lines, scaleThresholds(p, lines))
+
+	plan := Plan{
+		File:        filePath,
+		Preset:      a.preset.Name,
+		Dialect:     a.dialect.Name,
+		Material:    getPrintMaterial(lines),
+		LayerCount:  a.countLayers(lines),
+		DefaultTemp: getDefaultTemp(lines),
+		MaxFanSpeed: getMaxFanSpeed(lines),
+		Detections:  []Detection{},
+	}
+	plan.MaxTemp = getMaxTemp(plan.Material)
+	plan.LayerZ = a.getLayerZ(plan.LayerCount)
+	fmt.Printf("File '%s' has %d layers (%s)\n", filePath, plan.LayerCount, plan.Dialect)
+	if objects := countLabeledObjects(lines); objects > 0 {
+		fmt.Printf("Objects labeled for cancelling: %d\n", objects)
+	}
+	plan.PostProcessors = printPostProcessors(lines)
+
+	if err := ctx.Err(); err != nil {
+		return plan, err
+	}
+
+	// Process the file based on the selected mode; the perimeter lengths are needed by other detectors
+	probLayers := a.detectProblematicLayers(lines)
+	if !a.preset.hasDetector(DETECTOR_PERIMETER_CHANGE) {
+		probLayers = []int{}
+	}
+	if err := ctx.Err(); err != nil {
+		return plan, err
+	}
+	if a.preset.hasDetector(DETECTOR_COOLING_MODEL) && len(probLayers) > 0 {
+		fmt.Printf("Cooling model for %d perimeter-change layers:\n", len(probLayers))
+		probLayers = a.filterByCoolingModel(lines, probLayers, plan.Material)
+	}
+	fmt.Printf("Problematic layers: %v\n", displayLayers(probLayers))
+	for _, layer := range probLayers {
+		fmt.Printf("  Problematic %s: %s, travel %.1fmm\n", a.describeLayer(layer),
+			a.explanations[layer], a.travelLengths[layer])
+		plan.Detections = append(plan.Detections,
+			Detection{Layer: layer, Detector: DETECTOR_PERIMETER_CHANGE, Why: a.explanations[layer]})
+	}
+	if len(probLayers) > 0 {
+		fmt.Printf("  Thresholds: perimeter change between %.0f%% and %.0f%%, perimeter > %.0fmm, layer >= %d, not support-only\n",
+			a.preset.PerimPctChgLower, a.preset.PerimPctChgUpper, a.preset.MinCurrPerim, displayLayer(a.preset.MinProbLayer))
+	}
+	// Summed in layer order, as float sums depend on the order
+	travelLayers := []int{}
+	for layer := range a.travelLengths {
+		travelLayers = append(travelLayers, layer)
+	}
+	sort.Ints(travelLayers)
+	totalTravel := 0.0
+	for _, layer := range travelLayers {
+		totalTravel += a.travelLengths[layer]
+	}
+	fmt.Printf("Total travel length: %.1fmm\n", totalTravel)
+
+	if err := ctx.Err(); err != nil {
+		return plan, err
+	}
+	plan.LayerScores = a.getAdhesionScores(lines, plan.DefaultTemp)
+	if printAdhesionScores {
+		fmt.Println("Adhesion risk scores:")
+		for layer, score := range plan.LayerScores {
+			fmt.Printf("  %s: %.0f\n", a.describeLayer(layer), score)
+		}
+	}
+	correctedLayers := probLayers
+	if a.preset.hasDetector(DETECTOR_ADHESION_RISK) {
+		adhesionRisks := a.detectAdhesionRisk(plan.LayerScores)
+		fmt.Printf("Adhesion risk layers: %d\n", len(adhesionRisks))
+		for _, detection := range adhesionRisks {
+			fmt.Printf("  Adhesion risk at %s: %s\n", a.describeLayer(detection.Layer), detection.Details)
+			correctedLayers = mergeLayers(correctedLayers, []int{detection.Layer})
+		}
+		plan.Detections = append(plan.Detections, adhesionRisks...)
+	}
+
+	if a.preset.hasDetector(DETECTOR_INFILL_DENSITY) || printInfillDensities {
+		plan.InfillDensity = a.getInfillDensities(lines)
+	}
+	if printInfillDensities {
+		fmt.Println("Infill densities:")
+		for layer, density := range plan.InfillDensity {
+			if density > 0 {
+				fmt.Printf("  %s: %.1f%%\n", a.describeLayer(layer), density)
+			}
+		}
+	}
+	if a.preset.hasDetector(DETECTOR_INFILL_DENSITY) {
+		infillAnomalies := a.detectInfillDensity(plan.InfillDensity)
+		fmt.Printf("Infill density anomalies: %d\n", len(infillAnomalies))
+		for _, detection := range infillAnomalies {
+			if detection.EndLayer > detection.Layer {
+				fmt.Printf("  Infill density anomaly from %s to layer %d: %s\n", a.describeLayer(detection.Layer), displayLayer(detection.EndLayer), detection.Details)
+			} else {
+				fmt.Printf("  Infill density anomaly at %s: %s\n", a.describeLayer(detection.Layer), detection.Details)
+			}
+		}
+		plan.Detections = append(plan.Detections, infillAnomalies...)
+	}
+
+	a.calibratedTemps = a.getCalibratedTemps(lines, correctedLayers, plan.Material)
+	plan.Modifications = a.planModifications(correctedLayers, plan.DefaultTemp, plan.MaxFanSpeed)
+
+	if a.preset.hasDetector(DETECTOR_TIPPING_RISK) {
+		if err := ctx.Err(); err != nil {
+			return plan, err
+		}
+		tippingRisks := a.detectTippingRisk(lines)
+		fmt.Printf("Tipping risk runs: %d\n", len(tippingRisks))
+		for _, detection := range tippingRisks {
+			if detection.EndLayer > detection.Layer {
+				fmt.Printf("  Tipping risk from %s to layer %d: %s\n", a.describeLayer(detection.Layer), displayLayer(detection.EndLayer), detection.Details)
+			} else {
+				fmt.Printf("  Tipping risk at %s: %s\n", a.describeLayer(detection.Layer), detection.Details)
+			}
+		}
+		plan.Detections = append(plan.Detections, tippingRisks...)
+		plan.Modifications = append(plan.Modifications, a.planTippingModifications(tippingRisks)...)
+	}
+
+	if a.preset.hasDetector(DETECTOR_SMALL_FOOTPRINT) {
+		for _, detection := range a.detectSmallFootprint(lines) {
+			fmt.Printf("Recommendation: %s\n", detection.Details)
+			plan.Detections = append(plan.Detections, detection)
+		}
+	}
+
+	if a.preset.hasDetector(DETECTOR_CLOG_RISK) {
+		if err := ctx.Err(); err != nil {
+			return plan, err
+		}
+		clogRisks := a.detectClogRisk(lines)
+		fmt.Printf("Clog risk runs: %d\n", len(clogRisks))
+		for _, detection := range clogRisks {
+			fmt.Printf("  Clog risk from %s to layer %d: %s\n", a.describeLayer(detection.Layer), displayLayer(detection.EndLayer), detection.Details)
+		}
+		plan.Detections = append(plan.Detections, clogRisks...)
+		plan.Modifications = append(plan.Modifications, a.planClogModifications(clogRisks, plan.DefaultTemp)...)
+	}
+
+	reslice := 0
+	for i := range plan.Detections {
+		plan.Detections[i].Fix = getDetectionFix(plan.Detections[i].Detector)
+		plan.Detections[i].Severity = getDetectionSeverity(plan.Detections[i].Detector)
+		if plan.Detections[i].Fix == FIX_RESLICE {
+			reslice++
+		}
+	}
+	if reslice > 0 {
+		fmt.Printf("Findings fixable in post: %d, needing a re-slice: %d\n", len(plan.Detections)-reslice, reslice)
+	}
+	if highest := getHighestSeverity([]Plan{plan}); highest != SEVERITY_NONE {
+		fmt.Printf("Highest severity: %s\n", highest)
+	}
+	return plan, nil
+}
+
+// Apply reads a G-code file and returns its lines with the plan's modifications applied
+func Apply(ctx context.Context, filePath string, plan Plan) ([]string, error) {
+	lines, _, err := readLines(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyLines(ctx, lines, plan)
+}
+
+// ApplyLines returns the lines with the plan's modifications inserted, after enforcing the safety
+// clamps, along with the -label-objects labels, the -start-heating order, the
+// -preheat-chamber/-soak-minutes sequence, the -plugins insertions, the -notify-at-layer
+// notifications and the -standby-after temperature drops, on the lines as changed by the
+// -transforms rules and the -speed-override and -fan-override features. With -refresh-estimates,
+// the embedded time estimates are rewritten for the new timing, and -power-loss-every state saves
+// are added. The end of the print is audited and, with -sanitize, the output made plain ASCII and,
+// with -sanitize-metadata, stripped of identifying metadata; then the processing log and
+// MODIFIED_MARKER follow. Nothing is returned once the context is done.
+func ApplyLines(ctx context.Context, lines []string, plan Plan) ([]string, error) {
+	transformed := applyFanOverrides(applySpeedOverrides(applyTransforms(lines)))
+	// Report insertions against the lines being modified, which may not be the analyzed ones
+	a := newAnalysis(transformed, activePreset)
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pluginInsertions, err := a.runPlugins(ctx, transformed)
+	if err != nil {
+		return nil, err
+	}
+	modifications := clampModifications(plan.Modifications, plan.DefaultTemp, getMinTemp(plan.Material), plan.MaxTemp, a.countLayers(transformed))
+	modified := a.insertModifications(a.insertPreheat(a.reorderStartHeating(a.labelObjects(transformed))), modifications)
+	modified = a.insertPluginLines(modified, pluginInsertions)
+	modified = a.insertWipes(modified, plan.Detections)
+	modified = a.insertLayerNotifications(modified)
+	modified = a.insertStandbyTemps(modified)
+	if refreshEstimates {
+		modified = refreshTimeEstimates(modified)
+	}
+	modified = convertProgress(modified)
+	// Before the snapshots, which resume expects right after the layer change
+	modified = a.insertPowerLossMarkers(modified)
+	if stateSnapshots {
+		modified = a.insertStateSnapshots(modified)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	modified = auditEndOfFile(lines, modified)
+	if sanitizeOutput {
+		modified = sanitizeLines(modified)
+	}
+	if sanitizeMetadata {
+		modified = sanitizeMetadataLines(modified)
+	}
+	logEntries := []string{}
+	if reportEnergy {
+		energy := estimateEnergy(modified)
+		fmt.Printf("Estimated energy: %s\n", energy)
+		logEntries = append(logEntries, "energy: "+energy.String())
+	}
+	if !noComments {
+		modified = append(modified, getProcessingLog(lines, plan, modifications, pluginInsertions, logEntries)...)
+	}
+
+	return append(modified, MODIFIED_MARKER), nil
+}
+
+// Merge returns a plan with the detections and modifications of both plans; modifications that
+// appear in both are kept once
+func (p Plan) Merge(other Plan) Plan {
+	merged := p
+	merged.Detections = append(append([]Detection{}, p.Detections...), other.Detections...)
+	merged.Modifications = append([]modification{}, p.Modifications...)
+	seen := make(map[modification]bool)
+	for _, mod := range p.Modifications {
+		seen[mod] = true
+	}
+	for _, mod := range other.Modifications {
+		if !seen[mod] {
+			merged.Modifications = append(merged.Modifications, mod)
+			seen[mod] = true
+		}
+	}
+	return merged
+}
+
+const PLAN_FILE_VERSION = 1
+
+// planFile is the JSON document written by -plan-out and read by -plan-in
+type planFile struct {
+	Version int    `json:"version"`
+	Tool    string `json:"tool,omitempty"` // gcode_modifier version that wrote the file
+	Plans   []Plan `json:"plans"`
+}
+
+var planOutPath string // -plan-out, where the plans of this run are saved
+var planInPath string  // -plan-in, plans to apply instead of analyzing
+var exportedPlans []Plan
+var importedPlans []Plan
+
+// errNoPlan is returned by modifyLines for files -plan-in has no plan for, which are left as they
+// are: not written, and not marked as processed
+var errNoPlan = errors.New("no plan for the file")
+
+// savePlans writes the plans of this run to a plan file
+func savePlans(filePath string, plans []Plan) error {
+	data, err := json.MarshalIndent(planFile{Version: PLAN_FILE_VERSION, Tool: versionString(), Plans: plans}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, append(data, '\n'), 0644)
+}
+
+// loadPlans reads the plans from a plan file
+func loadPlans(filePath string) ([]Plan, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var pf planFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, err
+	}
+	if pf.Version != PLAN_FILE_VERSION {
+		return nil, fmt.Errorf("unsupported plan file version %d", pf.Version)
+	}
+	return pf.Plans, nil
+}
+
+// findImportedPlan returns the imported plan for a file: the one recorded for the same file name,
+// or the only plan when the plan file has just one, re-targeted by Z height with -plan-match z
+func findImportedPlan(filePath string, lines []string) (Plan, bool) {
+	var plan Plan
+	found := false
+	for _, p := range importedPlans {
+		if filepath.Base(p.File) == filepath.Base(filePath) {
+			plan, found = p, true
+			break
+		}
+	}
+	if !found && len(importedPlans) == 1 {
+		plan, found = importedPlans[0], true
+	}
+	if !found {
+		return plan, false
+	}
+
+	if planMatch == PLAN_MATCH_Z {
+		retargeted, err := retargetPlan(plan, lines)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return retargeted, true
+	}
+	if layerCount := newAnalysis(lines, activePreset).countLayers(lines); layerCount != plan.LayerCount {
+		fmt.Printf("Warning: plan for '%s' was made for %d layers, '%s' has %d (use -plan-match z for a re-sliced file)\n", plan.File, plan.LayerCount, filePath, layerCount)
+	}
+	return plan, true
+}
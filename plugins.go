@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var pluginPaths string // -plugins, comma-separated executables that insert lines at layer starts
+
+// pluginCommand is a command as sent to plugins
+type pluginCommand struct {
+	Line    int                `json:"line"` // 1-based line in the file
+	Cmd     string             `json:"cmd"`
+	Params  map[string]float64 `json:"params,omitempty"`
+	Comment string             `json:"comment,omitempty"`
+	Feature string             `json:"feature,omitempty"`
+	Type    string             `json:"feature_type,omitempty"` // Canonical type of the feature
+}
+
+// pluginLayer is one line of a plugin's input: the commands of a layer
+type pluginLayer struct {
+	Layer    int             `json:"layer"` // 0-based, like the layers of plans
+	Z        float64         `json:"z"`
+	Commands []pluginCommand `json:"commands"`
+}
+
+// pluginInsertion is one line of a plugin's output: lines to insert at the start of a layer
+type pluginInsertion struct {
+	Plugin string   `json:"-"`
+	Layer  int      `json:"layer"`
+	Lines  []string `json:"lines"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// getPluginLayers returns the commands of every layer in the form sent to plugins
+func (a *Analysis) getPluginLayers(lines []string) []pluginLayer {
+	doc := NewDocument(lines)
+	layers := make([]pluginLayer, 0, doc.LayerCount())
+	firstLine := len(doc.Header()) + 1
+	feature, featureType := "", ""
+	for layer := 0; layer < doc.LayerCount(); layer++ {
+		commands := []pluginCommand{}
+		layerLines := doc.Layer(layer).Lines()
+		for i, line := range layerLines {
+			if name, ok := getFeatureName(line); ok {
+				feature, featureType = name, canonicalFeature(name)
+			}
+			command, ok := parseCommand(line)
+			if !ok {
+				continue
+			}
+			params := make(map[string]float64, len(command.Params))
+			for letter, value := range command.Params {
+				params[string(letter)] = value
+			}
+			commands = append(commands, pluginCommand{Line: firstLine + i, Cmd: command.Name, Params: params,
+				Comment: command.Comment, Feature: feature, Type: featureType})
+		}
+		layers = append(layers, pluginLayer{Layer: layer, Z: a.layerZHeights[layer], Commands: commands})
+		firstLine += len(layerLines)
+	}
+	return layers
+}
+
+// runPlugin runs a plugin with the layers as JSON lines on its standard input and returns the
+// insertions it writes as JSON lines to its standard output. Anything it writes to standard
+// error is shown.
+func runPlugin(ctx context.Context, path string, layers []pluginLayer) ([]pluginInsertion, error) {
+	var input bytes.Buffer
+	encoder := json.NewEncoder(&input)
+	for _, layer := range layers {
+		if err := encoder.Encode(layer); err != nil {
+			return nil, err
+		}
+	}
+
+	var output, errOutput bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = &input
+	cmd.Stdout = &output
+	cmd.Stderr = &errOutput
+	err := cmd.Run()
+	for _, line := range strings.Split(strings.TrimSpace(errOutput.String()), "\n") {
+		if line != "" {
+			fmt.Printf("  [%s] %s\n", filepath.Base(path), line)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	insertions := []pluginInsertion{}
+	scanner := bufio.NewScanner(&output)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var insertion pluginInsertion
+		if err := json.Unmarshal(scanner.Bytes(), &insertion); err != nil {
+			return nil, fmt.Errorf("output line %d: %v", lineNum, err)
+		}
+		if insertion.Layer < 0 || insertion.Layer >= len(layers) {
+			return nil, fmt.Errorf("output line %d: layer %d is not in the file", lineNum, insertion.Layer)
+		}
+		insertion.Plugin = filepath.Base(path)
+		insertions = append(insertions, insertion)
+	}
+	return insertions, scanner.Err()
+}
+
+// runPlugins runs the -plugins in order over the lines and returns the insertions of all of them.
+// A plugin that fails stops the processing of the file.
+func (a *Analysis) runPlugins(ctx context.Context, lines []string) ([]pluginInsertion, error) {
+	if pluginPaths == "" {
+		return nil, nil
+	}
+	layers := a.getPluginLayers(lines)
+	all := []pluginInsertion{}
+	for _, path := range strings.Split(pluginPaths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		insertions, err := runPlugin(ctx, path, layers)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %v", path, err)
+		}
+		fmt.Printf("Plugin %s: %d insertions\n", filepath.Base(path), len(insertions))
+		for _, insertion := range insertions {
+			fmt.Printf("  %s: %s\n", a.describeLayer(insertion.Layer), insertion.Reason)
+		}
+		all = append(all, insertions...)
+	}
+	return all, nil
+}
+
+// insertPluginLines inserts the lines of plugin insertions at the start of their layers
+func (a *Analysis) insertPluginLines(lines []string, insertions []pluginInsertion) []string {
+	if len(insertions) == 0 {
+		return lines
+	}
+	byLayer := make(map[int][]pluginInsertion)
+	for _, insertion := range insertions {
+		byLayer[insertion.Layer] = append(byLayer[insertion.Layer], insertion)
+	}
+	return a.insertAtLayerStarts(lines, nil, func(layer int) []string {
+		layerLines := []string{}
+		for _, insertion := range byLayer[layer] {
+			for _, line := range insertion.Lines {
+				layerLines = append(layerLines, insertedLines(line, insertion.Plugin+": "+insertion.Reason)...)
+			}
+		}
+		return layerLines
+	})
+}
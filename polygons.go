@@ -0,0 +1,102 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+const LOOP_CLOSE_DISTANCE = 1.0 // mm, an outer wall ending this close to its start is a closed loop (seam gaps, scarf seams)
+
+// layerGeometry is the cross-section of the model in one layer, reconstructed from its outer walls
+type layerGeometry struct {
+	Area     float64 // mm², holes excluded
+	Centroid point
+	Loops    int     // Closed outer wall loops, islands and holes
+	Smallest float64 // mm², area within the smallest island's outline
+}
+
+// isOuterWallFeature reports whether a feature label is printed along the outside of the model,
+// counting overhanging stretches of the outer wall that some slicers label separately
+func isOuterWallFeature(feature string) bool {
+	canonical := canonicalFeature(feature)
+	return canonical == FEATURE_OUTER_WALL || canonical == FEATURE_OVERHANG_WALL
+}
+
+// getLayerLoops returns the closed loops printed as outer wall in each 0-based layer: runs of
+// extrusion without travel in between that end where they started
+func (a *Analysis) getLayerLoops(lines []string) map[int][][]point {
+	loops := make(map[int][][]point)
+	var state machineState
+	currentLayer := -1
+	outerWall := false
+	chain := []point{}
+	endChain := func() {
+		if len(chain) >= 4 && math.Hypot(chain[0].X-chain[len(chain)-1].X, chain[0].Y-chain[len(chain)-1].Y) <= LOOP_CLOSE_DISTANCE {
+			loops[currentLayer] = append(loops[currentLayer], chain)
+		}
+		chain = []point{}
+	}
+	for _, line := range lines {
+		if a.detectLayerChange(line) {
+			endChain()
+			currentLayer++
+			continue
+		}
+		if feature, ok := getFeatureName(line); ok {
+			if outerWall = isOuterWallFeature(feature); !outerWall {
+				endChain()
+			}
+		}
+		previous := state
+		state.update(line)
+		fields := strings.Fields(stripComment(line))
+		if currentLayer < 0 || !outerWall || len(fields) == 0 || (fields[0] != "G0" && fields[0] != "G1") ||
+			!previous.hasPosition || (state.X == previous.X && state.Y == previous.Y) {
+			continue
+		}
+		if state.E <= previous.E {
+			endChain()
+			continue
+		}
+		if len(chain) == 0 {
+			chain = append(chain, point{previous.X, previous.Y})
+		}
+		chain = append(chain, point{state.X, state.Y})
+	}
+	endChain()
+	return loops
+}
+
+// getLayerGeometry returns the area and centroid of the model's cross-section in each 0-based
+// layer. Loops inside an odd number of other loops are holes. Layers without closed outer wall
+// loops, such as those of files without feature labels, have no geometry.
+func (a *Analysis) getLayerGeometry(lines []string) map[int]layerGeometry {
+	geometry := make(map[int]layerGeometry)
+	for layer, loops := range a.getLayerLoops(lines) {
+		area, cx, cy := 0.0, 0.0, 0.0
+		smallest := math.Inf(1)
+		for i, loop := range loops {
+			depth := 0
+			for j, other := range loops {
+				if i != j && containsPoint(other, loop[0]) {
+					depth++
+				}
+			}
+			loopArea := polygonArea(loop)
+			if depth%2 == 1 {
+				loopArea = -loopArea
+			} else if depth == 0 {
+				smallest = math.Min(smallest, loopArea)
+			}
+			centroid := polygonCentroid(loop)
+			area += loopArea
+			cx += centroid.X * loopArea
+			cy += centroid.Y * loopArea
+		}
+		if area <= 0 {
+			continue
+		}
+		geometry[layer] = layerGeometry{Area: area, Centroid: point{cx / area, cy / area}, Loops: len(loops), Smallest: smallest}
+	}
+	return geometry
+}
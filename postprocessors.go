@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// postProcessor is another post-processor that leaves a marker in the files it processed, and
+// possibly blocks of its own between Begin and End comments
+type postProcessor struct {
+	Name   string
+	Marker string // Found, case-insensitively, in a comment or host command of its files
+	Begin  string // Comment opening a block it inserted, if any
+	End    string // Comment closing it
+	Note   string // How it interacts with the modifications
+}
+
+// postProcessors are the other post-processors recognized in the files
+var postProcessors = []postProcessor{
+	{Name: "ArcWelder", Marker: "arcwelder",
+		Note: "arcs (G2/G3) keep their I/J/R offsets, so transforms that scale X or Y distort them"},
+	{Name: "Octolapse", Marker: "@octolapse",
+		Note: "insertions go after its snapshot sequences"},
+	{Name: "klipper_estimator", Marker: "processed by klipper_estimator",
+		Note: "its time estimates and M73 progress don't account for the modifications without -refresh-estimates"},
+	{Name: "Cancel-Object preprocessor", Marker: "pre-processed for cancel-object support",
+		Note: "labeled objects are kept"},
+	{Name: "Cura TimeLapse", Marker: ";timelapse begin", Begin: ";TimeLapse Begin", End: ";TimeLapse End",
+		Note: "its park and snapshot blocks are left unchanged and insertions go after them"},
+	{Name: "Cura post-processing", Marker: ";postprocessed",
+		Note: "scripts ran in Cura before this"},
+}
+
+// getPostProcessors returns the other post-processors that left their marker in the lines
+func getPostProcessors(lines []string) []postProcessor {
+	found := []postProcessor{}
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, ";") && !strings.HasPrefix(trimmed, "@") {
+			continue
+		}
+		// Markers compare with single spaces, none after the semicolon
+		lower := strings.ReplaceAll(strings.ToLower(strings.Join(strings.Fields(trimmed), " ")), "; ", ";")
+		for _, p := range postProcessors {
+			if !seen[p.Name] && strings.Contains(lower, p.Marker) {
+				seen[p.Name] = true
+				found = append(found, p)
+			}
+		}
+	}
+	return found
+}
+
+// printPostProcessors prints the compatibility report of the other post-processors found in the
+// lines and returns their names
+func printPostProcessors(lines []string) []string {
+	names := []string{}
+	for _, p := range getPostProcessors(lines) {
+		fmt.Printf("Also processed by %s: %s\n", p.Name, p.Note)
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// getForeignBlocks marks the lines that belong to blocks inserted by time-lapse sequences and
+// other post-processors, which the modifications leave unchanged and don't insert into
+func getForeignBlocks(lines []string) []bool {
+	blocks := getTimelapseBlocks(lines)
+	open := -1 // Index in postProcessors of the open block
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if open < 0 {
+			for n, p := range postProcessors {
+				if p.Begin != "" && strings.EqualFold(trimmed, p.Begin) {
+					open = n
+				}
+			}
+		}
+		if open >= 0 {
+			blocks[i] = true
+			if strings.EqualFold(trimmed, postProcessors[open].End) {
+				open = -1
+			}
+		}
+	}
+	return blocks
+}
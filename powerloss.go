@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	POWER_LOSS_LAYER_VARIABLE = "gcode_modifier_layer" // Klipper save_variables holding the last saved layer
+	POWER_LOSS_Z_VARIABLE     = "gcode_modifier_z"     // and its Z height
+)
+
+var powerLossEvery int // -power-loss-every, save the print state every this many layers
+
+// getPowerLossLines returns the lines saving the print state at the start of a layer: a state
+// snapshot comment as a breadcrumb for resume (unless -snapshots adds one to every layer) and, on
+// Klipper, the layer and Z height in save_variables, which survive a power loss. Marlin saves its
+// own recovery state once M413 has enabled it, and RepRapFirmware once M911 is configured.
+func getPowerLossLines(layer int, state machineState) []string {
+	saved := []string{}
+	if !stateSnapshots {
+		saved = append(saved, SNAPSHOT_PREFIX+" "+state.String())
+	}
+	if getFirmware() == FIRMWARE_KLIPPER {
+		saved = append(saved,
+			withComment(fmt.Sprintf("SAVE_VARIABLE VARIABLE=%s VALUE=%d", POWER_LOSS_LAYER_VARIABLE, displayLayer(layer)), msg(MSG_POWER_LOSS_SAVE, displayLayer(layer))),
+			fmt.Sprintf("SAVE_VARIABLE VARIABLE=%s VALUE=%.3f", POWER_LOSS_Z_VARIABLE, state.Z))
+	}
+	return saved
+}
+
+// insertPowerLossMarkers saves the print state at the start of every -power-loss-every layer
+// and, on Marlin, enables power-loss recovery with M413 S1 at the first layer
+func (a *Analysis) insertPowerLossMarkers(lines []string) []string {
+	if powerLossEvery <= 0 {
+		return lines
+	}
+	var state machineState
+	saves := 0
+	marked := a.insertAtLayerStarts(lines, func(line string) { state.update(line) }, func(layer int) []string {
+		inserted := []string{}
+		if layer == 0 && getFirmware() == FIRMWARE_MARLIN {
+			inserted = append(inserted, withComment("M413 S1", msg(MSG_POWER_LOSS_ENABLE)))
+		}
+		if layer > 0 && layer%powerLossEvery == 0 && state.hasPosition {
+			saves++
+			inserted = append(inserted, getPowerLossLines(layer, state)...)
+		}
+		return inserted
+	})
+	fmt.Printf("Inserted %d power-loss state saves\n", saves)
+	return marked
+}
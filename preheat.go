@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var preheatChamber int // -preheat-chamber, chamber temperature in °C to wait for before the print
+var soakMinutes int    // -soak-minutes, minutes to hold the heat before the print
+
+// getFirstBedTemp returns the first bed temperature set before the first layer, 0 if none
+func (a *Analysis) getFirstBedTemp(lines []string) int {
+	var state machineState
+	for _, line := range lines {
+		if a.detectLayerChange(line) {
+			break
+		}
+		state.update(line)
+		if state.BedTemp > 0 {
+			return state.BedTemp
+		}
+	}
+	return 0
+}
+
+// getPreheatLines returns the firmware's commands to heat the bed, wait for the chamber to reach
+// -preheat-chamber and hold the heat for -soak-minutes, counting the minutes down on the display
+func getPreheatLines(bedTemp int) []string {
+	firmware := getFirmware()
+	preheat := []string{
+		withComment(fmt.Sprintf("M140 S%d", bedTemp), msg(MSG_PREHEAT_BED, bedTemp)),
+		fmt.Sprintf("M190 S%d", bedTemp),
+	}
+	if preheatChamber > 0 {
+		comment := msg(MSG_PREHEAT_CHAMBER, preheatChamber)
+		if firmware == FIRMWARE_KLIPPER {
+			// Klipper chambers are usually heated by the bed and only measured
+			preheat = append(preheat, withComment(fmt.Sprintf("TEMPERATURE_WAIT SENSOR=\"%s\" MINIMUM=%d", getChamberSensor(), preheatChamber), comment))
+		} else {
+			preheat = append(preheat, withComment(fmt.Sprintf("M141 S%d", preheatChamber), comment),
+				fmt.Sprintf("M191 S%d", preheatChamber))
+		}
+	}
+	for minutes := soakMinutes; minutes > 0; minutes-- {
+		preheat = append(preheat, "M117 "+msg(MSG_SOAK, minutes))
+		if firmware == FIRMWARE_KLIPPER {
+			preheat = append(preheat, "G4 P60000") // Klipper only takes milliseconds
+		} else {
+			preheat = append(preheat, "G4 S60")
+		}
+	}
+	return append(preheat, "M117")
+}
+
+// insertPreheat inserts the -preheat-chamber and -soak-minutes sequence before the first command
+// of the file, so the slicer's start G-code runs on a heat-soaked machine. The bed is heated to
+// the temperature the file first sets.
+func (a *Analysis) insertPreheat(lines []string) []string {
+	if preheatChamber <= 0 && soakMinutes <= 0 {
+		return lines
+	}
+	bedTemp := a.getFirstBedTemp(lines)
+	if bedTemp <= 0 {
+		fmt.Println("Warning: no bed temperature set before the first layer, skipping the preheat")
+		return lines
+	}
+	switch material := getPrintMaterial(lines); material {
+	case "PLA", "TPU":
+		fmt.Printf("Warning: heat soaking for %s, which may soften or clog in a warm chamber\n", material)
+	}
+
+	for i, line := range lines {
+		if strings.TrimSpace(stripComment(line)) == "" {
+			continue
+		}
+		fmt.Printf("Inserting a preheat to %d°C bed", bedTemp)
+		if preheatChamber > 0 {
+			fmt.Printf(", %d°C chamber", preheatChamber)
+		}
+		fmt.Printf(" and %d min soak (%s) before line %d\n", soakMinutes, getFirmware(), i+1)
+		return append(append(append([]string{}, lines[:i]...), getPreheatLines(bedTemp)...), lines[i:]...)
+	}
+	return lines
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DETECTOR_PERIMETER_CHANGE = "perimeter-change" // detectProblematicLayers
+	DEFAULT_PRESET            = "default"
+	PRESETS_DIR_NAME          = "gcode_modifier/presets" // Below os.UserConfigDir()
+)
+
+// preset bundles the detectors to run with the thresholds and modification rules they use
+type preset struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Detectors   []string `json:"detectors"`
+
+	// Perimeter change detection
+	PerimPctChgUpper float64 `json:"perim_pct_chg_upper"`
+	PerimPctChgLower float64 `json:"perim_pct_chg_lower"`
+	MinCurrPerim     float64 `json:"min_curr_perim"`
+	MinProbLayer     int     `json:"min_prob_layer"`
+
+	// Modification rules
+	FanSpeedPct  int  `json:"fan_speed_pct"`
+	TempIncrease int  `json:"temp_increase"`
+	SkipFan      bool `json:"skip_fan"`      // Only change the temperature
+	LayersBefore int  `json:"layers_before"` // Start the changes this many layers below the problematic layer
+	LayersAfter  int  `json:"layers_after"`  // Reset the changes this many layers above the problematic layer
+
+	// Clog risk detection and remedy
+	ClogMaxFlow   float64 `json:"clog_max_flow"`   // Average flow (mm³/s) below which a layer is at risk
+	ClogMinTemp   int     `json:"clog_min_temp"`   // Only layers printed at this temperature (°C) or hotter
+	ClogMinLayers int     `json:"clog_min_layers"` // Consecutive at-risk layers needed to flag a run
+	ClogTempDrop  int     `json:"clog_temp_drop"`  // Lower the temperature by this much over the run
+	ClogSpeedPct  int     `json:"clog_speed_pct"`  // Speed factor (M220) over the run
+
+	// Adhesion risk detection, corrected with the modification rules above
+	AdhesionScoreThreshold float64 `json:"adhesion_score_threshold"` // Flag layers scoring this (0-100) or more
+
+	// Infill density detection
+	InfillDensityTolerance float64 `json:"infill_density_tolerance"` // Flag layers whose density is this % off the median
+
+	// Tipping risk detection and remedy
+	TippingMaxRatio float64 `json:"tipping_max_ratio"` // Flag sections higher above the bed than this many times their width
+	TippingSpeedPct int     `json:"tipping_speed_pct"` // Speed factor (M220) from the first flagged layer on, 100 to only warn
+}
+
+var activePreset = builtinPresets[DEFAULT_PRESET]
+
+// detectorDefaults are the clog risk, adhesion risk, infill density and tipping risk settings of
+// the built-in presets, which only set them where they differ
+var detectorDefaults = preset{
+	ClogMaxFlow:            1.5,
+	ClogMinTemp:            240,
+	ClogMinLayers:          10,
+	ClogTempDrop:           10,
+	ClogSpeedPct:           150,
+	AdhesionScoreThreshold: 60,
+	InfillDensityTolerance: 50,
+	TippingMaxRatio:        8,
+	TippingSpeedPct:        100,
+}
+
+// withDetectorDefaults returns a built-in preset with the detectorDefaults settings it leaves at 0,
+// which none of them mean
+func withDetectorDefaults(p preset) preset {
+	setDefault := func(value *float64, def float64) {
+		if *value == 0 {
+			*value = def
+		}
+	}
+	setIntDefault := func(value *int, def int) {
+		if *value == 0 {
+			*value = def
+		}
+	}
+	setDefault(&p.ClogMaxFlow, detectorDefaults.ClogMaxFlow)
+	setIntDefault(&p.ClogMinTemp, detectorDefaults.ClogMinTemp)
+	setIntDefault(&p.ClogMinLayers, detectorDefaults.ClogMinLayers)
+	setIntDefault(&p.ClogTempDrop, detectorDefaults.ClogTempDrop)
+	setIntDefault(&p.ClogSpeedPct, detectorDefaults.ClogSpeedPct)
+	setDefault(&p.AdhesionScoreThreshold, detectorDefaults.AdhesionScoreThreshold)
+	setDefault(&p.InfillDensityTolerance, detectorDefaults.InfillDensityTolerance)
+	setDefault(&p.TippingMaxRatio, detectorDefaults.TippingMaxRatio)
+	setIntDefault(&p.TippingSpeedPct, detectorDefaults.TippingSpeedPct)
+	return p
+}
+
+var builtinPresets = map[string]preset{
+	DEFAULT_PRESET: withDetectorDefaults(preset{
+		Name:        DEFAULT_PRESET,
+		Description: "Slow the fan and raise the temperature around layers whose perimeter drops sharply",
+		Detectors: []string{DETECTOR_PERIMETER_CHANGE, DETECTOR_COOLING_MODEL, DETECTOR_INFILL_DENSITY,
+			DETECTOR_TIPPING_RISK, DETECTOR_SMALL_FOOTPRINT},
+		PerimPctChgUpper: PERIM_PCT_CHG_UPPER,
+		PerimPctChgLower: PERIM_PCT_CHG_LOWER,
+		MinCurrPerim:     MIN_CURR_PERIM,
+		MinProbLayer:     MIN_PROB_LAYER,
+		FanSpeedPct:      FAN_SPEED_PCT_PROB_LAYERS,
+		TempIncrease:     TEMP_INCREASE_PROB_LAYERS,
+		LayersBefore:     2,
+		LayersAfter:      3,
+	}),
+	"small-towers": withDetectorDefaults(preset{
+		Name:             "small-towers",
+		Description:      "Catch thin towers and pins early: lower perimeter and layer limits, milder correction, slower tall sections",
+		Detectors:        []string{DETECTOR_PERIMETER_CHANGE, DETECTOR_COOLING_MODEL, DETECTOR_TIPPING_RISK},
+		PerimPctChgUpper: -40,
+		PerimPctChgLower: -98,
+		MinCurrPerim:     30,
+		MinProbLayer:     5,
+		FanSpeedPct:      20,
+		TempIncrease:     10,
+		LayersBefore:     1,
+		LayersAfter:      4,
+		TippingSpeedPct:  70,
+	}),
+	"warping-petg": withDetectorDefaults(preset{
+		Name:             "warping-petg",
+		Description:      "Keep PETG warm over a wider window around shrinking layers to limit warping",
+		Detectors:        []string{DETECTOR_PERIMETER_CHANGE, DETECTOR_COOLING_MODEL},
+		PerimPctChgUpper: PERIM_PCT_CHG_UPPER,
+		PerimPctChgLower: PERIM_PCT_CHG_LOWER,
+		MinCurrPerim:     MIN_CURR_PERIM,
+		MinProbLayer:     10,
+		FanSpeedPct:      1,
+		TempIncrease:     10,
+		LayersBefore:     4,
+		LayersAfter:      5,
+	}),
+	"heat-creep": withDetectorDefaults(preset{
+		Name:             "heat-creep",
+		Description:      "Default corrections plus cooler, faster printing over long slow low-flow stretches",
+		Detectors:        []string{DETECTOR_PERIMETER_CHANGE, DETECTOR_COOLING_MODEL, DETECTOR_CLOG_RISK},
+		PerimPctChgUpper: PERIM_PCT_CHG_UPPER,
+		PerimPctChgLower: PERIM_PCT_CHG_LOWER,
+		MinCurrPerim:     MIN_CURR_PERIM,
+		MinProbLayer:     MIN_PROB_LAYER,
+		FanSpeedPct:      FAN_SPEED_PCT_PROB_LAYERS,
+		TempIncrease:     TEMP_INCREASE_PROB_LAYERS,
+		LayersBefore:     2,
+		LayersAfter:      3,
+	}),
+	"adhesion": withDetectorDefaults(preset{
+		Name:             "adhesion",
+		Description:      "Default corrections around layers with a high adhesion risk score instead of a perimeter drop",
+		Detectors:        []string{DETECTOR_ADHESION_RISK},
+		PerimPctChgUpper: PERIM_PCT_CHG_UPPER,
+		PerimPctChgLower: PERIM_PCT_CHG_LOWER,
+		MinCurrPerim:     MIN_CURR_PERIM,
+		MinProbLayer:     MIN_PROB_LAYER,
+		FanSpeedPct:      FAN_SPEED_PCT_PROB_LAYERS,
+		TempIncrease:     TEMP_INCREASE_PROB_LAYERS,
+		LayersBefore:     2,
+		LayersAfter:      3,
+	}),
+	"bridging": withDetectorDefaults(preset{
+		Name:             "bridging",
+		Description:      "Full fan and a cooler nozzle on layers whose perimeter grows sharply (bridges, overhangs)",
+		Detectors:        []string{DETECTOR_PERIMETER_CHANGE},
+		PerimPctChgUpper: 10000,
+		PerimPctChgLower: 100,
+		MinCurrPerim:     MIN_CURR_PERIM,
+		MinProbLayer:     2,
+		FanSpeedPct:      100,
+		TempIncrease:     -10,
+		LayersBefore:     0,
+		LayersAfter:      2,
+	}),
+}
+
+// hasDetector reports whether the preset runs the named detector
+func (p preset) hasDetector(name string) bool {
+	for _, detector := range p.Detectors {
+		if detector == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getPresetsDir returns the directory holding user-defined preset files (<name>.json)
+func getPresetsDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, PRESETS_DIR_NAME)
+}
+
+// loadUserPresets reads the user-defined presets; fields missing from a file keep the default
+// preset's values
+func loadUserPresets() map[string]preset {
+	presets := make(map[string]preset)
+	dir := getPresetsDir()
+	if dir == "" {
+		return presets
+	}
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Error reading preset '%s': %v\n", path, err)
+			continue
+		}
+		p := builtinPresets[DEFAULT_PRESET]
+		p.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+		if err := json.Unmarshal(data, &p); err != nil {
+			fmt.Printf("Error parsing preset '%s': %v\n", path, err)
+			continue
+		}
+		presets[p.Name] = p
+	}
+	return presets
+}
+
+// getAllPresets returns the built-in presets overlaid with the user-defined ones
+func getAllPresets() map[string]preset {
+	presets := make(map[string]preset)
+	for name, p := range builtinPresets {
+		presets[name] = p
+	}
+	for name, p := range loadUserPresets() {
+		presets[name] = p
+	}
+	return presets
+}
+
+// getPreset looks up a built-in or user-defined preset by name
+func getPreset(name string) (preset, error) {
+	p, ok := getAllPresets()[name]
+	if !ok {
+		return preset{}, fmt.Errorf("unknown preset '%s' (see 'presets list')", name)
+	}
+	return p, nil
+}
+
+// runPresetsCommand implements "presets list" and "presets show <name>"
+func runPresetsCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: gcode_modifier presets list | show <name>")
+		os.Exit(1)
+	}
+
+	presets := getAllPresets()
+	switch args[0] {
+	case "list":
+		names := make([]string, 0, len(presets))
+		for name := range presets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-16s %s\n", name, presets[name].Description)
+		}
+		fmt.Printf("\nUser presets are read from %s\n", getPresetsDir())
+	case "show":
+		if len(args) < 2 {
+			fmt.Println("Usage: gcode_modifier presets show <name>")
+			os.Exit(1)
+		}
+		p, err := getPreset(args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		data, _ := json.MarshalIndent(p, "", "  ")
+		fmt.Println(string(data))
+	default:
+		fmt.Printf("Unknown presets command '%s'\n", args[0])
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+)
+
+const PAUSE_PRIME_FEEDRATE = 300 // mm/min, slow enough to push out filament without skipping
+
+var pausePrime float64 // -pause-prime, mm of filament primed after inserted pauses, parks and dwells
+
+// getPrimeLines returns the commands that push out -pause-prime mm of filament at the nozzle's
+// position, to make up for what oozed during an inserted pause, park or dwell, and restore the
+// feedrate. In absolute E mode, the E position is moved back first so the file's E values still
+// follow on.
+func (a *Analysis) getPrimeLines(state machineState) []string {
+	if pausePrime <= 0 {
+		return nil
+	}
+	comment := msg(MSG_PAUSE_PRIME, pausePrime)
+	prime := []string{}
+	feedrate := a.numbers.param('F', PAUSE_PRIME_FEEDRATE)
+	if state.Mode.relativeE() {
+		prime = append(prime, withComment(fmt.Sprintf("G1 %s %s", a.numbers.param('E', pausePrime), feedrate), comment))
+	} else {
+		prime = append(prime,
+			withComment("G92 "+a.numbers.param('E', state.E-pausePrime), comment),
+			fmt.Sprintf("G1 %s %s", a.numbers.param('E', state.E), feedrate))
+	}
+	if state.Feedrate > 0 {
+		prime = append(prime, "G1 "+a.numbers.param('F', state.Feedrate))
+	}
+	return prime
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const PRINTERS_DIR_NAME = "gcode_modifier/printers" // Below os.UserConfigDir()
+
+// printerProfile describes the machine files are prepared for
+type printerProfile struct {
+	Name  string `json:"name"`
+	Model string `json:"model"` // As written by the slicer in "; printer_model = ..."
+
+	Firmware      string         `json:"firmware,omitempty"`       // FIRMWARE_MARLIN, FIRMWARE_KLIPPER or FIRMWARE_REPRAP
+	ChamberSensor string         `json:"chamber_sensor,omitempty"` // Klipper sensor measuring the chamber
+	Brush         *brushLocation `json:"brush,omitempty"`          // Nozzle brush used by -wipe-every and -wipe-flagged
+	Progress      string         `json:"progress,omitempty"`       // PROGRESS_KEEP, PROGRESS_STRIP or PROGRESS_M117
+	NotifyMacro   string         `json:"notify_macro,omitempty"`   // Klipper macro run at -notify-at-layer notifications, e.g. to flash the LEDs
+
+	BuildVolume             *buildVolume `json:"build_volume,omitempty"`              // Reachable nozzle positions, checked by bounds and when processing
+	GantryHeight            float64      `json:"gantry_height,omitempty"`             // mm from the nozzle tip up to the gantry; in sequential prints, objects printed before others must be lower
+	ExtruderClearanceRadius float64      `json:"extruder_clearance_radius,omitempty"` // mm around the nozzle the print head takes up below the gantry
+
+	Accel                float64       `json:"accel,omitempty"`                  // mm/s², for -refresh-estimates when the file doesn't set it
+	SquareCornerVelocity float64       `json:"square_corner_velocity,omitempty"` // mm/s, for -refresh-estimates
+	HeatRate             float64       `json:"heat_rate,omitempty"`              // °C/s the hotend heats at, for timing -standby-after reheats
+	Power                *powerProfile `json:"power,omitempty"`                  // Power draw, for -energy
+
+	Upload map[string]json.RawMessage `json:"upload,omitempty"` // Settings of each -upload backend, by its name
+}
+
+var activePrinter *printerProfile // -printer, nil when not given
+var strictPrinter bool            // Fail instead of warning when a file was sliced for another printer or loaded filament
+
+// getPrintersDir returns the directory holding printer profile files (<name>.json)
+func getPrintersDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, PRINTERS_DIR_NAME)
+}
+
+// loadPrinterProfile returns the named profile from the printers directory; a name without a
+// profile file is taken as the printer model itself
+func loadPrinterProfile(name string) (*printerProfile, error) {
+	profile := &printerProfile{Name: name, Model: name}
+	dir := getPrintersDir()
+	if dir == "" {
+		return profile, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name+".json"))
+	if os.IsNotExist(err) {
+		return profile, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, profile); err != nil {
+		return nil, fmt.Errorf("parsing printer profile '%s': %v", name, err)
+	}
+	return profile, nil
+}
+
+// getPrinterModel gets the printer the file was sliced for (e.g. "; printer_model = Bambu Lab X1 Carbon")
+func getPrinterModel(lines []string) string {
+	for _, line := range lines {
+		if strings.HasPrefix(line, "; printer_model = ") {
+			return strings.TrimSpace(strings.Split(line, " = ")[1])
+		}
+	}
+	return ""
+}
+
+// checkPrinterModel warns, or with -strict-printer exits, when the file was sliced for a
+// different printer than the -printer profile
+func checkPrinterModel(filePath string, lines []string) {
+	if activePrinter == nil || activePrinter.Model == "" {
+		return
+	}
+	model := getPrinterModel(lines)
+	if model == "" {
+		fmt.Printf("Warning: '%s' has no printer_model metadata to check against '%s'\n", filePath, activePrinter.Model)
+		return
+	}
+	if strings.EqualFold(model, activePrinter.Model) {
+		return
+	}
+	if strictPrinter {
+		fmt.Printf("Error: '%s' was sliced for '%s', not '%s'\n", filePath, model, activePrinter.Model)
+		os.Exit(1)
+	}
+	fmt.Printf("Warning: '%s' was sliced for '%s', not '%s'\n", filePath, model, activePrinter.Model)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	PROGRESS_KEEP  = "keep"
+	PROGRESS_STRIP = "strip" // For firmware that hangs on M73
+	PROGRESS_M117  = "m117"  // Show the progress as a display message instead
+)
+
+var progressMode string // -progress, overrides the printer profile's progress handling
+
+// getProgressMode returns how M73 progress commands are handled: -progress, else the printer
+// profile's, else they are kept
+func getProgressMode() string {
+	if progressMode != "" {
+		return progressMode
+	}
+	if activePrinter != nil && activePrinter.Progress != "" {
+		return activePrinter.Progress
+	}
+	return PROGRESS_KEEP
+}
+
+// validateProgressMode exits if -progress or the printer profile names an unknown mode
+func validateProgressMode() {
+	switch mode := getProgressMode(); mode {
+	case PROGRESS_KEEP, PROGRESS_STRIP, PROGRESS_M117:
+	default:
+		fmt.Printf("Error: unknown progress mode '%s' (use %s, %s or %s)\n", mode, PROGRESS_KEEP, PROGRESS_STRIP, PROGRESS_M117)
+		os.Exit(1)
+	}
+}
+
+// getProgressMessage returns the M117 message for an M73 command, or "" when it has no percentage
+// (e.g. Bambu's "M73 L12" layer counter)
+func getProgressMessage(fields []string) string {
+	percent, remaining := "", ""
+	for _, field := range fields[1:] {
+		if _, err := strconv.ParseFloat(field[1:], 64); err != nil {
+			continue
+		}
+		switch field[0] {
+		case 'P':
+			percent = field[1:]
+		case 'R':
+			remaining = field[1:]
+		}
+	}
+	if percent == "" {
+		return ""
+	}
+	if remaining == "" {
+		return fmt.Sprintf("M117 %s%%", percent)
+	}
+	return fmt.Sprintf("M117 %s%% %s min left", percent, remaining)
+}
+
+// convertProgress strips the M73 progress commands, or replaces them with M117 display messages,
+// as the -progress mode asks
+func convertProgress(lines []string) []string {
+	mode := getProgressMode()
+	if mode == PROGRESS_KEEP {
+		return lines
+	}
+	converted := make([]string, 0, len(lines))
+	stripped, replaced := 0, 0
+	for _, line := range lines {
+		fields := strings.Fields(stripComment(line))
+		if len(fields) == 0 || fields[0] != "M73" {
+			converted = append(converted, line)
+			continue
+		}
+		if mode == PROGRESS_M117 {
+			if message := getProgressMessage(fields); message != "" {
+				converted = append(converted, message)
+				replaced++
+				continue
+			}
+		}
+		stripped++
+	}
+	fmt.Printf("Progress commands (M73): %d removed, %d replaced with M117\n", stripped, replaced)
+	return converted
+}
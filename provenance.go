@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	PROVENANCE_MAP_SUFFIX = "_map.tsv" // Suffix of the provenance map written next to an output
+	PROVENANCE_WINDOW     = 200        // Lines looked ahead in either file to find where they agree again
+	PROVENANCE_LOG_RULE   = "processing-log"
+
+	ORIGIN_KEPT     = "kept"
+	ORIGIN_CHANGED  = "changed"  // An original line rewritten, e.g. by -transforms or -speed-override
+	ORIGIN_INSERTED = "inserted" // With the message ID of the rule that inserted it, when known
+)
+
+var provenanceMap bool // -provenance-map, write a map of each output line to its origin
+
+// lineOrigin is where an output line comes from
+type lineOrigin struct {
+	Kind     string // ORIGIN_*
+	Original int    // 1-based line of the input, 0 for inserted lines
+	Rule     string // Message ID of the inserted comment, or PROVENANCE_LOG_RULE
+}
+
+// messageRegexp is a message of the active catalog with its format verbs as wildcards
+type messageRegexp struct {
+	ID     string
+	Regexp *regexp.Regexp
+}
+
+// getMessageRegexps returns the messages of the active catalog as regexps, longest first so a
+// message containing another is recognized as itself. Messages with too little fixed text to
+// recognize are left out.
+func getMessageRegexps() []messageRegexp {
+	ids := []string{}
+	for id := range activeCatalog {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if len(activeCatalog[ids[i]]) != len(activeCatalog[ids[j]]) {
+			return len(activeCatalog[ids[i]]) > len(activeCatalog[ids[j]])
+		}
+		return ids[i] < ids[j]
+	})
+	messages := []messageRegexp{}
+	for _, id := range ids {
+		parts := formatVerbRegexp.Split(activeCatalog[id], -1)
+		if len(strings.Join(parts, "")) < 4 {
+			continue
+		}
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		messages = append(messages, messageRegexp{ID: id, Regexp: regexp.MustCompile(strings.Join(parts, ".*?"))})
+	}
+	return messages
+}
+
+// getInsertionRules returns the rule that inserted each output line, as far as it can be told
+// from the line: the message ID of its comment or of the message it shows, or
+// PROVENANCE_LOG_RULE for the processing log, and for -annotate comments the rule of the line they
+// explain. Lines inserted without a comment get "".
+func getInsertionRules(lines []string) []string {
+	messages := getMessageRegexps()
+	rules := make([]string, len(lines))
+	inLog := false
+	for i, line := range lines {
+		switch {
+		case line == LOG_BEGIN:
+			inLog = true
+		case inLog || line == MODIFIED_MARKER:
+		default:
+			for _, message := range messages {
+				if message.Regexp.MatchString(line) {
+					rules[i] = message.ID
+					break
+				}
+			}
+			continue
+		}
+		rules[i] = PROVENANCE_LOG_RULE
+		if strings.HasPrefix(line, LOG_END) {
+			inLog = false
+		}
+	}
+	// An -annotate comment belongs to the line it explains
+	for i := len(rules) - 2; i >= 0; i-- {
+		if rules[i] == MSG_INSERTED_NEXT_LINE && rules[i+1] != "" {
+			rules[i] = rules[i+1]
+		}
+	}
+	return rules
+}
+
+// findResync returns how many lines of the output (a) and the input (b) to skip from i and j until
+// two lines in a row agree again, with the fewest skipped; ok is false when they don't within
+// PROVENANCE_WINDOW lines
+func findResync(output, original []string, i, j int) (a, b int, ok bool) {
+	positions := make(map[string][]int)
+	for k := j; k < min(j+PROVENANCE_WINDOW, len(original)); k++ {
+		positions[original[k]] = append(positions[original[k]], k-j)
+	}
+	best := -1
+	for da := 0; da < PROVENANCE_WINDOW && i+da < len(output); da++ {
+		if best >= 0 && da >= best {
+			break
+		}
+		for _, db := range positions[output[i+da]] {
+			agrees := i+da+1 >= len(output) || j+db+1 >= len(original) || output[i+da+1] == original[j+db+1]
+			if agrees && (best < 0 || da+db < best) {
+				a, b, best = da, db, da+db
+			}
+		}
+	}
+	return a, b, best >= 0
+}
+
+// getLineOrigins traces every output line to the input line it was kept or changed from, or to the
+// rule that inserted it. The files are walked together; where they disagree, the lines until they
+// agree again are the output's inserted lines, recognized by their comments, and the rest are
+// paired in order with the input's skipped lines as changed ones. Input lines left over were
+// removed or moved, so moved lines count as inserted. Inserted lines without a comment, such as
+// the moves of a wipe, take the rule of the commented lines of the same block.
+func getLineOrigins(original, output []string) []lineOrigin {
+	rules := getInsertionRules(output)
+	origins := make([]lineOrigin, len(output))
+	j := 0
+	for i := 0; i < len(output); {
+		if j < len(original) && output[i] == original[j] {
+			origins[i] = lineOrigin{Kind: ORIGIN_KEPT, Original: j + 1}
+			i, j = i+1, j+1
+			continue
+		}
+		a, b, ok := findResync(output, original, i, j)
+		if !ok {
+			a, b = 1, 0
+		}
+		block, blockRule := []int{}, ""
+		for k := i; k < i+a; k++ {
+			switch {
+			case rules[k] != "":
+				origins[k] = lineOrigin{Kind: ORIGIN_INSERTED, Rule: rules[k]}
+				if blockRule == "" {
+					blockRule = rules[k]
+				}
+			case b > 0:
+				origins[k] = lineOrigin{Kind: ORIGIN_CHANGED, Original: j + 1}
+				j, b = j+1, b-1
+			default:
+				origins[k] = lineOrigin{Kind: ORIGIN_INSERTED}
+				block = append(block, k)
+			}
+		}
+		for _, k := range block {
+			origins[k].Rule = blockRule
+		}
+		i, j = i+a, j+b
+	}
+	return origins
+}
+
+// writeProvenanceMap writes the origin of each output line as tab-separated values: the output
+// line, kept, changed or inserted, the input line (or -) and the inserting rule (or -)
+func writeProvenanceMap(w io.Writer, origins []lineOrigin) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# output_line\torigin\toriginal_line\trule")
+	for i, origin := range origins {
+		original, rule := "-", "-"
+		if origin.Original > 0 {
+			original = fmt.Sprint(origin.Original)
+		}
+		if origin.Rule != "" {
+			rule = origin.Rule
+		}
+		fmt.Fprintf(bw, "%d\t%s\t%s\t%s\n", i+1, origin.Kind, original, rule)
+	}
+	return bw.Flush()
+}
+
+// saveProvenanceMap writes the provenance map of an output next to it, as <name>_map.tsv
+func saveProvenanceMap(outputFilePath string, original, output []string) {
+	origins := getLineOrigins(original, output)
+	counts := make(map[string]int)
+	for _, origin := range origins {
+		counts[origin.Kind]++
+	}
+	name, _ := splitGcodeExt(outputFilePath)
+	mapPath := name + PROVENANCE_MAP_SUFFIX
+	err := writeFileAtomic(mapPath, func(w io.Writer) error {
+		return writeProvenanceMap(w, origins)
+	})
+	if err != nil {
+		fmt.Printf("Error writing provenance map: %v\n", err)
+		return
+	}
+	fmt.Printf("Provenance map saved to %s: %d kept, %d changed and %d inserted lines\n", mapPath,
+		counts[ORIGIN_KEPT], counts[ORIGIN_CHANGED], counts[ORIGIN_INSERTED])
+}
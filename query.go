@@ -0,0 +1,329 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Fields of a query besides the single-letter command parameters
+const (
+	QUERY_LAYER   = "layer"
+	QUERY_LINE    = "line"
+	QUERY_CMD     = "cmd"
+	QUERY_FEATURE = "feature"
+	QUERY_COMMENT = "comment"
+)
+
+var queryOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "~", "!", "(", ")"}
+
+// queryLine is a command line of a file as a query sees it
+type queryLine struct {
+	Number  int // 1-based
+	Layer   int // 0-based, -1 before the first layer
+	Feature string
+	Command Command
+}
+
+// queryExpr is a parsed query predicate
+type queryExpr interface {
+	match(l queryLine) bool
+}
+
+type queryAnd struct{ left, right queryExpr }
+type queryOr struct{ left, right queryExpr }
+type queryNot struct{ expr queryExpr }
+
+// queryComparison compares a field of the line with a value: numbers with == != < <= > >=,
+// text case-insensitively with == != and ~ (contains)
+type queryComparison struct {
+	field  string
+	op     string
+	text   string
+	number float64
+}
+
+func (q queryAnd) match(l queryLine) bool { return q.left.match(l) && q.right.match(l) }
+func (q queryOr) match(l queryLine) bool  { return q.left.match(l) || q.right.match(l) }
+func (q queryNot) match(l queryLine) bool { return !q.expr.match(l) }
+
+func (q queryComparison) match(l queryLine) bool {
+	switch q.field {
+	case QUERY_CMD:
+		return q.matchText(l.Command.Name)
+	case QUERY_FEATURE:
+		// The slicer's label or its canonical type, e.g. "External perimeter" or outer_wall
+		if q.op == "!=" {
+			return q.matchText(l.Feature) && q.matchText(canonicalFeature(l.Feature))
+		}
+		return q.matchText(l.Feature) || q.matchText(canonicalFeature(l.Feature))
+	case QUERY_COMMENT:
+		return q.matchText(l.Command.Comment)
+	case QUERY_LAYER:
+		return q.matchNumber(float64(displayLayer(l.Layer)))
+	case QUERY_LINE:
+		return q.matchNumber(float64(l.Number))
+	}
+	value, ok := l.Command.Params[q.field[0]]
+	return ok && q.matchNumber(value)
+}
+
+// matchText compares text with the value, ignoring case
+func (q queryComparison) matchText(text string) bool {
+	text, value := strings.ToLower(text), strings.ToLower(q.text)
+	switch q.op {
+	case "==":
+		return text == value
+	case "!=":
+		return text != value
+	}
+	return strings.Contains(text, value)
+}
+
+// matchNumber compares a number with the value
+func (q queryComparison) matchNumber(number float64) bool {
+	switch q.op {
+	case "==":
+		return number == q.number
+	case "!=":
+		return number != q.number
+	case "<":
+		return number < q.number
+	case "<=":
+		return number <= q.number
+	case ">":
+		return number > q.number
+	}
+	return number >= q.number
+}
+
+// tokenizeQuery splits a query into operators, words and quoted strings (kept with their quotes)
+func tokenizeQuery(query string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(query); {
+		if query[i] == ' ' || query[i] == '\t' {
+			i++
+			continue
+		}
+		if query[i] == '"' {
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", i+1)
+			}
+			tokens = append(tokens, query[i:i+end+2])
+			i += end + 2
+			continue
+		}
+		operator := ""
+		for _, op := range queryOperators {
+			if strings.HasPrefix(query[i:], op) {
+				operator = op
+				break
+			}
+		}
+		if operator != "" {
+			tokens = append(tokens, operator)
+			i += len(operator)
+			continue
+		}
+		end := i
+		for end < len(query) && !strings.ContainsRune(" \t\"&|=!<>()~", rune(query[end])) {
+			end++
+		}
+		if end == i {
+			return nil, fmt.Errorf("unexpected '%c' at position %d", query[i], i+1)
+		}
+		tokens = append(tokens, query[i:end])
+		i = end
+	}
+	return tokens, nil
+}
+
+// queryParser parses tokens by recursive descent: || binds looser than &&, which binds looser
+// than ! and parentheses
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseQuery parses a query such as 'layer>50 && cmd==M106 && S<100'
+func parseQuery(query string) (queryExpr, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty query")
+	}
+	p := &queryParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+// peek returns the next token, "" at the end
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek() == "||" {
+		p.pos++
+		var right queryExpr
+		if right, err = p.parseAnd(); err == nil {
+			left = queryOr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.peek() == "&&" {
+		p.pos++
+		var right queryExpr
+		if right, err = p.parseUnary(); err == nil {
+			left = queryAnd{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *queryParser) parseUnary() (queryExpr, error) {
+	switch p.peek() {
+	case "!":
+		p.pos++
+		expr, err := p.parseUnary()
+		return queryNot{expr}, err
+	case "(":
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+// parseComparison parses "field op value"
+func (p *queryParser) parseComparison() (queryExpr, error) {
+	if p.pos+3 > len(p.tokens) {
+		return nil, fmt.Errorf("incomplete comparison at the end")
+	}
+	field, op, value := p.tokens[p.pos], p.tokens[p.pos+1], strings.Trim(p.tokens[p.pos+2], "\"")
+	p.pos += 3
+
+	comparison := queryComparison{field: strings.ToLower(field), op: op, text: value}
+	switch comparison.field {
+	case QUERY_CMD, QUERY_FEATURE, QUERY_COMMENT:
+		if op != "==" && op != "!=" && op != "~" {
+			return nil, fmt.Errorf("%s can only be compared with ==, != or ~, not '%s'", field, op)
+		}
+		return comparison, nil
+	case QUERY_LAYER, QUERY_LINE:
+	default:
+		if len(field) != 1 || !unicode.IsLetter(rune(field[0])) {
+			return nil, fmt.Errorf("unknown field '%s' (use %s, %s, %s, %s, %s or a parameter letter)",
+				field, QUERY_LAYER, QUERY_LINE, QUERY_CMD, QUERY_FEATURE, QUERY_COMMENT)
+		}
+		comparison.field = strings.ToUpper(field)
+	}
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("%s can't be compared with '%s'", field, op)
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be compared with a number, not '%s'", field, value)
+	}
+	comparison.number = number
+	return comparison, nil
+}
+
+// queryFlags are the flags of the query command
+type queryFlags struct {
+	inputFilePath *string
+	countOnly     *bool
+}
+
+// defineQueryFlags defines the flags of the query command on a flag set
+func defineQueryFlags(fs *flag.FlagSet) queryFlags {
+	var flags queryFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	flags.countOnly = fs.Bool("count", false, "Print only the number of matching lines (Default=false)")
+	addLayerBaseFlag(fs)
+	return flags
+}
+
+// runQueryCommand implements "query": it prints the command lines of a G-code file that match a
+// query, with their line and layer numbers
+func runQueryCommand(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	flags := defineQueryFlags(fs)
+	setCommandUsage(fs, "query")
+	fs.Parse(args)
+	validateLayerBase()
+
+	if *flags.inputFilePath == "" || fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	query, err := parseQuery(fs.Arg(0))
+	if err != nil {
+		fmt.Printf("Error in query: %v\n", err)
+		os.Exit(1)
+	}
+	lines, _, err := readLines(*flags.inputFilePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+
+	doc := NewDocument(lines)
+	matches := 0
+	feature := ""
+	visit := func(layer int, firstLine int, layerLines []string) {
+		for i, line := range layerLines {
+			if name, ok := getFeatureName(line); ok {
+				feature = name
+			}
+			command, ok := parseCommand(line)
+			if !ok || !query.match(queryLine{Number: firstLine + i, Layer: layer, Feature: feature, Command: command}) {
+				continue
+			}
+			matches++
+			if !*flags.countOnly {
+				fmt.Printf("%7d  layer %-4d %s\n", firstLine+i, displayLayer(layer), line)
+			}
+		}
+	}
+	visit(-1, 1, doc.Header())
+	firstLine := len(doc.Header()) + 1
+	for layer := 0; layer < doc.LayerCount(); layer++ {
+		visit(layer, firstLine, doc.Layer(layer).Lines())
+		firstLine += len(doc.Layer(layer).Lines())
+	}
+
+	fmt.Printf("%d matching lines\n", matches)
+	if matches == 0 {
+		os.Exit(1)
+	}
+}
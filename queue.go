@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	QUEUE_ORDER_NAME     = "name"
+	QUEUE_ORDER_OLDEST   = "oldest"
+	QUEUE_ORDER_SMALLEST = "smallest"
+
+	QUEUE_DEFAULT_POLL = 30 * time.Second
+)
+
+// queuedUpload is an output of a -d run waiting to be uploaded
+type queuedUpload struct {
+	Source string // The file it was made from
+	Output string
+}
+
+var (
+	queueOrder    string        // -queue-order, QUEUE_ORDER_NAME, QUEUE_ORDER_OLDEST or QUEUE_ORDER_SMALLEST
+	queueWait     bool          // -queue-wait, wait for a busy printer instead of leaving the uploads
+	queuePoll     time.Duration // -queue-poll, how often a busy printer is checked
+	queueUploads  bool          // Outputs are queued for runUploadQueue instead of uploaded at once
+	uploadQueue   []queuedUpload
+	queueStarted  bool // The last upload of the queue started a print
+	queueNotified bool // The printer being busy was reported
+)
+
+// validateQueueOrder exits if -queue-order is unknown
+func validateQueueOrder() {
+	if !slices.Contains([]string{QUEUE_ORDER_NAME, QUEUE_ORDER_OLDEST, QUEUE_ORDER_SMALLEST}, queueOrder) {
+		fmt.Printf("Error: unknown -queue-order '%s' (use %s, %s or %s)\n", queueOrder, QUEUE_ORDER_NAME, QUEUE_ORDER_OLDEST, QUEUE_ORDER_SMALLEST)
+		os.Exit(1)
+	}
+}
+
+// sortUploadQueue orders the queued uploads by -queue-order: by source name, oldest source first,
+// or smallest output first
+func sortUploadQueue() {
+	keys := make(map[string]int64)
+	for _, upload := range uploadQueue {
+		switch queueOrder {
+		case QUEUE_ORDER_OLDEST:
+			if info, err := os.Stat(upload.Source); err == nil {
+				keys[upload.Source] = info.ModTime().UnixNano()
+			}
+		case QUEUE_ORDER_SMALLEST:
+			if info, err := os.Stat(upload.Output); err == nil {
+				keys[upload.Source] = info.Size()
+			}
+		}
+	}
+	sort.SliceStable(uploadQueue, func(i, j int) bool {
+		a, b := uploadQueue[i], uploadQueue[j]
+		if keys[a.Source] != keys[b.Source] {
+			return keys[a.Source] < keys[b.Source]
+		}
+		return a.Source < b.Source
+	})
+}
+
+// waitForIdlePrinter returns once the -upload printer isn't busy. A busy printer is an error
+// without -queue-wait; with it, the printer is checked every -queue-poll until it's idle.
+func waitForIdlePrinter(ctx context.Context) error {
+	for {
+		status, ok, err := getPrinterStatus()
+		if err != nil {
+			return fmt.Errorf("checking the printer: %v", err)
+		}
+		if !ok || !status.Busy {
+			return nil
+		}
+		if !queueWait {
+			return fmt.Errorf("the printer is %s (use -queue-wait to wait for it)", status.State)
+		}
+		if !queueNotified {
+			fmt.Printf("Printer is %s, waiting for it to finish\n", status.State)
+			queueNotified = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(queuePoll):
+		}
+	}
+}
+
+// runUploadQueue uploads the queued outputs one at a time in -queue-order, each once the printer
+// is idle. Uploads that start a print therefore start each print when the previous one completes.
+func runUploadQueue(ctx context.Context) {
+	if len(uploadQueue) == 0 {
+		return
+	}
+	sortUploadQueue()
+	for n, upload := range uploadQueue {
+		if queueStarted {
+			// Give the print just started time to show in the printer's status
+			select {
+			case <-ctx.Done():
+			case <-time.After(queuePoll):
+			}
+		}
+		err := ctx.Err()
+		if err == nil {
+			err = waitForIdlePrinter(ctx)
+		}
+		if err != nil {
+			fmt.Printf("Left %d outputs not uploaded: %v\n", len(uploadQueue)-n, err)
+			for _, left := range uploadQueue[n:] {
+				fmt.Printf("  %s\n", left.Output)
+			}
+			return
+		}
+		queueNotified = false
+		queueStarted = uploadOutput(upload.Output)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"text/tabwriter"
+)
+
+const GRAMS_PER_KG = 1000.0
+
+// batchUsage is what printing one file of a directory run takes
+type batchUsage struct {
+	Duration float64 // s, heating waits included
+	Filament float64 // mm
+	Grams    float64
+	Energy   float64 // Wh
+}
+
+var batchRun bool         // Processing a -d directory
+var filamentPrice float64 // -filament-price, per kg
+var energyPrice float64   // -energy-price, per kWh
+var machineRate float64   // -machine-rate, per hour of printing
+var co2Intensity float64  // -co2-intensity, g CO2 per kWh
+
+// getBatchUsage returns the time, filament and energy printing the lines takes, with the filament
+// weighed at the file's density
+func getBatchUsage(lines []string) *batchUsage {
+	energy := estimateEnergy(lines)
+	filament := getFilamentUsed(lines)
+	area := math.Pi * math.Pow(getFilamentDiameter(lines)/2, 2) // mm²
+	return &batchUsage{
+		Duration: energy.Duration,
+		Filament: filament,
+		Grams:    area * filament * getFilamentDensity(lines) / 1000, // mm³ to cm³
+		Energy:   energy.Total(),
+	}
+}
+
+// getCost returns the filament, energy and machine time cost of a usage at the -filament-price,
+// -energy-price and -machine-rate
+func (u batchUsage) getCost() (filament, energy, machine float64) {
+	return u.Grams / GRAMS_PER_KG * filamentPrice, u.Energy / 1000 * energyPrice, u.Duration / 3600 * machineRate
+}
+
+// writeBatchSummary totals what printing the files of a directory run takes, for quoting a
+// production batch: a table of each file's print time, filament, energy and cost, then the totals
+// with the cost broken down and, with -co2-intensity, the emissions of the electricity
+func writeBatchSummary(w io.Writer, entries []batchEntry) {
+	counted := []batchEntry{}
+	for _, entry := range entries {
+		if entry.Usage != nil {
+			counted = append(counted, entry)
+		}
+	}
+	if len(counted) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Batch summary of %d files:\n", len(counted))
+	priced := filamentPrice > 0 || energyPrice > 0 || machineRate > 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "  file\ttime\tfilament (m)\tfilament (g)\tenergy (kWh)")
+	if priced {
+		fmt.Fprint(tw, "\tcost")
+	}
+	fmt.Fprintln(tw)
+	var total batchUsage
+	for _, entry := range counted {
+		usage := *entry.Usage
+		total.Duration += usage.Duration
+		total.Filament += usage.Filament
+		total.Grams += usage.Grams
+		total.Energy += usage.Energy
+		fmt.Fprintf(tw, "  %s\t%s\t%.2f\t%.1f\t%.3f", entry.File, formatEstimate(usage.Duration), usage.Filament/1000, usage.Grams, usage.Energy/1000)
+		if priced {
+			filament, energy, machine := usage.getCost()
+			fmt.Fprintf(tw, "\t%.2f", filament+energy+machine)
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "Total: %s, %.2fm (%.1fg) of filament, %.3fkWh\n", formatEstimate(total.Duration), total.Filament/1000, total.Grams, total.Energy/1000)
+	if priced {
+		filament, energy, machine := total.getCost()
+		fmt.Fprintf(w, "Cost: %.2f filament + %.2f energy + %.2f machine time = %.2f\n", filament, energy, machine, filament+energy+machine)
+	}
+	if co2Intensity > 0 {
+		fmt.Fprintf(w, "CO2: %.0fg at %.0fg/kWh\n", total.Energy/1000*co2Intensity, co2Intensity)
+	}
+}
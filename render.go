@@ -0,0 +1,66 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+)
+
+const LEGEND_WIDTH = 12 // Pixels of the color scale drawn right of a heatmap
+
+// heatmapStops are the colors of the heatmap scale from its lowest to its highest value
+var heatmapStops = []color.RGBA{
+	{48, 18, 59, 255}, {40, 120, 230, 255}, {30, 200, 160, 255}, {170, 230, 50, 255}, {250, 160, 30, 255}, {180, 20, 10, 255},
+}
+
+var heatmapEmpty = color.RGBA{24, 24, 24, 255}
+
+// heatmapColor returns the color of a value at a fraction (0-1) of the scale
+func heatmapColor(fraction float64) color.RGBA {
+	fraction = math.Max(0, math.Min(1, fraction))
+	position := fraction * float64(len(heatmapStops)-1)
+	i := int(position)
+	if i >= len(heatmapStops)-1 {
+		return heatmapStops[len(heatmapStops)-1]
+	}
+	t := position - float64(i)
+	from, to := heatmapStops[i], heatmapStops[i+1]
+	blend := func(a, b uint8) uint8 { return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5) }
+	return color.RGBA{blend(from.R, to.R), blend(from.G, to.G), blend(from.B, to.B), 255}
+}
+
+// renderHeatmap draws a grid of values (rows, then columns; NaN for no data) with the first row
+// at the bottom, each row rowHeight pixels tall, and a color scale from low to high on the right
+func renderHeatmap(grid [][]float64, rowHeight int, low float64, high float64) *image.RGBA {
+	columns := 0
+	if len(grid) > 0 {
+		columns = len(grid[0])
+	}
+	height := len(grid) * rowHeight
+	img := image.NewRGBA(image.Rect(0, 0, columns+LEGEND_WIDTH, height))
+	for row, values := range grid {
+		for column, value := range values {
+			c := heatmapEmpty
+			if !math.IsNaN(value) {
+				c = heatmapColor((value - low) / (high - low))
+			}
+			for y := 0; y < rowHeight; y++ {
+				img.SetRGBA(column, height-1-row*rowHeight-y, c)
+			}
+		}
+	}
+	for y := 0; y < height; y++ {
+		c := heatmapColor(float64(height-1-y) / float64(max(height-1, 1)))
+		for x := columns + LEGEND_WIDTH/3; x < columns+LEGEND_WIDTH; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// writePNG encodes an image as PNG
+func writePNG(w io.Writer, img image.Image) error {
+	return png.Encode(w, img)
+}
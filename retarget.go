@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	PLAN_MATCH_LAYER = "layer" // Apply imported plans at the layer numbers they were made for
+	PLAN_MATCH_Z     = "z"     // Re-target imported plans to the layers at the same Z heights
+)
+
+// retarget records how a modification or detection of an imported plan was moved to the layer at
+// the same Z height in a re-sliced file
+type retarget struct {
+	Entry  string  `json:"entry"`            // The modification or detection, as made for the original file
+	From   int     `json:"from"`             // 0-based layer in the original file
+	To     int     `json:"to"`               // 0-based layer in the re-sliced file, -1 when it couldn't be re-targeted
+	Z      float64 `json:"z"`                // Z height of the layer in the original file
+	Reason string  `json:"reason,omitempty"` // Why it couldn't be re-targeted
+}
+
+func (r retarget) String() string {
+	if r.Z == 0 {
+		return fmt.Sprintf("%s: not re-targeted, %s", r.Entry, r.Reason)
+	}
+	if r.To < 0 {
+		return fmt.Sprintf("%s (Z=%.2f): not re-targeted, %s", r.Entry, r.Z, r.Reason)
+	}
+	return fmt.Sprintf("%s (Z=%.2f): moved to layer %d", r.Entry, r.Z, displayLayer(r.To))
+}
+
+var planMatch string // -plan-match, PLAN_MATCH_LAYER or PLAN_MATCH_Z
+
+// validatePlanMatch exits if -plan-match is unknown
+func validatePlanMatch() {
+	if planMatch != PLAN_MATCH_LAYER && planMatch != PLAN_MATCH_Z {
+		fmt.Printf("Error: unknown -plan-match '%s' (use %s or %s)\n", planMatch, PLAN_MATCH_LAYER, PLAN_MATCH_Z)
+		os.Exit(1)
+	}
+}
+
+// getLayerZ returns the Z height of each 0-based layer, 0 where none is known
+func (a *Analysis) getLayerZ(layerCount int) []float64 {
+	layerZ := make([]float64, layerCount)
+	for layer := range layerZ {
+		layerZ[layer] = a.layerZHeights[layer]
+	}
+	return layerZ
+}
+
+// retargetPlan returns an imported plan with its modifications and detections moved to the layers
+// of the lines at the Z heights they were made for, so a plan survives re-slicing with a different
+// first layer or layer count. Entries with no layer within half a layer height of their Z are
+// dropped; every entry that moved or was dropped is recorded in the plan's Retargets and printed.
+func retargetPlan(plan Plan, lines []string) (Plan, error) {
+	if len(plan.LayerZ) == 0 {
+		return plan, fmt.Errorf("the plan for '%s' has no layer heights to re-target by (save it again with -plan-out)", plan.File)
+	}
+	a := newAnalysis(lines, activePreset)
+	layerZ := a.getLayerZ(a.countLayers(lines))
+	// A layer covers the heights within half a layer of its Z
+	layerHeight := getLayerHeight(lines)
+	if layerHeight == 0 {
+		layerHeight = REFERENCE_LAYER_HEIGHT
+	}
+	tolerance := layerHeight/2 + THRESHOLD_MATCH_TOLERANCE
+
+	// mapLayer returns the layer of the lines nearest the Z height of a layer of the plan, and the
+	// end of the print for the end of the plan's
+	mapLayer := func(entry string, from int) retarget {
+		r := retarget{Entry: entry, From: from, To: -1}
+		if from == len(plan.LayerZ) {
+			r.To = len(layerZ)
+			return r
+		}
+		if from < 0 || from >= len(plan.LayerZ) || plan.LayerZ[from] == 0 {
+			r.Reason = "no Z height recorded for the layer"
+			return r
+		}
+		r.Z = plan.LayerZ[from]
+		best := -1
+		for layer, z := range layerZ {
+			if z > 0 && (best < 0 || math.Abs(z-r.Z) < math.Abs(layerZ[best]-r.Z)) {
+				best = layer
+			}
+		}
+		if best < 0 || math.Abs(layerZ[best]-r.Z) > tolerance {
+			r.Reason = fmt.Sprintf("no layer within %.2fmm", tolerance)
+			return r
+		}
+		r.To = best
+		return r
+	}
+
+	retargeted := plan
+	retargeted.Modifications, retargeted.Detections, retargeted.Retargets = []modification{}, []Detection{}, nil
+	unchanged := 0
+	record := func(r retarget) {
+		if r.To == r.From {
+			unchanged++
+		} else {
+			retargeted.Retargets = append(retargeted.Retargets, r)
+		}
+	}
+	for _, mod := range plan.Modifications {
+		r := mapLayer(mod.String(), mod.Layer)
+		record(r)
+		if r.To >= 0 {
+			mod.Layer = r.To
+			retargeted.Modifications = append(retargeted.Modifications, mod)
+		}
+	}
+	for _, detection := range plan.Detections {
+		r := mapLayer(describeDetection(detection), detection.Layer)
+		record(r)
+		if r.To < 0 {
+			continue
+		}
+		if detection.EndLayer > detection.Layer {
+			if end := mapLayer("", detection.EndLayer); end.To >= r.To {
+				detection.EndLayer = end.To
+			} else {
+				detection.EndLayer = r.To
+			}
+		}
+		detection.Layer = r.To
+		retargeted.Detections = append(retargeted.Detections, detection)
+	}
+	// Per-layer values of the original file don't carry over
+	retargeted.LayerCount, retargeted.LayerZ = len(layerZ), layerZ
+	retargeted.LayerScores, retargeted.InfillDensity = nil, nil
+
+	dropped := 0
+	for _, r := range retargeted.Retargets {
+		if r.To < 0 {
+			dropped++
+		}
+	}
+	fmt.Printf("Re-targeted the plan for '%s' by Z height: %d entries moved, %d unchanged, %d couldn't be re-targeted\n",
+		plan.File, len(retargeted.Retargets)-dropped, unchanged, dropped)
+	for _, r := range retargeted.Retargets {
+		fmt.Printf("  %s\n", r)
+	}
+	return retargeted, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RepRapFirmware meta commands that open an indented block
+var rrfBlockKeywords = map[string]bool{"if": true, "elif": true, "else": true, "while": true}
+
+var objectLabelRegexp = regexp.MustCompile(`^(?:M486 S(\d+)|EXCLUDE_OBJECT_DEFINE NAME=(\S+))`)
+
+// getMetaKeyword returns the RepRapFirmware meta command keyword a line starts with ("if",
+// "while", "var", ...), or "" for G-code and comments
+func getMetaKeyword(line string) string {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return ""
+	}
+	switch fields[0] {
+	case "if", "elif", "else", "while", "break", "continue", "abort", "var", "global", "set", "echo":
+		return fields[0]
+	}
+	return ""
+}
+
+// getBlockDepths returns how deeply each line is nested in RepRapFirmware conditional and loop
+// blocks, which are delimited by indentation. Blank and comment-only lines don't end a block, and
+// elif/else lines belong to the block of their if.
+func getBlockDepths(lines []string) []int {
+	depths := make([]int, len(lines))
+	var indents []int // Indentation of the open block headers
+	for i, line := range lines {
+		if strings.TrimSpace(stripComment(line)) == "" {
+			depths[i] = len(indents)
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		for len(indents) > 0 && indents[len(indents)-1] >= indent {
+			indents = indents[:len(indents)-1]
+		}
+		keyword := getMetaKeyword(line)
+		depths[i] = len(indents)
+		if keyword == "elif" || keyword == "else" {
+			depths[i]++
+		}
+		if rrfBlockKeywords[keyword] {
+			indents = append(indents, indent)
+		}
+	}
+	return depths
+}
+
+// insertAtLayerStarts returns the lines with the lines from getLines inserted after each layer
+// change; visit, when given, sees every original line first. A layer change inside a conditional
+// or loop block gets its lines once the block has ended, so they run exactly once and neither
+// split the block nor end up in a branch that may not run. Likewise, a layer whose start parks the
+// head for a time-lapse frame, or runs a block of another post-processor, gets its lines after it.
+func (a *Analysis) insertAtLayerStarts(lines []string, visit func(line string), getLines func(layer int) []string) []string {
+	depths := getBlockDepths(lines)
+	foreign := getForeignBlocks(lines)
+	modifiedLines := make([]string, 0, len(lines))
+	var pending []string
+	holdUntil := -1 // Last line of a foreign block the pending lines wait for
+	currentLayer := -1
+	for i, line := range lines {
+		if len(pending) > 0 && i > holdUntil && depths[i] == 0 && strings.TrimSpace(stripComment(line)) != "" {
+			modifiedLines = append(modifiedLines, pending...)
+			pending = nil
+		}
+		modifiedLines = append(modifiedLines, line)
+		if visit != nil {
+			visit(line)
+		}
+		if a.detectLayerChange(line) {
+			currentLayer++
+			inserted := getLines(currentLayer)
+			if depths[i] > 0 && len(inserted) > 0 {
+				fmt.Printf("Layer %d starts inside a conditional block (line %d), inserting after the block\n", displayLayer(currentLayer), i+1)
+				pending = append(pending, inserted...)
+			} else if end := a.getBlockEnd(lines, foreign, i); end >= 0 && len(inserted) > 0 {
+				pending = append(pending, inserted...)
+				holdUntil = max(holdUntil, end)
+			} else {
+				modifiedLines = append(modifiedLines, inserted...)
+			}
+		}
+	}
+	return append(modifiedLines, pending...)
+}
+
+// countLabeledObjects returns the number of objects labeled with M486 or Klipper's
+// EXCLUDE_OBJECT_DEFINE, used by firmwares to cancel single objects
+func countLabeledObjects(lines []string) int {
+	objects := make(map[string]bool)
+	for _, line := range lines {
+		if m := objectLabelRegexp.FindStringSubmatch(line); m != nil {
+			objects[m[1]+m[2]] = true
+		}
+	}
+	return len(objects)
+}
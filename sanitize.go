@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const UTF8_BOM = "\ufeff"
+
+var sanitizeOutput bool // -sanitize, strip BOMs, control characters and non-ASCII from outputs
+
+// asciiReplacements are the ASCII spellings -sanitize uses for common non-ASCII characters in
+// slicer and gcode_modifier comments; others become '?'
+var asciiReplacements = map[rune]string{
+	'°': "", '²': "2", '³': "3", 'µ': "u", '×': "x", '±': "+/-", '\u00a0': " ", '\ufeff': "",
+	'–': "-", '—': "-", '‘': "'", '’': "'", '“': "\"", '”': "\"", '…': "...",
+	'ä': "ae", 'ö': "oe", 'ü': "ue", 'Ä': "Ae", 'Ö': "Oe", 'Ü': "Ue", 'ß': "ss",
+	'à': "a", 'â': "a", 'á': "a", 'ç': "c", 'é': "e", 'è': "e", 'ê': "e", 'ë': "e",
+	'î': "i", 'ï': "i", 'í': "i", 'ô': "o", 'ó': "o", 'ù': "u", 'û': "u", 'ú': "u", 'ñ': "n",
+}
+
+// isPlainByte reports whether a byte is printable ASCII or a tab, which every firmware reads
+func isPlainByte(b byte) bool {
+	return b == '\t' || (b >= 0x20 && b < 0x7f)
+}
+
+// getEncodingIssues returns descriptions of what in raw G-code can trip up firmware SD card
+// readers: a UTF-8 byte order mark, mixed or lone-CR line endings, control characters and
+// non-ASCII characters
+func getEncodingIssues(data []byte) []string {
+	issues := []string{}
+	if bytes.HasPrefix(data, []byte(UTF8_BOM)) {
+		issues = append(issues, "UTF-8 byte order mark at the start of the file")
+		data = data[len(UTF8_BOM):]
+	}
+	crlf := bytes.Count(data, []byte("\r\n"))
+	if lf := bytes.Count(data, []byte("\n")) - crlf; crlf > 0 && lf > 0 {
+		issues = append(issues, fmt.Sprintf("mixed line endings: %d CRLF and %d LF", crlf, lf))
+	}
+	if cr := bytes.Count(data, []byte("\r")) - crlf; cr > 0 {
+		issues = append(issues, fmt.Sprintf("%d carriage returns without a line feed", cr))
+	}
+
+	controlLines, nonASCIILines := 0, 0
+	firstControl, firstNonASCII := 0, 0
+	for lineNum, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		hasControl, hasNonASCII := false, false
+		for _, b := range line {
+			if b >= 0x80 {
+				hasNonASCII = true
+			} else if !isPlainByte(b) && b != '\r' {
+				hasControl = true
+			}
+		}
+		if hasControl {
+			if controlLines++; firstControl == 0 {
+				firstControl = lineNum + 1
+			}
+		}
+		if hasNonASCII {
+			if nonASCIILines++; firstNonASCII == 0 {
+				firstNonASCII = lineNum + 1
+			}
+		}
+	}
+	if controlLines > 0 {
+		issues = append(issues, fmt.Sprintf("control characters on %d lines (first on line %d)", controlLines, firstControl))
+	}
+	if nonASCIILines > 0 {
+		encoding := "UTF-8"
+		if !utf8.Valid(data) {
+			encoding = "not UTF-8"
+		}
+		issues = append(issues, fmt.Sprintf("non-ASCII characters (%s) on %d lines (first on line %d)", encoding, nonASCIILines, firstNonASCII))
+	}
+	return issues
+}
+
+// printEncodingIssues prints the encoding issues of the raw G-code read from r, possibly gzipped
+func printEncodingIssues(name string, r io.Reader) {
+	r, err := decompress(r)
+	if err != nil {
+		return
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+	issues := getEncodingIssues(data)
+	if len(issues) == 0 {
+		return
+	}
+	if sanitizeOutput {
+		fmt.Printf("Encoding issues in '%s', fixed by -sanitize:\n", name)
+	} else {
+		fmt.Printf("Warning: encoding issues in '%s' (fix them with -sanitize):\n", name)
+	}
+	for _, issue := range issues {
+		fmt.Printf("  %s\n", issue)
+	}
+}
+
+// checkFileEncoding prints the encoding issues of a G-code file, or of each G-code entry of a
+// zip archive or 3MF project
+func checkFileEncoding(filePath string) {
+	if isZipFile(filePath) || is3mfFile(filePath) {
+		reader, err := zip.OpenReader(filePath)
+		if err != nil {
+			return
+		}
+		defer reader.Close()
+		for _, f := range reader.File {
+			if !isZipGcodeEntry(f.Name) && !is3mfPlateEntry(f.Name) {
+				continue
+			}
+			if rc, err := f.Open(); err == nil {
+				printEncodingIssues(filePath+" ("+f.Name+")", rc)
+				rc.Close()
+			}
+		}
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	printEncodingIssues(filePath, file)
+}
+
+// sanitizeLine returns the line with BOMs and control characters removed and non-ASCII
+// characters spelled in ASCII. Line endings are made uniform by the lineWriter.
+func sanitizeLine(line string) string {
+	plain := true
+	for i := 0; i < len(line) && plain; i++ {
+		plain = isPlainByte(line[i])
+	}
+	if plain {
+		return line
+	}
+
+	var b strings.Builder
+	for i, r := range line {
+		switch {
+		case r < utf8.RuneSelf:
+			if isPlainByte(line[i]) {
+				b.WriteByte(line[i])
+			}
+		case r == utf8.RuneError:
+			b.WriteByte('?')
+		default:
+			if replacement, ok := asciiReplacements[r]; ok {
+				b.WriteString(replacement)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
+
+// sanitizeLines applies sanitizeLine to every line, reporting how many changed
+func sanitizeLines(lines []string) []string {
+	sanitized := make([]string, len(lines))
+	changed := 0
+	for i, line := range lines {
+		sanitized[i] = sanitizeLine(line)
+		if sanitized[i] != line {
+			changed++
+		}
+	}
+	if changed > 0 {
+		fmt.Printf("Sanitized %d lines\n", changed)
+	}
+	return sanitized
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SCHEMA_REPORT         = "report" // A Plan: the JSON of serve's /analyze, and of each plan in webhooks
+	SCHEMA_PLAN           = "plan"   // The file written by -plan-out and read by -plan-in
+	REPORT_SCHEMA_VERSION = 1        // Raised, like PLAN_FILE_VERSION, when a change breaks readers
+	SCHEMA_ID_PREFIX      = "https://github.com/brettbeaudoin/gcode/schemas/"
+)
+
+var schemaName string // -schema, print the JSON Schema of a format and exit
+
+// getSchemaNames returns the formats with a schema
+func getSchemaNames() []string {
+	return []string{SCHEMA_REPORT, SCHEMA_PLAN}
+}
+
+// getSchema returns the JSON Schema of a format, generated from the types that are marshalled to it
+func getSchema(name string) (map[string]interface{}, error) {
+	var schema map[string]interface{}
+	var version int
+	switch name {
+	case SCHEMA_REPORT:
+		schema, version = typeSchema(reflect.TypeOf(Plan{})), REPORT_SCHEMA_VERSION
+		schema["title"] = "gcode_modifier analysis report"
+	case SCHEMA_PLAN:
+		schema, version = typeSchema(reflect.TypeOf(planFile{})), PLAN_FILE_VERSION
+		schema["title"] = "gcode_modifier plan file"
+		// Readers reject other versions, so the schema only accepts its own
+		schema["properties"].(map[string]interface{})["version"] = map[string]interface{}{"const": PLAN_FILE_VERSION}
+	default:
+		return nil, fmt.Errorf("unknown schema '%s' (use %s)", name, strings.Join(getSchemaNames(), " or "))
+	}
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = fmt.Sprintf("%s%s-v%d.json", SCHEMA_ID_PREFIX, name, version)
+	return schema, nil
+}
+
+// typeSchema returns the JSON Schema of a Go type as encoding/json marshals it. Struct fields
+// without omitempty are required; unknown properties are allowed, so adding fields is not a
+// breaking change.
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		// encoding/json writes nil slices as null
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = typeSchema(field.Type)
+			if !strings.Contains(","+options+",", ",omitempty,") {
+				required = append(required, name)
+			}
+		}
+		sort.Strings(required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	return map[string]interface{}{}
+}
+
+// printSchema prints the JSON Schema of a format
+func printSchema(name string) error {
+	schema, err := getSchema(name)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SERVE_DEFAULT_ADDR          = ":8080"
+	SERVE_DEFAULT_MAX_UPLOAD_MB = 512
+	SERVE_DEFAULT_NAME          = "upload.gcode" // File name of uploads without ?name=
+
+	// Time clients have to send their request headers, and their whole request, so slow clients
+	// can't hold connections open indefinitely
+	SERVE_READ_HEADER_TIMEOUT = 10 * time.Second
+	SERVE_READ_TIMEOUT        = 5 * time.Minute
+	SERVE_IDLE_TIMEOUT        = 2 * time.Minute
+
+	// Reasons requests are rejected, as counted in the statistics
+	REJECT_AUTH = "auth"
+	REJECT_RATE = "rate"
+	REJECT_BUSY = "busy"
+	REJECT_SIZE = "size"
+)
+
+// Upper bounds in seconds of the processing time histogram buckets
+var processingBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// serveStats counts what the server has processed, for /stats and /metrics
+type serveStats struct {
+	mu              sync.Mutex
+	Started         time.Time      `json:"started"`
+	FilesProcessed  int            `json:"files_processed"`
+	FilesFailed     int            `json:"files_failed"`
+	LinesProcessed  int            `json:"lines_processed"`
+	LayersFlagged   int            `json:"layers_flagged"`
+	ProcessingTotal float64        `json:"processing_seconds_total"`
+	Rejected        map[string]int `json:"rejected"` // Requests turned away, by REJECT_* reason
+	bucketCounts    []int          // Per processingBuckets bound, not cumulative
+}
+
+var stats = serveStats{Rejected: map[string]int{}, bucketCounts: make([]int, len(processingBuckets))}
+var maxUploadMB int64 // -max-upload-mb
+
+// record adds the outcome of one request to the statistics
+func (s *serveStats) record(lines int, plan Plan, err error, elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.FilesFailed++
+		return
+	}
+	s.FilesProcessed++
+	s.LinesProcessed += lines
+	s.LayersFlagged += len(plan.Detections)
+	s.ProcessingTotal += elapsed.Seconds()
+	for i, bound := range processingBuckets {
+		if elapsed.Seconds() <= bound {
+			s.bucketCounts[i]++
+			break
+		}
+	}
+}
+
+// reject counts a request turned away for a REJECT_* reason
+func (s *serveStats) reject(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Rejected[reason]++
+}
+
+// serveFlags are the flags of the serve command
+type serveFlags struct {
+	addr        *string
+	presetName  *string
+	apiKeysPath *string
+	maxJobs     *int
+}
+
+// defineServeFlags defines the flags of the serve command on a flag set
+func defineServeFlags(fs *flag.FlagSet) serveFlags {
+	var flags serveFlags
+	flags.addr = fs.String("addr", SERVE_DEFAULT_ADDR, "Address to listen on (Default=:8080)")
+	flags.presetName = fs.String("preset", DEFAULT_PRESET, "Named preset of detectors and modification rules (see 'presets list')")
+	flags.apiKeysPath = fs.String("api-keys", "", "File of API keys, one per line, that requests must carry (Default=none, no authentication)")
+	fs.Int64Var(&maxUploadMB, "max-upload-mb", SERVE_DEFAULT_MAX_UPLOAD_MB, "Largest upload accepted in MB (Default=512)")
+	flags.maxJobs = fs.Int("max-jobs", SERVE_DEFAULT_MAX_JOBS, "Uploads processed or waiting at once; more are rejected (Default=4)")
+	fs.IntVar(&requestsPerMinute, "rate", 0, "Requests per minute allowed per API key or client address (Default=0, no limit)")
+	addLayerBaseFlag(fs)
+	addWebhookFlags(fs)
+	return flags
+}
+
+// runServeCommand implements "serve": an HTTP server that analyzes and modifies uploaded G-code
+func runServeCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags := defineServeFlags(fs)
+	setCommandUsage(fs, "serve")
+	fs.Parse(args)
+	fs.Visit(func(f *flag.Flag) { explicitFlags[f.Name] = true })
+	validateLayerBase()
+	if *flags.maxJobs < 1 || maxUploadMB < 1 {
+		fmt.Println("Error: -max-jobs and -max-upload-mb must be at least 1")
+		os.Exit(1)
+	}
+	jobSlots = make(chan struct{}, *flags.maxJobs)
+
+	p, err := getPreset(*flags.presetName)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	activePreset = p
+	if thresholdOverrides, err = loadThresholdOverrides(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *flags.apiKeysPath != "" {
+		if apiKeys, err = loadAPIKeys(*flags.apiKeysPath); err != nil {
+			fmt.Printf("Error reading API keys: %v\n", err)
+			os.Exit(1)
+		}
+		if len(apiKeys) == 0 {
+			fmt.Printf("Error: no API keys in '%s'\n", *flags.apiKeysPath)
+			os.Exit(1)
+		}
+	} else {
+		fmt.Println("Warning: serving without authentication (see -api-keys)")
+	}
+
+	stats.Started = time.Now()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/analyze", guard(handleUpload(false)))
+	mux.HandleFunc("/process", guard(handleUpload(true)))
+	mux.HandleFunc("/stats", guard(handleStats))
+	mux.HandleFunc("/metrics", guard(handleMetrics))
+
+	fmt.Printf("Serving on %s (%s)\n", *flags.addr, versionString())
+	server := &http.Server{
+		Addr:              *flags.addr,
+		Handler:           mux,
+		ReadHeaderTimeout: SERVE_READ_HEADER_TIMEOUT,
+		ReadTimeout:       SERVE_READ_TIMEOUT,
+		IdleTimeout:       SERVE_IDLE_TIMEOUT,
+	}
+	if err := server.ListenAndServe(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// handleUpload analyzes the G-code in the request body and responds with the plan as JSON or,
+// for /process, with the modified G-code
+func handleUpload(modify bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST the G-code as the request body", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = SERVE_DEFAULT_NAME
+		}
+		if r.ContentLength > maxUploadMB<<20 {
+			stats.reject(REJECT_SIZE)
+			http.Error(w, fmt.Sprintf("upload larger than %dMB", maxUploadMB), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// The upload is read before taking a job slot, so slow uploads can't hold the slots
+		lines, crlf, err := scanLines(http.MaxBytesReader(w, r.Body, maxUploadMB<<20))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			stats.reject(REJECT_SIZE)
+			http.Error(w, fmt.Sprintf("upload larger than %dMB", maxUploadMB), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			stats.record(0, Plan{}, err, 0)
+			http.Error(w, fmt.Sprintf("reading upload: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !acquireJobSlot() {
+			stats.reject(REJECT_BUSY)
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "too many uploads in progress", http.StatusTooManyRequests)
+			return
+		}
+		defer releaseJobSlot()
+
+		start := time.Now()
+		plan, modified, err := processUpload(r.Context(), name, lines, modify)
+		elapsed := time.Since(start)
+		stats.record(len(lines), plan, err, elapsed)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("processing '%s': %v", name, err), http.StatusServiceUnavailable)
+			return
+		}
+
+		event := webhookEvent{Event: EVENT_ANALYZED, File: name, Plans: []Plan{plan}}
+		if modify {
+			event.Event = EVENT_PROCESSED
+		}
+		go sendWebhooks(event)
+
+		if !modify {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(plan)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Problematic-Layers", strconv.Itoa(len(plan.Detections)))
+		newLineWriter(w, crlf).WriteLines(modified)
+	}
+}
+
+// processUpload analyzes the lines of an upload and, when modify is set, applies the plan
+func processUpload(ctx context.Context, name string, lines []string, modify bool) (Plan, []string, error) {
+	plan, err := AnalyzeLines(ctx, name, lines)
+	if err != nil || !modify {
+		return plan, nil, err
+	}
+	modified, err := ApplyLines(ctx, lines, plan)
+	return plan, modified, err
+}
+
+// handleStats responds with the statistics as JSON
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*serveStats
+		Version       string  `json:"version"`
+		UptimeSeconds float64 `json:"uptime_seconds"`
+	}{&stats, versionString(), time.Since(stats.Started).Seconds()})
+}
+
+// handleMetrics responds with the statistics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "gcode_modifier_files_processed_total", "counter", "Files processed, by result.",
+		metricSample{`result="ok"`, stats.FilesProcessed}, metricSample{`result="error"`, stats.FilesFailed})
+	writeMetric(w, "gcode_modifier_requests_rejected_total", "counter", "Requests turned away, by reason.",
+		metricSample{`reason="auth"`, stats.Rejected[REJECT_AUTH]}, metricSample{`reason="rate"`, stats.Rejected[REJECT_RATE]},
+		metricSample{`reason="busy"`, stats.Rejected[REJECT_BUSY]}, metricSample{`reason="size"`, stats.Rejected[REJECT_SIZE]})
+	writeMetric(w, "gcode_modifier_lines_processed_total", "counter", "G-code lines processed.",
+		metricSample{"", stats.LinesProcessed})
+	writeMetric(w, "gcode_modifier_layers_flagged_total", "counter", "Layers flagged by any detector.",
+		metricSample{"", stats.LayersFlagged})
+
+	fmt.Fprintln(w, "# HELP gcode_modifier_processing_seconds Time spent analyzing and modifying a file.")
+	fmt.Fprintln(w, "# TYPE gcode_modifier_processing_seconds histogram")
+	cumulative := 0
+	for i, bound := range processingBuckets {
+		cumulative += stats.bucketCounts[i]
+		fmt.Fprintf(w, "gcode_modifier_processing_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "gcode_modifier_processing_seconds_bucket{le=\"+Inf\"} %d\n", stats.FilesProcessed)
+	fmt.Fprintf(w, "gcode_modifier_processing_seconds_sum %g\n", stats.ProcessingTotal)
+	fmt.Fprintf(w, "gcode_modifier_processing_seconds_count %d\n", stats.FilesProcessed)
+}
+
+// metricSample is one value of a metric with its labels, e.g. `result="ok"`, or "" for none
+type metricSample struct {
+	Labels string
+	Value  int
+}
+
+// writeMetric writes a metric's help and type followed by its samples
+func writeMetric(w io.Writer, name string, kind string, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range samples {
+		if sample.Labels == "" {
+			fmt.Fprintf(w, "%s %d\n", name, sample.Value)
+		} else {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, sample.Labels, sample.Value)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SERVE_DEFAULT_MAX_JOBS = 4  // Uploads being processed or waiting for their turn
+	RATE_BURST             = 10 // Requests a client may make at once before -rate applies
+	RATE_SWEEP_INTERVAL    = time.Minute
+)
+
+var apiKeys []string // Keys accepted by the server, none to serve without authentication
+var jobSlots chan struct{}
+var requestsPerMinute int // -rate, per client, 0 for no limit
+
+// rateBucket is a token bucket limiting the requests of one client
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var rateBuckets = map[string]*rateBucket{}
+var rateSwept time.Time // When idle buckets were last evicted
+var rateMu sync.Mutex
+
+// loadAPIKeys reads the keys of an API key file, one per line; blank lines and lines starting
+// with '#' are ignored
+func loadAPIKeys(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	keys := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" && !strings.HasPrefix(key, "#") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// getRequestKey returns the API key of a request, from "Authorization: Bearer <key>" or
+// "X-API-Key: <key>"
+func getRequestKey(r *http.Request) string {
+	if key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(key)
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// isAuthorized reports whether the request carries one of the API keys, comparing in constant
+// time so keys can't be guessed from response times
+func isAuthorized(r *http.Request) bool {
+	if len(apiKeys) == 0 {
+		return true
+	}
+	key := getRequestKey(r)
+	authorized := false
+	for _, apiKey := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(apiKey)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// getClientAddress returns the remote address of a request, without its port
+func getClientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sweepRateBuckets evicts the buckets that have been idle long enough to refill, which are the same
+// as no bucket, so clients that come and go don't grow the map forever. rateMu must be held.
+func sweepRateBuckets(now time.Time) {
+	if now.Sub(rateSwept) < RATE_SWEEP_INTERVAL {
+		return
+	}
+	rateSwept = now
+	refill := time.Duration(RATE_BURST / float64(requestsPerMinute) * float64(time.Minute))
+	for client, bucket := range rateBuckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(rateBuckets, client)
+		}
+	}
+}
+
+// allowRequest takes a token from the client's bucket, which refills at -rate per minute
+func allowRequest(client string) bool {
+	if requestsPerMinute <= 0 {
+		return true
+	}
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	now := time.Now()
+	sweepRateBuckets(now)
+	bucket, ok := rateBuckets[client]
+	if !ok {
+		bucket = &rateBucket{tokens: RATE_BURST, last: now}
+		rateBuckets[client] = bucket
+	}
+	bucket.tokens = min(RATE_BURST, bucket.tokens+now.Sub(bucket.last).Minutes()*float64(requestsPerMinute))
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// guard wraps a handler with the rate limits and the API key check. Requests are limited per
+// client address before the key is checked, so keys can't be guessed at full speed, and then per
+// API key.
+func guard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rateLimited := func() {
+			stats.reject(REJECT_RATE)
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+		}
+		if !allowRequest("addr:" + getClientAddress(r)) {
+			rateLimited()
+			return
+		}
+		if !isAuthorized(r) {
+			stats.reject(REJECT_AUTH)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or unknown API key", http.StatusUnauthorized)
+			return
+		}
+		if key := getRequestKey(r); len(apiKeys) > 0 && !allowRequest("key:"+key) {
+			rateLimited()
+			return
+		}
+		next(w, r)
+	}
+}
+
+// acquireJobSlot reserves one of the -max-jobs slots for an upload, false when all are taken
+func acquireJobSlot() bool {
+	select {
+	case jobSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseJobSlot frees a slot taken with acquireJobSlot
+func releaseJobSlot() {
+	<-jobSlots
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	SEVERITY_NONE     = "none"
+	SEVERITY_INFO     = "info"
+	SEVERITY_WARNING  = "warning"
+	SEVERITY_CRITICAL = "critical"
+)
+
+// severityLevels are the severities from lowest to highest; the exit status of a run failed by
+// -fail-on is 1 plus the index of its highest severity, so 2 for info up to 4 for critical
+var severityLevels = []string{SEVERITY_NONE, SEVERITY_INFO, SEVERITY_WARNING, SEVERITY_CRITICAL}
+
+// detectorSeverities are the default severities of the findings of each detector
+var detectorSeverities = map[string]string{
+	DETECTOR_PERIMETER_CHANGE: SEVERITY_WARNING,
+	DETECTOR_ADHESION_RISK:    SEVERITY_WARNING,
+	DETECTOR_CLOG_RISK:        SEVERITY_WARNING,
+	DETECTOR_INFILL_DENSITY:   SEVERITY_INFO,
+	DETECTOR_TIPPING_RISK:     SEVERITY_CRITICAL,
+	DETECTOR_SMALL_FOOTPRINT:  SEVERITY_WARNING,
+}
+
+var severitySpec string    // -severity, e.g. 'infill-density=warning,tipping-risk=info'
+var failOn = SEVERITY_NONE // -fail-on, lowest severity that fails the run
+var severityOverrides = map[string]string{}
+
+// loadSeverities parses -severity and validates -fail-on
+func loadSeverities() error {
+	if !slices.Contains(severityLevels, failOn) {
+		return fmt.Errorf("unknown -fail-on '%s' (use %s)", failOn, strings.Join(severityLevels, ", "))
+	}
+	for _, entry := range strings.Split(severitySpec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		detector, severity, ok := strings.Cut(entry, "=")
+		detector, severity = strings.TrimSpace(detector), strings.TrimSpace(severity)
+		if _, known := detectorSeverities[detector]; !ok || !known {
+			return fmt.Errorf("-severity: invalid entry '%s' (use detector=severity with a detector that reports findings)", entry)
+		}
+		if !slices.Contains(severityLevels[1:], severity) {
+			return fmt.Errorf("-severity: unknown severity '%s' (use %s)", severity, strings.Join(severityLevels[1:], ", "))
+		}
+		severityOverrides[detector] = severity
+	}
+	return nil
+}
+
+// getDetectionSeverity returns the severity of a detector's findings, as set by -severity or
+// else its default; findings of unknown detectors are warnings
+func getDetectionSeverity(detector string) string {
+	if severity, ok := severityOverrides[detector]; ok {
+		return severity
+	}
+	if severity, ok := detectorSeverities[detector]; ok {
+		return severity
+	}
+	return SEVERITY_WARNING
+}
+
+// getHighestSeverity returns the highest severity of the findings of the plans, or SEVERITY_NONE
+func getHighestSeverity(plans []Plan) string {
+	highest := 0
+	for _, plan := range plans {
+		for _, detection := range plan.Detections {
+			highest = max(highest, slices.Index(severityLevels, getDetectionSeverity(detection.Detector)))
+		}
+	}
+	return severityLevels[highest]
+}
+
+// exitOnSeverity exits with the status of the highest severity found when it reaches -fail-on
+func exitOnSeverity(plans []Plan) {
+	if failOn == SEVERITY_NONE {
+		return
+	}
+	highest := getHighestSeverity(plans)
+	if slices.Index(severityLevels, highest) >= slices.Index(severityLevels, failOn) {
+		fmt.Printf("Failing: highest severity of the findings is %s (-fail-on %s)\n", highest, failOn)
+		os.Exit(1 + slices.Index(severityLevels, highest))
+	}
+}
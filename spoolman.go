@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const SPOOLMAN_TIMEOUT = 10 * time.Second
+
+var spoolmanURL string // -spoolman, base URL of the Spoolman server, e.g. http://spoolman:7912
+var spoolID int        // -spool, Spoolman spool each output's filament use is recorded against
+
+// getFilamentUsed returns the length of filament (mm) the lines extrude, net of retractions
+func getFilamentUsed(lines []string) float64 {
+	used := 0.0
+	var state machineState
+	for _, line := range lines {
+		command, ok := parseCommand(line)
+		if !ok {
+			continue
+		}
+		previous := state.E
+		state.update(line)
+		switch strings.ToUpper(command.Name) {
+		case "G0", "G1":
+			used += state.E - previous
+		case "G2", "G3":
+			// The state only follows G0/G1
+			if e, ok := command.Params['E']; ok {
+				if !state.Mode.relativeE() {
+					e -= state.E
+				}
+				used += e
+				state.E += e
+			}
+		}
+	}
+	return used
+}
+
+// validateSpoolman exits if only one of -spoolman and -spool is given
+func validateSpoolman() {
+	if (spoolmanURL == "") != (spoolID <= 0) {
+		fmt.Println("Error: -spoolman and -spool must be given together")
+		os.Exit(1)
+	}
+}
+
+// recordSpoolUsage records the filament the lines of an output will use against the -spool in
+// Spoolman; failures are reported but don't stop processing
+func recordSpoolUsage(filePath string, lines []string) {
+	used := getFilamentUsed(lines)
+	if used <= 0 {
+		return
+	}
+	body, _ := json.Marshal(map[string]float64{"use_length": used})
+	endpoint := fmt.Sprintf("%s/api/v1/spool/%d/use", strings.TrimRight(spoolmanURL, "/"), spoolID)
+	request, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Warning: recording filament use in Spoolman: %v\n", err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := (&http.Client{Timeout: SPOOLMAN_TIMEOUT}).Do(request)
+	if err != nil {
+		fmt.Printf("Warning: recording filament use in Spoolman: %v\n", err)
+		return
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		fmt.Printf("Warning: recording filament use in Spoolman: status %s\n", response.Status)
+		return
+	}
+
+	var spool struct {
+		RemainingWeight *float64 `json:"remaining_weight"`
+	}
+	json.NewDecoder(response.Body).Decode(&spool)
+	fmt.Printf("Recorded %.0f mm of filament for '%s' against Spoolman spool %d", used, filePath, spoolID)
+	if spool.RemainingWeight != nil {
+		fmt.Printf(" (%.0f g left)", *spool.RemainingWeight)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+const (
+	STANDBY_DEFAULT_DROP      = 30  // °C below the printing temperature the hotend waits at
+	STANDBY_DEFAULT_HEAT_RATE = 2.0 // °C/s a hotend heats at, when the -printer profile doesn't say
+)
+
+var standbyAfter float64 // -standby-after, seconds without extruding before the hotend drops to standby
+var standbyDrop int      // -standby-drop, °C the hotend drops by
+
+var toolChangeRegexp = regexp.MustCompile(`^T\d+$`)
+
+// standbySpan is a stretch of lines without extrusion between two extruding lines
+type standbySpan struct {
+	Start, End int          // Index of the last extruding line before the span and of the first after it
+	Idle       float64      // Estimated seconds between the two
+	Temp       int          // Hotend temperature (°C) held through the span
+	State      machineState // Before the first extruding line after it
+}
+
+// getHeatRate returns the °C/s the hotend heats at, from the -printer profile
+func getHeatRate() float64 {
+	if activePrinter != nil && activePrinter.HeatRate > 0 {
+		return activePrinter.HeatRate
+	}
+	return STANDBY_DEFAULT_HEAT_RATE
+}
+
+// findStandbySpans returns the spans from the first layer on in which the hotend doesn't extrude
+// for at least -standby-after seconds, and at least twice as long as reheating from standby takes,
+// such as the travel between the objects of a sequential print or a long dwell. Spans in which the
+// temperature is changed or the tool is switched are left to the file.
+func (a *Analysis) findStandbySpans(lines []string, lineTimes []float64) []standbySpan {
+	reheat := float64(standbyDrop) / getHeatRate()
+	spans := []standbySpan{}
+	var state machineState
+	layer, last, changed := -1, -1, false
+	for i, line := range lines {
+		if a.detectLayerChange(line) {
+			layer++
+		}
+		previous := state
+		state.update(line)
+		if fields := strings.Fields(stripComment(line)); len(fields) > 0 && toolChangeRegexp.MatchString(fields[0]) {
+			changed = true
+		}
+		if state.HotendTemp != previous.HotendTemp {
+			changed = true
+		}
+		if layer < 0 || state.E <= previous.E || (state.X == previous.X && state.Y == previous.Y) {
+			continue
+		}
+		if last >= 0 && !changed && state.HotendTemp > standbyDrop {
+			idle := lineTimes[i-1] - lineTimes[last]
+			if idle >= standbyAfter && idle >= 2*reheat {
+				spans = append(spans, standbySpan{Start: last, End: i, Idle: idle, Temp: state.HotendTemp, State: previous})
+			}
+		}
+		last, changed = i, false
+	}
+	return spans
+}
+
+// insertStandbyTemps drops the hotend by -standby-drop °C through spans found by findStandbySpans,
+// to reduce oozing. From the estimated times of the lines, the reheat starts as long before
+// printing resumes as heating back up takes at the profile's heat_rate, splitting a dwell it falls
+// into, and an M109 right before the next extrusion makes sure it has completed, followed by the
+// -pause-prime.
+func (a *Analysis) insertStandbyTemps(lines []string) []string {
+	if standbyAfter <= 0 {
+		return lines
+	}
+	lineTimes := getLineTimes(lines)
+	spans := a.findStandbySpans(lines, lineTimes)
+	if len(spans) == 0 {
+		fmt.Printf("No idle spans of %.0fs or more to drop the hotend to standby in\n", standbyAfter)
+		return lines
+	}
+	reheat := float64(standbyDrop) / getHeatRate()
+	insertions := make(map[int][]string)   // Lines inserted before each index
+	replacements := make(map[int][]string) // Dwells split around a reheat
+	idle := 0.0
+	for _, span := range spans {
+		standby := span.Temp - standbyDrop
+		// The latest line starting early enough to reheat in time
+		resume := lineTimes[span.End-1]
+		reheatAt := span.Start + 1
+		for j := span.Start + 1; j <= span.End; j++ {
+			if lineTimes[j-1] <= resume-reheat {
+				reheatAt = j
+			}
+		}
+		insertions[span.Start+1] = append(insertions[span.Start+1],
+			withComment(fmt.Sprintf("M104 S%d", standby), msg(MSG_STANDBY, standby, formatEstimate(span.Idle))))
+		reheatLine := withComment(fmt.Sprintf("M104 S%d", span.Temp), msg(MSG_STANDBY_REHEAT, span.Temp))
+		if command, ok := parseCommand(lines[reheatAt]); ok && reheatAt < span.End && strings.ToUpper(command.Name) == "G4" {
+			// Split a dwell the reheat falls into, e.g. a single long G4 between two objects
+			before := int(math.Round((resume - reheat - lineTimes[reheatAt-1]) * 1000))
+			after := int(math.Round((lineTimes[reheatAt]-lineTimes[reheatAt-1])*1000)) - before
+			replacements[reheatAt] = []string{fmt.Sprintf("G4 P%d", before), reheatLine, fmt.Sprintf("G4 P%d", after)}
+		} else {
+			insertions[reheatAt] = append(insertions[reheatAt], reheatLine)
+		}
+		insertions[span.End] = append(insertions[span.End], fmt.Sprintf("M109 S%d", span.Temp))
+		insertions[span.End] = append(insertions[span.End], a.getPrimeLines(span.State)...)
+		idle += span.Idle
+	}
+
+	withStandby := make([]string, 0, len(lines)+3*len(spans))
+	for i, line := range lines {
+		withStandby = append(withStandby, insertions[i]...)
+		if replacement, ok := replacements[i]; ok {
+			withStandby = append(withStandby, replacement...)
+		} else {
+			withStandby = append(withStandby, line)
+		}
+	}
+	fmt.Printf("Inserted %d standby temperature drops of %d°C (%s idle in total), reheating %.0fs ahead\n",
+		len(spans), standbyDrop, formatEstimate(idle), reheat)
+	return withStandby
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	START_HEATING_KEEP       = "keep"
+	START_HEATING_CONCURRENT = "concurrent" // Heat the bed and the hotend at the same time
+	START_HEATING_SEQUENTIAL = "sequential" // Heat the bed fully before the hotend, for drafty enclosures
+)
+
+var startHeating = START_HEATING_KEEP // -start-heating
+
+// validateStartHeating exits if -start-heating is unknown
+func validateStartHeating() {
+	switch startHeating {
+	case START_HEATING_KEEP, START_HEATING_CONCURRENT, START_HEATING_SEQUENTIAL:
+	default:
+		fmt.Printf("Error: unknown -start-heating '%s' (use %s, %s or %s)\n", startHeating, START_HEATING_KEEP, START_HEATING_CONCURRENT, START_HEATING_SEQUENTIAL)
+		os.Exit(1)
+	}
+}
+
+// startHeatCommand is a heater command of the start G-code
+type startHeatCommand struct {
+	Index int  // Of the line
+	Bed   bool // M140/M190, else M104/M109
+	Wait  bool // M190/M109
+	Temp  int
+}
+
+// getStartHeatCommands returns the heater commands before the first layer that heat (S or R
+// above 0)
+func (a *Analysis) getStartHeatCommands(lines []string) []startHeatCommand {
+	commands := []startHeatCommand{}
+	for i, line := range lines {
+		if a.detectLayerChange(line) {
+			break
+		}
+		command, ok := parseCommand(line)
+		if !ok {
+			continue
+		}
+		temp, ok := command.Params['S']
+		if !ok {
+			temp = command.Params['R']
+		}
+		name := strings.ToUpper(command.Name)
+		if temp <= 0 || !slices.Contains([]string{"M140", "M190", "M104", "M109"}, name) {
+			continue
+		}
+		commands = append(commands, startHeatCommand{Index: i, Bed: name == "M140" || name == "M190",
+			Wait: name == "M190" || name == "M109", Temp: int(temp)})
+	}
+	return commands
+}
+
+// reorderStartHeating rearranges the heating of the start G-code for -start-heating. Concurrent
+// sets the other heater heating before the first wait, so a start that heats the bed and then the
+// hotend (or the other way around) waits once instead of twice; the hotend gets the first
+// temperature the start sets, which may be a lower probing temperature. Sequential moves hotend
+// commands before the bed wait to right after it. Either way, an M105 before each wait has the
+// host log the temperatures it starts from.
+func (a *Analysis) reorderStartHeating(lines []string) []string {
+	if startHeating == START_HEATING_KEEP {
+		return lines
+	}
+	commands := a.getStartHeatCommands(lines)
+	firstWait := slices.IndexFunc(commands, func(c startHeatCommand) bool { return c.Wait })
+	if firstWait < 0 {
+		fmt.Println("No heating waits before the first layer, leaving the start G-code as it is")
+		return lines
+	}
+
+	before := make(map[int][]string) // Lines inserted before each index
+	moved := make(map[int]bool)
+	switch startHeating {
+	case START_HEATING_CONCURRENT:
+		wait := commands[firstWait]
+		if slices.ContainsFunc(commands[:firstWait], func(c startHeatCommand) bool { return c.Bed != wait.Bed }) {
+			fmt.Println("The start G-code already heats the bed and the hotend together")
+			break
+		}
+		other := slices.IndexFunc(commands, func(c startHeatCommand) bool { return c.Bed != wait.Bed })
+		if other < 0 {
+			break
+		}
+		command := fmt.Sprintf("M104 S%d", commands[other].Temp)
+		if commands[other].Bed {
+			command = fmt.Sprintf("M140 S%d", commands[other].Temp)
+		}
+		before[wait.Index] = append(before[wait.Index], withComment(command, msg(MSG_HEAT_CONCURRENTLY)))
+		fmt.Printf("Heating the bed and the hotend together from line %d\n", wait.Index+1)
+	case START_HEATING_SEQUENTIAL:
+		bedWait := slices.IndexFunc(commands, func(c startHeatCommand) bool { return c.Bed && c.Wait })
+		if bedWait < 0 {
+			fmt.Println("No bed wait before the first layer, leaving the start G-code as it is")
+			break
+		}
+		after := commands[bedWait].Index + 1
+		for _, command := range commands[:bedWait] {
+			if !command.Bed {
+				moved[command.Index] = true
+				if command.Wait {
+					before[after] = append(before[after], "M105")
+				}
+				before[after] = append(before[after], lines[command.Index])
+			}
+		}
+		if len(moved) > 0 {
+			fmt.Printf("Heating the hotend after the bed, moving %d commands after line %d\n", len(moved), after)
+		}
+	}
+	for _, command := range commands {
+		if command.Wait && !moved[command.Index] && (command.Index == 0 || !strings.EqualFold(strings.TrimSpace(stripComment(lines[command.Index-1])), "M105")) {
+			before[command.Index] = append(before[command.Index], "M105")
+		}
+	}
+
+	reordered := make([]string, 0, len(lines)+len(before))
+	for i, line := range lines {
+		reordered = append(reordered, before[i]...)
+		if !moved[i] {
+			reordered = append(reordered, line)
+		}
+	}
+	return append(reordered, before[len(lines)]...)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const SNAPSHOT_PREFIX = "; gcode_modifier state:"
+
+var stateSnapshots bool // Insert a machine state snapshot comment at every layer boundary
+
+// positioningMode tracks whether positions are relative. M82/M83 set the extruder's own mode;
+// G91 makes every axis relative, E included, and G90 makes them absolute again, returning E to the
+// mode M82/M83 last set.
+type positioningMode struct {
+	RelativeAxes     bool // G91
+	RelativeExtruder bool // M83
+}
+
+// update applies a command to the mode, reporting whether it was a positioning mode command
+func (m *positioningMode) update(command string) bool {
+	switch strings.ToUpper(command) {
+	case "M82":
+		m.RelativeExtruder = false
+	case "M83":
+		m.RelativeExtruder = true
+	case "G90":
+		m.RelativeAxes = false
+	case "G91":
+		m.RelativeAxes = true
+	default:
+		return false
+	}
+	return true
+}
+
+// relativeE reports whether E values are relative
+func (m positioningMode) relativeE() bool {
+	return m.RelativeAxes || m.RelativeExtruder
+}
+
+// machineState is the printer state tracked while reading G-code
+type machineState struct {
+	X, Y, Z, E  float64
+	Feedrate    float64 // mm/min
+	HotendTemp  int
+	BedTemp     int
+	FanSpeed    int // 0-255
+	SpeedFactor int // M220 percent, 0 until set
+	Mode        positioningMode
+	MotorsOff   bool // Steppers disabled (M84/M18) and not moved since
+	hasPosition bool
+	macroDepth  int // Macro calls being expanded
+}
+
+// update applies the effect of one G-code line to the state; calls to macros loaded with -macros
+// apply the effect of the commands they expand to
+func (s *machineState) update(line string) {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return
+	}
+	if s.macroDepth < MAX_MACRO_DEPTH {
+		if expansion, ok := expandMacro(line); ok {
+			s.macroDepth++
+			for _, command := range expansion {
+				s.update(command)
+			}
+			s.macroDepth--
+			return
+		}
+	}
+	params := make(map[byte]float64)
+	for _, field := range fields[1:] {
+		if value, err := strconv.ParseFloat(field[1:], 64); err == nil {
+			params[field[0]] = value
+		}
+	}
+
+	if s.Mode.update(fields[0]) {
+		return
+	}
+	switch fields[0] {
+	case "G0", "G1":
+		s.MotorsOff = false
+		// move applies a coordinate in the positioning mode
+		move := func(position *float64, value float64) {
+			if s.Mode.RelativeAxes {
+				*position += value
+			} else {
+				*position = value
+			}
+		}
+		if x, ok := params['X']; ok {
+			move(&s.X, x)
+			s.hasPosition = true
+		}
+		if y, ok := params['Y']; ok {
+			move(&s.Y, y)
+			s.hasPosition = true
+		}
+		if z, ok := params['Z']; ok {
+			move(&s.Z, z)
+		}
+		if e, ok := params['E']; ok {
+			if s.Mode.relativeE() {
+				s.E += e
+			} else {
+				s.E = e
+			}
+		}
+		if f, ok := params['F']; ok {
+			s.Feedrate = f
+		}
+	case "G92":
+		if e, ok := params['E']; ok {
+			s.E = e
+		}
+	case "M104", "M109":
+		if t, ok := params['S']; ok {
+			s.HotendTemp = int(t)
+		} else if t, ok := params['R']; ok {
+			s.HotendTemp = int(t)
+		}
+	case "M140", "M190":
+		if t, ok := params['S']; ok {
+			s.BedTemp = int(t)
+		}
+	case "M106", "M107":
+		// P1-P3 are other fans, such as Bambu's auxiliary and chamber fans
+		if params['P'] != 0 {
+			break
+		}
+		s.FanSpeed = 0
+		if fields[0] == "M106" {
+			s.FanSpeed = 255
+			if speed, ok := params['S']; ok {
+				s.FanSpeed = int(speed)
+			}
+		}
+	case "M220":
+		if factor, ok := params['S']; ok {
+			s.SpeedFactor = int(factor)
+		}
+	case "M84", "M18":
+		s.MotorsOff = true
+	case "SET_HEATER_TEMPERATURE":
+		// Klipper: SET_HEATER_TEMPERATURE HEATER=extruder TARGET=215
+		klipperParams := parseMacroParams(fields[1:])
+		target, _ := strconv.ParseFloat(klipperParams["TARGET"], 64)
+		switch klipperParams["HEATER"] {
+		case "extruder":
+			s.HotendTemp = int(target)
+		case "heater_bed":
+			s.BedTemp = int(target)
+		}
+	}
+}
+
+// speedFactor returns the M220 speed factor in percent, 100 until one is set
+func (s machineState) speedFactor() int {
+	if s.SpeedFactor == 0 {
+		return 100
+	}
+	return s.SpeedFactor
+}
+
+// String formats the state as the body of a snapshot comment
+func (s machineState) String() string {
+	relativeE := 0
+	if s.Mode.relativeE() {
+		relativeE = 1
+	}
+	return fmt.Sprintf("X=%.3f Y=%.3f Z=%.3f E=%.5f F=%.0f HOTEND=%d BED=%d FAN=%d RELATIVE_E=%d",
+		s.X, s.Y, s.Z, s.E, s.Feedrate, s.HotendTemp, s.BedTemp, s.FanSpeed, relativeE)
+}
+
+// parseStateSnapshot parses a snapshot comment written by insertStateSnapshots
+func parseStateSnapshot(line string) (machineState, bool) {
+	var s machineState
+	if !strings.HasPrefix(line, SNAPSHOT_PREFIX) {
+		return s, false
+	}
+	for _, field := range strings.Fields(line[len(SNAPSHOT_PREFIX):]) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		number, _ := strconv.ParseFloat(value, 64)
+		switch key {
+		case "X":
+			s.X = number
+		case "Y":
+			s.Y = number
+		case "Z":
+			s.Z = number
+		case "E":
+			s.E = number
+		case "F":
+			s.Feedrate = number
+		case "HOTEND":
+			s.HotendTemp = int(number)
+		case "BED":
+			s.BedTemp = int(number)
+		case "FAN":
+			s.FanSpeed = int(number)
+		case "RELATIVE_E":
+			s.Mode.RelativeExtruder = number != 0
+		}
+	}
+	s.hasPosition = true
+	return s, true
+}
+
+// insertStateSnapshots adds a snapshot comment of the machine state after every layer change
+func (a *Analysis) insertStateSnapshots(lines []string) []string {
+	// Drop snapshots from an earlier run; a fresh one follows each layer change
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if !strings.HasPrefix(line, SNAPSHOT_PREFIX) {
+			kept = append(kept, line)
+		}
+	}
+
+	var state machineState
+	return a.insertAtLayerStarts(kept, func(line string) { state.update(line) }, func(layer int) []string {
+		return []string{SNAPSHOT_PREFIX + " " + state.String()}
+	})
+}
+
+// getStateAtLayer returns the machine state at the start of a 0-based layer and the index of
+// the layer change line, preferring the layer's snapshot comment when the file has one
+func (a *Analysis) getStateAtLayer(lines []string, layer int) (machineState, int, bool) {
+	var state machineState
+	currentLayer := -1
+	for i, line := range lines {
+		if a.detectLayerChange(line) {
+			currentLayer++
+			if currentLayer == layer {
+				if i+1 < len(lines) {
+					if snapshot, ok := parseStateSnapshot(lines[i+1]); ok {
+						return snapshot, i, true
+					}
+				}
+				return state, i, true
+			}
+		}
+		state.update(line)
+	}
+	return state, -1, false
+}
+
+// resumeFlags are the flags of the resume command
+type resumeFlags struct {
+	inputFilePath *string
+	userLayer     *int
+}
+
+// defineResumeFlags defines the flags of the resume command on a flag set
+func defineResumeFlags(fs *flag.FlagSet) resumeFlags {
+	var flags resumeFlags
+	flags.inputFilePath = fs.String("f", "", "Path to the input G-code file")
+	flags.userLayer = fs.Int("layer", -1, "Layer to resume from, numbered according to -layer-base")
+	addLayerBaseFlag(fs)
+	addMacrosFlag(fs)
+	return flags
+}
+
+// runResumeCommand implements "resume": it writes a file that reheats, restores the machine state
+// at the start of a layer and continues the print from there
+func runResumeCommand(args []string) {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	flags := defineResumeFlags(fs)
+	setCommandUsage(fs, "resume")
+	fs.Parse(args)
+	layer := parseLayer(*flags.userLayer)
+	loadMacrosFlag()
+
+	if *flags.inputFilePath == "" || layer < 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	lines, crlf, err := readLines(*flags.inputFilePath)
+	if err != nil {
+		fmt.Printf("Error reading file: %v\n", err)
+		os.Exit(1)
+	}
+
+	a := newAnalysis(lines, activePreset)
+	state, start, ok := a.getStateAtLayer(lines, layer)
+	if !ok {
+		fmt.Printf("Error: layer %d not found in '%s'\n", *flags.userLayer, *flags.inputFilePath)
+		os.Exit(1)
+	}
+
+	extrusionMode := "M82"
+	if state.Mode.relativeE() {
+		extrusionMode = "M83"
+	}
+	resumed := []string{
+		fmt.Sprintf("; Resumed by gcode_modifier from layer %d of %s", *flags.userLayer, *flags.inputFilePath),
+		fmt.Sprintf("; The nozzle must be at Z=%.3f above the part before starting", state.Z),
+		fmt.Sprintf("M140 S%d", state.BedTemp),
+		fmt.Sprintf("M104 S%d", state.HotendTemp),
+		fmt.Sprintf("M190 S%d", state.BedTemp),
+		fmt.Sprintf("M109 S%d", state.HotendTemp),
+		"G28 X Y ; Home X and Y only, Z can't be homed over the part",
+		"G90",
+		extrusionMode,
+		fmt.Sprintf("G92 %s %s", a.numbers.param('Z', state.Z), a.numbers.param('E', state.E)),
+		fmt.Sprintf("M106 S%d", state.FanSpeed),
+		fmt.Sprintf("G0 %s %s %s", a.numbers.param('X', state.X), a.numbers.param('Y', state.Y), a.numbers.param('F', state.Feedrate)),
+	}
+	resumed = append(resumed, lines[start:]...)
+
+	outputFilePath := getDerivedFilePath(*flags.inputFilePath, fmt.Sprintf("_resume_layer%d", *flags.userLayer))
+	if err := writeLines(outputFilePath, resumed, crlf); err != nil {
+		fmt.Printf("Error creating output file: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Resume file saved as %s.\n", outputFilePath)
+}
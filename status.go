@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	STATUS_NONE = "none"
+	STATUS_M117 = "m117" // On the printer's display
+	STATUS_M118 = "m118" // On the host's console, e.g. OctoPrint's terminal or Mainsail's console
+	STATUS_BOTH = "both"
+
+	RESET_REASON_PREFIX = "reset after " // Reason of the modifications that end a modified region
+)
+
+var statusMessages = STATUS_NONE // -status-messages
+
+// validateStatusMessages exits if -status-messages is unknown
+func validateStatusMessages() {
+	switch statusMessages {
+	case STATUS_NONE, STATUS_M117, STATUS_M118, STATUS_BOTH:
+	default:
+		fmt.Printf("Error: unknown -status-messages '%s' (use %s, %s, %s or %s)\n", statusMessages, STATUS_NONE, STATUS_M117, STATUS_M118, STATUS_BOTH)
+		os.Exit(1)
+	}
+}
+
+// getStatusLines returns the -status-messages commands telling the operator that the
+// modifications for a reason take effect, or with a reset reason that they end
+func getStatusLines(reason string) []string {
+	if statusMessages == STATUS_NONE {
+		return nil
+	}
+	message := msg(MSG_STATUS_ACTIVE, reason)
+	if region, ok := strings.CutPrefix(reason, RESET_REASON_PREFIX); ok {
+		message = msg(MSG_STATUS_DONE, region)
+	}
+	message = strings.NewReplacer(";", ",", "\"", "'").Replace(message)
+	status := []string{}
+	if statusMessages == STATUS_M117 || statusMessages == STATUS_BOTH {
+		status = append(status, "M117 "+message)
+	}
+	if statusMessages == STATUS_M118 || statusMessages == STATUS_BOTH {
+		if getFirmware() == FIRMWARE_REPRAP {
+			status = append(status, fmt.Sprintf("M118 S\"%s\"", message))
+		} else {
+			status = append(status, "M118 "+message)
+		}
+	}
+	return status
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var plateNumber int // Plate to process in a .gcode.3mf project, 0 for all plates
+
+// Plate G-code entries in Bambu/Orca project files, e.g. "Metadata/plate_2.gcode"
+var plateGcodeRegexp = regexp.MustCompile(`^Metadata/plate_(\d+)\.gcode$`)
+
+// is3mfFile reports whether the path is a sliced 3MF project (e.g. "part.gcode.3mf")
+func is3mfFile(filePath string) bool {
+	return strings.HasSuffix(filePath, ".gcode.3mf")
+}
+
+// getPlateNumber returns the plate number of a 3MF entry, or 0 if it isn't plate G-code
+func getPlateNumber(name string) int {
+	match := plateGcodeRegexp.FindStringSubmatch(name)
+	if match == nil {
+		return 0
+	}
+	plate, _ := strconv.Atoi(match[1])
+	return plate
+}
+
+// readZipLines reads a zip entry as G-code lines, and reports whether it has CRLF line endings
+func readZipLines(f *zip.File) ([]string, bool, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+
+	return scanLines(rc)
+}
+
+// is3mfPlateEntry reports whether a 3MF entry is plate G-code
+func is3mfPlateEntry(name string) bool {
+	return getPlateNumber(name) != 0
+}
+
+// hasArchiveMarker reports whether any G-code entry of a 3MF project or zip archive contains
+// MODIFIED_MARKER
+func hasArchiveMarker(filePath string, isGcodeEntry func(name string) bool) bool {
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	for _, f := range reader.File {
+		if !isGcodeEntry(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		found := hasMarker(rc)
+		rc.Close()
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// process3mfFile modifies the selected plate (or every plate) of a 3MF project
+func process3mfFile(ctx context.Context, filePath string, overwrite bool) {
+	missing := fmt.Sprintf("no plate G-code found in '%s'", filePath)
+	if plateNumber != 0 {
+		missing = fmt.Sprintf("plate %d not found in '%s'", plateNumber, filePath)
+	}
+	processArchive(ctx, filePath, overwrite, missing, func(name string) (string, bool) {
+		plate := getPlateNumber(name)
+		if plate == 0 || (plateNumber != 0 && plate != plateNumber) {
+			return "", false
+		}
+		return fmt.Sprintf("plate %d", plate), true
+	})
+}
+
+// processZipFile modifies every G-code file in a zip archive
+func processZipFile(ctx context.Context, filePath string, overwrite bool) {
+	processArchive(ctx, filePath, overwrite, fmt.Sprintf("no G-code files found in '%s'", filePath), func(name string) (string, bool) {
+		return name, isZipGcodeEntry(name)
+	})
+}
+
+// processArchive modifies the G-code entries of a 3MF project or zip archive chosen by
+// selectEntry, which names them for messages, copying all other entries unchanged and
+// refreshing the MD5 checksum entries of modified ones. It exits with the missing error when
+// no entry is chosen.
+func processArchive(ctx context.Context, filePath string, overwrite bool, missing string, selectEntry func(name string) (string, bool)) {
+	fmt.Printf("Processing '%s'\n", filePath)
+	srcInfo := getSourceInfo(filePath)
+	reader, err := zip.OpenReader(filePath)
+	if err != nil {
+		fmt.Printf("Error opening file: %v\n", err)
+		os.Exit(1)
+	}
+	defer reader.Close()
+
+	// Modify the plate G-code first so the checksum entries can be rewritten while copying
+	modifiedEntries := make(map[string][]byte)
+	unplanned := 0 // Entries -plan-in has no plan for, copied unchanged
+	firstPlan := len(exportedPlans)
+	for _, f := range reader.File {
+		label, ok := selectEntry(f.Name)
+		if !ok {
+			continue
+		}
+		lines, crlf, err := readZipLines(f)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", label, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s:\n", label)
+		if analyzeOnly {
+			name := fmt.Sprintf("%s (%s)", filePath, label)
+			plan, err := AnalyzeLines(ctx, name, lines)
+			if err != nil {
+				fmt.Printf("Stopped analyzing '%s': %v\n", name, err)
+				return
+			}
+			exportedPlans = append(exportedPlans, clonePlan(plan))
+			addBatchEntry(lines, plan, lines)
+			modifiedEntries[f.Name] = nil
+			continue
+		}
+		if lines, err = modifyLines(ctx, fmt.Sprintf("%s (%s)", filePath, label), lines, nil); errors.Is(err, errNoPlan) {
+			unplanned++
+			continue
+		} else if err != nil {
+			fmt.Printf("Stopped processing '%s', leaving it unchanged: %v\n", filePath, err)
+			return
+		}
+
+		var buf bytes.Buffer
+		newLineWriter(&buf, crlf).WriteLines(lines)
+		modifiedEntries[f.Name] = buf.Bytes()
+	}
+
+	if len(modifiedEntries) == 0 && unplanned > 0 {
+		return
+	} else if len(modifiedEntries) == 0 {
+		fmt.Printf("Error: %s\n", missing)
+		os.Exit(1)
+	}
+	// -analyze-only reports the plates without writing the archive
+	if analyzeOnly {
+		sendWebhooks(webhookEvent{Event: EVENT_ANALYZED, File: filePath, Plans: exportedPlans[firstPlan:]})
+		return
+	}
+
+	// Build the new archive in memory; the source may be the output when overwriting
+	var out bytes.Buffer
+	writer := zip.NewWriter(&out)
+	for _, f := range reader.File {
+		header := f.FileHeader
+		w, err := writer.CreateHeader(&header)
+		if err != nil {
+			fmt.Printf("Error writing '%s': %v\n", f.Name, err)
+			os.Exit(1)
+		}
+
+		if data, ok := modifiedEntries[f.Name]; ok {
+			w.Write(data)
+		} else if data, ok := modifiedEntries[strings.TrimSuffix(f.Name, ".md5")]; ok && strings.HasSuffix(f.Name, ".md5") {
+			fmt.Fprintf(w, "%X", md5.Sum(data))
+		} else {
+			rc, err := f.Open()
+			if err != nil {
+				fmt.Printf("Error reading '%s': %v\n", f.Name, err)
+				os.Exit(1)
+			}
+			io.Copy(w, rc)
+			rc.Close()
+		}
+	}
+	if err := writer.Close(); err != nil {
+		fmt.Printf("Error writing archive: %v\n", err)
+		os.Exit(1)
+	}
+
+	outputFilePath := getOutputFilePath(filePath, overwrite)
+	err = writeFileAtomic(outputFilePath, func(w io.Writer) error {
+		_, err := w.Write(out.Bytes())
+		return err
+	})
+	if err != nil {
+		fmt.Printf("Error creating output file: %v\n", err)
+		os.Exit(1)
+	}
+	if err := preserveFileAttributes(srcInfo, outputFilePath); err != nil {
+		fmt.Printf("Error preserving file times: %v\n", err)
+	}
+	fmt.Printf("Modification complete. New file saved as %s.\n", outputFilePath)
+	sendWebhooks(webhookEvent{Event: EVENT_PROCESSED, File: filePath, Output: outputFilePath, Plans: exportedPlans[firstPlan:]})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	REFERENCE_LAYER_HEIGHT    = 0.2 // The preset thresholds are tuned for 0.2mm layers...
+	REFERENCE_NOZZLE_DIAMETER = 0.4 // ...and a 0.4mm nozzle
+	MIN_THRESHOLD_SCALE       = 0.25
+	MAX_THRESHOLD_SCALE       = 1.5
+	THRESHOLDS_FILE_NAME      = "gcode_modifier/thresholds.json" // Below os.UserConfigDir()
+	THRESHOLD_MATCH_TOLERANCE = 0.001
+)
+
+// thresholdOverride sets detection thresholds for one layer height and nozzle diameter
+// combination, replacing the scaled preset values; fields left out keep the scaled value
+type thresholdOverride struct {
+	LayerHeight      float64  `json:"layer_height"`
+	NozzleDiameter   float64  `json:"nozzle_diameter"`
+	PerimPctChgUpper *float64 `json:"perim_pct_chg_upper,omitempty"`
+	PerimPctChgLower *float64 `json:"perim_pct_chg_lower,omitempty"`
+	MinCurrPerim     *float64 `json:"min_curr_perim,omitempty"`
+	MinProbLayer     *int     `json:"min_prob_layer,omitempty"`
+}
+
+var thresholdOverrides []thresholdOverride
+
+// getThresholdsFile returns the path of the threshold override table
+func getThresholdsFile() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, THRESHOLDS_FILE_NAME)
+}
+
+// loadThresholdOverrides reads the threshold override table; a missing table means no overrides
+func loadThresholdOverrides() ([]thresholdOverride, error) {
+	path := getThresholdsFile()
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var overrides []thresholdOverride
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("parsing threshold table '%s': %v", path, err)
+	}
+	return overrides, nil
+}
+
+// getMetadataFloat returns the first value of the first metadata line starting with one of the
+// prefixes (e.g. "; nozzle_diameter = 0.4,0.4"), or 0 when there is none
+func getMetadataFloat(lines []string, prefixes ...string) float64 {
+	for _, line := range lines {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(line, prefix) {
+				value := strings.Split(strings.TrimPrefix(line, prefix), ",")[0]
+				if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && f > 0 {
+					return f
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// getLayerHeight gets the layer height (e.g. "; layer_height = 0.2" or Cura's ";Layer height: 0.2")
+func getLayerHeight(lines []string) float64 {
+	return getMetadataFloat(lines, "; layer_height = ", ";Layer height: ")
+}
+
+// getNozzleDiameter gets the nozzle diameter (e.g. "; nozzle_diameter = 0.4")
+func getNozzleDiameter(lines []string) float64 {
+	return getMetadataFloat(lines, "; nozzle_diameter = ", ";Nozzle diameter: ")
+}
+
+// scaleThresholds adjusts the perimeter-change thresholds of a preset to the file's layer height
+// and nozzle diameter. Thinner layers shrink less from one layer to the next, so the upper
+// percentage bound is scaled with the layer height, and the minimum problematic layer is kept at
+// the same height above the bed. Narrower lines need more path length to print the same feature,
+// so the minimum perimeter is scaled inversely with the nozzle diameter. An entry of the override
+// table matching both values replaces the scaled thresholds.
+func scaleThresholds(p preset, lines []string) preset {
+	layerHeight := getLayerHeight(lines)
+	if layerHeight == 0 {
+		layerHeight = REFERENCE_LAYER_HEIGHT
+	}
+	nozzleDiameter := getNozzleDiameter(lines)
+	if nozzleDiameter == 0 {
+		nozzleDiameter = REFERENCE_NOZZLE_DIAMETER
+	}
+
+	scaled := p
+	heightRatio := layerHeight / REFERENCE_LAYER_HEIGHT
+	scaled.PerimPctChgUpper = p.PerimPctChgUpper * max(MIN_THRESHOLD_SCALE, min(heightRatio, MAX_THRESHOLD_SCALE))
+	scaled.MinProbLayer = int(math.Round(float64(p.MinProbLayer) / heightRatio))
+	scaled.MinCurrPerim = p.MinCurrPerim * REFERENCE_NOZZLE_DIAMETER / nozzleDiameter
+
+	for _, override := range thresholdOverrides {
+		if math.Abs(override.LayerHeight-layerHeight) > THRESHOLD_MATCH_TOLERANCE ||
+			math.Abs(override.NozzleDiameter-nozzleDiameter) > THRESHOLD_MATCH_TOLERANCE {
+			continue
+		}
+		if override.PerimPctChgUpper != nil {
+			scaled.PerimPctChgUpper = *override.PerimPctChgUpper
+		}
+		if override.PerimPctChgLower != nil {
+			scaled.PerimPctChgLower = *override.PerimPctChgLower
+		}
+		if override.MinCurrPerim != nil {
+			scaled.MinCurrPerim = *override.MinCurrPerim
+		}
+		if override.MinProbLayer != nil {
+			scaled.MinProbLayer = *override.MinProbLayer
+		}
+		fmt.Printf("Using threshold overrides for %.2fmm layers with a %.2fmm nozzle\n", layerHeight, nozzleDiameter)
+		return scaled
+	}
+
+	if scaled.PerimPctChgUpper != p.PerimPctChgUpper || scaled.MinProbLayer != p.MinProbLayer || scaled.MinCurrPerim != p.MinCurrPerim {
+		fmt.Printf("Scaled thresholds for %.2fmm layers with a %.2fmm nozzle\n", layerHeight, nozzleDiameter)
+	}
+	return scaled
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+)
+
+// cameraTriggers are the commands that take a time-lapse frame
+var cameraTriggers = []string{"M240", "M971", "TIMELAPSE_TAKE_FRAME", "@OCTOLAPSE"}
+
+// isCameraTrigger reports whether a line takes a time-lapse frame
+func isCameraTrigger(line string) bool {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return false
+	}
+	for _, trigger := range cameraTriggers {
+		if strings.EqualFold(fields[0], trigger) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExtrudingMove reports whether a line is a move in XY that extrudes, unlike travel moves,
+// retractions and primes
+func isExtrudingMove(line string) bool {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "G0", "G1", "G2", "G3":
+	default:
+		return false
+	}
+	extrudes, moves := false, false
+	for _, field := range fields[1:] {
+		switch field[0] {
+		case 'E':
+			extrudes = true
+		case 'X', 'Y':
+			moves = true
+		}
+	}
+	return extrudes && moves
+}
+
+// getTimelapseBlocks marks the lines of the time-lapse sequences that park the head for a frame
+// and return it: Bambu's skippable timelapse blocks and M622/M623 conditionals, and otherwise the
+// travel moves, retractions and dwells around a camera trigger (M240, M971, Klipper's
+// TIMELAPSE_TAKE_FRAME, Octolapse's @OCTOLAPSE)
+func getTimelapseBlocks(lines []string) []bool {
+	blocks := make([]bool, len(lines))
+	skippable, conditional := -1, 0
+	for i, line := range lines {
+		comment := strings.ToUpper(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), ";")))
+		switch {
+		case strings.HasPrefix(comment, "SKIPPABLE_START"):
+			skippable = i
+		case strings.HasPrefix(comment, "SKIPTYPE:") && skippable >= 0 && strings.Contains(comment, "TIMELAPSE"):
+			for j := skippable; j <= i; j++ {
+				blocks[j] = true
+			}
+		case strings.HasPrefix(comment, "SKIPPABLE_END"):
+			if skippable >= 0 && blocks[skippable] {
+				blocks[i] = true
+			}
+			skippable = -1
+		}
+		fields := strings.Fields(stripComment(line))
+		if len(fields) > 0 && fields[0] == "M622" {
+			conditional++
+		}
+		if conditional > 0 || (skippable >= 0 && blocks[skippable]) {
+			blocks[i] = true
+		}
+		if len(fields) > 0 && fields[0] == "M623" && conditional > 0 {
+			conditional--
+		}
+	}
+
+	for i, line := range lines {
+		if !isCameraTrigger(line) || blocks[i] {
+			continue
+		}
+		blocks[i] = true
+		// The park moves lead up to the trigger and the return moves follow it
+		for j := i - 1; j >= 0 && isParkLine(lines[j]); j-- {
+			blocks[j] = true
+		}
+		for j := i + 1; j < len(lines) && isParkLine(lines[j]); j++ {
+			blocks[j] = true
+		}
+	}
+	return blocks
+}
+
+// isParkLine reports whether a line can be part of a park and return sequence around a camera
+// trigger: a travel move, retraction or prime, or a dwell
+func isParkLine(line string) bool {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "G0", "G1":
+		return !isExtrudingMove(line)
+	case "G4", "M400":
+		return true
+	}
+	return false
+}
+
+// getBlockEnd returns the last line of the marked block that line i is in, or that follows it
+// before the layer extrudes anything, or -1 when there is none
+func (a *Analysis) getBlockEnd(lines []string, blocks []bool, i int) int {
+	for j := i; j < len(lines); j++ {
+		if blocks[j] {
+			for j+1 < len(lines) && blocks[j+1] {
+				j++
+			}
+			return j
+		}
+		if j > i && (a.detectLayerChange(lines[j]) || isExtrudingMove(lines[j])) {
+			return -1
+		}
+	}
+	return -1
+}
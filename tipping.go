@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const DETECTOR_TIPPING_RISK = "tipping-risk"
+
+// getIslandWidth returns the diameter of the circle with the area of an island, the width a
+// section of the print stands on
+func getIslandWidth(area float64) float64 {
+	return 2 * math.Sqrt(area/math.Pi)
+}
+
+// detectTippingRisk returns the runs of layers at risk of being knocked over by the nozzle: their
+// smallest island is narrow for its height above the bed (height over width above the preset's
+// TippingMaxRatio), or their centroid lies outside the first layer's footprint, so the print
+// leans over its base
+func (a *Analysis) detectTippingRisk(lines []string) []Detection {
+	geometry := a.getLayerGeometry(lines)
+	footprint := []point{}
+	for _, loop := range a.getLayerLoops(lines)[0] {
+		footprint = append(footprint, loop...)
+	}
+	footprint = convexHull(footprint)
+
+	layers := []int{}
+	for layer := range geometry {
+		layers = append(layers, layer)
+	}
+	sort.Ints(layers)
+
+	detections := []Detection{}
+	runStart, runEnd := -1, -1
+	details := ""
+	endRun := func() {
+		if runStart >= 0 {
+			detections = append(detections, Detection{Layer: runStart, EndLayer: runEnd, Detector: DETECTOR_TIPPING_RISK, Details: details})
+		}
+		runStart = -1
+	}
+	for _, layer := range layers {
+		current := geometry[layer]
+		height := a.layerZHeights[layer]
+		width := getIslandWidth(current.Smallest)
+		reason := ""
+		if ratio := height / width; ratio > a.preset.TippingMaxRatio {
+			reason = fmt.Sprintf("%.1fmm above the bed on a %.1fmm wide section (ratio %.1f, limit %.1f)",
+				height, width, ratio, a.preset.TippingMaxRatio)
+		} else if len(footprint) >= 3 && !containsPoint(footprint, current.Centroid) {
+			reason = fmt.Sprintf("centroid X%.1f Y%.1f at %.1fmm is outside the first layer's footprint",
+				current.Centroid.X, current.Centroid.Y, height)
+		}
+		if reason == "" || (runStart >= 0 && layer != runEnd+1) {
+			endRun()
+		}
+		if reason == "" {
+			continue
+		}
+		if runStart < 0 {
+			runStart, details = layer, reason
+		}
+		runEnd = layer
+	}
+	endRun()
+	return detections
+}
+
+// planTippingModifications slows printing from the first tipping-risk layer to the end of the
+// print, since every layer above a narrow section or a lean loads it further, and restores the full
+// speed before the end sequence. A TippingSpeedPct of 100 or more only warns.
+func (a *Analysis) planTippingModifications(detections []Detection) []modification {
+	if len(detections) == 0 || a.preset.TippingSpeedPct >= 100 {
+		return []modification{}
+	}
+	reason := fmt.Sprintf("tipping risk from layer %d", displayLayer(detections[0].Layer))
+	return []modification{
+		{Layer: detections[0].Layer, Kind: MOD_SPEED_FACTOR, Value: a.preset.TippingSpeedPct, Reason: reason},
+		{Layer: len(a.layerLines), Kind: MOD_SPEED_FACTOR, Value: 100, Reason: RESET_REASON_PREFIX + reason},
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const TRANSFORM_DELETE = "delete"
+
+// transformAction changes one parameter of a matching command: "=" sets it (adding it when
+// missing), "*=", "+=" and "-=" scale or shift an existing value
+type transformAction struct {
+	Param byte
+	Op    string
+	Value float64
+}
+
+// transform is a rule from a -transforms file: the commands matching a query have actions applied
+// to their parameters, or are deleted
+type transform struct {
+	Rule    string
+	Query   queryExpr
+	Actions []transformAction
+	Delete  bool
+}
+
+var transformsPath string // -transforms, file of transform rules applied to every output
+var transforms []transform
+
+var transformActionRegexp = regexp.MustCompile(`^([A-Za-z])\s*(\*=|\+=|-=|=)\s*(-?[0-9]*\.?[0-9]+)$`)
+
+// parseTransform parses a rule such as 'feature~bridge && cmd==G1: F*=0.6' or 'cmd==M73: delete'
+func parseTransform(rule string) (transform, error) {
+	separator := -1
+	inString := false
+	for i := 0; i < len(rule); i++ {
+		switch {
+		case rule[i] == '"':
+			inString = !inString
+		case rule[i] == ':' && !inString:
+			separator = i
+		}
+	}
+	if separator < 0 {
+		return transform{}, fmt.Errorf("missing ':' between the query and the actions")
+	}
+	query, err := parseQuery(rule[:separator])
+	if err != nil {
+		return transform{}, err
+	}
+
+	t := transform{Rule: rule, Query: query}
+	for _, action := range strings.Split(rule[separator+1:], ",") {
+		action = strings.TrimSpace(action)
+		if strings.EqualFold(action, TRANSFORM_DELETE) {
+			t.Delete = true
+			continue
+		}
+		m := transformActionRegexp.FindStringSubmatch(action)
+		if m == nil {
+			return transform{}, fmt.Errorf("invalid action '%s' (use e.g. F*=0.6, S=128, E+=0.1 or %s)", action, TRANSFORM_DELETE)
+		}
+		value, _ := strconv.ParseFloat(m[3], 64)
+		t.Actions = append(t.Actions, transformAction{Param: strings.ToUpper(m[1])[0], Op: m[2], Value: value})
+	}
+	if t.Delete && len(t.Actions) > 0 {
+		return transform{}, fmt.Errorf("'%s' can't be combined with other actions", TRANSFORM_DELETE)
+	}
+	return t, nil
+}
+
+// loadTransforms reads the -transforms file: one rule per line, with blank lines and lines
+// starting with '#' skipped
+func loadTransforms(path string) ([]transform, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	loaded := []transform{}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		rule := strings.TrimSpace(scanner.Text())
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		t, err := parseTransform(rule)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		loaded = append(loaded, t)
+	}
+	return loaded, scanner.Err()
+}
+
+// applyActions returns the line with the actions applied to its parameters, written in the file's
+// number style, keeping its indentation and comment, and whether anything changed
+func applyActions(line string, actions []transformAction, numbers numberFormat) (string, bool) {
+	code := stripComment(line)
+	trimmed := strings.TrimRight(code, " \t")
+	indent := trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, " \t"))]
+	fields := strings.Fields(code)
+	changed := false
+
+	for _, action := range actions {
+		found := false
+		for i, field := range fields[1:] {
+			value, err := strconv.ParseFloat(field[1:], 64)
+			if len(field) < 2 || err != nil || strings.ToUpper(field[:1])[0] != action.Param {
+				continue
+			}
+			switch action.Op {
+			case "=":
+				value = action.Value
+			case "*=":
+				value *= action.Value
+			case "+=":
+				value += action.Value
+			case "-=":
+				value -= action.Value
+			}
+			fields[i+1] = field[:1] + numbers.format(action.Param, value)
+			found = true
+		}
+		if !found && action.Op == "=" {
+			fields = append(fields, numbers.param(action.Param, action.Value))
+			found = true
+		}
+		changed = changed || found
+	}
+	if !changed {
+		return line, false
+	}
+	return indent + strings.Join(fields, " ") + code[len(trimmed):] + line[len(code):], true
+}
+
+// applyTransforms applies the -transforms rules to every command, layer by layer. The first
+// delete rule that matches a command removes it; other matching rules apply in file order.
+// Commands in time-lapse sequences and other post-processors' blocks are left unchanged.
+func applyTransforms(lines []string) []string {
+	if len(transforms) == 0 {
+		return lines
+	}
+	changed := make([]int, len(transforms))
+	foreign := getForeignBlocks(lines)
+	numbers := getNumberFormat(lines)
+	feature := ""
+	transformLines := func(layer int, firstLine int, layerLines []string) []string {
+		transformed := make([]string, 0, len(layerLines))
+		for i, line := range layerLines {
+			if name, ok := getFeatureName(line); ok {
+				feature = name
+			}
+			command, ok := parseCommand(line)
+			ok = ok && !foreign[firstLine+i-1]
+			deleted := false
+			for n, t := range transforms {
+				if !ok || !t.Query.match(queryLine{Number: firstLine + i, Layer: layer, Feature: feature, Command: command}) {
+					continue
+				}
+				if t.Delete {
+					changed[n]++
+					deleted = true
+					break
+				}
+				if updated, didChange := applyActions(line, t.Actions, numbers); didChange {
+					line = updated
+					command, ok = parseCommand(line)
+					changed[n]++
+				}
+			}
+			if !deleted {
+				transformed = append(transformed, line)
+			}
+		}
+		return transformed
+	}
+
+	doc := NewDocument(lines)
+	firstLine := len(doc.Header()) + 1
+	doc.ReplaceHeader(transformLines(-1, 1, doc.Header())...)
+	for layer := 0; layer < doc.LayerCount(); layer++ {
+		layerLines := doc.Layer(layer).Lines()
+		doc.ReplaceLayer(layer, transformLines(layer, firstLine, layerLines)...)
+		firstLine += len(layerLines)
+	}
+
+	for n, t := range transforms {
+		if t.Delete {
+			fmt.Printf("Transform '%s': %d lines deleted\n", t.Rule, changed[n])
+		} else {
+			fmt.Printf("Transform '%s': %d lines changed\n", t.Rule, changed[n])
+		}
+	}
+	return doc.Lines()
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	UPLOAD_PRUSALINK = "prusalink"
+	UPLOAD_DUET      = "duet"
+	UPLOAD_OCTOPRINT = "octoprint"
+	UPLOAD_MOONRAKER = "moonraker"
+	UPLOAD_REPETIER  = "repetier"
+
+	UPLOAD_TIMEOUT            = 10 * time.Minute // Large files over Wi-Fi take a while
+	PRUSALINK_DEFAULT_STORAGE = "usb"
+	DUET_DEFAULT_STORAGE      = "0:/gcodes"
+)
+
+// uploadConfig holds the settings every backend takes, in the printer profile's "upload" section
+// of the backend
+type uploadConfig struct {
+	URL    string `json:"url"`               // e.g. http://192.168.1.20
+	APIKey string `json:"api_key,omitempty"` // Sent as X-Api-Key
+	Print  bool   `json:"print,omitempty"`   // Start printing the file once uploaded
+}
+
+// Uploader sends files to a printer or print server
+type Uploader interface {
+	// Connect checks the printer can be reached with the configured credentials, and opens a
+	// session on printers that need one
+	Connect() error
+	// Upload sends a file and returns its path on the printer
+	Upload(filePath string) (string, error)
+	// StartPrint starts printing an uploaded file
+	StartPrint(remotePath string) error
+}
+
+// uploaderBackends are the backends -upload can select by name. Each creates its uploader from
+// its section of the printer profile's "upload" settings, so new printers only need an entry here.
+var uploaderBackends = map[string]func(config json.RawMessage) (Uploader, error){
+	UPLOAD_PRUSALINK: newPrusaLinkUploader,
+	UPLOAD_DUET:      newDuetUploader,
+	UPLOAD_OCTOPRINT: newOctoprintUploader,
+	UPLOAD_MOONRAKER: newMoonrakerUploader,
+	UPLOAD_REPETIER:  newRepetierUploader,
+}
+
+// StatusReporter is an uploader that can tell whether the printer is busy, so queued uploads wait
+// for it
+type StatusReporter interface {
+	Status() (printerStatus, error)
+}
+
+// printerStatus is the state of a printer as its backend reports it
+type printerStatus struct {
+	State    string // As the backend names it, e.g. printing
+	Busy     bool   // Printing, paused or otherwise not ready for another print
+	Material string // Filament loaded, as the printer names it, empty when unknown
+}
+
+var uploadBackend string // -upload, the backend each output is sent to
+
+// getUploaderNames returns the names of the upload backends, sorted
+func getUploaderNames() []string {
+	names := []string{}
+	for name := range uploaderBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newUploader returns the uploader of a backend, configured from the -printer profile, and the
+// settings common to all backends
+func newUploader(backend string) (Uploader, uploadConfig, error) {
+	var common uploadConfig
+	newBackend, ok := uploaderBackends[backend]
+	if !ok {
+		return nil, common, fmt.Errorf("unknown upload backend '%s' (use %s)", backend, strings.Join(getUploaderNames(), ", "))
+	}
+	config, ok := activePrinter.Upload[backend]
+	if !ok {
+		return nil, common, fmt.Errorf("printer profile '%s' has no \"upload\" settings for %s", activePrinter.Name, backend)
+	}
+	if err := decodeUploadConfig(config, &common); err != nil {
+		return nil, common, err
+	}
+	if common.URL == "" {
+		return nil, common, fmt.Errorf("%s upload settings have no url", backend)
+	}
+	uploader, err := newBackend(config)
+	return uploader, common, err
+}
+
+// decodeUploadConfig parses a backend's upload settings
+func decodeUploadConfig(config json.RawMessage, settings any) error {
+	if err := json.Unmarshal(config, settings); err != nil {
+		return fmt.Errorf("parsing upload settings: %v", err)
+	}
+	return nil
+}
+
+// validateUpload exits if -upload names an unknown backend, or one the -printer profile has no
+// valid settings for
+func validateUpload() {
+	if uploadBackend == "" {
+		return
+	}
+	if activePrinter == nil {
+		fmt.Println("Error: -upload needs a -printer profile with \"upload\" settings")
+		os.Exit(1)
+	}
+	if _, _, err := newUploader(uploadBackend); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// uploadOutput sends an output file to the -upload backend and starts printing it when its
+// settings ask to, and reports whether it did; failures are reported but leave the output in place
+func uploadOutput(filePath string) bool {
+	uploader, config, err := newUploader(uploadBackend)
+	if err == nil {
+		err = uploader.Connect()
+	}
+	if closer, ok := uploader.(io.Closer); ok && err == nil {
+		defer closer.Close()
+	}
+	remotePath := ""
+	if err == nil {
+		remotePath, err = uploader.Upload(filePath)
+	}
+	if err != nil {
+		fmt.Printf("Error uploading '%s' to %s: %v\n", filePath, config.URL, err)
+		return false
+	}
+	if !config.Print {
+		fmt.Printf("Uploaded '%s' to %s\n", filePath, config.URL)
+		return false
+	}
+	if err := uploader.StartPrint(remotePath); err != nil {
+		fmt.Printf("Uploaded '%s' to %s, but starting the print failed: %v\n", filePath, config.URL, err)
+		return false
+	}
+	fmt.Printf("Uploaded '%s' to %s and started printing it\n", filePath, config.URL)
+	return true
+}
+
+// getPrinterStatus returns the status of the -upload backend's printer; ok is false for backends
+// that don't report one
+func getPrinterStatus() (status printerStatus, ok bool, err error) {
+	uploader, _, err := newUploader(uploadBackend)
+	if err != nil {
+		return status, false, err
+	}
+	reporter, ok := uploader.(StatusReporter)
+	if !ok {
+		return status, false, nil
+	}
+	if err := uploader.Connect(); err != nil {
+		return status, true, err
+	}
+	if closer, ok := uploader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	status, err = reporter.Status()
+	return status, true, err
+}
+
+// queryLoadedMaterial sets the filament type loaded in the -upload printer, when its backend
+// reports one, so corrections suit what's printed
+func queryLoadedMaterial() {
+	if uploadBackend == "" {
+		return
+	}
+	status, ok, err := getPrinterStatus()
+	if err != nil {
+		fmt.Printf("Warning: could not check the filament loaded in the printer: %v\n", err)
+		return
+	}
+	if ok && status.Material != "" {
+		loadedMaterial = normalizeMaterial(status.Material)
+		fmt.Printf("Printer has %s loaded\n", loadedMaterial)
+	}
+}
+
+// checkUploadResponse returns an error for a failed request or an unsuccessful status
+func checkUploadResponse(response *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("status %s", response.Status)
+	}
+	return nil
+}
+
+// sendUploadRequest sends a request with the API key, if any, and checks its response
+func sendUploadRequest(method, endpoint, apiKey, contentType string, body io.Reader) error {
+	request, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if apiKey != "" {
+		request.Header.Set("X-Api-Key", apiKey)
+	}
+	return checkUploadResponse((&http.Client{Timeout: UPLOAD_TIMEOUT}).Do(request))
+}
+
+// getUploadJSON sends a GET request with the API key, if any, and decodes its JSON response
+func getUploadJSON(endpoint, apiKey string, reply any) error {
+	request, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	return doUploadJSON(request, apiKey, reply)
+}
+
+// postUploadJSON posts a JSON body with the API key, if any, and decodes its JSON response
+func postUploadJSON(endpoint, apiKey, body string, reply any) error {
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return doUploadJSON(request, apiKey, reply)
+}
+
+// doUploadJSON sends a request with the API key, if any, and decodes its JSON response
+func doUploadJSON(request *http.Request, apiKey string, reply any) error {
+	if apiKey != "" {
+		request.Header.Set("X-Api-Key", apiKey)
+	}
+	response, err := (&http.Client{Timeout: UPLOAD_TIMEOUT}).Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("status %s", response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(reply); err != nil {
+		return fmt.Errorf("unexpected response: %v", err)
+	}
+	return nil
+}
+
+// escapePath escapes each element of a slash-separated path for a URL
+func escapePath(path string) string {
+	elements := strings.Split(path, "/")
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return strings.Join(elements, "/")
+}
+
+// postMultipart posts a file as the form field fileField, with the other form fields. The file is
+// streamed rather than read into memory, with its length known up front for printers that don't
+// take chunked requests.
+func postMultipart(endpoint, apiKey string, fields map[string]string, fileField, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	form := multipart.NewWriter(&buffer)
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		form.WriteField(name, fields[name])
+	}
+	form.CreateFormFile(fileField, filepath.Base(filePath))
+	head := bytes.Clone(buffer.Bytes())
+	buffer.Reset()
+	form.Close()
+	tail := buffer.Bytes()
+
+	request, err := http.NewRequest(http.MethodPost, endpoint, io.MultiReader(bytes.NewReader(head), file, bytes.NewReader(tail)))
+	if err != nil {
+		return err
+	}
+	request.ContentLength = int64(len(head)) + info.Size() + int64(len(tail))
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	if apiKey != "" {
+		request.Header.Set("X-Api-Key", apiKey)
+	}
+	return checkUploadResponse((&http.Client{Timeout: UPLOAD_TIMEOUT}).Do(request))
+}
+
+// prusaLinkUploader uploads to a printer running PrusaLink
+type prusaLinkUploader struct {
+	uploadConfig
+	Storage string `json:"storage,omitempty"` // usb by default
+}
+
+// newPrusaLinkUploader returns a PrusaLink uploader from its upload settings
+func newPrusaLinkUploader(config json.RawMessage) (Uploader, error) {
+	u := &prusaLinkUploader{Storage: PRUSALINK_DEFAULT_STORAGE}
+	return u, decodeUploadConfig(config, u)
+}
+
+// Connect checks the API key with GET /api/version
+func (u *prusaLinkUploader) Connect() error {
+	return sendUploadRequest(http.MethodGet, strings.TrimRight(u.URL, "/")+"/api/version", u.APIKey, "", nil)
+}
+
+// Upload sends a file with PUT /api/v1/files, replacing a file of the same name
+func (u *prusaLinkUploader) Upload(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	remotePath := u.Storage + "/" + filepath.Base(filePath)
+	request, err := http.NewRequest(http.MethodPut, strings.TrimRight(u.URL, "/")+"/api/v1/files/"+escapePath(remotePath), file)
+	if err != nil {
+		return "", err
+	}
+	request.ContentLength = info.Size()
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("X-Api-Key", u.APIKey)
+	request.Header.Set("Overwrite", "?1")
+	return remotePath, checkUploadResponse((&http.Client{Timeout: UPLOAD_TIMEOUT}).Do(request))
+}
+
+// StartPrint prints a file with POST /api/v1/files
+func (u *prusaLinkUploader) StartPrint(remotePath string) error {
+	return sendUploadRequest(http.MethodPost, strings.TrimRight(u.URL, "/")+"/api/v1/files/"+escapePath(remotePath), u.APIKey, "", nil)
+}
+
+// Status reads the printer state of GET /api/v1/status, and the loaded filament of GET /api/printer
+func (u *prusaLinkUploader) Status() (printerStatus, error) {
+	var reply struct {
+		Printer struct {
+			State string `json:"state"`
+		} `json:"printer"`
+	}
+	if err := getUploadJSON(strings.TrimRight(u.URL, "/")+"/api/v1/status", u.APIKey, &reply); err != nil {
+		return printerStatus{}, err
+	}
+	state := strings.ToLower(reply.Printer.State)
+	status := printerStatus{State: state, Busy: !slices.Contains([]string{"idle", "ready", "finished", "stopped"}, state)}
+
+	// The loaded filament is only in the telemetry of the older API
+	var printer struct {
+		Telemetry struct {
+			Material string `json:"material"`
+		} `json:"telemetry"`
+	}
+	if getUploadJSON(strings.TrimRight(u.URL, "/")+"/api/printer", u.APIKey, &printer) == nil && printer.Telemetry.Material != "---" {
+		status.Material = printer.Telemetry.Material
+	}
+	return status, nil
+}
+
+// octoprintUploader uploads to OctoPrint's local storage
+type octoprintUploader struct{ uploadConfig }
+
+// newOctoprintUploader returns an OctoPrint uploader from its upload settings
+func newOctoprintUploader(config json.RawMessage) (Uploader, error) {
+	u := &octoprintUploader{}
+	return u, decodeUploadConfig(config, u)
+}
+
+// Connect checks the API key with GET /api/version
+func (u *octoprintUploader) Connect() error {
+	return sendUploadRequest(http.MethodGet, strings.TrimRight(u.URL, "/")+"/api/version", u.APIKey, "", nil)
+}
+
+// Upload sends a file with POST /api/files/local
+func (u *octoprintUploader) Upload(filePath string) (string, error) {
+	return filepath.Base(filePath), postMultipart(strings.TrimRight(u.URL, "/")+"/api/files/local", u.APIKey, nil, "file", filePath)
+}
+
+// StartPrint selects and prints a file with the select command of POST /api/files/local
+func (u *octoprintUploader) StartPrint(remotePath string) error {
+	return sendUploadRequest(http.MethodPost, strings.TrimRight(u.URL, "/")+"/api/files/local/"+escapePath(remotePath), u.APIKey,
+		"application/json", strings.NewReader(`{"command": "select", "print": true}`))
+}
+
+// Status reads the state flags of GET /api/printer
+func (u *octoprintUploader) Status() (printerStatus, error) {
+	var reply struct {
+		State struct {
+			Text  string          `json:"text"`
+			Flags map[string]bool `json:"flags"`
+		} `json:"state"`
+	}
+	if err := getUploadJSON(strings.TrimRight(u.URL, "/")+"/api/printer?exclude=temperature,sd", u.APIKey, &reply); err != nil {
+		return printerStatus{}, err
+	}
+	flags := reply.State.Flags
+	busy := flags["printing"] || flags["paused"] || flags["pausing"] || flags["cancelling"] || !flags["ready"]
+	return printerStatus{State: strings.ToLower(reply.State.Text), Busy: busy}, nil
+}
+
+// moonrakerUploader uploads to the gcodes directory of Moonraker
+type moonrakerUploader struct{ uploadConfig }
+
+// newMoonrakerUploader returns a Moonraker uploader from its upload settings
+func newMoonrakerUploader(config json.RawMessage) (Uploader, error) {
+	u := &moonrakerUploader{}
+	return u, decodeUploadConfig(config, u)
+}
+
+// Connect checks Moonraker is up with GET /server/info
+func (u *moonrakerUploader) Connect() error {
+	return sendUploadRequest(http.MethodGet, strings.TrimRight(u.URL, "/")+"/server/info", u.APIKey, "", nil)
+}
+
+// Upload sends a file with POST /server/files/upload
+func (u *moonrakerUploader) Upload(filePath string) (string, error) {
+	return filepath.Base(filePath), postMultipart(strings.TrimRight(u.URL, "/")+"/server/files/upload", u.APIKey,
+		map[string]string{"root": "gcodes"}, "file", filePath)
+}
+
+// StartPrint prints a file with POST /printer/print/start
+func (u *moonrakerUploader) StartPrint(remotePath string) error {
+	return sendUploadRequest(http.MethodPost, strings.TrimRight(u.URL, "/")+"/printer/print/start?filename="+url.QueryEscape(remotePath),
+		u.APIKey, "", nil)
+}
+
+// Status reads the print_stats state of Klipper through GET /printer/objects/query, and the
+// material of the active Spoolman spool
+func (u *moonrakerUploader) Status() (printerStatus, error) {
+	var reply struct {
+		Result struct {
+			Status struct {
+				PrintStats struct {
+					State string `json:"state"`
+				} `json:"print_stats"`
+			} `json:"status"`
+		} `json:"result"`
+	}
+	if err := getUploadJSON(strings.TrimRight(u.URL, "/")+"/printer/objects/query?print_stats", u.APIKey, &reply); err != nil {
+		return printerStatus{}, err
+	}
+	state := reply.Result.Status.PrintStats.State
+	return printerStatus{State: state, Busy: state == "printing" || state == "paused", Material: u.getSpoolMaterial()}, nil
+}
+
+// getSpoolMaterial returns the material of the active spool of Moonraker's Spoolman integration,
+// empty when Spoolman isn't set up or no spool is active
+func (u *moonrakerUploader) getSpoolMaterial() string {
+	base := strings.TrimRight(u.URL, "/")
+	var active struct {
+		Result struct {
+			SpoolID *int `json:"spool_id"`
+		} `json:"result"`
+	}
+	if getUploadJSON(base+"/server/spoolman/spool_id", u.APIKey, &active) != nil || active.Result.SpoolID == nil {
+		return ""
+	}
+	request := fmt.Sprintf(`{"request_method": "GET", "path": "/v1/spool/%d"}`, *active.Result.SpoolID)
+	var spool struct {
+		Result struct {
+			Filament struct {
+				Material string `json:"material"`
+			} `json:"filament"`
+		} `json:"result"`
+	}
+	if postUploadJSON(base+"/server/spoolman/proxy", u.APIKey, request, &spool) != nil {
+		return ""
+	}
+	return spool.Result.Filament.Material
+}
+
+// repetierUploader uploads to a printer of Repetier-Server
+type repetierUploader struct {
+	uploadConfig
+	Printer string `json:"printer"` // Slug of the printer
+}
+
+// newRepetierUploader returns a Repetier-Server uploader from its upload settings
+func newRepetierUploader(config json.RawMessage) (Uploader, error) {
+	u := &repetierUploader{}
+	if err := decodeUploadConfig(config, u); err != nil {
+		return nil, err
+	}
+	if u.Printer == "" {
+		return nil, fmt.Errorf("%s upload settings have no printer", UPLOAD_REPETIER)
+	}
+	return u, nil
+}
+
+// Connect checks the API key with the listPrinter action
+func (u *repetierUploader) Connect() error {
+	return sendUploadRequest(http.MethodGet, strings.TrimRight(u.URL, "/")+"/printer/api/"+url.PathEscape(u.Printer)+"?a=listPrinter",
+		u.APIKey, "", nil)
+}
+
+// Upload sends a file to the printer's stored models with POST /printer/model/<slug>, or, to print
+// it, as a job with POST /printer/job/<slug>
+func (u *repetierUploader) Upload(filePath string) (string, error) {
+	kind := "model"
+	if u.Print {
+		kind = "job"
+	}
+	name := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	return name, postMultipart(strings.TrimRight(u.URL, "/")+"/printer/"+kind+"/"+url.PathEscape(u.Printer), u.APIKey,
+		map[string]string{"a": "upload", "name": name}, "filename", filePath)
+}
+
+// StartPrint does nothing more: Repetier-Server starts an uploaded job once the printer is free
+func (u *repetierUploader) StartPrint(remotePath string) error {
+	return nil
+}
+
+// Status reads the job of the printer from the listPrinter action
+func (u *repetierUploader) Status() (printerStatus, error) {
+	var reply []struct {
+		Slug   string `json:"slug"`
+		Job    string `json:"job"`
+		Paused bool   `json:"paused"`
+	}
+	err := getUploadJSON(strings.TrimRight(u.URL, "/")+"/printer/api/"+url.PathEscape(u.Printer)+"?a=listPrinter", u.APIKey, &reply)
+	if err != nil {
+		return printerStatus{}, err
+	}
+	for _, printer := range reply {
+		if printer.Slug == u.Printer {
+			if printer.Job == "" || printer.Job == "none" {
+				return printerStatus{State: "idle"}, nil
+			}
+			return printerStatus{State: "printing " + printer.Job, Busy: true}, nil
+		}
+	}
+	return printerStatus{}, fmt.Errorf("no printer '%s'", u.Printer)
+}
+
+// duetUploader uploads to the SD card of a Duet running RepRapFirmware
+type duetUploader struct {
+	uploadConfig
+	Password string `json:"password,omitempty"` // Board password, if one is set
+	Storage  string `json:"storage,omitempty"`  // Directory, 0:/gcodes by default
+
+	client     *http.Client
+	sessionKey string
+}
+
+// newDuetUploader returns a Duet uploader from its upload settings
+func newDuetUploader(config json.RawMessage) (Uploader, error) {
+	u := &duetUploader{Storage: DUET_DEFAULT_STORAGE, client: &http.Client{Timeout: UPLOAD_TIMEOUT}}
+	return u, decodeUploadConfig(config, u)
+}
+
+// duetReply is the JSON response of a Duet's rr_ requests
+type duetReply struct {
+	Err        int             `json:"err"` // 0 on success
+	SessionKey string          `json:"sessionKey"`
+	Result     json.RawMessage `json:"result"` // Value of the rr_model key
+}
+
+// request sends a request to the Duet's HTTP interface (rr_ requests of RepRapFirmware in
+// standalone mode) within the session, and returns its response
+func (u *duetUploader) request(method, path string, body *os.File, size int64) (duetReply, error) {
+	var reply duetReply
+	request, err := http.NewRequest(method, strings.TrimRight(u.URL, "/")+path, nil)
+	if err != nil {
+		return reply, err
+	}
+	if body != nil {
+		request.Body, request.ContentLength = body, size
+		request.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if u.sessionKey != "" {
+		request.Header.Set("X-Session-Key", u.sessionKey)
+	}
+	response, err := u.client.Do(request)
+	if err != nil {
+		return reply, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return reply, fmt.Errorf("status %s", response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		return reply, fmt.Errorf("unexpected response: %v", err)
+	}
+	if reply.SessionKey != "" {
+		u.sessionKey = reply.SessionKey
+	}
+	return reply, nil
+}
+
+// Connect opens a session with rr_connect
+func (u *duetUploader) Connect() error {
+	now := time.Now().Format("2006-01-02T15:04:05")
+	reply, err := u.request(http.MethodGet, "/rr_connect?password="+url.QueryEscape(u.Password)+"&time="+url.QueryEscape(now), nil, 0)
+	switch {
+	case err != nil:
+		return err
+	case reply.Err == 1:
+		return fmt.Errorf("wrong password")
+	case reply.Err != 0:
+		return fmt.Errorf("no more sessions available (rr_connect error %d)", reply.Err)
+	}
+	return nil
+}
+
+// Close ends the session with rr_disconnect
+func (u *duetUploader) Close() error {
+	_, err := u.request(http.MethodGet, "/rr_disconnect", nil, 0)
+	return err
+}
+
+// Upload sends a file with rr_upload
+func (u *duetUploader) Upload(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	remotePath := strings.TrimRight(u.Storage, "/") + "/" + filepath.Base(filePath)
+	modified := info.ModTime().Format("2006-01-02T15:04:05")
+	reply, err := u.request(http.MethodPost, "/rr_upload?name="+url.QueryEscape(remotePath)+"&time="+url.QueryEscape(modified), file, info.Size())
+	if err != nil {
+		return "", err
+	}
+	if reply.Err != 0 {
+		return "", fmt.Errorf("rr_upload of '%s' failed", remotePath)
+	}
+	return remotePath, nil
+}
+
+// StartPrint prints a file by running M32 through rr_gcode
+func (u *duetUploader) StartPrint(remotePath string) error {
+	_, err := u.request(http.MethodGet, "/rr_gcode?gcode="+url.QueryEscape(fmt.Sprintf("M32 \"%s\"", remotePath)), nil, 0)
+	return err
+}
+
+// Status reads state.status of the object model with rr_model (RepRapFirmware 3), and the
+// filament loaded in the first extruder that has one
+func (u *duetUploader) Status() (printerStatus, error) {
+	reply, err := u.request(http.MethodGet, "/rr_model?key=state.status", nil, 0)
+	if err != nil {
+		return printerStatus{}, err
+	}
+	var state string
+	if err := json.Unmarshal(reply.Result, &state); err != nil {
+		return printerStatus{}, fmt.Errorf("unexpected state.status: %v", err)
+	}
+	status := printerStatus{State: state, Busy: state != "idle" && state != "off"}
+
+	// Filaments are loaded per extruder with M701
+	var extruders []struct {
+		Filament string `json:"filament"`
+	}
+	if reply, err := u.request(http.MethodGet, "/rr_model?key=move.extruders", nil, 0); err == nil && json.Unmarshal(reply.Result, &extruders) == nil {
+		for _, extruder := range extruders {
+			if extruder.Filament != "" {
+				status.Material = extruder.Filament
+				break
+			}
+		}
+	}
+	return status, nil
+}
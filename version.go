@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...";
+// the Makefile does this from git. Otherwise they're filled from the Go build info where available.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// getVersionInfo returns the version, commit and build date, falling back to the VCS details Go
+// records in the binary when they weren't set with -ldflags
+func getVersionInfo() (string, string, string) {
+	v, c, d := version, commit, buildDate
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v, c, d
+	}
+	if v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if c == "" {
+				c = setting.Value
+			}
+		case "vcs.time":
+			if d == "" {
+				d = setting.Value
+			}
+		}
+	}
+	return v, c, d
+}
+
+// versionString formats the version info for --version, reports and the processing log
+func versionString() string {
+	v, c, d := getVersionInfo()
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	if len(c) > 12 {
+		c = c[:12]
+	}
+	if reproducible {
+		// The build date differs between builds of the same commit
+		return fmt.Sprintf("%s (commit %s)", v, c)
+	}
+	return fmt.Sprintf("%s (commit %s, built %s)", v, c, d)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	EVENT_PROCESSED = "processed" // A file was modified and written (or returned by the server)
+	EVENT_ANALYZED  = "analyzed"  // A file was analyzed without writing an output
+
+	WEBHOOK_SECRET_ENV       = "GCODE_MODIFIER_WEBHOOK_SECRET" // Read when -webhook-secret isn't given
+	WEBHOOK_TIMEOUT          = 10 * time.Second
+	WEBHOOK_ATTEMPTS         = 3
+	WEBHOOK_SIGNATURE_HEADER = "X-Gcode-Modifier-Signature"
+)
+
+// webhookEvent is the JSON body posted to the webhooks when a file finishes processing
+type webhookEvent struct {
+	Event  string    `json:"event"` // EVENT_PROCESSED or EVENT_ANALYZED
+	File   string    `json:"file"`
+	Output string    `json:"output,omitempty"` // Path of the written output
+	Plans  []Plan    `json:"plans"`            // One per file, or per plate of a 3MF project
+	Tool   string    `json:"tool"`
+	Time   time.Time `json:"time"`
+}
+
+var webhookURLs string   // -webhook, comma-separated URLs to post events to
+var webhookSecret string // -webhook-secret, key of the HMAC-SHA256 signature of each event
+
+// addWebhookFlags registers the webhook and chat notification flags on a command's flag set
+func addWebhookFlags(fs *flag.FlagSet) {
+	fs.StringVar(&webhookURLs, "webhook", "", "URLs (comma-separated) to POST a JSON event to when a file finishes processing")
+	fs.StringVar(&webhookSecret, "webhook-secret", "", "Sign webhook events with HMAC-SHA256 using this secret (Default=$"+WEBHOOK_SECRET_ENV+")")
+	fs.StringVar(&slackWebhookURL, "slack-webhook", "", "Slack incoming webhook URL to post a summary of each file to (Default=$"+SLACK_WEBHOOK_ENV+")")
+	fs.StringVar(&discordWebhookURL, "discord-webhook", "", "Discord webhook URL to post a summary of each file to (Default=$"+DISCORD_WEBHOOK_ENV+")")
+}
+
+// getWebhookSecret returns -webhook-secret, else the secret in the environment, which keeps it out
+// of the command line
+func getWebhookSecret() string {
+	if webhookSecret != "" {
+		return webhookSecret
+	}
+	return os.Getenv(WEBHOOK_SECRET_ENV)
+}
+
+// sendWebhooks posts an event to every -webhook URL and its summary to Slack and Discord,
+// retrying failed deliveries. Failures are reported but don't stop processing.
+func sendWebhooks(event webhookEvent) {
+	slackWebhookURL, discordWebhookURL := getChatWebhookURLs()
+	if webhookURLs == "" && slackWebhookURL == "" && discordWebhookURL == "" {
+		return
+	}
+	event.Tool = versionString()
+	event.Time = time.Now().UTC()
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Warning: encoding webhook event: %v\n", err)
+		return
+	}
+
+	for _, url := range strings.Split(webhookURLs, ",") {
+		if url = strings.TrimSpace(url); url == "" {
+			continue
+		}
+		if err := postWebhook(url, body, true); err != nil {
+			fmt.Printf("Warning: webhook %s failed: %v\n", url, err)
+		}
+	}
+	sendChatNotifications(event)
+}
+
+// postWebhook posts a body to a URL, up to WEBHOOK_ATTEMPTS times while it fails to connect or
+// gets a server error; signed bodies carry the -webhook-secret signature
+func postWebhook(url string, body []byte, signed bool) error {
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	var err error
+	for attempt := 1; attempt <= WEBHOOK_ATTEMPTS; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * time.Second)
+		}
+		var request *http.Request
+		if request, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(body)); err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if secret := getWebhookSecret(); signed && secret != "" {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			request.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		var response *http.Response
+		if response, err = client.Do(request); err != nil {
+			continue
+		}
+		response.Body.Close()
+		if response.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("status %s", response.Status)
+		if response.StatusCode < 500 {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+)
+
+const (
+	WIPE_Z_HOP            = 2.0  // mm, lift above the print before travelling to the brush
+	WIPE_TRAVEL_FEEDRATE  = 9000 // mm/min
+	WIPE_STROKE_FEEDRATE  = 6000 // mm/min
+	DEFAULT_BRUSH_WIDTH   = 20.0 // mm, length of a stroke across the brush
+	DEFAULT_BRUSH_STROKES = 3    // Back and forth strokes per wipe
+)
+
+// brushLocation is where a printer profile's nozzle brush is, for -wipe-every and -wipe-flagged
+type brushLocation struct {
+	X       float64 `json:"x"` // Start of the strokes, which run along +X
+	Y       float64 `json:"y"`
+	Z       float64 `json:"z,omitempty"` // Height to wipe at, 0 to wipe at the hopped print height
+	Width   float64 `json:"width,omitempty"`
+	Strokes int     `json:"strokes,omitempty"`
+}
+
+var wipeEvery int    // -wipe-every, wipe the nozzle at the start of every Nth layer
+var wipeFlagged bool // -wipe-flagged, wipe the nozzle at the start of detected layers
+var activeBrush *brushLocation
+
+// validateWipe exits if a wipe is asked for without a printer profile giving the brush location
+func validateWipe() {
+	if wipeEvery <= 0 && !wipeFlagged {
+		return
+	}
+	if activePrinter == nil || activePrinter.Brush == nil {
+		fmt.Println("Error: -wipe-every and -wipe-flagged need a -printer profile with a \"brush\" location")
+		os.Exit(1)
+	}
+	activeBrush = activePrinter.Brush
+	if activeBrush.Width <= 0 {
+		activeBrush.Width = DEFAULT_BRUSH_WIDTH
+	}
+	if activeBrush.Strokes <= 0 {
+		activeBrush.Strokes = DEFAULT_BRUSH_STROKES
+	}
+}
+
+// getWipeLines returns the moves that hop up, wipe the nozzle across the brush and return to
+// where the print left off, restoring the feedrate. Filament isn't moved, except for the
+// -pause-prime: the nozzle is normally retracted at a layer change.
+func (a *Analysis) getWipeLines(layer int, state machineState) []string {
+	n := a.numbers
+	hopZ := state.Z + WIPE_Z_HOP
+	wipeZ := hopZ
+	if activeBrush.Z > 0 {
+		wipeZ = activeBrush.Z
+	}
+	travel := n.param('F', WIPE_TRAVEL_FEEDRATE)
+	wipe := []string{
+		withComment(fmt.Sprintf("G1 %s %s", n.param('Z', hopZ), travel), msg(MSG_WIPE, displayLayer(layer))),
+		fmt.Sprintf("G1 %s %s %s", n.param('X', activeBrush.X), n.param('Y', activeBrush.Y), travel),
+		"G1 " + n.param('Z', wipeZ),
+		"G1 " + n.param('F', WIPE_STROKE_FEEDRATE),
+	}
+	for stroke := 0; stroke < activeBrush.Strokes; stroke++ {
+		wipe = append(wipe,
+			"G1 "+n.param('X', activeBrush.X+activeBrush.Width),
+			"G1 "+n.param('X', activeBrush.X))
+	}
+	wipe = append(wipe,
+		fmt.Sprintf("G1 %s %s", n.param('Z', hopZ), travel),
+		fmt.Sprintf("G1 %s %s", n.param('X', state.X), n.param('Y', state.Y)),
+		"G1 "+n.param('Z', state.Z))
+	if primed := a.getPrimeLines(state); len(primed) > 0 {
+		// The prime restores the feedrate
+		return append(wipe, primed...)
+	}
+	if state.Feedrate > 0 {
+		wipe = append(wipe, "G1 "+n.param('F', state.Feedrate))
+	}
+	return wipe
+}
+
+// insertWipes inserts a nozzle wipe at the start of every -wipe-every layer and, with
+// -wipe-flagged, of every layer a detector flagged with a finding fixable in post, after the nozzle has printed something
+func (a *Analysis) insertWipes(lines []string, detections []Detection) []string {
+	if activeBrush == nil {
+		return lines
+	}
+	flagged := []int{}
+	if wipeFlagged {
+		for _, detection := range detections {
+			if detection.Fix != FIX_RESLICE {
+				flagged = append(flagged, detection.Layer)
+			}
+		}
+	}
+
+	var state machineState
+	wipes := 0
+	wiped := a.insertAtLayerStarts(lines, func(line string) { state.update(line) }, func(layer int) []string {
+		if layer == 0 || !state.hasPosition {
+			return nil
+		}
+		if (wipeEvery > 0 && layer%wipeEvery == 0) || slices.Contains(flagged, layer) {
+			wipes++
+			return a.getWipeLines(layer, state)
+		}
+		return nil
+	})
+	fmt.Printf("Inserted %d nozzle wipes\n", wipes)
+	return wiped
+}